@@ -0,0 +1,37 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// saveActual records whether to save the output of each failed test beside it.
+var saveActual bool
+
+// actualSuffixes lists the extensions of the files holding the actual output
+// and error output of a failed test, in the same form as its companion files.
+var actualSuffixes = map[byte]string{'>': ".actual.out", '!': ".actual.err"}
+
+// writeActual writes all the output and error output received from the program
+// in a failed test, before it failed, into files beside the test case, or in
+// its directory under -artifacts, so that they may be compared with what was
+// expected, or renamed to become its companion files.
+func writeActual(t Test, r Result) error {
+	for _, stream := range []byte{'>', '!'} {
+		data := r.transcript.stream(stream)
+		dest := companionPath(t.path, actualSuffixes[stream])
+		if artifactsDir != "" {
+			dest = filepath.Join(artifactDir(t), filepath.Base(dest))
+			if e := os.MkdirAll(artifactDir(t), 0755); e != nil {
+				return e
+			}
+		}
+		if e := os.WriteFile(dest, []byte(data), 0644); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ansiMode is how ANSI escape sequences, such as those for colors and moving the
+// cursor, in the program's output are treated before matching: "" to leave them,
+// "strip" to remove them, or "show" to replace each with a canonical form written
+// in ordinary text, such as "\e[1;31m", so that test cases need not contain
+// escape characters.
+var ansiMode string
+
+// maxEscape is the longest escape sequence recognized; a longer one is treated
+// as ordinary text.
+const maxEscape = 4096
+
+// checkANSI checks the -ansi option.
+func checkANSI() error {
+	switch ansiMode {
+	case "", "strip", "show":
+		return nil
+	}
+	return fmt.Errorf("unknown -ansi mode %q; must be strip or show", ansiMode)
+}
+
+// ANSIFilter strips or shows the escape sequences in one of the program's output
+// streams, which may be split between reads anywhere, even within a sequence.
+type ANSIFilter struct {
+	partial []byte // an incomplete escape sequence at the end of the data so far
+}
+
+// filter returns the data with its escape sequences stripped or shown. Part of
+// a sequence at the end of the data is held back until the rest arrives, unless
+// end reports that this is the end of the stream.
+func (f *ANSIFilter) filter(data []byte, end bool) []byte {
+	if len(f.partial) > 0 {
+		data = append(f.partial, data...)
+		f.partial = nil
+	}
+	var out []byte
+	for k := 0; k < len(data); {
+		if data[k] != '\x1b' {
+			n := bytes.IndexByte(data[k:], '\x1b')
+			if n < 0 {
+				n = len(data) - k
+			}
+			out = append(out, data[k:k+n]...)
+			k += n
+			continue
+		}
+		n := escapeLength(data[k:])
+		if n == 0 && !end && len(data)-k < maxEscape {
+			f.partial = append([]byte(nil), data[k:]...)
+			break
+		} else if n <= 0 {
+			out = append(out, data[k])
+			k++
+			continue
+		}
+		if ansiMode == "show" {
+			out = append(out, showEscape(data[k:k+n])...)
+		}
+		k += n
+	}
+	return out
+}
+
+// escapeLength returns the length of the escape sequence at the start of data,
+// which begins with ESC; 0 if data ends first; or -1 if this is not a valid sequence.
+// A sequence is either a control sequence (ESC [, parameters, intermediate bytes,
+// and a final byte), an operating system command (ESC ], ended by BEL or ESC \),
+// or ESC, intermediate bytes, and a final byte.
+func escapeLength(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	k := 2
+	switch data[1] {
+	case '[':
+		for k < len(data) && 0x30 <= data[k] && data[k] <= 0x3f {
+			k++
+		}
+		for k < len(data) && 0x20 <= data[k] && data[k] <= 0x2f {
+			k++
+		}
+		if k == len(data) {
+			return 0
+		} else if data[k] < 0x40 || data[k] > 0x7e {
+			return -1
+		}
+		return k + 1
+	case ']':
+		for ; k < len(data); k++ {
+			if data[k] == '\a' {
+				return k + 1
+			} else if data[k] == '\x1b' {
+				if k+1 == len(data) {
+					return 0
+				} else if data[k+1] == '\\' {
+					return k + 2
+				}
+				return -1
+			}
+		}
+		return 0
+	default:
+		k = 1
+		for k < len(data) && 0x20 <= data[k] && data[k] <= 0x2f {
+			k++
+		}
+		if k == len(data) {
+			return 0
+		} else if data[k] < 0x30 || data[k] > 0x7e {
+			return -1
+		}
+		return k + 1
+	}
+}
+
+// showEscape returns the canonical form of an escape sequence: ESC is written
+// as "\e", and BEL as "\a". An operating system command always ends with BEL,
+// and in a sequence selecting colors and other attributes, empty parameters are
+// written as 0, and leading zeros are removed, so "\e[m" and "\e[00m" are both "\e[0m".
+func showEscape(seq []byte) []byte {
+	s := string(seq[1:])
+	if strings.HasPrefix(s, "]") {
+		s = strings.TrimSuffix(strings.TrimSuffix(s, "\a"), "\x1b\\") + "\a"
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "m") {
+		params := strings.Split(s[1:len(s)-1], ";")
+		for k, p := range params {
+			if p = strings.TrimLeft(p, "0"); p == "" {
+				p = "0"
+			}
+			params[k] = p
+		}
+		s = "[" + strings.Join(params, ";") + "m"
+	}
+	s = strings.ReplaceAll(strings.ReplaceAll(s, "\x1b", `\e`), "\a", `\a`)
+	return []byte(`\e` + s)
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// expandArgsFiles replaces each argument "@file" with the lines of the file, one
+// argument per line, so that long lists of test cases need not fit in the limits
+// the system places on command lines. Blank lines are skipped, and the lines are
+// not expanded again. An argument beginning with "@@" stands for itself, with the
+// first "@" removed.
+func expandArgsFiles(args []string) ([]string, error) {
+	var expanded []string
+	for _, a := range args {
+		if strings.HasPrefix(a, "@@") {
+			expanded = append(expanded, a[1:])
+			continue
+		} else if !strings.HasPrefix(a, "@") || a == "@" {
+			expanded = append(expanded, a)
+			continue
+		}
+		data, e := os.ReadFile(a[1:])
+		if e != nil {
+			return nil, e
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSuffix(line, "\r"); line != "" {
+				expanded = append(expanded, line)
+			}
+		}
+	}
+	return expanded, nil
+}
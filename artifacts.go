@@ -0,0 +1,74 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// artifactsDir is the directory in which to write a directory of files describing
+// each failed test; "" for none.
+var artifactsDir string
+
+// artifactDir returns the directory holding the files describing a failed test.
+func artifactDir(t Test) string {
+	return filepath.Join(artifactsDir, artifactName(t.path))
+}
+
+// commandInfo describes how the program was run for a test case.
+func commandInfo(t Test, r Result, program []string) string {
+	wd, _ := os.Getwd()
+	command := r.command
+	if command == "" {
+		command = shellJoin(testCommand(program, t.path))
+	}
+	return fmt.Sprintf("directory: %s\ncommand: %s\ninvigilate: %s\n", wd, command, shellJoin(os.Args))
+}
+
+// resultInfo describes the outcome of a test case, and how long it took.
+func resultInfo(t Test, r Result) string {
+	info := fmt.Sprintf("test: %s\nstatus: %s\ncategory: %s\nduration: %s\n",
+		t.path, r.status, r.category, r.duration)
+	if r.exited {
+		info += fmt.Sprintf("exit code: %d\n", r.exitCode)
+	}
+	if first, ok := r.transcript.firstOutput(); ok {
+		info += fmt.Sprintf("first output: %s\n", first)
+	}
+	if r.userTime > 0 || r.systemTime > 0 {
+		info += fmt.Sprintf("cpu time: %s user, %s system\n", r.userTime, r.systemTime)
+	}
+	if r.maxRSS > 0 {
+		info += fmt.Sprintf("peak memory: %d bytes\n", r.maxRSS)
+	}
+	return info
+}
+
+// writeArtifacts writes a directory describing a failed test, for examining it
+// after the run, as when it is uploaded from a CI job: the command line, the
+// environment, the transcript of the run, and its outcome and timing.
+func writeArtifacts(t Test, r Result, program []string) error {
+	dir := artifactDir(t)
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+	var transcript bytes.Buffer
+	r.transcript.write(&transcript)
+	files := []bundleFile{
+		{"command.txt", 0644, commandInfo(t, r, program)},
+		{"env.txt", 0644, strings.Join(os.Environ(), "\n") + "\n"},
+		{"transcript.txt", 0644, transcript.String()},
+		{"result.txt", 0644, resultInfo(t, r)},
+	}
+	for _, f := range files {
+		if e := os.WriteFile(filepath.Join(dir, f.name), []byte(f.content), os.FileMode(f.mode)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Test cases are normally run directly on the host. With the docker backend,
+// each is instead run in a new container, created from the image given with
+// -image, so that tests run in a reproducible environment. The current directory
+// is bind-mounted at the same path in the container, and used as its working
+// directory, so that test case paths mean the same inside and outside it.
+
+// backend is how test cases are run: "local" or "docker".
+var backend string
+
+// image is the container image used by the docker backend.
+var image string
+
+// dockerPath is the path to the docker program.
+var dockerPath string
+
+// checkBackend checks the -backend and -image options.
+func checkBackend() error {
+	switch backend {
+	case "local":
+		if image != "" {
+			return fmt.Errorf("-image requires -backend docker")
+		}
+	case "docker":
+		if image == "" {
+			return fmt.Errorf("-backend docker requires -image")
+		} else if cgroupParent != "" {
+			return fmt.Errorf("-cgroup cannot be used with -backend docker")
+		} else if ptySpec != "" {
+			return fmt.Errorf("-pty cannot be used with -backend docker")
+		}
+		var e error
+		if dockerPath, e = exec.LookPath("docker"); e != nil {
+			return e
+		}
+	default:
+		return fmt.Errorf("unknown backend %q; must be local or docker", backend)
+	}
+	return nil
+}
+
+// Container is a container created for a single test.
+// Its methods may be called on a nil *Container, and then do nothing.
+type Container struct {
+	name string
+}
+
+// containerCount is used to give each container a distinct name.
+var containerCount atomic.Int64
+
+// dockerCommand returns the command line for running args in a new container,
+// with the given resource limits and any memory limit. The container is left
+// when the command exits, so that its state may be examined; it should then be removed.
+func dockerCommand(args []string, path, workdir string, rl Rlimits) ([]string, *Container, error) {
+	wd, e := os.Getwd()
+	if e != nil {
+		return nil, nil, e
+	}
+	ct := &Container{name: fmt.Sprintf("invigilate-%d-%d", os.Getpid(), containerCount.Add(1))}
+	cmd := []string{dockerPath, "run", "-i", "--init", "--name", ct.name, "-v", wd + ":" + wd}
+	if workdir == "" {
+		workdir = wd
+	} else if workdir, e = filepath.Abs(workdir); e != nil {
+		return nil, nil, e
+	}
+	cmd = append(cmd, "-w", workdir)
+
+	// A test case outside the current directory is made available read-only,
+	// and a working directory given by a cwd or fixture directive writable.
+	dir, e := filepath.Abs(filepath.Dir(path))
+	if e != nil {
+		return nil, nil, e
+	}
+	outside := func(d string) bool {
+		rel, e := filepath.Rel(wd, d)
+		return e != nil || strings.HasPrefix(rel, "..")
+	}
+	if outside(dir) {
+		cmd = append(cmd, "-v", dir+":"+dir+":ro")
+	}
+	if workdir != dir && outside(workdir) {
+		cmd = append(cmd, "-v", workdir+":"+workdir)
+	}
+
+	for name, n := range rl {
+		if name == "as" {
+			return nil, nil, fmt.Errorf("the docker backend cannot limit address space; use -memory-max")
+		}
+		limit := strconv.FormatUint(n, 10)
+		cmd = append(cmd, "--ulimit", name+"="+limit+":"+limit)
+	}
+	if memoryMax > 0 {
+		limit := strconv.FormatUint(memoryMax, 10)
+		cmd = append(cmd, "--memory", limit, "--memory-swap", limit)
+	}
+	cmd = append(append(cmd, image), args...)
+	return cmd, ct, nil
+}
+
+// oomKilled reports whether the container's program was killed for exceeding
+// the memory limit.
+func (ct *Container) oomKilled() bool {
+	if ct == nil {
+		return false
+	}
+	out, e := exec.Command(dockerPath, "inspect", "-f", "{{.State.OOMKilled}}", ct.name).Output()
+	return e == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// remove removes the container, stopping it if it is still running.
+func (ct *Container) remove() {
+	if ct != nil {
+		exec.Command(dockerPath, "rm", "-f", ct.name).Run()
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// The -before and -after options give shell commands run once for the whole
+// invocation, such as starting and stopping services the tests need. The -before
+// command is run before the build, if any; the -after command once everything
+// else is done, even if the run was interrupted, and even if it was interrupted
+// a second time, before invigilate exits.
+
+// beforeCmd and afterCmd are shell commands run once before and after all the
+// tests, given with -before and -after; "" for none.
+var beforeCmd, afterCmd string
+
+// afterOnce ensures that the -after command is run only once, whether at the
+// end of the run or on a second interrupt.
+var afterOnce sync.Once
+
+// runBefore runs the -before command, killing it if ctx is cancelled. Its result
+// is reported as if it were a test case, as for -build, so that a failure appears
+// in the reports of the run.
+func runBefore(ctx context.Context) (r Result) {
+	r = Result{path: "(before)", status: passed}
+	started := time.Now()
+	defer func() { r.duration = time.Since(started) }()
+	if output, e := runCaptured(commandContext(ctx, []string{"/bin/sh", "-c", beforeCmd})); e != nil {
+		log.Printf("before command failed: %s\n%s", e, printable(output))
+		r.status, r.category = errored, "before"
+	}
+	return r
+}
+
+// runAfter runs the -after command, if there is one and it has not already been
+// run, counting its failure as an error. If it is already running, runAfter waits
+// for it to finish.
+func runAfter() {
+	if afterCmd == "" {
+		return
+	}
+	afterOnce.Do(func() {
+		if output, e := runCaptured(exec.Command("/bin/sh", "-c", afterCmd)); e != nil {
+			log.Printf("after command failed: %s\n%s", e, printable(output))
+			errorCount++
+		}
+	})
+}
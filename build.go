@@ -0,0 +1,69 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// buildCmd is a shell command building the program to be tested, as given with
+// -build; "" for none. It writes the program to the file named by {out}.
+var buildCmd string
+
+// builtProgram is the file to which buildCmd writes the program; "" if there is none.
+var builtProgram string
+
+// buildProgram runs the build command once, before any test case, and replaces
+// {out} in the program's command line by the file it wrote. The result of the
+// build is reported as if it were a test case, so that a failed build appears
+// in the reports of the run.
+func buildProgram(program []string) (r Result) {
+	r = Result{path: "(build)", status: passed}
+	started := time.Now()
+	defer func() { r.duration = time.Since(started) }()
+
+	dir, e := os.MkdirTemp("", "invigilate-build")
+	if e != nil {
+		log.Printf("build failed: %s", e)
+		r.status, r.category = errored, "build"
+		return r
+	}
+	builtProgram = filepath.Join(dir, "program")
+	cmd := exec.Command("/bin/sh", "-c", strings.ReplaceAll(buildCmd, "{out}", shellQuote(builtProgram)))
+	if out, e := cmd.CombinedOutput(); e != nil {
+		log.Printf("build failed: %s\n%s", e, out)
+		r.status, r.category = errored, "build"
+		return r
+	}
+	for k, a := range program {
+		program[k] = strings.ReplaceAll(a, "{out}", builtProgram)
+	}
+	return r
+}
+
+// removeBuild removes the program written by the build command.
+func removeBuild() {
+	if builtProgram != "" {
+		os.RemoveAll(filepath.Dir(builtProgram))
+	}
+}
+
+// unbuilt returns the program's command line as given, with {out} in place of
+// the file written by the build command, for use when the file no longer exists
+// or has a different name, as when running a test case again.
+func unbuilt(program []string) []string {
+	if builtProgram == "" {
+		return program
+	}
+	var words []string
+	for _, a := range program {
+		words = append(words, strings.ReplaceAll(a, builtProgram, "{out}"))
+	}
+	return words
+}
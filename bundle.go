@@ -0,0 +1,134 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bundleDir is the directory in which to write reproducer bundles for failed tests; "" for none.
+var bundleDir string
+
+// shellQuote quotes a string for use as a single word in a shell command.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellJoin quotes each word for the shell, and joins them with spaces.
+func shellJoin(words []string) string {
+	quoted := make([]string, len(words))
+	for k, w := range words {
+		quoted[k] = shellQuote(w)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// bundleFile is one file in a reproducer bundle.
+type bundleFile struct {
+	name    string
+	mode    int64
+	content string
+}
+
+// writeBundle writes a compressed tar archive holding everything needed to reproduce
+// a failed test on another machine: the test case, the command line, the environment,
+// the transcript of the failed run, and a script to run the test again.
+func writeBundle(t Test, r Result, program []string) error {
+	if e := os.MkdirAll(bundleDir, 0755); e != nil {
+		return e
+	}
+	dest := filepath.Join(bundleDir, artifactName(t.path)+".tar.gz")
+
+	testName := filepath.Base(t.source())
+	options := append([]string{"invigilate"}, replayOptions()...)
+	run := fmt.Sprintf(`#!/bin/sh
+# Run the failed test case again. The program under test must be installed at the same
+# location as on the original machine; the original environment is listed in env.txt.
+cd "$(dirname "$0")" || exit 1
+exec %s %s -- test/%s
+`, shellJoin(options), shellJoin(unbuilt(program)), shellQuote(testName))
+
+	var transcript bytes.Buffer
+	r.transcript.write(&transcript)
+	content := t.content
+	if t.streamed {
+		data, e := os.ReadFile(t.path)
+		if e != nil {
+			return e
+		}
+		content = string(data)
+	}
+
+	files := []bundleFile{
+		{"test/" + testName, 0644, content},
+		{"command.txt", 0644, commandInfo(t, r, program)},
+		{"env.txt", 0644, strings.Join(os.Environ(), "\n") + "\n"},
+		{"transcript.txt", 0644, transcript.String()},
+		{"result.txt", 0644, resultInfo(t, r)},
+		{"run.sh", 0755, run},
+	}
+	companions, e := readCompanions(t.path)
+	if e != nil {
+		return e
+	}
+	for k, c := range companions.contents() {
+		if c != "" {
+			name := "test/" + filepath.Base(companionPath(t.path, goldenExtensions[k]))
+			files = append(files, bundleFile{name, 0644, c})
+		}
+	}
+	for _, ref := range testReferences(t) {
+		// Files outside the test case's directory are left out.
+		if content, e := readReference(t, ref); e == nil && filepath.IsLocal(ref) {
+			files = append(files, bundleFile{"test/" + filepath.ToSlash(filepath.Clean(ref)), 0644, content})
+		}
+	}
+	e = walkFixtures(t, func(fixture, path string, data []byte) error {
+		// As with referenced files, fixtures outside the test case's directory are left out.
+		if rel, e := filepath.Rel(filepath.Dir(t.path), path); e == nil && filepath.IsLocal(rel) {
+			files = append(files, bundleFile{"test/" + filepath.ToSlash(rel), 0644, string(data)})
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	prefix := artifactName(t.path) + "/"
+	now := time.Now()
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    prefix + f.name,
+			Mode:    f.mode,
+			Size:    int64(len(f.content)),
+			ModTime: now,
+		}
+		if e := tw.WriteHeader(hdr); e != nil {
+			return e
+		}
+		if _, e := tw.Write([]byte(f.content)); e != nil {
+			return e
+		}
+	}
+	if e := tw.Close(); e != nil {
+		return e
+	}
+	if e := zw.Close(); e != nil {
+		return e
+	}
+	return os.WriteFile(dest, buf.Bytes(), 0644)
+}
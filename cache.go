@@ -0,0 +1,141 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Passing results are cached, so that a test need not be run again while the program,
+// its arguments, the test case, and the options affecting the result are unchanged.
+
+// noCache disables the result cache.
+var noCache bool
+
+// cacheDir is the directory holding the result cache; "" if caching is disabled.
+var cacheDir string
+
+// programHash identifies the contents of the program being tested.
+var programHash string
+
+// initCache prepares the result cache for use, unless it has been disabled.
+// The cache is kept in the directory named by $INVIGILATE_CACHE, if that is set;
+// setting it to "off" disables the cache. So does the docker backend, unless
+// the image is given by digest, since the image named by a tag may change.
+func initCache(program []string) {
+	if noCache || soakCount > 1 || repeatCount > 1 || checkDeterminism || backend == "docker" && !strings.Contains(image, "@") {
+		return
+	}
+	dir := os.Getenv("INVIGILATE_CACHE")
+	if dir == "off" {
+		return
+	} else if dir == "" {
+		base, e := os.UserCacheDir()
+		if e != nil {
+			return
+		}
+		dir = filepath.Join(base, "invigilate")
+	}
+
+	// If the program cannot be identified, results cannot safely be cached.
+	if len(program) == 0 {
+		return
+	}
+	path, e := exec.LookPath(program[0])
+	if e != nil {
+		return
+	}
+	f, e := os.Open(path)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, e = io.Copy(h, f); e != nil {
+		return
+	}
+	programHash = hex.EncodeToString(h.Sum(nil))
+	cacheDir = dir
+}
+
+// cacheKey returns the key identifying a test in the cache, or "" if caching is disabled.
+func cacheKey(t Test, program []string) string {
+	if cacheDir == "" {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "invigilate %s\x00", version)
+	fmt.Fprintf(h, "program %s\x00", programHash)
+	for _, a := range unbuilt(program) {
+		fmt.Fprintf(h, "arg %q\x00", a)
+	}
+	fmt.Fprintf(h, "path %q\x00comment %q\x00limit %s\x00", t.path, comment, limit)
+	fmt.Fprintf(h, "exit-codes %v\x00rlimits %s\x00memory-max %d\x00", exitCodes, rlimits, memoryMax)
+	fmt.Fprintf(h, "wrap %q\x00backend %s\x00image %q\x00pty %q\x00", wrapper, backend, image, ptySpec)
+	fmt.Fprintf(h, "ansi %s\x00merge %t\x00ignore-stderr %t\x00ignore-stdout %t\x00", ansiMode, mergeOutput, ignoreStderr, ignoreStdout)
+	fmt.Fprintf(h, "sort %t\x00whitespace %s\x00lenient-newline %t\x00crlf %t\x00scrub %q\x00comparator %s\x00", sortOutput, whitespaceSpec, lenientNewline, crlf, scrubs.values(), comparatorCmd)
+	fmt.Fprintf(h, "max-output %d\x00compile %q\x00stdin %t\x00strip %t\x00", maxOutput, compileCmd, stdinInput, stripLines)
+	if !t.streamed {
+		fmt.Fprintf(h, "content %d\x00%s", len(t.content), t.content)
+	} else {
+		h.Write([]byte("streamed content\x00"))
+		lr := t.lines()
+		for lr.scan() {
+			io.WriteString(h, lr.text())
+		}
+		if lr.close() != nil {
+			return ""
+		}
+	}
+	companions, e := readCompanions(t.path)
+	if e != nil {
+		return ""
+	}
+	for k, c := range companions.contents() {
+		fmt.Fprintf(h, "\x00companion %s %d\x00%s", goldenExtensions[k], len(c), c)
+	}
+	for _, ref := range testReferences(t) {
+		content, e := readReference(t, ref)
+		if e != nil {
+			return ""
+		}
+		fmt.Fprintf(h, "\x00file %q %d\x00%s", ref, len(content), content)
+	}
+	if hashFixtures(h, t) != nil || hashFileChecks(h, t) != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheFile returns the file recording that the test with the given key passed.
+func cacheFile(key string) string {
+	return filepath.Join(cacheDir, key[:2], key)
+}
+
+// isCached reports whether a test is known to pass.
+func isCached(key string) bool {
+	if key == "" {
+		return false
+	}
+	_, e := os.Stat(cacheFile(key))
+	return e == nil
+}
+
+// storeCached records that a test passed. Failure to do so is not an error.
+func storeCached(key string) {
+	if key == "" {
+		return
+	}
+	file := cacheFile(key)
+	if os.MkdirAll(filepath.Dir(file), 0755) == nil {
+		os.WriteFile(file, nil, 0644)
+	}
+}
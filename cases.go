@@ -0,0 +1,79 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A file may hold several test cases, each beginning with a "case" directive
+// naming it, as in "#case empty-input". The lines before the first of these are
+// shared by all the test cases in the file: each consists of those lines followed
+// by its own. The program is run separately for each test case, and given a copy
+// of it, with the same name as the file, in a temporary directory. Each test case
+// is reported as the path of the file, a colon, and its name, as in
+// "parse.test:empty-input".
+
+// checkCase checks the argument of a case directive.
+func checkCase(arg string) error {
+	if arg == "" || strings.ContainsAny(arg, " \t/\\") {
+		return fmt.Errorf("test case name %q must be a single word, without slashes", arg)
+	}
+	return nil
+}
+
+// source returns the path of the file holding a test case.
+func (t Test) source() string {
+	if t.file != "" {
+		return t.file
+	}
+	return t.path
+}
+
+// splitCases returns the test cases held in a file: just the test case itself,
+// if it has no case directives.
+func splitCases(t Test) ([]Test, error) {
+	var shared strings.Builder
+	var names []string
+	var bodies []*strings.Builder
+	lr := t.lines()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "case" {
+				for _, n := range names {
+					if n == arg {
+						lr.close()
+						return nil, fmt.Errorf("%s:%d: duplicate test case %q", t.path, lr.lineno, arg)
+					}
+				}
+				names, bodies = append(names, arg), append(bodies, &strings.Builder{})
+			}
+		}
+		if len(bodies) == 0 {
+			shared.WriteString(line)
+		} else {
+			bodies[len(bodies)-1].WriteString(line)
+		}
+	}
+	if e := lr.close(); e != nil {
+		return nil, e
+	} else if len(names) == 0 {
+		return []Test{t}, nil
+	}
+
+	cases := make([]Test, len(names))
+	for k, name := range names {
+		cases[k] = Test{
+			path:    t.path + ":" + name,
+			file:    t.source(),
+			content: shared.String() + bodies[k].String(),
+			found:   t.found,
+			loaded:  t.loaded,
+			reading: t.reading,
+		}
+	}
+	return cases, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// catalogPath is the message catalog used to resolve "msg" references in
+// expected output; "" for none.
+var catalogPath string
+
+// catalog maps message identifiers to message texts.
+var catalog map[string]string
+
+// msgPrefix begins expected output lines that refer to the message catalog.
+const msgPrefix = "msg "
+
+// loadCatalog reads a message catalog. Each line has the form "ID=text";
+// blank lines and lines beginning with "#" are ignored. Within the text,
+// "{name}" is replaced by the value given for the argument name.
+func loadCatalog(path string) error {
+	f, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	catalog = map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for k := 1; scanner.Scan(); k++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, text, ok := strings.Cut(line, "=")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return fmt.Errorf("%s:%d: expected ID=text", path, k)
+		}
+		catalog[id] = text
+	}
+	return scanner.Err()
+}
+
+// resolveMessages replaces expected output lines of the form
+// "#>msg ID name=value ..." (or the same with "#!") with the text of the
+// message from the catalog, with the arguments substituted. A streamed test
+// case is only checked here; its lines are resolved as they are read.
+func resolveMessages(t *Test) error {
+	if catalog == nil {
+		return nil
+	} else if t.streamed {
+		lr := t.lines()
+		for lr.scan() {
+		}
+		return lr.close()
+	}
+	lines := strings.SplitAfter(t.content, "\n")
+	for k, line := range lines {
+		resolved, e := resolveLine(line)
+		if e != nil {
+			return fmt.Errorf("%s:%d: %s", t.path, k+1, e)
+		}
+		lines[k] = resolved
+	}
+	t.content = strings.Join(lines, "")
+	return nil
+}
+
+// resolveLine resolves the message reference in one line of a test case, if it has one.
+func resolveLine(line string) (string, error) {
+	if !strings.HasPrefix(line, comment) {
+		return line, nil
+	}
+	rest := line[len(comment):]
+	if rest == "" || rest[0] != '>' && rest[0] != '!' || !strings.HasPrefix(rest[1:], msgPrefix) {
+		return line, nil
+	}
+	body := strings.TrimSuffix(rest[1+len(msgPrefix):], "\n")
+	text, e := message(body)
+	if e != nil {
+		return "", e
+	}
+	return comment + rest[:1] + text + rest[1+len(msgPrefix)+len(body):], nil
+}
+
+// message looks up a message reference, "ID name=value ...", in the catalog.
+// A value may be written as a Go string literal if it contains spaces.
+func message(ref string) (string, error) {
+	fields, e := messageFields(ref)
+	if e != nil {
+		return "", e
+	} else if len(fields) == 0 {
+		return "", fmt.Errorf("missing message ID")
+	}
+	text, ok := catalog[fields[0]]
+	if !ok {
+		return "", fmt.Errorf("message %s not in catalog %s", fields[0], catalogPath)
+	}
+
+	args := map[string]string{}
+	for _, f := range fields[1:] {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return "", fmt.Errorf("message argument %q is not of the form name=value", f)
+		}
+		args[name] = value
+	}
+
+	var out strings.Builder
+	for {
+		open := strings.IndexByte(text, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(text[open:], '}')
+		if end < 0 {
+			break
+		}
+		name := text[open+1 : open+end]
+		value, ok := args[name]
+		if !ok {
+			return "", fmt.Errorf("message %s needs argument %s", fields[0], name)
+		}
+		out.WriteString(text[:open])
+		out.WriteString(value)
+		text = text[open+end+1:]
+	}
+	out.WriteString(text)
+	return out.String(), nil
+}
+
+// messageFields splits a message reference into white space separated fields,
+// unquoting values written as Go string literals.
+func messageFields(ref string) ([]string, error) {
+	var fields []string
+	for {
+		ref = strings.TrimLeft(ref, " \t")
+		if ref == "" {
+			return fields, nil
+		}
+		end := strings.IndexAny(ref, " \t")
+		if eq := strings.IndexByte(ref, '='); eq >= 0 && (end < 0 || eq < end) && eq+1 < len(ref) && ref[eq+1] == '"' {
+			quoted, e := strconv.QuotedPrefix(ref[eq+1:])
+			if e != nil {
+				return nil, fmt.Errorf("bad quoted value in %q", ref)
+			}
+			value, _ := strconv.Unquote(quoted)
+			fields = append(fields, ref[:eq+1]+value)
+			ref = ref[eq+1+len(quoted):]
+			continue
+		}
+		if end < 0 {
+			end = len(ref)
+		}
+		fields = append(fields, ref[:end])
+		ref = ref[end:]
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Resource limits apply to each process separately, so they cannot bound the
+// total memory used by a program that starts other processes. For that, each
+// test may be run in a cgroup of its own, with a memory limit. The cgroup is
+// created directly, with cgroup v2, within the cgroup given by -cgroup, which must
+// have been delegated to the user, with the memory controller enabled for its
+// children. Otherwise, the program is run in a transient scope with systemd-run.
+
+// memoryMaxSpec is the memory limit for each test, as given with -memory-max; "" for none.
+var memoryMaxSpec string
+
+// memoryMax is the memory limit for each test, in bytes; 0 for none.
+var memoryMax uint64
+
+// cgroupParent is the cgroup directory in which to create a cgroup for each test;
+// "" to use systemd-run instead.
+var cgroupParent string
+
+// parseMemoryMax checks the -memory-max option.
+func parseMemoryMax() error {
+	n, e := parseSize(memoryMaxSpec)
+	if e != nil || n == 0 {
+		return fmt.Errorf("invalid memory limit %q", memoryMaxSpec)
+	} else if !cgroupSupported && backend != "docker" {
+		return fmt.Errorf("memory limits are not supported on this system")
+	}
+	memoryMax = n
+	return nil
+}
+
+// systemdScope arranges for a command to run in a transient systemd scope
+// with a memory limit.
+func systemdScope(cmd *exec.Cmd) error {
+	path, e := exec.LookPath("systemd-run")
+	if e != nil {
+		return fmt.Errorf("-memory-max needs either -cgroup or systemd-run: %w", e)
+	}
+	args := []string{path, "--scope", "--quiet", "--collect", "-p", "MemoryMax=" + strconv.FormatUint(memoryMax, 10)}
+	if os.Getuid() != 0 {
+		args = append(args, "--user")
+	}
+	cmd.Args = append(append(args, "--"), cmd.Args...)
+	cmd.Path = path
+	return nil
+}
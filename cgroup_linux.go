@@ -0,0 +1,104 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cgroupSupported indicates whether memory limits can be enforced on this system.
+const cgroupSupported = true
+
+// Cgroup is a cgroup created for a single test.
+// Its methods may be called on a nil *Cgroup, and then do nothing.
+type Cgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// cgroupCount is used to give each cgroup a distinct name.
+var cgroupCount atomic.Int64
+
+// memoryCgroup arranges for a command to run with the memory limit, if there is one.
+// It returns the cgroup created for the command, if any; this should be removed
+// once the command has finished.
+func memoryCgroup(cmd *exec.Cmd) (*Cgroup, error) {
+	if memoryMax == 0 {
+		return nil, nil
+	} else if cgroupParent == "" {
+		return nil, systemdScope(cmd)
+	}
+
+	dir := filepath.Join(cgroupParent, fmt.Sprintf("invigilate-%d-%d", os.Getpid(), cgroupCount.Add(1)))
+	if e := os.Mkdir(dir, 0755); e != nil {
+		return nil, e
+	}
+	cg := &Cgroup{dir: dir}
+	limit := []byte(strconv.FormatUint(memoryMax, 10))
+	if e := os.WriteFile(filepath.Join(dir, "memory.max"), limit, 0); e != nil {
+		cg.remove()
+		return nil, e
+	}
+	// Without this, the program would be slowed by swapping rather than stopped.
+	os.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0)
+
+	f, e := os.Open(dir)
+	if e != nil {
+		cg.remove()
+		return nil, e
+	}
+	cg.fd = f
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return cg, nil
+}
+
+// oomKilled reports whether any process in the cgroup was killed for exceeding
+// the memory limit.
+func (cg *Cgroup) oomKilled() bool {
+	if cg == nil {
+		return false
+	}
+	f, e := os.Open(filepath.Join(cg.dir, "memory.events"))
+	if e != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if count, ok := strings.CutPrefix(scanner.Text(), "oom_kill "); ok {
+			return count != "0"
+		}
+	}
+	return false
+}
+
+// remove kills any processes left in the cgroup, and removes it.
+func (cg *Cgroup) remove() {
+	if cg == nil {
+		return
+	}
+	if cg.fd != nil {
+		cg.fd.Close()
+	}
+	os.WriteFile(filepath.Join(cg.dir, "cgroup.kill"), []byte("1"), 0)
+	for k := 0; k < 50; k++ {
+		if e := os.Remove(cg.dir); e == nil || os.IsNotExist(e) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// cgroupSupported indicates whether memory limits can be enforced on this system.
+const cgroupSupported = false
+
+// Cgroup would be a cgroup created for a single test, but this system has none.
+type Cgroup struct{}
+
+// memoryCgroup would arrange for a command to run with the memory limit,
+// but parseMemoryMax does not allow one to be set on this system.
+func memoryCgroup(cmd *exec.Cmd) (*Cgroup, error) {
+	return nil, nil
+}
+
+// oomKilled reports whether any process in the cgroup was killed for exceeding
+// the memory limit.
+func (cg *Cgroup) oomKilled() bool {
+	return false
+}
+
+// remove removes the cgroup.
+func (cg *Cgroup) remove() {
+}
@@ -0,0 +1,54 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// Output of many megabytes, which is always the same, need not be kept at all.
+// The line "#>sha256 " followed by a SHA-256 checksum in hexadecimal expects all
+// the remaining output, to the end, to have that checksum; "#!sha256 " does the
+// same for error output. The checksum is of the output as it is matched, after
+// any filters, such as -ansi strip, are applied.
+
+// checksumPrefix begins the data of expected output lines giving checksums.
+const checksumPrefix = "sha256 "
+
+// checksumText reports whether the data of an expected output line gives a
+// checksum, and if so returns it, in lowercase hexadecimal.
+func checksumText(data string) (string, bool) {
+	sum, ok := strings.CutPrefix(data, checksumPrefix)
+	return strings.ToLower(strings.TrimSpace(sum)), ok
+}
+
+// checkChecksum checks the data of an expected output line giving a checksum.
+func checkChecksum(data string) error {
+	sum, _ := checksumText(data)
+	if b, e := hex.DecodeString(sum); e != nil || len(b) != 32 {
+		return errors.New("SHA-256 checksum must be 64 hexadecimal digits")
+	}
+	return nil
+}
+
+// checksum reads all the remaining data, to the end of the stream, and returns
+// its SHA-256 checksum in hexadecimal.
+func (s *Stream) checksum(deadline time.Time) (string, error) {
+	h := sha256.New()
+	for {
+		_, e := s.read(deadline)
+		h.Write(s.pending())
+		s.consume(len(s.pending()))
+		if e == io.EOF {
+			return hex.EncodeToString(h.Sum(nil)), nil
+		} else if e != nil {
+			return "", e
+		}
+	}
+}
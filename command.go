@@ -0,0 +1,38 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// commandEnv returns the environment variables given to a command beyond those
+// of invigilate itself, leaving out those it uses only internally.
+func commandEnv(cmd *exec.Cmd) []string {
+	own := os.Environ()
+	var env []string
+	for _, v := range cmd.Env {
+		if !slices.Contains(own, v) && !strings.HasPrefix(v, rlimitEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
+// describeCommand describes how the program is run for a test case, as a shell
+// command that runs it again by hand: the command line, with any wrapper or
+// container, preceded by any change of directory and environment variables.
+func describeCommand(args []string, cmd *exec.Cmd) string {
+	desc := shellJoin(args)
+	if env := commandEnv(cmd); len(env) > 0 {
+		desc = "env " + shellJoin(env) + " " + desc
+	}
+	if cmd.Dir != "" {
+		desc = "cd " + shellQuote(cmd.Dir) + " && " + desc
+	}
+	return desc
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Test cases written in several languages each need the comment delimiter of
+// their language. With -comments, the delimiter is chosen by the extension of
+// the test case, such as "//" for .c or "--" for .sql, and -c gives it for the
+// others. Files with these extensions are also test cases when directories are
+// searched. A test case may also name its own delimiter on its first line, or
+// its second after a "#!" line, with "invigilate: comment=" followed by the
+// delimiter, as in "-- invigilate: comment=--". Test cases are read and run one
+// at a time, so the delimiter is set in comment before each is examined.
+
+// commentSpec gives the comment delimiters for extensions, as given with -comments.
+var commentSpec string
+
+// commentDelimiters holds the comment delimiter for each extension, parsed from commentSpec.
+var commentDelimiters = map[string]string{}
+
+// defaultComment is the comment delimiter given with -c.
+var defaultComment string
+
+// commentMarker introduces the comment delimiter named by a test case.
+const commentMarker = "invigilate: comment="
+
+// parseComments parses commentSpec, a comma separated list of items
+// ".ext=delimiter", into commentDelimiters.
+func parseComments() error {
+	defaultComment = comment
+	if commentSpec == "" {
+		return nil
+	}
+	for _, item := range strings.Split(commentSpec, ",") {
+		ext, delim, _ := strings.Cut(item, "=")
+		ext, delim = strings.TrimSpace(ext), strings.TrimSpace(delim)
+		if len(ext) < 2 || ext[0] != '.' || delim == "" {
+			return fmt.Errorf("invalid comment delimiter %q: must be .ext=delimiter", item)
+		}
+		commentDelimiters[ext] = delim
+	}
+	return nil
+}
+
+// selectComment sets comment to the comment delimiter for a test case.
+func selectComment(t Test) {
+	if delim, ok := namedComment(t); ok {
+		comment = delim
+	} else if delim, ok := matchExtension(t.path, commentDelimiters); ok {
+		comment = delim
+	} else {
+		comment = defaultComment
+	}
+}
+
+// namedComment returns the comment delimiter named by a test case, if any.
+func namedComment(t Test) (string, bool) {
+	if t.err != nil {
+		return "", false
+	}
+	lines, e := headLines(t, 2)
+	if e != nil || len(lines) == 0 {
+		return "", false
+	} else if len(lines) > 1 && !strings.HasPrefix(lines[0], "#!") {
+		lines = lines[:1]
+	}
+	for _, line := range lines {
+		if _, rest, ok := strings.Cut(line, commentMarker); ok {
+			if delim := strings.Fields(rest); len(delim) > 0 {
+				return delim[0], true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"os"
+)
+
+// Input and expected output that are too large, or too far from text, to be
+// written as lines of a test case may instead be kept in companion files beside
+// it, with the extension of the test case replaced: foo.in holds the input for
+// foo.test, foo.out its expected output, and foo.err its expected error output,
+// all exactly as the program reads or writes them. Their contents follow those of
+// the test case itself: the input is given after any "#<" lines, while the
+// expected output and error output are matched after any "#>" and "#!" lines.
+
+// Companions holds the contents of a test case's companion files; each is ""
+// if there is no such file.
+type Companions struct {
+	input, output, errors string
+}
+
+// companionPath returns the path of a test case's companion file with the given
+// extension. These are the golden files of the golden subcommand.
+func companionPath(path, suffix string) string {
+	return testBase(path) + suffix
+}
+
+// readCompanions reads the companion files of a test case.
+func readCompanions(path string) (Companions, error) {
+	var c Companions
+	for k, dest := range []*string{&c.input, &c.output, &c.errors} {
+		data, e := os.ReadFile(companionPath(path, goldenExtensions[k]))
+		if e != nil && !os.IsNotExist(e) {
+			return c, e
+		}
+		*dest = string(data)
+	}
+	return c, nil
+}
+
+// contents returns the contents of the companion files, in the order of goldenExtensions.
+func (c Companions) contents() []string {
+	return []string{c.input, c.output, c.errors}
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// For output in formats of its own, such as images or documents with embedded
+// dates, no comparison of text may serve. The -comparator option, or the
+// comparator directive, gives a shell command that compares the output with the
+// expected output instead; it is run once the program has finished, for each of
+// the output and error output, with {expected} and {actual} replaced by the names
+// of files holding the expected and actual data, or with these names appended if
+// neither appears. The output matches if the command exits with status 0. As with
+// -sort, input is then given without waiting for any output, and searches, at-exit
+// directives, and blocks are not treated specially.
+
+// comparatorCmd records the -comparator option.
+var comparatorCmd string
+
+// checkComparator checks a "comparator" directive.
+func checkComparator(arg string) error {
+	if arg == "" {
+		return errors.New("missing command")
+	}
+	return nil
+}
+
+// testComparator returns the comparator command for a test case, or "" for none.
+// A comparator directive takes precedence over the -comparator option.
+func testComparator(t Test) string {
+	command := comparatorCmd
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "comparator" {
+				command = arg
+			}
+		}
+	}
+	return command
+}
+
+// runComparator runs the comparator command on the expected and actual data.
+// It reports whether they match, with any output of the command, which should
+// explain the differences; an error means the command could not be run.
+func runComparator(ctx context.Context, command, want, have string, deadline time.Time) (bool, string, error) {
+	dir, e := os.MkdirTemp("", "invigilate-compare")
+	if e != nil {
+		return false, "", e
+	}
+	defer os.RemoveAll(dir)
+	wantPath, havePath := filepath.Join(dir, "expected"), filepath.Join(dir, "actual")
+	if e := os.WriteFile(wantPath, []byte(want), 0644); e != nil {
+		return false, "", e
+	}
+	if e := os.WriteFile(havePath, []byte(have), 0644); e != nil {
+		return false, "", e
+	}
+
+	if !strings.Contains(command, "{expected}") && !strings.Contains(command, "{actual}") {
+		command += " {expected} {actual}"
+	}
+	command = strings.ReplaceAll(command, "{expected}", shellQuote(wantPath))
+	command = strings.ReplaceAll(command, "{actual}", shellQuote(havePath))
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	e = cmd.Run()
+	var ee *exec.ExitError
+	if e == nil {
+		return true, "", nil
+	} else if ctx.Err() == context.DeadlineExceeded {
+		return false, "", os.ErrDeadlineExceeded
+	} else if errors.As(e, &ee) {
+		return false, strings.TrimRight(out.String(), "\n"), nil
+	}
+	return false, "", e
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// compareTo is a JSON report with which the results of this run should be compared; "" for none.
+var compareTo string
+
+// Comparison lists the differences between two sets of results.
+type Comparison struct {
+	regressions, fixes, added, removed []Result
+}
+
+// resultKey identifies a result within a run: by the path of the test, and by
+// which run of it this was, with -count.
+type resultKey struct {
+	path      string
+	iteration int
+}
+
+// lastResults returns the index of the last result with each key.
+func lastResults(results []Result) map[resultKey]int {
+	last := map[resultKey]int{}
+	for k, r := range results {
+		last[resultKey{r.path, r.iteration}] = k
+	}
+	return last
+}
+
+// compareResults compares the current results with older ones. Results are matched
+// by path, and with -count, by run; a result appearing more than once in a run
+// counts as its last appearance. Only the status of each result is compared.
+func compareResults(older, current []Result) (c Comparison) {
+	before, after := lastResults(older), lastResults(current)
+	for k, r := range current {
+		key := resultKey{r.path, r.iteration}
+		if after[key] != k {
+			continue // not the last result for this key
+		}
+		o, ok := before[key]
+		if !ok {
+			c.added = append(c.added, r)
+		} else if older[o].status == passed && r.status != passed {
+			c.regressions = append(c.regressions, r)
+		} else if older[o].status != passed && r.status == passed {
+			c.fixes = append(c.fixes, r)
+		}
+	}
+	for k, r := range older {
+		key := resultKey{r.path, r.iteration}
+		if _, ok := after[key]; !ok && before[key] == k {
+			c.removed = append(c.removed, r)
+		}
+	}
+	return
+}
+
+// print writes the comparison to w.
+func (c Comparison) print(w io.Writer) {
+	if len(c.regressions)+len(c.fixes)+len(c.added)+len(c.removed) == 0 {
+		fmt.Fprintln(w, "No changes.")
+		return
+	}
+	show := func(title string, results []Result, detail bool) {
+		if len(results) == 0 {
+			return
+		}
+		fmt.Fprintln(w, title)
+		for _, r := range results {
+			name := r.path
+			if r.iteration > 0 {
+				name += fmt.Sprintf(" run %d", r.iteration)
+			}
+			if detail && r.status != passed {
+				fmt.Fprintf(w, "  %s (%s: %s)\n", name, r.status, r.category)
+			} else if detail {
+				fmt.Fprintf(w, "  %s (%s)\n", name, r.status)
+			} else {
+				fmt.Fprintf(w, "  %s\n", name)
+			}
+		}
+	}
+	show("Regressions:", c.regressions, true)
+	show("Fixes:", c.fixes, false)
+	show("Added:", c.added, true)
+	show("Removed:", c.removed, false)
+}
+
+// diff implements the "diff" subcommand, which compares two JSON reports.
+func diff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `
+Usage: invigilate diff old.json new.json
+
+Diff compares two JSON reports written with the -json option, listing regressions
+(tests that passed before but not now), fixes, and tests that were added or removed.
+The exit code is 1 if there are any regressions.
+`)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		fatal(exitError, "Exactly two reports must be given")
+	}
+
+	older, e := readReport(fs.Arg(0))
+	if e != nil {
+		fatal(exitError, e)
+	}
+	current, e := readReport(fs.Arg(1))
+	if e != nil {
+		fatal(exitError, e)
+	}
+
+	c := compareResults(older, current)
+	c.print(os.Stdout)
+	if len(c.regressions) > 0 {
+		os.Exit(exitFailed)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Where each test case must be compiled, as when it is itself a program, or in
+// the submit-and-judge workflow of programming contests, the -compile option
+// gives a shell command run before each test case, such as "cc -o {exe} {test}".
+// It is given the path to the test case in place of {test}, and must write the
+// program to the file named by {exe}, which is then used in place of {exe} in the
+// program's command line, such as "{exe}". A failure to compile fails the test.
+
+// compileCmd is the shell command compiling each test case, as given with
+// -compile; "" for none.
+var compileCmd string
+
+// compileTest runs the compile command for a test case, returning the program
+// it wrote, in a directory of its own, which should be removed once the test is
+// done. An error includes the output of the command.
+func compileTest(ctx context.Context, t Test) (string, error) {
+	dir, e := os.MkdirTemp("", "invigilate-compile")
+	if e != nil {
+		return "", e
+	}
+	exe, src := filepath.Join(dir, "program"), t.path
+	if needsCopy(t) {
+		if src, e = writeCopy(t, dir); e != nil {
+			return exe, e
+		}
+	}
+	command := strings.ReplaceAll(compileCmd, "{test}", shellQuote(src))
+	command = strings.ReplaceAll(command, "{exe}", shellQuote(exe))
+	if out, e := exec.CommandContext(ctx, "/bin/sh", "-c", command).CombinedOutput(); e != nil {
+		return exe, fmt.Errorf("compilation failed: %s\n%s", e, printable(out))
+	}
+	return exe, nil
+}
+
+// withCompiled returns the program's command line with {exe} replaced by the
+// program written by the compile command.
+func withCompiled(program []string, exe string) []string {
+	var words []string
+	for _, a := range program {
+		words = append(words, strings.ReplaceAll(a, "{exe}", exe))
+	}
+	return words
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import "strings"
+
+// Where output is too changeable to give line by line, a line such as "#>? needle"
+// expects a line of output containing the text "needle", somewhere ahead; any lines
+// before it are skipped. "#!? needle" does the same for the error output. When the
+// last line expecting a stream's output is such a search, the rest of that output is
+// skipped too. So a test case expecting output only with searches checks that the
+// output contains each text, in the order given.
+//
+// Conversely, a line such as "#>^ panic:" expects that the text "panic:" appears
+// nowhere in the output, guarding against leaked debug output or crashes; "#!^"
+// does the same for the error output. These are checked once all the output has
+// been received, wherever they appear in the test case.
+
+// searchText returns the text to search for, if the data of a "#>" or "#!" line,
+// without the ">" or "!", is a search; that is, if it begins with "?" and white space.
+func searchText(data string) (string, bool) {
+	return markedText(data, '?')
+}
+
+// forbiddenText returns the text that must not appear, if the data of a "#>" or
+// "#!" line, without the ">" or "!", begins with "^" and white space.
+func forbiddenText(data string) (string, bool) {
+	return markedText(data, '^')
+}
+
+// markedText returns the text following mark and white space at the start of data.
+func markedText(data string, mark byte) (string, bool) {
+	if len(data) < 2 || data[0] != mark || data[1] != ' ' && data[1] != '\t' {
+		return "", false
+	}
+	text := strings.TrimSpace(data[2:])
+	return text, text != ""
+}
+
+// findForbidden returns the first of the texts found in the output, and the line
+// of the output containing it.
+func findForbidden(output string, texts []string) (text, line string, found bool) {
+	for _, text := range texts {
+		if n := strings.Index(output, text); n >= 0 {
+			start := strings.LastIndexByte(output[:n], '\n') + 1
+			end := strings.IndexByte(output[n:], '\n')
+			if end < 0 {
+				end = len(output) - n
+			}
+			return text, output[start : n+end], true
+		}
+	}
+	return "", "", false
+}
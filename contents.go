@@ -0,0 +1,119 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The contents of a file written by the program may be matched as its output
+// is, with the same kinds of lines. A contents block begins with the directive
+// "#contents out.txt", naming the file relative to the program's working
+// directory, and ends with "#end-contents"; the "#>" lines between them give
+// the expected contents of the file, rather than output, and are matched once
+// the program has exited. They may be searches, forbidden text, references to
+// other files, encoded data, or checksums, just as for output. As with file
+// directives, the program is run in a new, empty directory unless a cwd
+// directive is given.
+
+// checkContents checks a "contents" directive.
+func checkContents(arg string) error {
+	if arg == "" {
+		return errors.New("missing file name")
+	}
+	return nil
+}
+
+// ContentsCheck holds a contents block.
+type ContentsCheck struct {
+	path  string   // the file, relative to the program's working directory
+	lines []string // the data of the "#>" lines in the block, without the ">"
+}
+
+// verify matches the contents of the file written by the program run in dir,
+// or in the current directory if dir is "". It logs any problem found, and
+// reports whether there was none.
+func (cc ContentsCheck) verify(t Test, dir string) bool {
+	what := "file " + cc.path
+	data, e := os.ReadFile(filepath.Join(dir, filepath.FromSlash(cc.path)))
+	if errors.Is(e, os.ErrNotExist) {
+		log.Printf("%s: %s was not written", t.path, what)
+		return false
+	} else if e != nil {
+		log.Printf("%s: %s: %s", t.path, what, e)
+		return false
+	}
+	have := string(data)
+
+	pos, skipRest := 0, false
+	var forbidden []string
+	mismatch := func(want string) bool {
+		logContentDiff(fmt.Sprintf("%s: incorrect contents of %s", t.path, what), want, have)
+		return false
+	}
+	expect := func(want string) bool {
+		if !strings.HasPrefix(have[pos:], want) {
+			return mismatch(have[:pos] + want)
+		}
+		pos, skipRest = pos+len(want), false
+		return true
+	}
+	for _, line := range cc.lines {
+		if ref, ok := fileReference(line); ok {
+			content, e := readReference(t, ref)
+			if e != nil {
+				log.Printf("%s: %s", t.path, e)
+				return false
+			} else if !expect(content) {
+				return false
+			}
+		} else if decoded, ok, _ := encodedData(line); ok {
+			if !expect(decoded) {
+				return false
+			}
+		} else if text, ok := forbiddenText(line); ok {
+			forbidden = append(forbidden, text)
+		} else if sum, ok := checksumText(line); ok {
+			hash := sha256.Sum256([]byte(have[pos:]))
+			if actual := hex.EncodeToString(hash[:]); actual != sum {
+				log.Printf("%s: incorrect checksum of %s", t.path, what)
+				log.Printf("expected: %s", sum)
+				log.Printf("  actual: %s", actual)
+				return false
+			}
+			pos, skipRest = len(have), false
+		} else if needle, ok := searchText(line); ok {
+			n := strings.Index(have[pos:], needle)
+			if n < 0 {
+				log.Printf("%s: %s does not contain: %s", t.path, what, printable(needle))
+				return false
+			}
+			pos += n
+			if end := strings.IndexByte(have[pos:], '\n'); end >= 0 {
+				pos += end + 1
+			} else {
+				pos = len(have)
+			}
+			skipRest = true
+		} else if !expect(line) {
+			return false
+		}
+	}
+	if pos < len(have) && !skipRest {
+		return mismatch(have[:pos])
+	}
+	if text, line, found := findForbidden(have, forbidden); found {
+		log.Printf("%s: %s contains forbidden text: %s", t.path, what, printable(text))
+		log.Printf("  actual: %s", printable(line))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+// repeatCount is the number of times each test should be run, each run being
+// reported separately, as given with -count.
+var repeatCount int
+
+// With -count, repeatedRuns and failedRuns count the runs of tests, and the failed
+// runs of tests not in quarantine. failedRepeats and erroredRepeats record the
+// paths of the tests with failed runs, and with runs ending in errors, so that
+// each test is counted once in failCount or errorCount.
+var (
+	repeatedRuns   int
+	failedRuns     int
+	failedRepeats  = map[string]bool{}
+	erroredRepeats = map[string]bool{}
+)
+
+// firstRepeat reports whether a failed or errored result is the first for its
+// test among those noted in seen, and notes it there. A result of a test not
+// repeated with -count is always the first.
+func firstRepeat(r Result, seen map[string]bool) bool {
+	if r.iteration == 0 {
+		return true
+	} else if seen[r.path] {
+		return false
+	}
+	seen[r.path] = true
+	return true
+}
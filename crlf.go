@@ -0,0 +1,49 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+// Programs built for Windows usually end their lines with "\r\n", and test case
+// files edited there often do too. With the -crlf option, each "\r\n" is treated
+// as "\n", both in the lines of test case files and in the output and error output
+// of the program, so that the same test cases serve for programs built on Windows
+// and on Unix.
+
+// crlf records the -crlf option.
+var crlf bool
+
+// CRLFFilter replaces each "\r\n" in one of the program's output streams with "\n".
+// The data may be split between reads anywhere, so a final "\r" is held back until
+// it is known whether a newline follows it.
+type CRLFFilter struct {
+	held bool // whether a "\r" has been held back
+}
+
+// filter returns the data with each "\r\n" replaced by "\n". If end is true,
+// this is the end of the stream, so no "\r" is held back.
+func (f *CRLFFilter) filter(data []byte, end bool) []byte {
+	out := make([]byte, 0, len(data)+1)
+	for _, c := range data {
+		if f.held && c != '\n' {
+			out = append(out, '\r')
+		}
+		f.held = c == '\r'
+		if !f.held {
+			out = append(out, c)
+		}
+	}
+	if end && f.held {
+		out = append(out, '\r')
+		f.held = false
+	}
+	return out
+}
+
+// trimCR returns a line of a test case with a final "\r\n" replaced by "\n",
+// if the -crlf option is given.
+func trimCR(line string) string {
+	if crlf && len(line) >= 2 && line[len(line)-2:] == "\r\n" {
+		line = line[:len(line)-2] + "\n"
+	}
+	return line
+}
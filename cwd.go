@@ -0,0 +1,61 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// A program may read data files by relative paths, and so need to be run in a
+// particular directory. The directive "#cwd data" runs it in the directory data,
+// relative to the directory holding the test case, rather than in invigilate's
+// own working directory. The paths of the program and the test case on its
+// command line are then made absolute, so that they are still found.
+
+// checkCwd checks a "cwd" directive.
+func checkCwd(arg string) error {
+	if arg == "" {
+		return errors.New("missing directory")
+	}
+	return nil
+}
+
+// testCwd returns the directory in which to run the program for a test case,
+// or "" for invigilate's own working directory.
+func testCwd(t Test) string {
+	dir := ""
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "cwd" {
+				if dir = filepath.FromSlash(arg); !filepath.IsAbs(dir) {
+					dir = referencePath(t, arg)
+				}
+			}
+		}
+	}
+	return dir
+}
+
+// absCommand returns the program's command line and the path of a test case,
+// with relative paths made absolute, for running in another directory. Only the
+// program's own path is changed, if it has a directory; other arguments cannot
+// be known to be paths.
+func absCommand(program []string, path string) ([]string, string, error) {
+	abs, e := filepath.Abs(path)
+	if e != nil {
+		return nil, "", e
+	}
+	program = append([]string{}, program...)
+	if strings.ContainsRune(program[0], filepath.Separator) || strings.ContainsRune(program[0], '/') {
+		if program[0], e = filepath.Abs(program[0]); e != nil {
+			return nil, "", e
+		}
+	}
+	return program, abs, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// checkDeterminism records whether to run each test twice, failing those whose
+// output differs between the runs.
+var checkDeterminism bool
+
+// determinismTest runs a test twice and compares the output, error output, and
+// exit codes of the two runs, whatever was expected of them. The test fails if
+// either run fails, or if the runs differ; otherwise the result is that of the
+// first run. A test failing the first time is not run again, since it already
+// needs attention.
+func determinismTest(ctx context.Context, t Test, program []string, span *Span) Result {
+	first := runTest(ctx, t, program, span)
+	if first.status != passed || ctx.Err() != nil {
+		return first
+	}
+	second := runTest(ctx, t, program, span)
+	if second.status != passed || ctx.Err() != nil {
+		return second
+	}
+
+	// A program killed on purpose, as by a "signal" directive, may have been
+	// stopped at a different point in each run; so only complete runs are compared.
+	if !first.exited || !second.exited {
+		return first
+	}
+	for _, stream := range []string{">output", "!error output"} {
+		a, b := first.transcript.stream(stream[0]), second.transcript.stream(stream[0])
+		if n, ok := firstDifference(a, b); !ok {
+			log.Printf("%s: %s differs between runs at line %d\n first run: %s\nsecond run: %s",
+				t.path, stream[1:], n, lineAt(a, n), lineAt(b, n))
+			first.status, first.category = failed, "nondeterministic"
+			return first
+		}
+	}
+	if first.exitCode != second.exitCode {
+		log.Printf("%s: exit code differs between runs: %d, then %d", t.path, first.exitCode, second.exitCode)
+		first.status, first.category = failed, "nondeterministic"
+	}
+	return first
+}
+
+// firstDifference compares two outputs line by line, returning the number of
+// the first line that differs, counting from 1, and false; or 0 and true if
+// they are the same.
+func firstDifference(a, b string) (int, bool) {
+	la, lb := strings.SplitAfter(a, "\n"), strings.SplitAfter(b, "\n")
+	n := min(len(la), len(lb))
+	for k := 0; k < n; k++ {
+		if la[k] != lb[k] {
+			return k + 1, false
+		}
+	}
+	if len(la) != len(lb) {
+		return n + 1, false
+	}
+	return 0, true
+}
+
+// lineAt returns line n of an output, counting from 1, quoted; or a note that
+// there is no such line.
+func lineAt(output string, n int) string {
+	lines := strings.SplitAfter(output, "\n")
+	if n > len(lines) || n == len(lines) && lines[n-1] == "" {
+		return "(no line)"
+	}
+	return fmt.Sprintf("%q", lines[n-1])
+}
@@ -0,0 +1,314 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directive describes one kind of directive that may appear in test case files.
+// A directive line consists of the comment delimiter, the directive name,
+// and optionally some white space followed by an argument;
+// for example, "#requires-invigilate >=0.5".
+type Directive struct {
+	// check validates the argument of the directive; it returns an error
+	// if the test case should not be run.
+	check func(arg string) error
+}
+
+// directives lists the known directives, by name.
+var directives = map[string]Directive{
+	"at-exit":             {checkAtExit},
+	"case":                {checkCase},
+	"comparator":          {checkComparator},
+	"contents":            {checkContents},
+	"cwd":                 {checkCwd},
+	"end-contents":        {checkNoArgument},
+	"end-json":            {checkNoArgument},
+	"end-unordered":       {checkNoArgument},
+	"error-bytes":         {checkVolume("error-bytes")},
+	"expand":              {checkNoArgument},
+	"error-lines":         {checkVolume("error-lines")},
+	"file":                {checkFileCheck},
+	"first-output-within": {checkFirstOutput},
+	"fixture":             {checkFixture},
+	"include":             {checkInclude},
+	"killed":              {checkSignal},
+	"lenient-newline":     {checkNoArgument},
+	"ignore-stderr":       {checkNoArgument},
+	"ignore-stdout":       {checkNoArgument},
+	"json":                {checkJSON},
+	"matrix":              {checkMatrix},
+	"merge-output":        {checkNoArgument},
+	"output-bytes":        {checkVolume("output-bytes")},
+	"output-lines":        {checkVolume("output-lines")},
+	"pty":                 {checkPty},
+	"requires-invigilate": {checkVersion},
+	"rlimit":              {checkRlimit},
+	"scrub":               {checkScrub},
+	"signal":              {checkSignal},
+	"sort-output":         {checkNoArgument},
+	"unordered":           {checkNoArgument},
+	"whitespace":          {checkWhitespace},
+}
+
+// blockDirectives lists the directives beginning blocks, each ended by a directive
+// with "end-" added to its name.
+var blockDirectives = map[string]bool{"contents": true, "json": true, "unordered": true}
+
+// extensionPrefix begins the names of directives reserved for use by other tools.
+const extensionPrefix = "x-"
+
+// warned records the unknown extension directives that have already been reported.
+var warned = map[string]bool{}
+
+// isDirective reports whether a line, with the comment delimiter removed,
+// is a directive: a known directive, or an extension directive. Any other line
+// is an ordinary comment, even if it looks like a directive, as "#todo: fix".
+func isDirective(line string) bool {
+	name := directiveName(line)
+	if _, ok := directives[name]; ok {
+		return true
+	}
+	return strings.HasPrefix(name, extensionPrefix)
+}
+
+// directiveName returns the name of the directive a line, with the comment
+// delimiter removed, appears to hold: a lowercase letter, followed by lowercase
+// letters, digits, and hyphens, and then white space, the end of the line, or
+// the "!" beginning the argument of an at-exit directive. It returns "" if the
+// line does not look like a directive.
+func directiveName(line string) string {
+	if line == "" || line[0] < 'a' || 'z' < line[0] {
+		return ""
+	}
+	name, _ := splitDirective(line)
+	if len(name) < len(line) && !strings.ContainsRune(" \t\r\n", rune(line[len(name)])) && line[len(name)] != '!' {
+		return ""
+	}
+	return name
+}
+
+// splitDirective separates a directive line, with the comment delimiter removed,
+// into the directive name and its argument. The name consists of lowercase letters,
+// digits, and hyphens; the argument is the remainder of the line, without
+// any white space separating it from the name, and without the final newline.
+func splitDirective(line string) (name, arg string) {
+	line = strings.TrimSuffix(line, "\n")
+	n := 0
+	for n < len(line) && (line[n] == '-' || 'a' <= line[n] && line[n] <= 'z' || '0' <= line[n] && line[n] <= '9') {
+		n++
+	}
+	return line[:n], strings.TrimLeft(line[n:], " \t")
+}
+
+// checkDirectives checks all the directives in a test case.
+func checkDirectives(t Test) error {
+	lr := t.lines()
+	defer lr.close()
+	statuses := 0
+	block, blockLine := "", 0 // the block being read, and its first line
+	for lr.scan() {
+		line := lr.text()
+		if block != "" && strings.HasPrefix(line, comment+"<") {
+			return fmt.Errorf("%s:%d: input in the %s block beginning at line %d", t.path, lr.lineno, block, blockLine)
+		} else if block == "contents" && strings.HasPrefix(line, comment+"!") {
+			return fmt.Errorf("%s:%d: error output in the %s block beginning at line %d", t.path, lr.lineno, block, blockLine)
+		}
+		if data := strings.TrimPrefix(line, comment); len(data) > 0 && len(data) < len(line) && strings.ContainsRune("<>!", rune(data[0])) {
+			if _, ok := fileReference(data[1:]); ok {
+				if e := checkReference(t, data[1:]); e != nil {
+					return fmt.Errorf("%s:%d: %s", t.path, lr.lineno, e)
+				}
+			} else if _, _, e := encodedData(data[1:]); e != nil {
+				return fmt.Errorf("%s:%d: %s", t.path, lr.lineno, e)
+			} else if _, ok := checksumText(data[1:]); ok && data[0] != '<' {
+				if e := checkChecksum(data[1:]); e != nil {
+					return fmt.Errorf("%s:%d: %s", t.path, lr.lineno, e)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, comment+"?") {
+			if statuses++; statuses > 1 {
+				return fmt.Errorf("%s:%d: more than one #? line", t.path, lr.lineno)
+			} else if _, e := parseExitStatuses(line[len(comment)+1:]); e != nil {
+				return fmt.Errorf("%s:%d: %s", t.path, lr.lineno, e)
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, comment) || !isDirective(line[len(comment):]) {
+			continue
+		}
+		name, arg := splitDirective(line[len(comment):])
+		switch {
+		case blockDirectives[name] && block != "":
+			return fmt.Errorf("%s:%d: %s block inside the %s block beginning at line %d", t.path, lr.lineno, name, block, blockLine)
+		case blockDirectives[name]:
+			block, blockLine = name, lr.lineno
+		case strings.HasPrefix(name, "end-") && blockDirectives[name[len("end-"):]] && name != "end-"+block:
+			return fmt.Errorf("%s:%d: %s without %s", t.path, lr.lineno, name, name[len("end-"):])
+		case strings.HasPrefix(name, "end-") && blockDirectives[name[len("end-"):]]:
+			block = ""
+		}
+		d, ok := directives[name]
+		if !ok {
+			if !warned[name] {
+				log.Printf("%s:%d: warning: ignoring extension directive %q", t.path, lr.lineno, name)
+				warned[name] = true
+			}
+			continue
+		}
+		if d.check != nil {
+			if e := d.check(arg); e != nil {
+				return fmt.Errorf("%s:%d: %s", t.path, lr.lineno, e)
+			}
+		}
+	}
+	if e := lr.close(); e != nil {
+		return e
+	} else if block != "" {
+		return fmt.Errorf("%s:%d: %s block has no end-%s", t.path, blockLine, block, block)
+	}
+	return nil
+}
+
+// hasDirective reports whether a test case has a directive with the given name.
+func hasDirective(t Test, name string) bool {
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if n, _ := splitDirective(line[len(comment):]); n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkNoArgument checks a directive which takes no argument, such as "merge-output".
+func checkNoArgument(arg string) error {
+	if arg != "" {
+		return errors.New("unexpected argument")
+	}
+	return nil
+}
+
+// checkAtExit checks an "at-exit" directive.
+func checkAtExit(arg string) error {
+	if !strings.HasPrefix(arg, "!") {
+		return fmt.Errorf("at-exit must be followed by \"!\" and the expected error output")
+	}
+	return nil
+}
+
+// checkFirstOutput checks a "first-output-within" directive.
+func checkFirstOutput(arg string) error {
+	_, e := parseFirstOutput(arg)
+	return e
+}
+
+// parseFirstOutput parses the argument of a "first-output-within" directive.
+func parseFirstOutput(arg string) (time.Duration, error) {
+	d, e := time.ParseDuration(strings.TrimSpace(arg))
+	if e != nil {
+		return 0, fmt.Errorf("first-output-within needs a duration, such as 200ms")
+	} else if d <= 0 {
+		return 0, fmt.Errorf("first-output-within needs a positive duration")
+	}
+	return d, nil
+}
+
+// checkSignal checks a "signal" or "killed" directive.
+func checkSignal(arg string) error {
+	_, e := parseSignal(arg)
+	return e
+}
+
+// checkVersion handles the "requires-invigilate" directive.
+func checkVersion(req string) error {
+	req = strings.TrimSpace(req)
+	ok, e := versionSatisfies(version, req)
+	if e != nil {
+		return e
+	} else if !ok {
+		return fmt.Errorf("harness too old: requires invigilate %s, but this is version %s", req, version)
+	}
+	return nil
+}
+
+// versionSatisfies reports whether version have meets the requirement req,
+// which is a dotted version number optionally preceded by one of the
+// comparison operators >=, >, <=, <, or =. With no operator, >= is assumed.
+func versionSatisfies(have, req string) (bool, error) {
+	op := ">="
+	for _, o := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(req, o) {
+			op = o
+			req = strings.TrimSpace(req[len(o):])
+			break
+		}
+	}
+
+	want, e := parseVersion(req)
+	if e != nil {
+		return false, e
+	}
+	got, e := parseVersion(have)
+	if e != nil {
+		panic(e)
+	}
+
+	cmp := 0
+	for k := 0; cmp == 0 && (k < len(got) || k < len(want)); k++ {
+		var g, w int
+		if k < len(got) {
+			g = got[k]
+		}
+		if k < len(want) {
+			w = want[k]
+		}
+		if g < w {
+			cmp = -1
+		} else if g > w {
+			cmp = 1
+		}
+	}
+
+	switch op {
+	case ">=":
+		return cmp >= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case "<":
+		return cmp < 0, nil
+	default:
+		return cmp == 0, nil
+	}
+}
+
+// parseVersion splits a dotted version number such as "0.5.1" into its parts.
+func parseVersion(v string) ([]int, error) {
+	if v == "" {
+		return nil, errors.New("missing version number")
+	}
+	var parts []int
+	for _, s := range strings.Split(v, ".") {
+		n, e := strconv.Atoi(s)
+		if e != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version number %q", v)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A large suite may be spread across several machines. Each runs the worker
+// subcommand, and a coordinator, given the workers' addresses with -workers,
+// dispatches the test cases to them as they become free, and reports the results
+// as if it had run the tests itself. Each worker must have the program and the
+// test cases at the same paths, relative to its working directory, as the
+// coordinator, as in a shared or identical checkout.
+//
+// The coordinator and a worker exchange JSON values over TCP. The coordinator
+// first sends a Job, and then a WorkRequest for each test case; the worker
+// replies to each request with a WorkResult. The worker runs each test case
+// with a separate invigilate process, given the options of the Job.
+
+// workerAddrs is a comma separated list of the addresses of the workers; "" to run tests locally.
+var workerAddrs string
+
+// Job describes how a worker should run the test cases it is sent.
+type Job struct {
+	Version string   // of the coordinator, which must match the worker's
+	Options []string // options for running each test case
+	Program []string
+}
+
+// WorkRequest asks a worker to run one test case.
+type WorkRequest struct {
+	Path string
+}
+
+// WorkResult is a worker's reply to a WorkRequest.
+type WorkResult struct {
+	Result ReportEntry
+	Cases  []ReportEntry // the results of any further test cases in the same file
+	Stdout string        // the output of invigilate for the test case, such as verbose output
+	Stderr string        // its error output, describing any failure
+}
+
+// jobOptions returns the options workers need to run test cases as this run would.
+func jobOptions() []string {
+	opts := testOptions()
+	if noCache {
+		opts = append(opts, "-no-cache")
+	}
+	if showResources {
+		opts = append(opts, "-resources")
+	}
+	if verbose {
+		opts = append(opts, "-v")
+	}
+	return opts
+}
+
+// distribute runs the test cases from ch on the workers, recording their results.
+// It returns early, leaving ch open, if ctx is cancelled.
+func distribute(ctx context.Context, ch <-chan Test, program []string) {
+	job := Job{version, jobOptions(), program}
+	work := make(chan Test)
+	out := make(chan WorkResult)
+	addrs := strings.Split(workerAddrs, ",")
+	lost := make(chan struct{}, len(addrs))
+	for _, addr := range addrs {
+		go runWorker(strings.TrimSpace(addr), job, work, out, lost)
+	}
+
+	live, pending := len(addrs), 0
+	handle := func(wr WorkResult) {
+		os.Stdout.WriteString(wr.Stdout)
+		os.Stderr.WriteString(wr.Stderr)
+		record(entryResult(wr.Result))
+		for _, c := range wr.Cases {
+			record(entryResult(c))
+		}
+		pending--
+	}
+	for t := range ch {
+		if ctx.Err() != nil {
+			break
+		} else if t.err != nil {
+			log.Print(t.err)
+			record(Result{path: t.path, status: errored, category: "read"})
+			continue
+		}
+		for sent := false; !sent; {
+			if live == 0 {
+				log.Printf("%s: no workers available", t.path)
+				record(Result{path: t.path, status: errored, category: "worker"})
+				break
+			}
+			select {
+			case work <- t:
+				sent = true
+				pending++
+			case wr := <-out:
+				handle(wr)
+			case <-lost:
+				live--
+			}
+		}
+	}
+	close(work)
+	for pending > 0 {
+		select {
+		case wr := <-out:
+			handle(wr)
+		case <-lost:
+		}
+	}
+}
+
+// runWorker sends test cases from work to the worker at addr, and their results to out.
+// If the worker cannot be reached, or stops responding, it signals on lost and returns;
+// a test case the worker was running is reported as an error.
+func runWorker(addr string, job Job, work <-chan Test, out chan<- WorkResult, lost chan<- struct{}) {
+	conn, e := net.Dial("tcp", addr)
+	if e != nil {
+		log.Printf("worker %s: %s", addr, e)
+		lost <- struct{}{}
+		return
+	}
+	defer conn.Close()
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	if e = enc.Encode(job); e != nil {
+		log.Printf("worker %s: %s", addr, e)
+		lost <- struct{}{}
+		return
+	}
+	for t := range work {
+		var wr WorkResult
+		if e = enc.Encode(WorkRequest{t.path}); e == nil {
+			e = dec.Decode(&wr)
+		}
+		if e != nil {
+			out <- WorkResult{
+				Result: ReportEntry{Path: t.path, Status: errored, Category: "worker"},
+				Stderr: fmt.Sprintf("%s: worker %s: %s\n", t.path, addr, e),
+			}
+			lost <- struct{}{}
+			return
+		}
+		out <- wr
+	}
+}
+
+// worker implements the "worker" subcommand.
+func worker(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:7420", "listen for coordinators at this `address`")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `
+Usage: invigilate worker [options]
+
+Worker runs test cases sent by other invigilate processes, given its address
+with the -workers option, and returns their results. The program and the test
+cases must be available at the same paths, relative to the worker's working
+directory, as for the coordinator. The worker runs whatever programs the
+coordinators ask for, so it should only be reachable by trusted machines.
+
+Options:
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		fatal(exitError, "Unexpected arguments")
+	}
+
+	ln, e := net.Listen("tcp", *listen)
+	if e != nil {
+		fatal(exitError, e)
+	}
+	log.Printf("listening on %s", ln.Addr())
+	for {
+		conn, e := ln.Accept()
+		if e != nil {
+			fatal(exitError, e)
+		}
+		go serveCoordinator(conn)
+	}
+}
+
+// serveCoordinator runs the test cases sent by one coordinator.
+func serveCoordinator(conn net.Conn) {
+	defer conn.Close()
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	var job Job
+	if dec.Decode(&job) != nil {
+		return
+	}
+	for {
+		var req WorkRequest
+		if dec.Decode(&req) != nil {
+			return
+		}
+		var wr WorkResult
+		if job.Version != version {
+			wr = workerError(req.Path, fmt.Errorf("worker runs invigilate %s, but the coordinator runs %s", version, job.Version))
+		} else {
+			wr = workerRun(job, req.Path)
+		}
+		if enc.Encode(wr) != nil {
+			return
+		}
+	}
+}
+
+// workerRun runs a single test case file for a coordinator.
+func workerRun(job Job, path string) WorkResult {
+	self, e := os.Executable()
+	if e != nil {
+		return workerError(path, e)
+	}
+	dir, e := os.MkdirTemp("", "invigilate-worker")
+	if e != nil {
+		return workerError(path, e)
+	}
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.json")
+
+	args := append(append(job.Options[:len(job.Options):len(job.Options)], "-json", report), job.Program...)
+	cmd := exec.Command(self, append(append(args, "--"), path)...)
+	cmd.Env = childEnv()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if e = cmd.Run(); e != nil {
+		if _, ok := e.(*exec.ExitError); !ok {
+			return workerError(path, e)
+		}
+	}
+	results, e := readReport(report)
+	if e != nil {
+		return workerError(path, fmt.Errorf("%s%w", stderr.String(), e))
+	} else if len(results) == 0 {
+		return workerError(path, fmt.Errorf("%sno results", stderr.String()))
+	}
+
+	// Remove the summary of the run, which the coordinator gives for all the tests.
+	wr := WorkResult{Result: reportEntry(results[0]), Stdout: stdout.String(), Stderr: stderr.String()}
+	allPassed := results[0].status == passed
+	for _, r := range results[1:] {
+		wr.Cases = append(wr.Cases, reportEntry(r))
+		allPassed = allPassed && r.status == passed
+	}
+	if allPassed {
+		wr.Stdout = strings.TrimSuffix(wr.Stdout, "\nAll tests passed.\n")
+	} else {
+		lines := strings.SplitAfter(strings.TrimSuffix(wr.Stderr, "\n"), "\n")
+		wr.Stderr = strings.Join(lines[:len(lines)-1], "")
+	}
+	return wr
+}
+
+// workerError returns the result for a test case the worker could not run.
+func workerError(path string, e error) WorkResult {
+	return WorkResult{
+		Result: ReportEntry{Path: path, Status: errored, Category: "worker"},
+		Stderr: fmt.Sprintf("%s: %s\n", path, e),
+	}
+}
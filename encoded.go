@@ -0,0 +1,80 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Binary data, and text with control characters, cannot be written directly as
+// lines of a test case. Input and expected output lines may instead give their
+// data encoded: "#<esc " is followed by text with backslash escapes, such as
+// "\n", "\t", "\e", "\0", "\\", and "\x7f", and "#>b64 " by base64. The data is
+// exactly what is encoded; the newline ending the line is not part of it.
+
+// Prefixes of the data of input and expected output lines holding encoded data
+const (
+	escapePrefix = "esc "
+	base64Prefix = "b64 "
+)
+
+// encodedData reports whether the data of an input or expected output line is
+// encoded, and if so returns it decoded.
+func encodedData(data string) (string, bool, error) {
+	if text, ok := strings.CutPrefix(data, escapePrefix); ok {
+		decoded, e := unescape(strings.TrimSuffix(text, "\n"))
+		return decoded, true, e
+	} else if text, ok := strings.CutPrefix(data, base64Prefix); ok {
+		decoded, e := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+		if e != nil {
+			return "", true, fmt.Errorf("invalid base64 data: %s", e)
+		}
+		return string(decoded), true, nil
+	}
+	return data, false, nil
+}
+
+// unescape replaces the backslash escapes in text by the characters they stand for.
+func unescape(text string) (string, error) {
+	var s strings.Builder
+	for k := 0; k < len(text); k++ {
+		if text[k] != '\\' {
+			s.WriteByte(text[k])
+			continue
+		} else if k++; k == len(text) {
+			return "", errors.New("backslash at end of line")
+		}
+		switch text[k] {
+		case 'n':
+			s.WriteByte('\n')
+		case 't':
+			s.WriteByte('\t')
+		case 'r':
+			s.WriteByte('\r')
+		case 'e':
+			s.WriteByte('\x1b')
+		case '0':
+			s.WriteByte(0)
+		case '\\':
+			s.WriteByte('\\')
+		case 'x':
+			if k+2 >= len(text) {
+				return "", errors.New("incomplete escape \\x")
+			}
+			n, e := strconv.ParseUint(text[k+1:k+3], 16, 8)
+			if e != nil {
+				return "", fmt.Errorf("invalid escape \\x%s", text[k+1:k+3])
+			}
+			s.WriteByte(byte(n))
+			k += 2
+		default:
+			return "", fmt.Errorf("unknown escape \\%c", text[k])
+		}
+	}
+	return s.String(), nil
+}
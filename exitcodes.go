@@ -0,0 +1,67 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// exitCodesPath is a file classifying particular exit codes of the program; "" for none.
+// This is useful when the program is a wrapper, such as valgrind with --error-exitcode,
+// which uses exit codes of its own to report problems it finds.
+var exitCodesPath string
+
+// exitClass describes how a particular exit code is reported.
+type exitClass struct {
+	name     string
+	status   string
+	category string
+}
+
+// exitClasses lists the classes that may be given to exit codes.
+var exitClasses = []exitClass{
+	{"tool error", errored, "tool error"},
+	{"memory error", failed, "memory error"},
+	{"test failure", failed, "exit code"},
+}
+
+// exitCodes maps exit codes to their classes, as read from exitCodesPath.
+var exitCodes = map[int]exitClass{}
+
+// loadExitCodes reads the exit code classification file. Each line holds
+// an exit code and the name of a class, such as "99 memory error";
+// blank lines and lines beginning with "#" are ignored.
+func loadExitCodes() error {
+	data, e := os.ReadFile(exitCodesPath)
+	if e != nil {
+		return e
+	}
+	for k, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		code, class, _ := strings.Cut(line, " ")
+		n, e := strconv.Atoi(code)
+		if e != nil {
+			return fmt.Errorf("%s:%d: invalid exit code %q", exitCodesPath, k+1, code)
+		}
+		class = strings.Join(strings.Fields(class), " ")
+		found := false
+		for _, c := range exitClasses {
+			if c.name == class {
+				exitCodes[n] = c
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s:%d: unknown class %q; must be tool error, memory error, or test failure",
+				exitCodesPath, k+1, class)
+		}
+	}
+	return nil
+}
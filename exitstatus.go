@@ -0,0 +1,65 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A line such as "#? 1|2|77" in a test case gives the exit codes the program may
+// exit with, for programs which exit with different codes on different systems.
+// Each alternative is a code, a range of codes such as 64-78, "any-nonzero", or "any".
+
+// ExitStatuses is a set of acceptable exit codes, as given by a "#?" line.
+type ExitStatuses struct {
+	spec    string
+	nonzero bool     // whether all nonzero codes are accepted
+	any     bool     // whether all codes are accepted
+	ranges  [][2]int // other codes accepted, as inclusive ranges
+}
+
+// parseExitStatuses parses the text following "#?".
+func parseExitStatuses(spec string) (*ExitStatuses, error) {
+	es := &ExitStatuses{spec: strings.TrimSpace(spec)}
+	if es.spec == "" {
+		return nil, fmt.Errorf("#? needs exit codes, such as 1|2 or any-nonzero")
+	}
+	for _, alt := range strings.Split(es.spec, "|") {
+		alt = strings.TrimSpace(alt)
+		switch alt {
+		case "any":
+			es.any = true
+			continue
+		case "any-nonzero":
+			es.nonzero = true
+			continue
+		}
+		lo, hi, isRange := strings.Cut(alt, "-")
+		l, e1 := strconv.Atoi(lo)
+		h, e2 := l, error(nil)
+		if isRange {
+			h, e2 = strconv.Atoi(hi)
+		}
+		if e1 != nil || e2 != nil || l < 0 || h < l {
+			return nil, fmt.Errorf("invalid exit code %q; must be a code, a range such as 64-78, any-nonzero, or any", alt)
+		}
+		es.ranges = append(es.ranges, [2]int{l, h})
+	}
+	return es, nil
+}
+
+// accepts reports whether a program exiting with the given code is acceptable.
+func (es *ExitStatuses) accepts(code int) bool {
+	if es.any || es.nonzero && code != 0 {
+		return true
+	}
+	for _, r := range es.ranges {
+		if r[0] <= code && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Many programs write their results to files, rather than to their output. Once
+// the program has exited, file directives check the files it should have written,
+// relative to its working directory: "#file out.txt exists" checks that out.txt
+// was written, "#file out.txt absent" that it was not, and "#file out.txt ==
+// expected/out.txt" that its contents are exactly those of expected/out.txt,
+// relative to the directory holding the test case. Unless a cwd directive is
+// given, the program is run in a new, empty directory, as for fixtures, so that
+// files left by an earlier run are not mistaken for its own.
+
+// FileCheck is one check of a file written by the program.
+type FileCheck struct {
+	path string // relative to the program's working directory
+	op   string // "exists", "absent", or "=="
+	ref  string // for "==", the file holding the expected contents
+	want string // for "==", the expected contents
+}
+
+// parseFileCheck parses the argument of a file directive.
+func parseFileCheck(arg string) (FileCheck, error) {
+	words := strings.Fields(arg)
+	switch {
+	case len(words) == 0:
+		return FileCheck{}, errors.New("missing file name")
+	case len(words) == 2 && (words[1] == "exists" || words[1] == "absent"):
+		return FileCheck{path: words[0], op: words[1]}, nil
+	case len(words) == 3 && words[1] == "==":
+		return FileCheck{path: words[0], op: words[1], ref: words[2]}, nil
+	}
+	return FileCheck{}, fmt.Errorf("invalid file check %q: expected a file name, then exists, absent, or == and a file name", arg)
+}
+
+// checkFileCheck checks a file directive.
+func checkFileCheck(arg string) error {
+	_, e := parseFileCheck(arg)
+	return e
+}
+
+// testFileChecks returns the file checks of a test case, with the expected
+// contents of files read.
+func testFileChecks(t Test) ([]FileCheck, error) {
+	var checks []FileCheck
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "file" {
+				fc, _ := parseFileCheck(arg)
+				if fc.op == "==" {
+					data, e := os.ReadFile(referencePath(t, fc.ref))
+					if e != nil {
+						return nil, fmt.Errorf("reading expected file: %s", e)
+					}
+					fc.want = string(data)
+				}
+				checks = append(checks, fc)
+			}
+		}
+	}
+	return checks, nil
+}
+
+// hashFileChecks adds the expected contents of files checked by a test case
+// to a hash, so that a change to them is noticed.
+func hashFileChecks(h io.Writer, t Test) error {
+	checks, e := testFileChecks(t)
+	for _, fc := range checks {
+		fmt.Fprintf(h, "\x00expected file %q %d\x00%s", fc.ref, len(fc.want), fc.want)
+	}
+	return e
+}
+
+// verify checks a file written by the program run in dir, or in the current
+// directory if dir is "". It logs any problem found, and reports whether there
+// was none.
+func (fc FileCheck) verify(t Test, dir string) bool {
+	path := filepath.Join(dir, filepath.FromSlash(fc.path))
+	data, e := os.ReadFile(path)
+	switch {
+	case fc.op == "absent" && e == nil:
+		log.Printf("%s: file %s exists, but should not", t.path, fc.path)
+		return false
+	case fc.op == "absent" && errors.Is(e, os.ErrNotExist):
+		return true
+	case errors.Is(e, os.ErrNotExist):
+		log.Printf("%s: file %s was not written", t.path, fc.path)
+		return false
+	case e != nil:
+		log.Printf("%s: file %s: %s", t.path, fc.path, e)
+		return false
+	case fc.op == "==" && string(data) != fc.want:
+		logContentDiff(fmt.Sprintf("%s: incorrect contents of file %s", t.path, fc.path), fc.want, string(data))
+		return false
+	}
+	return true
+}
+
+// logContentDiff logs a message, followed by the first difference between the
+// expected and actual contents of a file: the lines holding it, with the line
+// number added to the message, or hexdumps for binary data.
+func logContentDiff(msg, want, have string) {
+	at := 0
+	for at < len(want) && at < len(have) && want[at] == have[at] {
+		at++
+	}
+	if binaryData(want) || binaryData(have) {
+		log.Print(msg)
+		logHexDiff(want, []byte(have), at)
+		return
+	}
+	line := func(data string) string {
+		start := strings.LastIndexByte(data[:min(at, len(data))], '\n') + 1
+		if start >= len(data) {
+			return "(end of file)"
+		} else if end := strings.IndexByte(data[start:], '\n'); end >= 0 {
+			return data[start : start+end]
+		}
+		return data[start:]
+	}
+	log.Printf("%s at line %d", msg, strings.Count(have[:at], "\n")+1)
+	log.Printf("expected: %s", printable(line(want)))
+	log.Printf("  actual: %s", printable(line(have)))
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Large input and expected output may be kept in files of their own, referred to
+// from anywhere in a test case: "#<file inputs/session1.txt" gives the contents of
+// that file as input, and "#>file expected/big_output.txt" and "#!file errors.txt"
+// expect the contents of those files as output and error output, exactly as they
+// are. The paths are relative to the directory holding the test case.
+
+// filePrefix begins the data of input and expected output lines referring to files.
+const filePrefix = "file "
+
+// fileReference reports whether the data of an input or expected output line
+// refers to a file, and if so returns the path given.
+func fileReference(data string) (string, bool) {
+	ref, ok := strings.CutPrefix(data, filePrefix)
+	return strings.TrimSpace(ref), ok
+}
+
+// referencePath returns the path of a file referred to by a test case.
+func referencePath(t Test, ref string) string {
+	return filepath.Join(filepath.Dir(t.path), filepath.FromSlash(ref))
+}
+
+// readReference returns the contents of a file referred to by a test case.
+func readReference(t Test, ref string) (string, error) {
+	data, e := os.ReadFile(referencePath(t, ref))
+	if e != nil {
+		return "", fmt.Errorf("reading referenced file: %s", e)
+	}
+	return string(data), nil
+}
+
+// checkReference checks a line referring to a file, whose data is given.
+func checkReference(t Test, data string) error {
+	ref, _ := fileReference(data)
+	if ref == "" {
+		return errors.New("missing file name")
+	} else if _, e := os.Stat(referencePath(t, ref)); e != nil {
+		return e
+	}
+	return nil
+}
+
+// testReferences returns the files referred to by a test case.
+func testReferences(t Test) []string {
+	var refs []string
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && len(line) > len(comment) && strings.ContainsRune("<>!", rune(line[len(comment)])) {
+			if ref, ok := fileReference(line[len(comment)+1:]); ok && ref != "" {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A program may read its input from files, rather than from its standard input.
+// The directive "#fixture data/input.csv" copies that file, relative to the
+// directory holding the test case, into a new, empty directory made for the
+// test, in which the program is run; a directory is copied with all its
+// contents. The directory is removed once the test is done.
+
+// checkFixture checks a "fixture" directive.
+func checkFixture(arg string) error {
+	if arg == "" {
+		return errors.New("missing file name")
+	}
+	return nil
+}
+
+// testFixtures returns the files to be copied for a test case, as given.
+func testFixtures(t Test) []string {
+	var fixtures []string
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "fixture" {
+				fixtures = append(fixtures, arg)
+			}
+		}
+	}
+	return fixtures
+}
+
+// makeSandbox makes a new directory for running a test case, and copies its
+// fixtures into it. It should be removed once the test is done.
+func makeSandbox(t Test, fixtures []string) (string, error) {
+	dir, e := os.MkdirTemp("", "invigilate-sandbox")
+	if e != nil {
+		return "", e
+	}
+	for _, f := range fixtures {
+		src := referencePath(t, f)
+		if e := copyFixture(src, filepath.Join(dir, filepath.Base(src))); e != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("copying fixture %s: %s", f, e)
+		}
+	}
+	return dir, nil
+}
+
+// copyFixture copies a file, or a directory with all its contents, keeping
+// the permissions of each file.
+func copyFixture(src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		rel, e := filepath.Rel(src, path)
+		if e != nil {
+			return e
+		}
+		target := filepath.Join(dest, rel)
+		info, e := d.Info()
+		if e != nil {
+			return e
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		data, e := os.ReadFile(path)
+		if e != nil {
+			return e
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
+// walkFixtures calls fn for each file among the fixtures of a test case, with
+// the fixture as given, the path of the file, and its contents.
+func walkFixtures(t Test, fn func(fixture, path string, data []byte) error) error {
+	for _, f := range testFixtures(t) {
+		e := filepath.WalkDir(referencePath(t, f), func(path string, d fs.DirEntry, e error) error {
+			if e != nil || d.IsDir() {
+				return e
+			}
+			data, e := os.ReadFile(path)
+			if e != nil {
+				return e
+			}
+			return fn(f, path, data)
+		})
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// hashFixtures adds the names and contents of the fixtures of a test case
+// to a hash, so that a change to them is noticed.
+func hashFixtures(h io.Writer, t Test) error {
+	return walkFixtures(t, func(fixture, path string, data []byte) error {
+		fmt.Fprintf(h, "\x00fixture %q %q %d\x00%s", fixture, path, len(data), data)
+		return nil
+	})
+}
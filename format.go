@@ -0,0 +1,109 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// format implements the fmt subcommand, which rewrites test case files with
+// their directives in a standard form.
+func format(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	fs.StringVar(&comment, "c", "#", "comment delimiter for expected input and output")
+	fs.StringVar(&commentSpec, "comments", "", "use these comment delimiters for test cases with these extensions, given as a comma separated `map` such as \".c=//,.sql=--\"")
+	fs.StringVar(&extension, "e", ".test", "test case files have this extension")
+	listOnly := fs.Bool("l", false, "only list the files that would be changed")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `
+Usage: invigilate fmt [options] files
+
+Fmt rewrites test case files with their directives in a standard form: a single
+space between the name of a directive and its argument, if they are separated at
+all, and between "#?" and the exit codes it accepts, with no white space after a
+directive without an argument. The lines giving input and expected output, and
+all other lines, are left as they are, so the meaning of a test case never
+changes. The paths of the files changed are listed; with -l, they are only listed.
+
+Options:
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		fatal(exitError, "No test case files specified")
+	}
+	if e := parseComments(); e != nil {
+		fatal(exitError, e)
+	}
+
+	ch := make(chan Test, lookahead)
+	go findTests(context.Background(), fs.Args(), ch)
+	for t := range ch {
+		if t.err == nil {
+			loadTest(&t)
+		}
+		selectComment(t)
+		if t.err != nil {
+			fatal(exitError, t.err)
+		}
+		formatted, e := formatTest(t)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		if formatted == t.content && !t.streamed {
+			continue
+		} else if t.streamed {
+			if old, e := os.ReadFile(t.path); e != nil {
+				fatal(exitError, e)
+			} else if string(old) == formatted {
+				continue
+			}
+		}
+		fmt.Println(t.path)
+		if !*listOnly {
+			info, e := os.Stat(t.path)
+			if e == nil {
+				e = os.WriteFile(t.path, []byte(formatted), info.Mode().Perm())
+			}
+			if e != nil {
+				fatal(exitError, e)
+			}
+		}
+	}
+}
+
+// formatTest returns the content of a test case, with its directives in the
+// standard form.
+func formatTest(t Test) (string, error) {
+	var s strings.Builder
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		end := ""
+		if strings.HasSuffix(line, "\n") {
+			end = "\n"
+		}
+		if rest, ok := strings.CutPrefix(line, comment+"?"); ok {
+			line = comment + "? " + strings.TrimLeft(strings.TrimSuffix(rest, "\n"), " \t") + end
+		} else if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			// An argument not separated from the name, as in "#at-exit!text", is left so.
+			name, arg := splitDirective(line[len(comment):])
+			if rest := strings.TrimSuffix(line[len(comment)+len(name):], "\n"); rest != arg && arg != "" {
+				line = comment + name + " " + arg + end
+			} else if arg == "" {
+				line = comment + name + end
+			}
+		}
+		s.WriteString(line)
+	}
+	return s.String(), lr.close()
+}
@@ -0,0 +1,604 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Golden files are sidecar files holding the raw data for a test case file:
+// for foo.test, foo.out holds its expected output, foo.err its expected error
+// output, and foo.in its input. The golden subcommand manages them.
+
+// goldenExtensions lists the extensions of golden files, which are also the
+// companion files of the test cases.
+var goldenExtensions = []string{".in", ".out", ".err"}
+
+// goldenManifest is the name of the file, in the root of a tree of test cases,
+// recording the SHA-256 hashes of the golden files in the tree. It has the format
+// of the sha256sum program, with paths relative to the root, except that a hash
+// may be preceded by a comment line, beginning with "#", describing where the
+// golden file came from.
+const goldenManifest = "golden.sha256"
+
+// Manifest holds the contents of a golden file manifest.
+type Manifest struct {
+	hashes map[string]string // by path, relative to the root
+	notes  map[string]string // provenance comments, by path
+}
+
+// goldenFile is one golden file found in a tree of test cases.
+type goldenFile struct {
+	path   string // relative to the root of the tree
+	test   string // the test case file it belongs to, also relative to the root
+	orphan bool   // whether it is recorded in the manifest, but belongs to no test case
+}
+
+// findGoldens finds the golden files in the tree rooted at the directory root,
+// sorted by path: the companion files of the test cases found there, as they are
+// found when running the tests, and the files recorded in the manifest. Those
+// recorded that belong to no test case are orphans. Other files with the same
+// extensions, such as data read by the tests, are not golden files.
+func findGoldens(root string) ([]goldenFile, error) {
+	m, e := readManifest(root)
+	if e != nil {
+		return nil, e
+	}
+	ch := make(chan Test, lookahead)
+	go findTests(context.Background(), []string{root}, ch)
+	var goldens []goldenFile
+	known := map[string]bool{}
+	for t := range ch {
+		if t.err != nil {
+			if e == nil {
+				e = t.err
+			}
+			continue
+		}
+		test, err := filepath.Rel(root, t.path)
+		if err != nil {
+			if e == nil {
+				e = err
+			}
+			continue
+		}
+		for _, ext := range goldenExtensions {
+			path := companionPath(test, ext)
+			if info, err := os.Stat(filepath.Join(root, path)); err == nil && info.Mode().IsRegular() && !known[path] {
+				goldens = append(goldens, goldenFile{path, test, false})
+				known[path] = true
+			}
+		}
+	}
+	if e != nil {
+		return nil, e
+	}
+	for path := range m.hashes {
+		if _, err := os.Stat(filepath.Join(root, path)); err == nil && !known[path] {
+			goldens = append(goldens, goldenFile{path: path, orphan: true})
+		}
+	}
+	sort.Slice(goldens, func(i, j int) bool { return goldens[i].path < goldens[j].path })
+	return goldens, nil
+}
+
+// hashFile returns the SHA-256 hash of a file, in hexadecimal.
+func hashFile(path string) (string, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return "", e
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readManifest reads the golden file manifest in root.
+// A missing manifest is treated as empty.
+func readManifest(root string) (Manifest, error) {
+	m := Manifest{map[string]string{}, map[string]string{}}
+	f, e := os.Open(filepath.Join(root, goldenManifest))
+	if os.IsNotExist(e) {
+		return m, nil
+	} else if e != nil {
+		return m, e
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	note := ""
+	for k := 1; scanner.Scan(); k++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			note = strings.TrimSpace(line[1:])
+			continue
+		}
+		hash, path, ok := strings.Cut(line, "  ")
+		if !ok || len(hash) != 2*sha256.Size {
+			return m, fmt.Errorf("%s:%d: expected a hash and a path", f.Name(), k)
+		}
+		path = filepath.FromSlash(path)
+		m.hashes[path] = hash
+		if note != "" {
+			m.notes[path] = note
+			note = ""
+		}
+	}
+	return m, scanner.Err()
+}
+
+// writeManifest records the hashes of the golden files in root, other than orphans.
+// The provenance comment of a file is kept from the old manifest while the file is
+// unchanged; a file that has changed gets its comment from fresh, if any.
+func writeManifest(root string, goldens []goldenFile, old Manifest, fresh map[string]string) error {
+	m := Manifest{map[string]string{}, map[string]string{}}
+	for _, g := range goldens {
+		if g.orphan {
+			continue
+		}
+		hash, e := hashFile(filepath.Join(root, g.path))
+		if e != nil {
+			return e
+		}
+		m.hashes[g.path] = hash
+		if hash == old.hashes[g.path] {
+			m.notes[g.path] = old.notes[g.path]
+		} else {
+			m.notes[g.path] = fresh[g.path]
+		}
+	}
+	return m.save(root)
+}
+
+// save writes the manifest into root, sorted by path.
+func (m Manifest) save(root string) error {
+	var paths []string
+	for path := range m.hashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var out strings.Builder
+	for _, path := range paths {
+		if note := m.notes[path]; note != "" {
+			fmt.Fprintf(&out, "# %s\n", note)
+		}
+		fmt.Fprintf(&out, "%s  %s\n", m.hashes[path], filepath.ToSlash(path))
+	}
+	return os.WriteFile(filepath.Join(root, goldenManifest), []byte(out.String()), 0644)
+}
+
+// provenance describes the origin of golden files written now by the program.
+func provenance(program []string) string {
+	what := shellJoin(program)
+	if path, e := exec.LookPath(program[0]); e == nil {
+		if hash, e := hashFile(path); e == nil {
+			what += " (sha256 " + hash[:16] + ")"
+		}
+	}
+	return fmt.Sprintf("updated %s by invigilate %s from %s", time.Now().UTC().Format(time.DateOnly), version, what)
+}
+
+// golden implements the "golden" subcommand.
+func golden(args []string) {
+	actions := map[string]func(fs *flag.FlagSet, args []string){
+		"list":   goldenList,
+		"verify": goldenVerify,
+		"hash":   goldenHash,
+		"prune":  goldenPrune,
+		"update": goldenUpdate,
+	}
+	if len(args) == 0 || actions[args[0]] == nil {
+		fmt.Fprint(os.Stderr, goldenUsage)
+		fatal(exitError, "A golden file action must be given")
+	}
+
+	fs := flag.NewFlagSet("golden "+args[0], flag.ExitOnError)
+	fs.StringVar(&comment, "c", "#", "comment delimiter for expected input and output")
+	fs.StringVar(&commentSpec, "comments", "", "use these comment delimiters for test cases with these extensions, given as a comma separated `map` such as \".c=//,.sql=--\"")
+	fs.StringVar(&extension, "e", ".test", "test case files have this extension")
+	fs.StringVar(&interpSpec, "interp", "", "run test cases with these extensions with these interpreters, given as a comma separated `map` such as \".py=python3,.awk=awk -f\"")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, goldenUsage+"\nOptions:\n\n")
+		fs.PrintDefaults()
+	}
+	actions[args[0]](fs, args[1:])
+}
+
+const goldenUsage = `
+Usage: invigilate golden list [options] directories
+       invigilate golden verify [options] directories
+       invigilate golden hash [options] directories
+       invigilate golden prune [options] directories
+       invigilate golden update [options] program -- directories
+
+Golden files are files holding the raw data for a test case: for foo.test,
+foo.out holds its expected output, foo.err its expected error output, and foo.in
+its input. The golden subcommand manages the golden files in trees of test cases.
+Test cases are found as when running them, so the -e, -interp, and -comments
+options should be given as they are then. Other files with these extensions, such
+as data the tests read, are left alone.
+
+List shows the golden files, marking as orphaned those recorded in golden.sha256
+whose test case file no longer exists.
+
+Verify checks the golden files against the SHA-256 hashes recorded in the file
+golden.sha256 at the root of each tree, reporting files that have changed, are
+missing, or are not recorded. The exit code is 1 if there are any such files.
+
+Hash records the hashes of the golden files in golden.sha256, after they have
+been changed deliberately.
+
+Prune deletes orphaned golden files, and removes them from golden.sha256; with -n,
+it only lists them.
+
+Update runs each test case that has .out or .err golden files as it would be run
+in a test, with its .in file as input, but without checking the output or error
+output, and replaces those golden files with the program's output and error output.
+Golden files that do not already exist are not written; nor are those of a test
+case that fails for another reason, such as an unexpected exit status. The hashes
+in golden.sha256 are then updated. With -provenance, each file
+that changed is preceded there by a comment giving the date, the version of
+invigilate, and the program and the hash of its executable, so that reviewers of
+the changes can see what produced them.
+`
+
+// goldenRoots parses the options and returns the directories given.
+func goldenRoots(fs *flag.FlagSet, args []string) []string {
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		fatal(exitError, "No directories specified")
+	}
+	parseGoldenOptions()
+	return fs.Args()
+}
+
+// parseGoldenOptions parses the options by which test cases are found.
+func parseGoldenOptions() {
+	if interpSpec != "" {
+		if e := parseInterpreters(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if e := parseComments(); e != nil {
+		fatal(exitError, e)
+	}
+}
+
+// goldenList implements "golden list".
+func goldenList(fs *flag.FlagSet, args []string) {
+	for _, root := range goldenRoots(fs, args) {
+		goldens, e := findGoldens(root)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		for _, g := range goldens {
+			if g.orphan {
+				fmt.Println(filepath.Join(root, g.path), "(orphaned)")
+			} else {
+				fmt.Println(filepath.Join(root, g.path))
+			}
+		}
+	}
+}
+
+// goldenVerify implements "golden verify".
+func goldenVerify(fs *flag.FlagSet, args []string) {
+	problems := 0
+	for _, root := range goldenRoots(fs, args) {
+		goldens, e := findGoldens(root)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		m, e := readManifest(root)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		hashes := m.hashes
+
+		for _, g := range goldens {
+			if g.orphan {
+				continue
+			}
+			path := filepath.Join(root, g.path)
+			want, ok := hashes[g.path]
+			delete(hashes, g.path)
+			if !ok {
+				fmt.Println(path + ": not recorded")
+				problems++
+				continue
+			}
+			have, e := hashFile(path)
+			if e != nil {
+				fatal(exitError, e)
+			} else if have != want {
+				fmt.Println(path + ": changed")
+				problems++
+			}
+		}
+
+		var missing []string
+		for path := range hashes {
+			missing = append(missing, path)
+		}
+		sort.Strings(missing)
+		for _, path := range missing {
+			fmt.Println(filepath.Join(root, path) + ": missing")
+			problems++
+		}
+	}
+	if problems > 0 {
+		os.Exit(exitFailed)
+	}
+}
+
+// goldenHash implements "golden hash".
+func goldenHash(fs *flag.FlagSet, args []string) {
+	for _, root := range goldenRoots(fs, args) {
+		goldens, e := findGoldens(root)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		m, e := readManifest(root)
+		if e == nil {
+			e = writeManifest(root, goldens, m, nil)
+		}
+		if e != nil {
+			fatal(exitError, e)
+		}
+	}
+}
+
+// goldenPrune implements "golden prune".
+func goldenPrune(fs *flag.FlagSet, args []string) {
+	dryRun := fs.Bool("n", false, "only list the orphaned golden files, without deleting them")
+	for _, root := range goldenRoots(fs, args) {
+		goldens, e := findGoldens(root)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		m, e := readManifest(root)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		for _, g := range goldens {
+			if !g.orphan {
+				continue
+			}
+			path := filepath.Join(root, g.path)
+			fmt.Println(path)
+			if !*dryRun {
+				if e := os.Remove(path); e != nil {
+					fatal(exitError, e)
+				}
+				delete(m.hashes, g.path)
+			}
+		}
+		if !*dryRun {
+			if e := m.save(root); e != nil {
+				fatal(exitError, e)
+			}
+		}
+	}
+}
+
+// goldenUpdate implements "golden update".
+func goldenUpdate(fs *flag.FlagSet, args []string) {
+	fs.DurationVar(&limit, "t", 2*time.Second, "time limit for individual test cases")
+	withProvenance := fs.Bool("provenance", false, "record where changed golden files came from in golden.sha256")
+	program, roots := programAndRoots(fs, args)
+	parseGoldenOptions()
+
+	failures := 0
+	for _, root := range roots {
+		goldens, e := findGoldens(root)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		has := map[string]bool{}
+		for _, g := range goldens {
+			if !g.orphan && (strings.HasSuffix(g.path, ".out") || strings.HasSuffix(g.path, ".err")) {
+				has[g.test] = true
+			}
+		}
+
+		m, e := readManifest(root)
+		if e != nil {
+			fatal(exitError, e)
+		}
+		fresh := map[string]string{}
+		note := provenance(program)
+
+		var tests []string
+		for test := range has {
+			tests = append(tests, test)
+		}
+		sort.Strings(tests)
+		for _, test := range tests {
+			t := Test{path: filepath.Join(root, test)}
+			loadTest(&t)
+			if e := updateGoldens(program, t, false); e != nil {
+				log.Print(e)
+				failures++
+				continue
+			}
+			if *withProvenance {
+				fresh[companionPath(test, ".out")] = note
+				fresh[companionPath(test, ".err")] = note
+			}
+		}
+
+		if goldens, e = findGoldens(root); e == nil {
+			e = writeManifest(root, goldens, m, fresh)
+		}
+		if e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if failures > 0 {
+		os.Exit(exitFailed)
+	}
+}
+
+// programAndRoots parses the options, and returns the program and the test
+// cases or directories given after "--".
+func programAndRoots(fs *flag.FlagSet, args []string) ([]string, []string) {
+	fs.Parse(args)
+	program, roots := fs.Args(), []string(nil)
+	for k, a := range program {
+		if a == "--" {
+			program, roots = program[:k], program[k+1:]
+			break
+		}
+	}
+	if len(program) == 0 || len(roots) == 0 {
+		fs.Usage()
+		fatal(exitError, "A program and directories must be given")
+	}
+	return program, roots
+}
+
+// recordGoldens implements the record subcommand, which writes golden files for
+// new test cases from the output of the program.
+func recordGoldens(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	fs.StringVar(&comment, "c", "#", "comment delimiter for expected input and output")
+	fs.StringVar(&commentSpec, "comments", "", "use these comment delimiters for test cases with these extensions, given as a comma separated `map` such as \".c=//,.sql=--\"")
+	fs.StringVar(&extension, "e", ".test", "test case files have this extension")
+	fs.StringVar(&interpSpec, "interp", "", "run test cases with these extensions with these interpreters, given as a comma separated `map` such as \".py=python3,.awk=awk -f\"")
+	fs.DurationVar(&limit, "t", 2*time.Second, "time limit for individual test cases")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `
+Usage: invigilate record [options] program -- files
+
+Record runs the program on each test case that has neither .out nor .err golden
+files, and whose own lines give no input or expected output, with its .in file,
+if any, as input. It writes the output to the .out file, and any error output to
+the .err file, so that the test case then expects exactly that. The paths of the
+test cases recorded are listed. Golden files already recorded are changed only by
+"invigilate update"; where golden.sha256 is kept, "invigilate golden hash" should
+be run afterwards.
+
+Options:
+
+`)
+		fs.PrintDefaults()
+	}
+	program, roots := programAndRoots(fs, args)
+	parseGoldenOptions()
+
+	ch := make(chan Test, lookahead)
+	go findTests(context.Background(), roots, ch)
+	for t := range ch {
+		if t.err == nil {
+			loadTest(&t)
+		}
+		if t.err != nil {
+			fatal(exitError, t.err)
+		}
+		selectComment(t)
+		if hasGolden(t.path, ".out") || hasGolden(t.path, ".err") || hasDataLines(t) {
+			continue
+		}
+		if e := updateGoldens(program, t, true); e != nil {
+			fatal(exitError, e)
+		}
+	}
+}
+
+// hasDataLines reports whether a test case gives any input or expected output
+// in its own lines.
+func hasDataLines(t Test) bool {
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && len(line) > len(comment) && strings.ContainsRune("<>!", rune(line[len(comment)])) {
+			return true
+		}
+	}
+	return false
+}
+
+// updatingGoldens records whether the output of the tests is being written to
+// their golden files, and so must be kept in their transcripts.
+var updatingGoldens bool
+
+// hasGolden reports whether a test case has the golden file with the given extension.
+func hasGolden(test, ext string) bool {
+	info, e := os.Stat(companionPath(test, ext))
+	return e == nil && info.Mode().IsRegular()
+}
+
+// updateGoldens runs a test case, as in a test but without checking its output
+// or error output, and writes them to its golden files. Only the golden files
+// that already exist are written, unless record is true; then the .out file is
+// always written, and the .err file if there is any error output.
+func updateGoldens(program []string, t Test, record bool) error {
+	if t.err != nil {
+		return t.err
+	}
+	selectComment(t)
+	if e := expandIncludes(&t); e != nil {
+		return e
+	} else if e := substitute(&t); e != nil {
+		return e
+	} else if e := checkDirectives(t); e != nil {
+		return e
+	}
+	writeOut, writeErr := record || hasGolden(t.path, ".out"), hasGolden(t.path, ".err")
+	for _, w := range []struct {
+		write  bool
+		prefix string
+		ext    string
+	}{{writeOut, ">", ".out"}, {writeErr, "!", ".err"}} {
+		if w.write && hasLinePrefix(t, comment+w.prefix) {
+			return fmt.Errorf("%s: not updated, since %s lines would be matched before %s", t.path, comment+w.prefix, companionPath(t.path, w.ext))
+		}
+	}
+	program, e := testProgram(t, program)
+	if e != nil {
+		return fmt.Errorf("%s: %s", t.path, e)
+	}
+
+	ignoreStdout, ignoreStderr, updatingGoldens = true, true, true
+	r := runTest(context.Background(), t, program, nil)
+	if r.status != passed {
+		return fmt.Errorf("%s: not updated, since the test did not pass", t.path)
+	}
+	fmt.Println(t.path)
+	if writeOut {
+		if e := os.WriteFile(companionPath(t.path, ".out"), []byte(r.transcript.stream('>')), 0644); e != nil {
+			return e
+		}
+	}
+	stderr := r.transcript.stream('!')
+	if writeErr || record && stderr != "" {
+		return os.WriteFile(companionPath(t.path, ".err"), []byte(stderr), 0644)
+	}
+	return nil
+}
+
+// hasLinePrefix reports whether any line of a test case begins with prefix.
+func hasLinePrefix(t Test, prefix string) bool {
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		if strings.HasPrefix(lr.text(), prefix) {
+			return true
+		}
+	}
+	return false
+}
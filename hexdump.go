@@ -0,0 +1,75 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// When the expected or actual data of a mismatch is binary, showing it as text
+// would be unreadable, and may upset the terminal. The mismatch is then shown as
+// a hexdump of both, side by side, around the first difference.
+
+// hexRows is the number of rows of 16 bytes shown in a hexdump of a mismatch.
+const hexRows = 2
+
+// binaryData reports whether data is binary, rather than text: whether it is
+// not valid UTF-8, or holds control characters other than tab, newline, carriage
+// return, and escape, which are common in text written to a terminal.
+func binaryData[T string | []byte](data T) bool {
+	for _, c := range []byte(data) {
+		if c < ' ' && c != '\t' && c != '\n' && c != '\r' && c != '\x1b' || c == 0x7f {
+			return true
+		}
+	}
+	return !utf8.Valid([]byte(data))
+}
+
+// hexDiff returns lines showing the expected and actual data as hexdumps, side by
+// side, beginning with the row of 16 bytes holding the first difference, at offset at.
+func hexDiff(want, have []byte, at int) []string {
+	lines := []string{
+		fmt.Sprintf("first difference at byte %d:", at),
+		fmt.Sprintf("      %-67s  %s", "expected", "actual"),
+	}
+	for start := at &^ 15; start < at&^15+16*hexRows; start += 16 {
+		if start >= len(want) && start >= len(have) {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%04x  %s  %s", start, hexRow(want, start), hexRow(have, start)))
+	}
+	return lines
+}
+
+// hexRow formats the 16 bytes of data from start, in hexadecimal and as ASCII.
+func hexRow(data []byte, start int) string {
+	var hex, text strings.Builder
+	for k := start; k < start+16; k++ {
+		if k == start+8 {
+			hex.WriteByte(' ')
+		}
+		if k >= len(data) {
+			hex.WriteString("   ")
+			text.WriteByte(' ')
+			continue
+		}
+		fmt.Fprintf(&hex, "%02x ", data[k])
+		if c := data[k]; ' ' <= c && c < 0x7f {
+			text.WriteByte(c)
+		} else {
+			text.WriteByte('.')
+		}
+	}
+	return hex.String() + "|" + text.String() + "|"
+}
+
+// logHexDiff logs the expected and actual data of a mismatch as hexdumps.
+func logHexDiff(want string, have []byte, at int) {
+	for _, line := range hexDiff([]byte(want), have, at) {
+		log.Print(line)
+	}
+}
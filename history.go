@@ -0,0 +1,180 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The history database is an SQLite database, accessed through the sqlite3
+// command line program so that invigilate itself needs no database driver.
+
+// historyPath is the history database to which results should be added; "" for none.
+var historyPath string
+
+// sqlite3 is the program used to access history databases.
+var sqlite3 = "sqlite3"
+
+// historySchema creates the history tables, if they do not already exist.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	started TEXT NOT NULL,
+	command TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS results (
+	run INTEGER NOT NULL REFERENCES runs(id),
+	path TEXT NOT NULL,
+	status TEXT NOT NULL,
+	duration REAL NOT NULL,
+	category TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_path ON results(path, run);
+`
+
+// sqlQuote quotes a string for use in SQL.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// runSQL executes SQL statements against a history database,
+// returning any query results as CSV records.
+func runSQL(db, sql string) ([][]string, error) {
+	cmd := exec.Command(sqlite3, "-bail", "-csv", db)
+	cmd.Stdin = strings.NewReader(sql)
+	var out, errout bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errout
+	if e := cmd.Run(); e != nil {
+		if msg := strings.TrimSpace(errout.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", db, msg)
+		}
+		return nil, fmt.Errorf("%s: %s", db, e)
+	}
+	return csv.NewReader(&out).ReadAll()
+}
+
+// saveHistory adds the results of this run to the history database.
+func saveHistory(started time.Time, results []Result) error {
+	var sql strings.Builder
+	sql.WriteString(historySchema)
+	sql.WriteString("BEGIN;\n")
+	fmt.Fprintf(&sql, "INSERT INTO runs (started, command) VALUES (%s, %s);\n",
+		sqlQuote(started.UTC().Format(time.RFC3339)), sqlQuote(strings.Join(os.Args, " ")))
+	for _, r := range results {
+		fmt.Fprintf(&sql, "INSERT INTO results VALUES ((SELECT max(id) FROM runs), %s, %s, %f, %s);\n",
+			sqlQuote(r.path), sqlQuote(r.status), r.duration.Seconds(), sqlQuote(r.category))
+	}
+	sql.WriteString("COMMIT;\n")
+	_, e := runSQL(historyPath, sql.String())
+	return e
+}
+
+// trends implements the "trends" subcommand, which compares the latest run
+// in a history database with earlier runs.
+func trends(args []string) {
+	fs := flag.NewFlagSet("trends", flag.ExitOnError)
+	runs := fs.Int("n", 5, "compare durations with the average over this many earlier runs")
+	drift := fs.Float64("d", 0.5, "report duration changes larger than this fraction")
+	minDrift := fs.Duration("m", 100*time.Millisecond, "ignore duration changes smaller than this")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `
+Usage: invigilate trends [options] database
+
+Trends compares the latest run recorded in a history database (see the -history
+option) with earlier runs. It lists tests that failed in the latest run but passed
+in the run before it, or were not in it, tests that passed in the latest run but
+failed before, and passing tests whose durations differ noticeably from their
+average over recent runs.
+
+Options:
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		fatal(exitError, "Exactly one history database must be given")
+	}
+	db := fs.Arg(0)
+
+	ids, e := runSQL(db, "SELECT id FROM runs ORDER BY id DESC LIMIT 2;")
+	if e != nil {
+		fatal(exitError, e)
+	} else if len(ids) < 2 {
+		fatal(exitError, db+": at least two runs are needed to show trends")
+	}
+	latest, previous := ids[0][0], ids[1][0]
+
+	// A test not in the previous run is newly failing if it fails now.
+	changes, e := runSQL(db, fmt.Sprintf(`
+SELECT DISTINCT n.path, n.status, n.category
+FROM results n LEFT JOIN results o ON n.path = o.path AND o.run = %s
+WHERE n.run = %s AND (o.status IS NULL AND n.status != 'pass'
+	OR (n.status = 'pass') != (o.status = 'pass'))
+ORDER BY n.path;`, previous, latest))
+	if e != nil {
+		fatal(exitError, e)
+	}
+
+	durations, e := runSQL(db, fmt.Sprintf(`
+SELECT r.path, r.duration, avg(p.duration)
+FROM results r JOIN results p ON r.path = p.path
+WHERE r.run = %s AND r.status = 'pass'
+	AND p.run IN (SELECT id FROM runs WHERE id < r.run ORDER BY id DESC LIMIT %d)
+	AND p.status = 'pass'
+GROUP BY r.path
+ORDER BY r.path;`, latest, *runs))
+	if e != nil {
+		fatal(exitError, e)
+	}
+
+	var failing, recovered, drifted []string
+	for _, c := range changes {
+		if c[1] == passed {
+			recovered = append(recovered, c[0])
+		} else {
+			failing = append(failing, fmt.Sprintf("%s (%s: %s)", c[0], c[1], c[2]))
+		}
+	}
+	for _, d := range durations {
+		now, e1 := strconv.ParseFloat(d[1], 64)
+		before, e2 := strconv.ParseFloat(d[2], 64)
+		if e1 != nil || e2 != nil || before <= 0 {
+			continue
+		}
+		change := now - before
+		if math.Abs(change) < minDrift.Seconds() || math.Abs(change) < *drift*before {
+			continue
+		}
+		drifted = append(drifted, fmt.Sprintf("%s: %.3fs -> %.3fs (%+.0f%%)",
+			d[0], before, now, 100*change/before))
+	}
+
+	if len(failing)+len(recovered)+len(drifted) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+	show := func(title string, lines []string) {
+		if len(lines) > 0 {
+			fmt.Println(title)
+			for _, l := range lines {
+				fmt.Println("  " + l)
+			}
+		}
+	}
+	show("Newly failing:", failing)
+	show("Recovered:", recovered)
+	show("Duration drift:", drifted)
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+)
+
+// Tests in a directory may share an expensive fixture, such as a local server.
+// A script _setup.sh in the directory is run once, with /bin/sh in that
+// directory, before the first test in it, or in any directory below it, is run;
+// and a script _teardown.sh once after the last. If the setup script fails, the
+// tests in the directory are not run, but reported as errors; the teardown
+// script is still run, to clean up whatever the setup script did manage. The
+// scripts are not run for tests whose results are cached, nor for tests run by
+// workers.
+
+// Names of the scripts run before and after the tests in a directory
+const (
+	setupScript    = "_setup.sh"
+	teardownScript = "_teardown.sh"
+)
+
+// Hook records a directory whose tests are being run, and which has a setup
+// or teardown script.
+type Hook struct {
+	dir string
+	err error // the failure of the setup script, if any
+}
+
+// hooks lists the directories holding the tests now being run that have setup
+// or teardown scripts, outermost first.
+var hooks []Hook
+
+// isHook reports whether a file name is that of a setup or teardown script,
+// and so not a test case, even if it has the test case extension.
+func isHook(name string) bool {
+	return name == setupScript || name == teardownScript
+}
+
+// testDirs returns the directories holding a test case, outermost first.
+func testDirs(path string) []string {
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+	slices.Reverse(dirs)
+	return dirs
+}
+
+// enterHooks runs the teardown scripts of the directories left since the last
+// test run, and the setup scripts of those entered for this one. It returns an
+// error if the setup script of any directory holding the test case failed.
+func enterHooks(path string) error {
+	dirs := testDirs(path)
+	for len(hooks) > 0 && !slices.Contains(dirs, hooks[len(hooks)-1].dir) {
+		leaveHook()
+	}
+	for _, dir := range dirs {
+		if slices.ContainsFunc(hooks, func(h Hook) bool { return h.dir == dir }) {
+			continue
+		}
+		setup, teardown := hookExists(dir, setupScript), hookExists(dir, teardownScript)
+		if !setup && !teardown {
+			continue
+		}
+		h := Hook{dir: dir}
+		if setup {
+			if h.err = runHook(dir, setupScript); h.err != nil {
+				log.Print(h.err)
+			}
+		}
+		hooks = append(hooks, h)
+	}
+	for _, h := range hooks {
+		if h.err != nil {
+			return fmt.Errorf("not run, since %s failed", filepath.Join(h.dir, setupScript))
+		}
+	}
+	return nil
+}
+
+// leaveHook runs the teardown script of the innermost directory in hooks,
+// if it has one, and removes it.
+func leaveHook() {
+	h := hooks[len(hooks)-1]
+	hooks = hooks[:len(hooks)-1]
+	if hookExists(h.dir, teardownScript) {
+		if e := runHook(h.dir, teardownScript); e != nil {
+			log.Print(e)
+			errorCount++
+		}
+	}
+}
+
+// finishHooks runs the teardown scripts of all the directories still in hooks.
+func finishHooks() {
+	for len(hooks) > 0 {
+		leaveHook()
+	}
+}
+
+// hookExists reports whether a directory has the given script.
+func hookExists(dir, script string) bool {
+	info, e := os.Stat(filepath.Join(dir, script))
+	return e == nil && info.Mode().IsRegular()
+}
+
+// runHook runs a setup or teardown script in its directory. An error includes
+// the output of the script.
+func runHook(dir, script string) error {
+	cmd := exec.Command("/bin/sh", script)
+	cmd.Dir = dir
+	if output, e := runCaptured(cmd); e != nil {
+		return fmt.Errorf("%s: %s\n%s", filepath.Join(dir, script), e, printable(output))
+	}
+	return nil
+}
+
+// runCaptured runs a command, returning its output and error output together.
+// They are gathered in a file, rather than a pipe, so that a server started in
+// the background by the command need not be waited for.
+func runCaptured(cmd *exec.Cmd) (string, error) {
+	out, e := os.CreateTemp("", "invigilate-hook")
+	if e != nil {
+		return "", e
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	cmd.Stdout, cmd.Stderr = out, out
+	e = cmd.Run()
+	output, _ := os.ReadFile(out.Name())
+	return string(output), e
+}
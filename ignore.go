@@ -0,0 +1,29 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+// Many programs write log messages or progress reports to their error output,
+// which may differ from run to run. With the -ignore-stderr option, or the
+// ignore-stderr directive, the error output is still read, and kept in the
+// transcript of the test, but not checked; "#!" lines, and at-exit directives,
+// then only mean that the program is expected to exit with a nonzero status.
+// Likewise, for programs whose main output goes to files, the -ignore-stdout
+// option, or the ignore-stdout directive, leaves the output unchecked, so that
+// only the error output and exit status are.
+
+// ignoreStderr records the -ignore-stderr option.
+var ignoreStderr bool
+
+// ignoreStdout records the -ignore-stdout option.
+var ignoreStdout bool
+
+// testIgnoresStderr reports whether a test case's error output is to be ignored.
+func testIgnoresStderr(t Test) bool {
+	return ignoreStderr || hasDirective(t, "ignore-stderr")
+}
+
+// testIgnoresStdout reports whether a test case's output is to be ignored.
+func testIgnoresStdout(t Test) bool {
+	return ignoreStdout || hasDirective(t, "ignore-stdout")
+}
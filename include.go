@@ -0,0 +1,99 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Interactions repeated across many test cases, such as logging in, may be kept
+// in a file of their own and included with a line such as
+// "#include common/login.inc". The lines of the file, whose path, unless it is
+// absolute, is relative to the directory holding the file with the include
+// directive, are spliced in place of that line before the test case is checked
+// or run; they may include other files in turn. The program is still given the
+// test case file itself.
+
+// maxIncludeDepth limits how deeply files may include one another.
+const maxIncludeDepth = 16
+
+// checkInclude checks the argument of an include directive.
+func checkInclude(arg string) error {
+	if arg == "" {
+		return errors.New("missing file")
+	}
+	return nil
+}
+
+// expandIncludes splices the files included by a test case into its content.
+// A test case with no include directives is left as it is.
+func expandIncludes(t *Test) error {
+	if !hasDirective(*t, "include") {
+		return nil
+	}
+	content := t.content
+	if t.streamed {
+		data, e := os.ReadFile(t.path)
+		if e != nil {
+			return e
+		}
+		content = string(data)
+	}
+	expanded, e := splice(*t, content, t.source(), []string{t.source()})
+	if e != nil {
+		return e
+	}
+	t.content, t.streamed = expanded, false
+	return nil
+}
+
+// splice returns content, the lines of the file at path, with the files it
+// includes spliced in. The files being included, beginning with the file of the
+// test case t, are listed in active.
+func splice(t Test, content, path string, active []string) (string, error) {
+	var out strings.Builder
+	for k, line := range strings.SplitAfter(content, "\n") {
+		directive, ok := strings.CutPrefix(line, comment)
+		name, arg := splitDirective(directive)
+		if !ok || !isDirective(directive) || name != "include" {
+			out.WriteString(line)
+			continue
+		}
+
+		where := fmt.Sprintf("%s:%d", path, k+1)
+		arg, e := expandVars(arg, t)
+		if e != nil {
+			return "", fmt.Errorf("%s: %s", where, e)
+		}
+		inc := filepath.FromSlash(arg)
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(path), inc)
+		}
+		for _, a := range active {
+			if filepath.Clean(a) == inc {
+				return "", fmt.Errorf("%s: %s includes itself", where, arg)
+			}
+		}
+		if len(active) > maxIncludeDepth {
+			return "", fmt.Errorf("%s: files are included more than %d deep", where, maxIncludeDepth)
+		}
+		data, e := os.ReadFile(inc)
+		if e != nil {
+			return "", fmt.Errorf("%s: %s", where, e)
+		}
+		spliced, e := splice(t, string(data), inc, append(active, inc))
+		if e != nil {
+			return "", e
+		}
+		out.WriteString(spliced)
+		if spliced != "" && !strings.HasSuffix(spliced, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A tree of test cases may mix scripts for several interpreters. With -shebang,
+// a test case beginning with a "#!" line is run with the interpreter named
+// there, and its arguments, in place of the program given on the command line.
+// The "#!" line is not then read as expected error output. With -interp, a test
+// case is run with the interpreter given for its extension, such as "python3"
+// for .py; files with those extensions are also test cases when directories are
+// searched. With either, the program may be omitted.
+
+// shebangMode is whether test cases are run with the interpreter named on
+// their "#!" lines.
+var shebangMode bool
+
+// interpSpec gives the interpreters for extensions, as given with -interp.
+var interpSpec string
+
+// interpreters holds the interpreter for each extension, parsed from interpSpec.
+var interpreters = map[string][]string{}
+
+// parseInterpreters parses interpSpec, a comma separated list of items
+// ".ext=command", into interpreters.
+func parseInterpreters() error {
+	for _, item := range strings.Split(interpSpec, ",") {
+		ext, command, _ := strings.Cut(item, "=")
+		ext = strings.TrimSpace(ext)
+		if len(ext) < 2 || ext[0] != '.' || len(strings.Fields(command)) == 0 {
+			return fmt.Errorf("invalid interpreter %q: must be .ext=command", item)
+		}
+		interpreters[ext] = strings.Fields(command)
+	}
+	return nil
+}
+
+// matchExtension returns the value in m for the longest extension in m that
+// path ends with, if any.
+func matchExtension[V any](path string, m map[string]V) (V, bool) {
+	v, ok := m[longestExtension(path, m)]
+	return v, ok
+}
+
+// longestExtension returns the longest extension in m that path ends with;
+// "" if there is none.
+func longestExtension[V any](path string, m map[string]V) string {
+	best := ""
+	for ext := range m {
+		if strings.HasSuffix(path, ext) && len(ext) > len(best) {
+			best = ext
+		}
+	}
+	return best
+}
+
+// testBase returns the path of a test case file without the extension by which
+// it is recognized as a test case: the longest of the extension given with -e,
+// and those given with -interp and -comments, that it ends with.
+func testBase(path string) string {
+	ext := longestExtension(path, interpreters)
+	if delimited := longestExtension(path, commentDelimiters); len(delimited) > len(ext) {
+		ext = delimited
+	}
+	if len(extension) > len(ext) && strings.HasSuffix(path, extension) {
+		ext = extension
+	}
+	return strings.TrimSuffix(path, ext)
+}
+
+// interpreterFor returns the interpreter for a file, chosen by its extension;
+// nil if there is none.
+func interpreterFor(path string) []string {
+	interp, _ := matchExtension(path, interpreters)
+	return interp
+}
+
+// programOptional reports whether the program may be omitted from the command
+// line, since test cases may name their own interpreters.
+func programOptional() bool {
+	return shebangMode || len(interpreters) > 0
+}
+
+// isTestFile reports whether a file found searching a directory is a test case.
+func isTestFile(base string) bool {
+	_, delimited := matchExtension(base, commentDelimiters)
+	return (strings.HasSuffix(base, extension) || interpreterFor(base) != nil || delimited) && !isHook(base)
+}
+
+// testProgram returns the program to run a test case with.
+func testProgram(t Test, program []string) ([]string, error) {
+	if shebangMode {
+		line, e := firstLine(t)
+		if e != nil {
+			return nil, e
+		}
+		if interp, ok := strings.CutPrefix(line, "#!"); ok && len(strings.Fields(interp)) > 0 {
+			return strings.Fields(interp), nil
+		}
+	}
+	if interp := interpreterFor(t.source()); interp != nil {
+		return interp, nil
+	}
+	if len(program) == 0 {
+		return nil, fmt.Errorf("no program for the test case")
+	}
+	return program, nil
+}
+
+// firstLine returns the first line of a test case, without its newline.
+func firstLine(t Test) (string, error) {
+	lines, e := headLines(t, 1)
+	if e != nil || len(lines) == 0 {
+		return "", e
+	}
+	return lines[0], nil
+}
+
+// headLines returns up to the first n lines of a test case, without their
+// newlines, as they are in the file.
+func headLines(t Test, n int) ([]string, error) {
+	var lines []string
+	if !t.streamed {
+		for rest := t.content; rest != "" && len(lines) < n; {
+			var line string
+			line, rest, _ = strings.Cut(rest, "\n")
+			lines = append(lines, line)
+		}
+		return lines, nil
+	}
+	f, e := os.Open(t.path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for len(lines) < n {
+		line, e := r.ReadString('\n')
+		if line != "" {
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			return nil, e
+		}
+	}
+	return lines, nil
+}
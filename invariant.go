@@ -0,0 +1,48 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// invariantCmd is a shell command run after every test, which should exit with
+// status 0 as long as global state has not been corrupted; "" for none.
+var invariantCmd string
+
+// checkInvariant runs the invariant command after the test that produced r,
+// and marks the test as failed if the command reports a problem.
+func checkInvariant(r Result) Result {
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", invariantCmd)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	e := cmd.Run()
+	if e == nil {
+		return r
+	}
+
+	msg := strings.TrimSpace(out.String())
+	var ee *exec.ExitError
+	if !errors.As(e, &ee) {
+		log.Printf("%s: running invariant: %s", r.path, e)
+		r.status, r.category = errored, "invariant"
+		return r
+	}
+	if msg == "" {
+		msg = e.Error()
+	}
+	log.Printf("%s: invariant violated after test: %s", r.path, msg)
+	if r.status == passed {
+		r.status, r.category = failed, "invariant"
+	}
+	return r
+}
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -20,7 +22,17 @@ import (
 // Function usage prints a usage message to stderr.
 func usage() {
 	fmt.Fprint(os.Stderr, `
-Usage: invigilate [options] program -- files
+Usage: invigilate [run] [options] program -- files
+       invigilate diff old.json new.json
+       invigilate fmt [options] files
+       invigilate golden action [options] directories
+       invigilate list [options] files
+       invigilate record [options] program -- files
+       invigilate serve [options]
+       invigilate trends [options] database
+       invigilate update [options] program -- directories
+       invigilate validate [options] files
+       invigilate worker [options]
 
 Program invigilate runs a number of test cases against a single program.
 
@@ -32,9 +44,50 @@ with the extension given by the -e option; these will be used as test cases.
 Test case files listed directly in the command line do not need to end with
 the extension given with -e.
 
+The program may instead be given with -program, as a single string split into words
+as by the shell, with single and double quotes and backslashes but no expansions;
+for example, -program "judge --sep -- 'two words'". All the arguments after the
+options are then test cases, and "--" may be omitted.
+
 The program being tested is run once for each test case. The command line consists
 of the "program" part of the invigilate arguments, followed by one additional
-argument, the path to the file containing the test case.
+argument, the path to the file containing the test case. If "{test}" appears in
+any of the program's arguments, it is replaced by the path instead, which is then
+not added at the end; for example, "python3 judge.py --case={test}". An argument
+that is exactly "{}" is replaced in the same way, as in "interp --script {} --strict".
+
+With -stdin, the test case file is instead given to the program on its standard input,
+for programs that read their program text there, and the path is not added. Input
+may then not be given with "#<" lines or a .in file.
+
+With -strip, the lines meant for invigilate, giving input, expected output, exit codes,
+and directives, are removed from the test case given to the program, for languages
+that would not accept them. With -stdin, they are removed from the text on standard
+input; otherwise, the program, and any -compile command, is given the path to a copy
+of the test case without them, with the same name, in a temporary directory. Other
+files in the directory of the test case are then not beside the copy.
+
+With -shebang, a test case whose first line begins with "#!" is run with the interpreter
+named there, split into words at white space, in place of the program; for example,
+"#!/usr/bin/awk -f". The "#!" line is then not read as expected error output. The
+program is used for test cases without such a line, and may be omitted, with the "--",
+if there are none.
+
+With -interp, test cases are run with interpreters chosen by their extensions, given
+as a comma separated list such as ".py=python3,.awk=awk -f"; each interpreter is split
+into words at white space. When directories are searched, files with these extensions
+are test cases as well as those with the extension given by -e. A "#!" line, with
+-shebang, takes precedence, and the program is used for other test cases; it may be
+omitted, with the "--", if there are none. With -shebang or -interp and no program,
+results are not cached.
+
+With -comments, test cases use comment delimiters chosen by their extensions, given
+as a comma separated list such as ".c=//,.sql=--", so that test cases in several
+languages may be run together; -c gives the delimiter for other test cases. When
+directories are searched, files with these extensions are test cases as well.
+A test case may also name its own delimiter, taking precedence over both, with
+"invigilate: comment=" followed by the delimiter on its first line, or on its second
+after a "#!" line; for example, "-- invigilate: comment=--".
 
 The expected results of a test case are described in comments embedded in the test file.
 A line beginning with "#>" means that the remainder of the line should appear on standard
@@ -44,13 +97,583 @@ be produced or consumed in the order in which they appear in the test file. The
 may be used to specify another comment delimiter instead of "#", but the delimiter
 must always appear at the beginning of a line.
 
+A line beginning with "#:" gives a title for the test case, such as "#: Rejects an
+empty file", for readers of the results who do not know the test cases by their
+paths; the text of several such lines is joined. The title is shown with the path
+in verbose output and when the test case fails, and is included in JSON reports.
+
+Where output is too changeable to give line by line, a line such as "#>? needle",
+with white space after the "?", expects a line of output containing "needle"
+somewhere ahead, skipping any lines before it; "#!? needle" does the same for the
+error output. If the last line expecting output of either kind is such a search,
+the rest of that output is skipped as well. Conversely, a line such as "#>^ panic:"
+expects that "panic:" appears nowhere in the output, and "#!^" the same for the
+error output; these guard against leaked debug output or crashes, and are checked
+once all the output has been received, wherever they appear in the test case.
+
+Where the order of the lines of output does not matter at all, the -sort option, or
+the sort-output directive, is simpler than unordered blocks. All the lines expected
+on each of the output and error output are compared with all the lines received
+there, once the program has finished, with both sorted. Input is then given without
+waiting for any output, and searches, at-exit, and unordered blocks are not
+treated specially.
+
+The program is expected to exit with status 0, or, if the test case expects error
+output, with a nonzero status. A line beginning with "#?" instead gives the exit
+codes that are acceptable, separated by "|"; each may be a code, a range such as
+64-78, "any-nonzero", or "any". For example, "#? 1|2" accepts exit codes 1 and 2,
+for a portable program which exits with different codes on different systems.
+
+Other lines beginning with the comment delimiter immediately followed by a lowercase
+letter are directives, which give further instructions for running the test case.
+The directives are:
+
+  #at-exit!text
+      The text should appear on the standard error output after standard input has
+      been closed, following all other error output; this is for messages produced
+      when the program shuts down. Error output already produced when the input is
+      closed is not accepted as matching.
+
+  #case empty-input
+      Begins another test case in the same file, with the given name, a single
+      word. The lines before the first "case" are shared by all the test cases in
+      the file; each consists of those lines followed by its own, up to the next
+      "case". The program is run separately for each test case, and given a copy
+      of it, with the same name as the file, in a temporary directory. Each is
+      reported as the path of the file, a colon, and its name, such as
+      "parse.test:empty-input". Companion files are not used for such test cases,
+      and a replay script runs all the test cases in the file.
+
+  #fixture data/input.csv
+      Copy the given file or directory, relative to the directory holding the test
+      case, into a new, empty directory made for the test, and run the program
+      there; the directory is removed afterwards. This may be given more than once,
+      but not with "cwd".
+
+  #file out.txt exists
+  #file out.txt absent
+  #file out.txt == expected/out.txt
+      Once the program has exited, check that the given file, relative to its
+      working directory, was written; that it was not; or that its contents are
+      exactly those of the second file, relative to the directory holding the test
+      case. Unless "cwd" is given, the program is run in a new, empty directory,
+      as with "fixture", so that files left by an earlier run are not mistaken for
+      its own.
+
+  #include common/login.inc
+      Splice in the lines of the given file, relative, unless its path is absolute,
+      to the directory holding the file with this directive, in place of this line,
+      before the test case is checked or run; this keeps sequences repeated across
+      many test cases, such as logging in, in one place. Included files may include
+      others in turn. The program is still given the test case file itself.
+
+  #first-output-within 200ms
+      The program's first output, on either the standard output or the standard
+      error output, should be received within the given time from the start of the
+      test; this catches regressions in the responsiveness of interactive programs.
+
+  #comparator cmp
+      Compare the output with the expected output by running the given shell
+      command, instead of that given with the -comparator option, described below.
+
+  #contents out.txt
+      Begins a contents block, ended by "end-contents". The "#>" lines in the block
+      give the expected contents of the given file, written by the program, rather
+      than output; they are matched once the program has exited, and may be
+      searches, forbidden text, references to files, encoded data, or checksums,
+      as for output. As with "file", the program is run in a new, empty directory
+      unless "cwd" is given.
+
+  #cwd data
+      Run the program in the given directory, relative to the directory holding
+      the test case, rather than in the current directory. The paths of the program
+      and the test case on its command line are made absolute.
+
+  #end-contents
+      Ends a contents block; see "contents".
+
+  #end-json
+      Ends a JSON block; see "json".
+
+  #end-unordered
+      Ends an unordered block; see "unordered".
+
+  #expand
+      Replace references to variables in the lines of input, expected output,
+      and expected error output, as well as in the arguments of directives.
+
+  #error-lines >=1
+      Check the number of lines of error output, as "output-lines" does for the
+      output; error-bytes likewise checks the number of bytes.
+
+  #ignore-stderr
+      Do not check the program's error output, as with the -ignore-stderr option,
+      described below.
+
+  #ignore-stdout
+      Do not check the program's output, as with the -ignore-stdout option,
+      described below.
+
+  #json ignore=id,time
+      The lines from here to the next "end-json" directive hold a JSON value,
+      expected as output or error output, which is compared with the value received
+      as data rather than text: the order of the keys of objects, and white space,
+      do not matter. The output is read a line at a time until it holds a whole
+      value. The fields given with "ignore=", if any, are ignored wherever they
+      appear in objects. Input cannot be given within the block.
+
+  #killed SEGV
+      The program should be terminated by the given signal, rather than exiting;
+      this is for testing crash handling and watchdogs. The test case fails if the
+      program exits normally or is terminated by another signal.
+
+  #lenient-newline
+      Ignore a missing final newline in the output or expected output, as with the
+      -lenient-newline option, described below.
+
+  #matrix SIZE=1,10,1000
+      Run the test case once for each of the given values, with "%{SIZE}" replaced
+      by the value throughout: in the input, the expected output, and the arguments
+      of directives. With more than one matrix directive, it is run for each
+      combination of their values. Each run is reported as the path of the file,
+      a colon, and the values, as in "sort.test:SIZE=10", and the program is given
+      a copy of the test case with the values in place, as for "case".
+
+  #merge-output
+      Merge the program's output and error output, as with the -merge option,
+      described below.
+
+  #output-lines 90-110
+      Check the number of lines of output, for programs whose output does not
+      matter in detail, but whose volume does; output-bytes likewise checks the
+      number of bytes, and may be given a size such as 64K. The count may be a
+      number, a range, or a bound such as >=90, >90, <=110, or <110. Output beyond
+      that matched by the test case is then not reported as extra, but only
+      counted. The count is of the output as it is matched, after any filters,
+      such as -ansi strip, are applied; a last line without a newline counts.
+
+  #pty 100x30
+      Run the program under a pseudo-terminal, of the given size, or as given with
+      the -pty option, or 80x24, as described below.
+
+  #requires-invigilate >=0.5
+      The test case needs at least the given version of invigilate; if this version is
+      too old, the test case is reported as an error rather than run. The operators
+      >, <=, <, and = may be used instead of >=.
+
+  #rlimit nofile=16
+      Run the program with the given resource limits, in addition to or instead of
+      those given with the -rlimit option, as described below.
+
+  #scrub /[0-9]+ms/TIME/
+      Apply the given substitution to each line of the output and error output
+      before it is matched, after those given with the -scrub option, described
+      below.
+
+  #signal USR1
+      Send the given signal to the program at this point in the test case, to test
+      its handling of signals, such as reloading its configuration or shutting down
+      gracefully. The signal is named as in the kill command, such as HUP, USR1,
+      TERM, or SEGV, with or without the prefix "SIG".
+
+  #sort-output
+      Compare the output with the lines of both it and the expected output sorted,
+      as with the -sort option, described below.
+
+  #unordered
+      The lines expected from here to the next "end-unordered" directive may be
+      received in any order, for programs which iterate over hash maps or run
+      goroutines. For each of the output and error output, as many lines are read
+      as are expected, and they must be the same lines, in some order. Input
+      cannot be given within the block.
+
+  #whitespace trailing,blank
+      Ignore the given differences in white space, in addition to those given with
+      the -whitespace option, described below.
+
+A directive name must be followed by white space or the end of the line. Any other
+comment line is left alone, even one that looks like a directive, such as "#todo fix
+this"; the validate subcommand reports these. Directive names beginning with "x-" are
+reserved for extensions by other tools; invigilate warns about these and otherwise
+ignores them.
+
+The arguments of directives may refer to environment variables, as in "#fixture
+${DATA}/in.csv", and to these values, as in "#cwd %{tmpdir}":
+
+  %{testdir}   the absolute path of the directory holding the test case
+  %{testname}  the name of the test case file, without its directory or extension
+  %{tmpdir}    a directory made for the run, and removed at its end
+
+With the expand directive, so may the lines of input, expected output, and expected
+error output, as in "#>%{testname}". The argument of an include directive is
+replaced before the file is read. A reference to an environment variable that is
+not set, or to an unknown value, is left as it is. "$${" and "%%{" stand for "${"
+and "%{" themselves.
+
+When the -catalog option names a message catalog, expected output may refer to
+messages in it, so that a suite for a localized program can be run against each
+language build by changing only the catalog. A line such as
+
+  #>msg ERR_NOT_FOUND file=foo.txt
+
+expects the text of message ERR_NOT_FOUND, with "{file}" in that text replaced by
+"foo.txt"; "#!msg" works the same way for error output. A value containing spaces
+may be written as a Go string literal. Each line of the catalog has the form
+"ID=text"; blank lines and lines beginning with "#" are ignored.
+
+Invigilate caches the results of tests that pass. A test is not run again while the
+program (including the contents of its executable file), its arguments, the test case
+file, and the options affecting the result are unchanged; it is simply reported as
+passing. Use the -no-cache option to run all the tests anyway. The cache is kept in
+the directory named by $INVIGILATE_CACHE, or in the user's cache directory if that is
+not set; setting INVIGILATE_CACHE to "off" disables the cache. Note that the cache
+cannot know about other files a test case depends on.
+
+The -history option records the results of each run in an SQLite database, using the
+sqlite3 program, which must be installed. The "invigilate trends" subcommand summarizes
+the changes between recent runs recorded there; see "invigilate trends -h".
+
+Sidecar golden files, such as foo.out beside foo.test, may be listed, verified
+against recorded checksums, pruned, and updated with the "invigilate golden"
+subcommand; see "invigilate golden". "invigilate update" is short for "invigilate golden
+update", and "invigilate record" writes golden files for new test cases that have none;
+see "invigilate record -h".
+
+"invigilate run" is the same as running the tests without a subcommand. A program
+named like a subcommand must follow "run", an option, or "--", as in "invigilate --
+list -- tests". "invigilate list" lists the test cases that would be run, with the
+options -comments, -e, -interp, -shard, and -shard-balance meaning the same as for
+running them. "invigilate fmt" rewrites test case
+files in a standard layout, with single spaces after directive names and "#?"; see
+"invigilate fmt -h".
+
+The "invigilate validate" subcommand checks the directives in test case files
+without running them and, with -schema, checks that the test cases follow the
+conventions of a suite, such as which directives they may or must use;
+see "invigilate validate -h".
+
+The -json option writes a report of the results of a run, including for each test
+the time until its first output was received, whether it was the first test run,
+when the program was less likely to be cached by the operating system, and the
+CPU time and peak memory used by the program. The -resources option shows the
+CPU time and peak memory as each test completes. The
+"invigilate diff" subcommand compares two such reports, and the -compare-to option
+compares the results of the current run with an earlier report.
+
+The -dirs option adds a table to the end of the run showing, for each directory of
+test cases, the number of tests, failures, and other errors, and the total time taken.
+The directories with the most failures and errors are listed first, then those taking
+the most time, so that the areas of a large tree needing attention stand out.
+
+The -quarantine option names a file listing known flaky tests, one path or
+filepath.Match pattern per line. Failures of these tests are reported, but do not
+cause the run to fail. A summary of the quarantined tests is shown at the end of
+the run, including how often each has failed in the -history database, if any.
+
+The -count option runs each test case the given number of times, reporting each
+run as a separate result, so that flaky tests may be found and fixes to them
+checked; the failure of any run fails the test case, which is counted once among
+the failed tests, followed by the number of failed runs. Each failed run is
+identified in the error output, and in JSON reports, by its number. The result
+cache is not used.
+
+The -determinism option runs each test case twice, failing it if either run fails,
+or if the output, error output, or exit code of the program differ between the
+runs, even when both are accepted by the test case, as with -sort, -scrub, or
+"ignore-stdout". This finds hidden nondeterminism, such as the order of a hash table
+or a timestamp, before it makes a test flaky. A test case failing the first time is
+not run again, and the runs are compared only if the program exited by itself in
+both. It cannot be used with -soak.
+
+The -soak option runs each test case several times. Besides failing if any of the
+runs fails, the test case fails if the peak memory use of the program grows with
+every run, by more than the fraction given with -leak overall, suggesting a leak.
+
+The -shard option splits the tests into several parts, running only one of them, so
+that a large run may be spread across several machines; for example, "-shard 3/8"
+runs the third of eight shards. Tests are assigned to shards by hashing their paths,
+unless -shard-balance names a history database; then the shards are balanced so
+that each should take about the same time.
+
+The -repro-bundle option writes an archive for each failed test into the given
+directory. The archive holds the test case, the command line, the environment
+variables, a transcript of the failed run, and a script run.sh which runs the
+test case again, so that the failure can be reproduced on another machine.
+
+The -replay option writes a shell script for each failed test into the given
+directory. The script runs invigilate again, on just that test case, with the same
+program, options, working directory, and environment.
+
+The -artifacts option writes a directory for each failed test into the given
+directory, for examining the failure after the run, as when the directory is
+uploaded from a CI job. It holds the command line and working directory of the
+program, the environment variables, a transcript of the run, and the outcome of
+the test, with its exit status and timing.
+
+With -v, each test case is shown as it runs: first its path, then the command
+running the program, such as "$ /bin/sh foo.test", which may be copied to run it
+by hand, and then the lines of input given and output matched.
+
+The -transcript option shows the whole transcript of each failed test after the
+messages describing the failure: the command running the program, and then every
+line of input, output, and error output, in the order they were exchanged with the
+program, each with its time since the start of the test and marked "<", ">", or
+"!" for its stream.
+
+The -save-actual option saves all the output and error output received from the
+program in each failed test, up to the point of failure, in files beside it, with
+the extension of the test case replaced: foo.actual.out and foo.actual.err for
+foo.test, or in its directory under -artifacts. They may be compared with what was
+expected, or, for a test case whose lines expect no output, renamed to foo.out and
+foo.err once checked, to become its companion files.
+
+The -invariant option gives a shell command to be run after every test, to check
+that global state shared by the tests is still sound; for example, that no stray
+files have been left in a fixture directory, or that a server is still healthy. If
+the command exits with a nonzero status, the test just run is reported as failing,
+along with any output from the command, pinpointing the test that corrupted the state.
+
+Tests in a directory may share an expensive fixture, such as a local server. A
+script _setup.sh in the directory is run once, with /bin/sh in that directory,
+before the first test in it or below it is run, and a script _teardown.sh once
+after the last. If the setup script fails, those tests are reported as errors
+without being run; the teardown script is run all the same. The scripts are not
+run for tests whose results are cached.
+
+The program may be run by a wrapper, such as valgrind, given with the -wrap option
+as a single argument, such as -wrap "valgrind -q --error-exitcode=99". The wrapper
+is split into words at white space. A word {program} is replaced by the program and
+its arguments, and {test} anywhere in a word by the path to the test case; without
+{test}, the path follows the program as usual, and without {program}, the program
+follows the wrapper. Wrappers, whether given with -wrap or as part of the program,
+often report the problems they find with exit codes of their own. The -exit-codes
+option names a file classifying these exit codes, one per line, such as
+
+  99 memory error
+
+The classes are "tool error", reported as an error rather than a test failure;
+"memory error", reported as a failure in that category; and "test failure", reported
+as a failure even where the test case expects a nonzero exit code, unless the test
+case lists the code in a "#?" line.
+
+The -build option gives a shell command, such as "go build -o {out} ./cmd/tool",
+which is run once before any test case to build the program being tested, so that
+building and testing it is a single command. The command must write the program to
+the file named by {out}, which is then used in place of {out} in the program's command
+line, as in
+
+  invigilate -build "go build -o {out} ./cmd/tool" {out} -v -- tests
+
+If the build fails, its output is shown, no tests are run, and the failure is
+included in the reports of the run as an error for "(build)".
+
+The -compile option gives a shell command run before each test case, to compile
+it, where the test case is itself a program, or is judged by compiling it, as
+in programming contests; for example, with -c "//" for C:
+
+  invigilate -c "//" -e .c -compile "cc -o {exe} {test}" {exe} -- tests
+
+The command is given the path to the test case in place of {test}, and must write
+the program to the file named by {exe}, which is then used in place of {exe} in
+the program's command line. If the compilation fails, its output is shown, and
+the test fails.
+
+The -before and -after options give shell commands run once before and after all
+the tests, such as "docker compose up -d" and "docker compose down", so that the
+whole workflow of testing lives in one command. The -before command is run before
+any build. If it fails, its output is shown, no tests are run, and the failure is
+included in the reports as an error for "(before)"; the -after command is run
+regardless, to clean up, even when the run is interrupted, and even when a second
+interrupt makes invigilate exit at once.
+
+The -rlimit option, and the rlimit directive, set limits on the resources the
+program may use: "as" limits its address space, in bytes; "fsize" limits the size
+of the files it writes, in bytes; "cpu" limits its CPU time, in seconds; and
+"nofile" limits the number of files it may have open. Sizes may have the suffix K,
+M, or G, and CPU time may be given as a duration, such as 1.5s. Several limits may
+be given, separated by commas. These allow testing behaviour under memory pressure
+or descriptor exhaustion, and keep runaway tests from exhausting the host. A program
+exceeding its CPU or file size limit is killed by SIGXCPU or SIGXFSZ; see "killed".
+
+Resource limits apply to each process separately. On Linux, the -memory-max option
+limits the total memory used by the program and all the processes it starts, such
+as 512M, by running each test case in a cgroup of its own. The cgroup is created in
+the cgroup v2 directory given with -cgroup, which must be writable and have the
+memory controller enabled for its children; without -cgroup, the program is run in
+a transient scope with systemd-run. A test case in which a process is killed for
+exceeding the limit fails in the category "memory".
+
+The -pty option, and the pty directive, run the program with a pseudo-terminal of
+the given size, such as 80x24 (columns by rows), as its standard input and output,
+for testing programs that behave differently when used interactively, such as by
+prompting or buffering output by lines. The error output is still separate. The
+terminal does not echo input or turn newlines into carriage returns and newlines,
+so test cases are written as usual. The end of the input is signalled by typing
+^D, which a program that has put the terminal into raw mode will see as a
+character instead. Pseudo-terminals are supported only on Linux.
+
+With the -merge option, or the merge-output directive, the program's output and
+error output are sent to the same pipe, so that they are received in the order in
+which the program wrote them, and the "#>" and "#!" lines of a test case are both
+matched against them, in the order given; this is for programs in which that order
+matters. A "#!" line still means the program is expected to exit with a nonzero status.
+
+With the -ignore-stderr option, or the ignore-stderr directive, the program's
+error output is not checked, for programs that write log messages or progress
+reports there which may differ from run to run; it is still recorded in the
+transcripts of reproducer bundles. Then "#!" lines and at-exit directives only mean
+that the program is expected to exit with a nonzero status. Likewise, with the
+-ignore-stdout option, or the ignore-stdout directive, the program's output is not
+checked, for programs whose main output goes to files; only the error output and
+exit status are. Output that is merged cannot also be ignored.
+
+Programs that color their output, or move the cursor, do so with ANSI escape
+sequences. With -ansi strip, these are removed from the output and error output
+before it is matched, so that test cases need only give the text. With -ansi show,
+each is replaced by a canonical form written in ordinary text, with "\e" for the
+escape character, so that "#>\e[1;31mError:\e[0m failed" expects "Error:" in bold
+red; equivalent forms of a sequence, such as "\e[m" and "\e[0m", are shown alike.
+
+Expected output written by hand often differs from the real output only in white
+space. The -whitespace option, or the whitespace directive, gives a comma separated
+list of such differences to ignore: with trailing, spaces and tabs at the ends of
+lines; with collapse, the lengths of runs of spaces and tabs; and with blank, lines
+that are empty or hold only spaces and tabs. The output, error output, and expected
+output are all normalized in these ways before they are compared.
+
+Whether output ends with a newline is often an accident of how it was written, as
+with "echo -n" and "echo", and a test case file may or may not end with one. With
+the -lenient-newline option, or the lenient-newline directive, output and expected
+output that differ only in a final newline are treated as equal.
+
+Programs built for Windows usually end their lines with "\r\n", and test case
+files edited there often do too. With the -crlf option, each "\r\n" is treated as
+"\n", both in the lines of test case files and in the output and error output of
+the program, so that the same test cases serve for programs built on Windows and
+on Unix.
+
+Output often holds text that changes from run to run, such as timestamps, UUIDs,
+and the names of temporary files. The -scrub option, which may be given more than
+once, and the scrub directive give substitutions applied to each line of the output
+and error output before it is matched, replacing such text with stable tokens.
+Each is written as in sed, as "/regexp/replacement/", where any character may take
+the place of "/", and the replacement may refer to submatches as "$1" or "${name}";
+so "-scrub '/[0-9a-f]{8}(-[0-9a-f]{4}){3}-[0-9a-f]{12}/UUID/'" replaces UUIDs. A
+line is scrubbed once it is complete, or once the program stops writing for the
+moment, as it does when it prompts for input.
+
+For output in formats of its own, such as images or documents with embedded dates,
+no comparison of text may serve. The -comparator option, or the comparator
+directive, gives a shell command that compares the output with the expected output
+instead. It is run once the program has finished, for each of the output and error
+output, with {expected} and {actual} replaced by the names of files holding the
+expected and actual data, or with these names appended if neither appears; the
+output matches if it exits with status 0, and otherwise its own output is shown.
+As with -sort, input is then given without waiting for any output, and searches,
+at-exit directives, and blocks are not treated specially.
+
+Input and expected output that are too large, or too far from text, to be written
+as lines of a test case may instead be kept in companion files beside it, with the
+extension of the test case replaced: foo.in holds the input for foo.test, foo.out
+its expected output, and foo.err its expected error output, all exactly as the
+program reads or writes them. Their contents follow those of the test case itself:
+the input is given after any "#<" lines, and the input is then closed, while the
+expected output and error output are matched after any "#>" and "#!" lines.
+
+Such files may also be referred to from anywhere in a test case: the line
+"#<file inputs/session1.txt" gives the contents of that file as input, and the
+lines "#>file expected/output.txt" and "#!file errors.txt" expect the contents of
+those files as output and error output, exactly as they are. The paths are
+relative to the directory holding the test case.
+
+Binary data, and text with control characters, cannot be written directly as lines
+of a test case. Input and expected output lines may instead give their data
+encoded: "#<esc " is followed by text with backslash escapes, such as "\n", "\t",
+"\r", "\e", "\0", "\\", and "\x7f", and "#>b64 " by base64. The data is exactly
+what is encoded; the newline ending the line is not part of it. So "#<esc y\x04"
+gives the input "y" followed by a control-D, without a newline. When expected or actual
+output that does not match is binary, it is shown as hexdumps, side by side,
+around the first difference.
+
+A program stuck in a loop may write gigabytes of output, which invigilate would
+otherwise hold, and record, until the time limit. With the -max-output option, a
+program writing more than the given size, such as 10M, on either its output or its
+error output is killed, and the test fails, showing the beginning of that output.
+
+Output of many megabytes, which is always the same, need not be kept at all. The
+line "#>sha256 " followed by a SHA-256 checksum in hexadecimal expects all the
+remaining output, to the end, to have that checksum; "#!sha256 " does the same for
+error output. The checksum is of the output as it is matched, after any filters,
+such as -ansi strip, are applied.
+
+Control characters in other output shown in failure messages are shown in caret
+notation, as by "cat -v", such as "^M" for a carriage return and "^[" for escape,
+so that they cannot upset the terminal; other characters that cannot be shown are
+shown as Go escapes, such as "\xff".
+
+The -backend option selects how test cases are run. With the default, local, they
+are run directly on the host. With docker, each test case is run in a new container
+created from the image given with -image, so that the tests run in a reproducible
+environment; the program must be available in the image. The current directory is
+bind-mounted at the same path in the container and used as its working directory,
+and the directory of a test case outside it is bind-mounted read-only. Resource
+limits other than "as", and -memory-max, are applied to the container; -cgroup is
+not used. Each container is removed once its test case is finished.
+
+The "invigilate serve" subcommand runs invigilate as a daemon with an HTTP API,
+through which editors and bots may start runs and fetch their results; see
+"invigilate serve -h". The runs are carried out one at a time, within the
+server, so that no new process need be started for each. It also serves metrics of
+the runs, in the Prometheus format, at /metrics. After a batch run, the -pushgateway
+option pushes the same metrics to a Prometheus Pushgateway, as the job "invigilate".
+
+A large suite may be spread across several machines, each running "invigilate
+worker". The -workers option gives their addresses, such as host1:7420,host2:7420;
+the test cases are then sent to the workers as they become free, and the results
+reported as if they had been run locally. Each worker must have the program and the
+test cases at the same paths, relative to its working directory, as for this run.
+The options affecting the outcome of test cases are passed on to the workers, but
+-artifacts, -invariant, -replay, -repro-bundle, and -save-actual have no effect,
+and no setup or teardown scripts are run. See "invigilate worker -h".
+
+Each test case runs in a process group of its own. When a test case exceeds its time
+limit, the program and any processes it started are sent SIGTERM, so that they may
+flush their logs and clean up, and are killed if they have not exited after the
+period given with -grace. The report of the timeout says how the program ended.
+When a test case fails in other ways, its processes are killed at once.
+
+Invigilate exits with status 0 if all tests pass, 1 if some tests fail, 2 if there
+are errors other than test failures (such as unreadable test case files or invalid
+options), and 3 if no test cases are found.
+
+If invigilate receives SIGINT or SIGTERM, it kills the test in progress, along with
+any processes it started, and starts no more tests. The results so far are reported
+as usual, and invigilate exits with status 128 plus the signal number. A second
+signal makes invigilate exit at once. SIGHUP, SIGUSR1, and SIGUSR2 are passed on to
+the test in progress, if any, and its process group; they are otherwise ignored.
+
+An argument "@file" anywhere on the command line is replaced by the lines of the file,
+each line as one argument, skipping blank lines; this allows more test cases than fit
+on a command line. An argument beginning with "@@" stands for itself with the first
+"@" removed.
+
+Default options may be given in the environment variable INVIGILATE_OPTS, split into
+words at white space, such as "-t 10s -no-cache". They are parsed before the command
+line, so options given on the command line take precedence. INVIGILATE_OPTS may hold
+only options, and applies only to running tests, not to the other subcommands. It is
+not passed on to the copies of invigilate started by workers or by replay scripts,
+which are given the options they need.
+
 Options:
 
 `)
 
-	flag.PrintDefaults()
+	runFlags.PrintDefaults()
 }
 
+// version is the version of invigilate, as checked by "requires-invigilate" lines.
+const version = "0.5"
+
 // verbose indicates whether verbose output was requested
 var verbose bool
 
@@ -73,130 +696,809 @@ var limit time.Duration
 
 // Test represents one test case file to be executed or reported as an error.
 type Test struct {
-	// The path to the file
+	// The path to the file, or for one of several test cases in a file,
+	// the path to the file, a colon, and the name of the test case
 	path string
 
-	// The content of the file; "" whenever err is not nil.
+	// The path to the file holding the test case, when it is one of several
+	// in the file; "" otherwise
+	file string
+
+	// The content of the file, which is read only when the test is about
+	// to be run; "" until then, and whenever err is not nil.
 	content string
 
+	// Whether the file is too large to be held in content, and so is read
+	// a line at a time whenever it is needed
+	streamed bool
+
 	// Any error that occurred processing the file
 	err error
+
+	// When the file was found, when reading it started, and how long that took
+	found time.Time
+	loaded time.Time
+	reading time.Duration
+}
+
+// Exit codes, distinguishing the different ways a run can go wrong
+const (
+	exitFailed  = 1 // some tests failed
+	exitError   = 2 // errors reading tests, setting up, or in the command line
+	exitNoTests = 3 // no tests were found
+)
+
+// fatal logs a message and exits with the given code; or, in a run for the
+// server, ends just that run.
+func fatal(code int, v ...any) {
+	log.Print(v...)
+	if serving {
+		panic(exitStatus(code))
+	}
+	os.Exit(code)
+}
+
+// subcommands lists the subcommands, which are recognized only as the first argument.
+var subcommands = map[string]func(args []string){
+	"diff":     diff,
+	"fmt":      format,
+	"golden":   golden,
+	"list":     list,
+	"record":   recordGoldens,
+	"serve":    serve,
+	"trends":   trends,
+	"update":   func(args []string) { golden(append([]string{"update"}, args...)) },
+	"validate": validate,
+	"worker":   worker,
 }
 
 func main() {
 	log.SetFlags(0)
 
+	if spec, ok := os.LookupEnv(rlimitEnv); ok && len(os.Args) > 1 {
+		runLimited(spec)
+	}
+	if args, e := expandArgsFiles(os.Args[1:]); e != nil {
+		fatal(exitError, e)
+	} else {
+		os.Args = append(os.Args[:1:1], args...)
+	}
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			sub(os.Args[2:])
+			return
+		} else if os.Args[1] == "run" {
+			// The same as running the tests without a subcommand.
+			os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		}
+	}
+
+	os.Exit(runTests(flag.CommandLine, strings.Fields(os.Getenv("INVIGILATE_OPTS")), os.Args[1:]))
+}
+
+// runFlags holds the options of the current run.
+var runFlags *flag.FlagSet
+
+// runTests runs the tests as given by the options opts, from INVIGILATE_OPTS,
+// and the command line args, defined in fs, and returns the exit code.
+func runTests(fs *flag.FlagSet, opts, args []string) int {
 	var help bool
-	flag.StringVar(&comment, "c", "#", "comment delimiter for expected input and output")
-	flag.StringVar(&extension, "e", ".test", "test case files have this extension")
-	flag.BoolVar(&help, "h", false, "print this help information")
-	flag.DurationVar(&limit, "t", 2 * time.Second, "time limit for individual test cases")
-	flag.BoolVar(&verbose, "v", false, "show verbose output")
-	flag.CommandLine.Usage = usage
-	flag.Parse()
+	runFlags = fs
+	// Options whose values accumulate are reset, in case of an earlier run.
+	rlimits, scrubs = Rlimits{}, nil
+	discoveryFlags(fs)
+	fs.StringVar(&afterCmd, "after", "", "shell `command` run once after all the tests")
+	fs.StringVar(&ansiMode, "ansi", "", "strip ANSI escape sequences from output before matching, or show them as text; `mode` is strip or show")
+	fs.StringVar(&artifactsDir, "artifacts", "", "write a directory of files describing each failed test into this directory")
+	fs.StringVar(&backend, "backend", "local", "run test cases locally or, with docker, each in a new container")
+	fs.StringVar(&beforeCmd, "before", "", "shell `command` run once before all the tests; if it fails, no tests are run")
+	fs.StringVar(&buildCmd, "build", "", "shell `command` building the program into {out}, run once before the tests")
+	fs.StringVar(&cgroupParent, "cgroup", "", "with -memory-max, create a cgroup for each test in this cgroup v2 `directory`")
+	fs.StringVar(&comment, "c", "#", "comment delimiter for expected input and output")
+	fs.BoolVar(&crlf, "crlf", false, "treat each \"\\r\\n\" in test cases and output as \"\\n\"")
+	fs.StringVar(&catalogPath, "catalog", "", "message catalog for \"msg\" references in expected output")
+	fs.StringVar(&comparatorCmd, "comparator", "", "compare output with expected output by running this shell `command` on {expected} and {actual}")
+	fs.StringVar(&compileCmd, "compile", "", "shell `command` compiling each test case into {exe}, run before the test")
+	fs.IntVar(&repeatCount, "count", 1, "run each test this many times, reporting each run separately")
+	fs.StringVar(&compareTo, "compare-to", "", "compare results with this earlier JSON report")
+	fs.StringVar(&cpuProfile, "cpuprofile", "", "write a CPU profile of invigilate itself to this `file`")
+	fs.StringVar(&csvPath, "csv", "", "write a CSV summary of test results to this file")
+	fs.StringVar(&exitCodesPath, "exit-codes", "", "file classifying particular exit codes of the program, such as a wrapper's")
+	fs.BoolVar(&checkDeterminism, "determinism", false, "run each test twice, failing those whose output or exit code differs between the runs")
+	fs.BoolVar(&dirSummary, "dirs", false, "summarize the results for each directory at the end of the run")
+	fs.DurationVar(&gracePeriod, "grace", time.Second, "after a timeout, time allowed for the program to exit after SIGTERM; 0 to kill it at once")
+	fs.BoolVar(&help, "h", false, "print this help information")
+	fs.StringVar(&image, "image", "", "with -backend docker, run test cases in containers created from this `image`")
+	fs.BoolVar(&ignoreStderr, "ignore-stderr", false, "do not check the error output of the program")
+	fs.BoolVar(&ignoreStdout, "ignore-stdout", false, "do not check the output of the program")
+	fs.StringVar(&invariantCmd, "invariant", "", "run this shell command after every test; a nonzero exit fails the test")
+	fs.StringVar(&jsonPath, "json", "", "write a JSON report of test results to this file")
+	fs.Float64Var(&leakThreshold, "leak", 0.2, "in soak mode, report peak memory growth beyond this fraction as a leak")
+	fs.StringVar(&historyPath, "history", "", "add test results to this SQLite history database")
+	fs.StringVar(&maxOutputSpec, "max-output", "", "kill a program writing more than this `size` of output or error output")
+	fs.StringVar(&memProfile, "memprofile", "", "write a memory profile of invigilate itself to this `file`")
+	fs.StringVar(&memoryMaxSpec, "memory-max", "", "limit the total memory used by each test to this `size`, using a cgroup (Linux only)")
+	fs.BoolVar(&lenientNewline, "lenient-newline", false, "treat output as expected when it differs only in a final newline")
+	fs.BoolVar(&mergeOutput, "merge", false, "merge the output and error output of the program, matching them as one stream")
+	fs.BoolVar(&noCache, "no-cache", false, "run all tests, even those known to pass from the result cache")
+	fs.StringVar(&otelEndpoint, "otel-endpoint", "", "send trace spans to this OpenTelemetry (OTLP/HTTP) collector")
+	fs.StringVar(&pprofAddr, "pprof", "", "serve profiles and runtime metrics of invigilate itself at this address")
+	fs.StringVar(&programSpec, "program", "", "the program's `command` line, split into words as by the shell, in place of the arguments before \"--\"")
+	fs.StringVar(&ptySpec, "pty", "", "run the program under a pseudo-terminal of this `size`, such as 80x24")
+	fs.StringVar(&pushgateway, "pushgateway", "", "push metrics of the run to the Prometheus Pushgateway at this `URL`")
+	fs.StringVar(&quarantinePath, "quarantine", "", "file listing tests whose failures do not fail the run")
+	fs.StringVar(&replayDir, "replay", "", "write a script for running each failed test again into this directory")
+	fs.StringVar(&bundleDir, "repro-bundle", "", "write an archive for reproducing each failed test into this directory")
+	fs.BoolVar(&showResources, "resources", false, "show the CPU time and peak memory used by each test")
+	fs.Var(rlimits, "rlimit", "resource `limits` for the program, such as as=512M,nofile=16")
+	fs.BoolVar(&saveActual, "save-actual", false, "save the output and error output of each failed test beside it, in .actual.out and .actual.err files")
+	fs.Var(&scrubs, "scrub", "apply this `substitution`, such as /[0-9]+ms/TIME/, to each line of output; may be repeated")
+	fs.BoolVar(&shebangMode, "shebang", false, "run each test case beginning with a \"#!\" line with the interpreter named there")
+	fs.IntVar(&soakCount, "soak", 1, "run each test this many times, checking for growing memory use")
+	fs.BoolVar(&sortOutput, "sort", false, "compare the output of the program with the expected output, with the lines of both sorted")
+	fs.BoolVar(&stdinInput, "stdin", false, "give each test case to the program on standard input instead of as an argument")
+	fs.BoolVar(&stripLines, "strip", false, "give the program the test case without the lines of input, expected output, and directives")
+	fs.DurationVar(&limit, "t", 2 * time.Second, "time limit for individual test cases")
+	fs.BoolVar(&showTranscript, "transcript", false, "show the whole transcript of each failed test, with the time of each line")
+	fs.BoolVar(&verbose, "v", false, "show verbose output")
+	fs.StringVar(&whitespaceSpec, "whitespace", "", "ignore these comma separated `differences` in white space: trailing, collapse, blank")
+	fs.StringVar(&workerAddrs, "workers", "", "run the tests on the workers at these comma separated `addresses`")
+	fs.StringVar(&wrapper, "wrap", "", "run the program with this wrapper `command`, such as valgrind")
+	fs.Usage = usage
+	if len(opts) > 0 {
+		if e := fs.Parse(opts); e != nil {
+			return exitError
+		} else if fs.NArg() > 0 {
+			fatal(exitError, "INVIGILATE_OPTS may hold only options; found ", fs.Arg(0))
+		}
+	}
+	if e := fs.Parse(args); e != nil {
+		return exitError
+	}
 
 	if help {
 		usage()
-		return
+		return 0
 	}
 
 	var program, roots []string
-	for k, a := range flag.Args() {
-		if a == "--" {
-			// Allocate a spot for a test name in the program's command line
-			program = make([]string, k, k + 1)
-			copy(program, flag.Args()[:k])
-			roots = flag.Args()[k+1:]
+	if programSpec != "" {
+		words, e := shellSplit(programSpec)
+		if e != nil {
+			fatal(exitError, "-program: ", e)
+		}
+		program = make([]string, len(words), len(words) + 1)
+		copy(program, words)
+		roots = fs.Args()
+		for _, a := range roots {
+			if a == "--" {
+				fatal(exitError, "-program cannot be used with a program before \"--\"")
+			}
+		}
+	} else {
+		for k, a := range fs.Args() {
+			if a == "--" {
+				// Allocate a spot for a test name in the program's command line
+				program = make([]string, k, k + 1)
+				copy(program, fs.Args()[:k])
+				roots = fs.Args()[k+1:]
+			}
+		}
+	}
+	if interpSpec != "" {
+		if e := parseInterpreters(); e != nil {
+			fatal(exitError, e)
 		}
 	}
-	if len(program) == 0 {
+	if e := parseComments(); e != nil {
+		fatal(exitError, e)
+	}
+	if roots == nil && programOptional() {
+		// Any "--" before the test cases was taken by flag.Parse.
+		roots = fs.Args()
+	}
+	if len(program) == 0 && !programOptional() {
 		usage()
-		log.Fatal("No program specified")
+		fatal(exitError, "No program specified")
 	} else if len(roots) == 0 {
 		usage()
-		log.Fatal("No test cases specified")
+		fatal(exitError, "No test cases specified")
 	}
 
-	ch := make(chan Test, 10)
-	go findTests(roots, ch)
+	if shardSpec != "" {
+		if e := parseShard(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if pprofAddr != "" {
+		if e := startPprof(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if e := startProfiles(); e != nil {
+		fatal(exitError, e)
+	}
+	if csvPath != "" {
+		if e := openCSV(csvPath); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if catalogPath != "" {
+		if e := loadCatalog(catalogPath); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if e := checkANSI(); e != nil {
+		fatal(exitError, e)
+	}
+	if e := checkBackend(); e != nil {
+		fatal(exitError, e)
+	}
+	if e := parseWhitespace(whitespaceSpec, &Whitespace{}); e != nil {
+		fatal(exitError, e)
+	}
+	if repeatCount < 1 {
+		fatal(exitError, "-count must be at least 1")
+	} else if checkDeterminism && soakCount > 1 {
+		fatal(exitError, "-determinism cannot be used with -soak")
+	}
+	if mergeOutput && ignoreStderr {
+		fatal(exitError, "-ignore-stderr cannot be used with -merge")
+	} else if mergeOutput && ignoreStdout {
+		fatal(exitError, "-ignore-stdout cannot be used with -merge")
+	}
+	if ptySpec != "" {
+		if e := parsePty(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if workerAddrs != "" && buildCmd != "" {
+		fatal(exitError, "-build cannot be used with -workers")
+	}
+	if maxOutputSpec != "" {
+		if e := parseMaxOutput(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if memoryMaxSpec != "" {
+		if e := parseMemoryMax(); e != nil {
+			fatal(exitError, e)
+		}
+	} else if cgroupParent != "" {
+		fatal(exitError, "-cgroup requires -memory-max")
+	}
+	if exitCodesPath != "" {
+		if e := loadExitCodes(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if quarantinePath != "" {
+		if e := loadQuarantine(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	var previous []Result
+	if compareTo != "" {
+		var e error
+		if previous, e = readReport(compareTo); e != nil {
+			fatal(exitError, e)
+		}
+	}
 
+	started := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	if !serving {
+		handleSignals(cancel)
+	}
+	// ready records whether the tests may be run, once the -before command and
+	// the build are done.
+	ready := true
+	if beforeCmd != "" {
+		if r := runBefore(ctx); r.status != passed {
+			record(r)
+			ready = false
+		}
+	}
+	if buildCmd != "" && ready {
+		if r := buildProgram(program); r.status != passed {
+			record(r)
+			ready = false
+		}
+	}
+	initCache(program)
+	ch := make(chan Test, lookahead)
+	go findTests(ctx, roots, ch)
+	if shardSpec != "" {
+		all := ch
+		ch = make(chan Test, lookahead)
+		go shardTests(ctx, all, ch)
+	}
+
+	runSpan := startSpan("invigilate", nil, started)
+	runSpan.setAttr("program", strings.Join(program, " "))
+	if workerAddrs != "" && ready {
+		// This consumes all the tests, unless interrupted; so the loop below
+		// runs no tests locally.
+		distribute(ctx, ch, program)
+	}
 	for t := range ch {
+		if ctx.Err() != nil || !ready {
+			break
+		}
+		if t.err == nil {
+			loadTest(&t)
+		}
+		selectComment(t)
 		if t.err != nil {
 			log.Print(t.err)
-			errorCount++
+			record(Result{path: t.path, status: errored, category: "read"})
+		} else if e := expandIncludes(&t); e != nil {
+			log.Print(e)
+			record(Result{path: t.path, status: errored, category: "include"})
+		} else if instances, e := expandMatrix(t); e != nil {
+			log.Print(e)
+			record(Result{path: t.path, status: errored, category: "directive"})
 		} else {
-			runTest(t, program)
+			for k := range instances {
+				if ctx.Err() != nil {
+					break
+				}
+				processInstance(ctx, instances[k], program, runSpan)
+				instances[k] = Test{} // drop its content
+			}
+		}
+	}
+	cancel()
+	finishHooks()
+	runAfter()
+	removeBuild()
+	removeTmpDir()
+	runSpan.finish(time.Now())
+
+	if e := closeCSV(); e != nil {
+		log.Print(e)
+		errorCount++
+	}
+	if historyPath != "" {
+		if e := saveHistory(started, results); e != nil {
+			log.Print(e)
+			errorCount++
+		}
+	}
+	if jsonPath != "" {
+		if e := writeReport(jsonPath, started, results); e != nil {
+			log.Print(e)
+			errorCount++
+		}
+	}
+	if e := exportSpans(); e != nil {
+		log.Print(e)
+		errorCount++
+	}
+	if pushgateway != "" {
+		if e := pushMetrics(results); e != nil {
+			log.Print(e)
+			errorCount++
 		}
 	}
+	if e := stopProfiles(); e != nil {
+		log.Print(e)
+		errorCount++
+	}
 
+	if e := reportQuarantine(); e != nil {
+		log.Print(e)
+		errorCount++
+	}
+	if compareTo != "" {
+		fmt.Println()
+		fmt.Printf("Compared with %s:\n", compareTo)
+		compareResults(previous, results).print(os.Stdout)
+	}
+	if dirSummary && len(results) > 0 {
+		printDirSummary(os.Stdout, results)
+	}
+
+	if sig := interrupted(); sig != nil {
+		log.Printf("Interrupted after %d tests: %d failed tests; %d other errors",
+			len(results), failCount, errorCount)
+		return exitCode(sig)
+	}
 	if errorCount > 0 || failCount > 0 {
 		emsg := ""
+		code := exitFailed
 		if errorCount > 0 {
 			emsg = fmt.Sprintf("; %d other errors", errorCount)
+			code = exitError
 		}
-		log.Fatalf("%d failed tests%s", failCount, emsg)
+		runs := ""
+		if failedRuns > 0 {
+			runs = fmt.Sprintf(" (%d of %d runs)", failedRuns, repeatedRuns)
+		}
+		log.Printf("%d failed tests%s%s", failCount, runs, emsg)
+		return code
+	}
+	if len(results) == 0 {
+		log.Print("No tests found")
+		return exitNoTests
 	}
 
 	if verbose {
 		fmt.Println()
 		fmt.Println("All tests passed.")
 	}
+	return 0
+}
+
+// processInstance checks and runs an instance of a test case file, as given
+// by the matrix directives in it, and records the results of the test cases
+// it holds.
+func processInstance(ctx context.Context, t Test, program []string, runSpan *Span) {
+	if e := substitute(&t); e != nil {
+		log.Print(e)
+		record(Result{path: t.path, status: errored, category: "directive"})
+	} else if e := checkDirectives(t); e != nil {
+		log.Print(e)
+		record(Result{path: t.path, status: errored, category: "directive"})
+	} else if e := resolveMessages(&t); e != nil {
+		log.Print(e)
+		record(Result{path: t.path, status: errored, category: "catalog"})
+	} else if cases, e := splitCases(t); e != nil {
+		log.Print(e)
+		record(Result{path: t.path, status: errored, category: "directive"})
+	} else {
+		for j, c := range cases {
+			for k := 1; k <= repeatCount && ctx.Err() == nil; k++ {
+				r := processTest(ctx, c, program, runSpan)
+				if repeatCount > 1 {
+					r.iteration = k
+					if r.status != passed {
+						log.Printf("%s: run %d of %d", r.path, k, repeatCount)
+					}
+				}
+				if r.title = testTitle(c); r.title != "" && r.status != passed {
+					log.Printf("%s: title: %s", r.path, r.title)
+				}
+				record(r)
+			}
+			cases[j] = Test{} // drop its content
+		}
+	}
+}
+
+// processTest runs a test case, unless it is known to pass from the result cache,
+// and handles the bookkeeping around running it. Cancelling ctx kills the test.
+func processTest(ctx context.Context, t Test, program []string, runSpan *Span) Result {
+	program, e := testProgram(t, program)
+	if e != nil {
+		log.Printf("%s: %s", t.path, e)
+		return Result{path: t.path, status: errored, category: "setup"}
+	}
+	key := cacheKey(t, program)
+	if isCached(key) {
+		if verbose {
+			fmt.Println()
+			fmt.Println(displayName(t), "(cached)")
+		}
+		return Result{path: t.path, status: passed, cached: true}
+	}
+	if e := enterHooks(t.source()); e != nil {
+		log.Printf("%s: %s", t.path, e)
+		return Result{path: t.path, status: errored, category: "setup"}
+	}
+
+	span := startSpan(t.path, runSpan, t.found)
+	// The discovery span runs from finding the file until its content was read.
+	startSpan("discovery", span, t.found).finish(t.loaded.Add(t.reading))
+	var r Result
+	run, compileErr := program, error(nil)
+	if compileCmd != "" {
+		var exe string
+		exe, compileErr = compileTest(ctx, t)
+		if exe != "" {
+			defer os.RemoveAll(filepath.Dir(exe))
+		}
+		run = withCompiled(program, exe)
+	}
+	if compileErr != nil {
+		log.Printf("%s: %s", t.path, compileErr)
+		r = Result{path: t.path, status: failed, category: "compile"}
+	} else if soakCount > 1 {
+		r = soakTest(ctx, t, run, span)
+	} else if checkDeterminism {
+		r = determinismTest(ctx, t, run, span)
+	} else {
+		r = runTest(ctx, t, run, span)
+	}
+	if ctx.Err() != nil && r.status != passed {
+		r.status, r.category = errored, "interrupted"
+	} else if invariantCmd != "" {
+		r = checkInvariant(r)
+	}
+	r.cold = !ranTest
+	ranTest = true
+	span.setAttr("status", r.status)
+	if first, ok := r.transcript.firstOutput(); ok {
+		span.setAttr("first_output_ms", fmt.Sprint(first.Milliseconds()))
+	}
+	if r.status != passed {
+		span.setError(r.category)
+	}
+	span.finish(time.Now())
+
+	if r.status == passed {
+		storeCached(key)
+	}
+	if bundleDir != "" && r.status == failed {
+		if e := writeBundle(t, r, program); e != nil {
+			log.Printf("%s: writing reproducer bundle: %s", t.path, e)
+			errorCount++
+		}
+	}
+	if showTranscript && r.status == failed {
+		logTranscript(t, r)
+	}
+	if artifactsDir != "" && r.status == failed {
+		if e := writeArtifacts(t, r, program); e != nil {
+			log.Printf("%s: writing artifacts: %s", t.path, e)
+			errorCount++
+		}
+	}
+	if saveActual && r.status == failed {
+		if e := writeActual(t, r); e != nil {
+			log.Printf("%s: saving actual output: %s", t.path, e)
+			errorCount++
+		}
+	}
+	if replayDir != "" && r.status == failed {
+		if e := writeReplay(t, program); e != nil {
+			log.Printf("%s: writing replay script: %s", t.path, e)
+			errorCount++
+		}
+	}
+	// The transcript, which may be large, is not kept with the result.
+	r.transcript = nil
+	return r
 }
 
-// findTests finds the test cases to be executed
-func findTests(roots []string, ch chan <-Test) {
+// ranTest records whether any test has been run yet, rather than taken from the cache.
+var ranTest bool
+
+// findTests finds the test cases to be executed, and sends them on ch.
+// It stops early if ctx is cancelled.
+func findTests(ctx context.Context, roots []string, ch chan <-Test) {
+	defer close(ch)
 	for _, r := range roots {
 		info, e := os.Lstat(r)
 		if e != nil {
-			ch <- Test{r, "", e}
+			if !sendTest(ctx, Test{path: r, err: e}, ch) {
+				return
+			}
 			continue
 		}
 		if info.Mode().IsRegular() {
-			reportTest(r, ch)
+			if !reportTest(ctx, r, ch) {
+				return
+			}
 		} else if !info.IsDir() {
-			ch <- Test{r, "", fmt.Errorf("%s is neither a regular file nor a directory", r)}
+			if !sendTest(ctx, Test{path: r, err: fmt.Errorf("%s is neither a regular file nor a directory", r)}, ch) {
+				return
+			}
+		} else if files, ok := testCache.files(r); ok {
+			for _, path := range files {
+				if !reportTest(ctx, path, ch) {
+					return
+				}
+			}
 		} else {
+			// What is found is kept only for the server, and only if the whole tree was searched.
+			stopped, complete := false, testCache != nil
+			tree := cachedTree{dirs: map[string]time.Time{}}
 			filepath.WalkDir(r, func(path string, de fs.DirEntry, err error) error {
 				if err != nil {
-					ch <- Test{path, "", err}
+					stopped, complete = !sendTest(ctx, Test{path: path, err: err}, ch), false
+				} else if de.IsDir() && complete {
+					if info, e := de.Info(); e == nil {
+						tree.dirs[path] = info.ModTime()
+					} else {
+						complete = false
+					}
 				} else if de.Type().IsRegular() {
 					base := filepath.Base(path)
-					if strings.HasSuffix(base, extension) {
-						reportTest(path, ch)
+					if isTestFile(base) {
+						stopped = !reportTest(ctx, path, ch)
+						if complete {
+							tree.files = append(tree.files, path)
+						}
 					}
 				}
+				if stopped {
+					return filepath.SkipAll
+				}
 				return nil
 			})
+			if stopped {
+				return
+			} else if complete {
+				testCache.storeFiles(r, tree)
+			}
+		}
+	}
+}
+
+// lookahead is how many test cases discovery may get ahead of their execution.
+const lookahead = 10
+
+// reportTest lists one test case that should be executed.
+// It returns false if discovery has been stopped.
+func reportTest(ctx context.Context, path string, ch chan <-Test) bool {
+	return sendTest(ctx, Test{path: path, found: time.Now()}, ch)
+}
+
+// loadTest reads the content of a test case file, just before the test is run.
+// The content is dropped once the test has been run, so that only the test cases
+// being run at the moment are held in memory; except that the server keeps it
+// in testCache for later runs.
+func loadTest(t *Test) {
+	t.loaded = time.Now()
+	if info, e := os.Stat(t.path); e != nil {
+		t.err = e
+	} else if info.Size() > streamThreshold {
+		t.streamed = true
+	} else if content, ok := testCache.content(t.path, info); ok {
+		t.content = content
+	} else {
+		data, e := os.ReadFile(t.path)
+		t.content, t.err = string(data), e
+		if e == nil {
+			testCache.storeContent(t.path, info, t.content)
+		}
+	}
+	t.reading = time.Since(t.loaded)
+}
+
+// sendTest passes a test case on for execution, unless ctx is cancelled first.
+// It returns false if discovery has been stopped.
+func sendTest(ctx context.Context, t Test, ch chan <-Test) bool {
+	select {
+	case ch <- t:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// drainTime is how long to wait for error output that may already have been produced,
+// when checking for error output expected only at exit.
+const drainTime = 20 * time.Millisecond
+
+// runTest runs a single test case, recording its progress in span.
+// If ctx is cancelled, the program is killed.
+func runTest(ctx context.Context, t Test, program []string, span *Span) (r Result) {
+	r = Result{path: t.path, status: passed, transcript: newTranscript(transcriptStreams(t))}
+	started := time.Now()
+	defer func() {
+		r.duration = time.Since(started)
+		r.firstOutput, _ = r.transcript.firstOutput()
+	}()
+
+	args, rl := testCommand(program, t.source()), testRlimits(t)
+	size, onTerminal := testTerminal(t)
+	merged, ignoreOuts, ignoreErrs := testMerged(t), testIgnoresStdout(t), testIgnoresStderr(t)
+	sorted, ws, lenient := testSorted(t), testWhitespace(t), testLenientNewline(t)
+	ss, comparator, volumes := testScrubs(t), testComparator(t), testVolumes(t)
+	var ct *Container
+	var cg *Cgroup
+	companions, e := readCompanions(t.path)
+	if e != nil {
+		log.Printf("%s: reading companion file: %s", t.path, e)
+		r.status, r.category = errored, "setup"
+		return
+	}
+	var stdinText string
+	if stdinInput {
+		if companions.input != "" || hasInputLines(t) {
+			log.Printf("%s: input cannot be given with -stdin", t.path)
+			r.status, r.category = errored, "directive"
+			return
+		} else if stdinText, e = programText(t); e != nil {
+			log.Printf("%s: %s", t.path, e)
+			r.status, r.category = errored, "setup"
+			return
+		}
+	}
+	path := t.source()
+	if needsCopy(t) {
+		tmp, e := os.MkdirTemp("", "invigilate-copy")
+		if e == nil {
+			defer os.RemoveAll(tmp)
+			path, e = writeCopy(t, tmp)
+		}
+		if e != nil {
+			log.Printf("%s: writing copy of test case: %s", t.path, e)
+			r.status, r.category = errored, "setup"
+			return
+		}
+		args = testCommand(program, path)
+	}
+	files, e := testFileChecks(t)
+	if e != nil {
+		log.Printf("%s: %s", t.path, e)
+		r.status, r.category = errored, "setup"
+		return
+	}
+	dir := testCwd(t)
+	if fixtures := testFixtures(t); len(fixtures) > 0 && dir != "" {
+		log.Printf("%s: cwd and fixture directives cannot both be given", t.path)
+		r.status, r.category = errored, "directive"
+		return
+	} else if len(fixtures) > 0 || (len(files) > 0 || hasDirective(t, "contents")) && dir == "" {
+		// Files left by an earlier run must not be mistaken for the program's.
+		if dir, e = makeSandbox(t, fixtures); e != nil {
+			log.Printf("%s: %s", t.path, e)
+			r.status, r.category = errored, "setup"
+			return
+		}
+		defer os.RemoveAll(dir)
+	}
+	if dir != "" {
+		if info, e := os.Stat(dir); e != nil {
+			log.Printf("%s: working directory: %s", t.path, e)
+			r.status, r.category = errored, "setup"
+			return
+		} else if !info.IsDir() {
+			log.Printf("%s: working directory: %s is not a directory", t.path, dir)
+			r.status, r.category = errored, "setup"
+			return
+		}
+		absProgram, absPath, e := absCommand(program, path)
+		if e != nil {
+			log.Printf("%s: working directory: %s", t.path, e)
+			r.status, r.category = errored, "setup"
+			return
 		}
+		args = testCommand(absProgram, absPath)
 	}
-	close(ch)
-}
-
-// reportTest lists one test case that should be executed
-func reportTest(path string, ch chan <-Test) {
-	content, e := os.ReadFile(path)
-	if e != nil {
-		ch <- Test{path, "", e}
+	if merged && (ignoreOuts || ignoreErrs) {
+		log.Printf("%s: output cannot be both merged and ignored", t.path)
+		r.status, r.category = errored, "directive"
 		return
 	}
-	ch <- Test{path, string(content), nil}
-}
-
-// Type Deadliner has os.File.SetDeadline
-type Deadliner interface {
-	SetDeadline(time.Time) error
-}
-
-// runTest runs a single test case
-func runTest(t Test, program []string) {
-	cmd := exec.Command(program[0], append(program[1:], t.path)...)
+	if backend == "docker" && onTerminal {
+		log.Printf("%s: a pseudo-terminal cannot be used with -backend docker", t.path)
+		r.status, r.category = errored, "setup"
+		return
+	} else if backend == "docker" {
+		if args, ct, e = dockerCommand(args, path, dir, rl); e != nil {
+			log.Printf("%s: setting up container: %s", t.path, e)
+			r.status, r.category = errored, "setup"
+			return
+		}
+		defer ct.remove()
+	}
+	cmd := commandContext(ctx, args)
+	newProcessGroup(cmd)
+	if ct == nil {
+		cmd.Dir = dir
+		if e = limitCommand(cmd, rl); e != nil {
+			log.Printf("%s: setting resource limits: %s", t.path, e)
+			r.status, r.category = errored, "setup"
+			return
+		}
+		if cg, e = memoryCgroup(cmd); e != nil {
+			log.Printf("%s: setting memory limit: %s", t.path, e)
+			r.status, r.category = errored, "setup"
+			return
+		}
+		defer cg.remove()
+	}
 	deadline := time.Now().Add(limit)
 
 	var iPipe io.WriteCloser
 	var oPipe, ePipe io.ReadCloser
 	pipeError := func(msg string, err error) {
 		log.Printf("error %s for %s: %s", msg, t.path, err)
-		errorCount++
+		r.status, r.category = errored, "setup"
 		if iPipe != nil {
 			iPipe.Close()
 			cmd.Stdin.(io.Closer).Close()
@@ -211,103 +1513,148 @@ func runTest(t Test, program []string) {
 		}
 	}
 
-	var e error
-	if iPipe, e = cmd.StdinPipe(); e != nil {
-		pipeError("opening input pipe", e)
-		return
-	}
-	if e = iPipe.(Deadliner).SetDeadline(deadline); e != nil {
-		pipeError("setting input deadline", e)
-		return
-	}
-
-	if oPipe, e = cmd.StdoutPipe(); e != nil {
-		pipeError("opening output pipe", e)
-		return
-	}
-	if e = oPipe.(Deadliner).SetDeadline(deadline); e != nil {
-		pipeError("setting output deadline", e)
-		return
+	if onTerminal {
+		master, tty, e := openTerminal(size)
+		if e != nil {
+			pipeError("opening terminal", e)
+			return
+		}
+		runOnTerminal(cmd, tty)
+		iPipe, oPipe = &Terminal{f: master}, terminalOutput{master}
+	} else {
+		if iPipe, e = cmd.StdinPipe(); e != nil {
+			pipeError("opening input pipe", e)
+			return
+		}
+		if oPipe, e = cmd.StdoutPipe(); e != nil {
+			pipeError("opening output pipe", e)
+			return
+		}
 	}
-
-	if ePipe, e = cmd.StderrPipe(); e != nil {
+	if merged {
+		// The same pipe, so that the output is received in the order written.
+		cmd.Stderr = cmd.Stdout
+	} else if ePipe, e = cmd.StderrPipe(); e != nil {
 		pipeError("opening error output pipe", e)
 		return
 	}
-	if e = ePipe.(Deadliner).SetDeadline(deadline); e != nil {
-		pipeError("setting error output deadline", e)
-		return
-	}
 
-	// From here on, cmd.Start and cmd.Wait will close the pipes for us.
+	// From here on, cmd.Start and cmd.Wait will close the pipes for us,
+	// except for a terminal.
 	// Also, any errors occurring after this point will be considered test failures.
 
+	r.command = describeCommand(args, cmd)
 	if verbose {
 		fmt.Println()
-		fmt.Println(t.path)
+		fmt.Println(displayName(t))
+		fmt.Println("$", r.command)
 	}
 
+	procSpan := startSpan("process", span, time.Now())
 	if e = cmd.Start(); e != nil {
 		log.Printf("%s: %s\n", t.path, e)
-		failCount++
+		r.status, r.category = failed, "start"
+		procSpan.setError(e.Error())
+		procSpan.finish(time.Now())
+		if onTerminal {
+			iPipe.Close()
+			cmd.Stdin.(io.Closer).Close()
+		}
 		return
 	}
+	if onTerminal {
+		// The program has the terminal now; we only need the controlling side.
+		cmd.Stdin.(io.Closer).Close()
+	}
+	setRunning(cmd)
+	defer setRunning(nil)
+	matchSpan := startSpan("matcher", span, time.Now())
 
-	fail := func() {
-		failCount++
+	fail := func(category string) {
+		r.status, r.category = failed, category
+		matchSpan.setError(category)
+		matchSpan.finish(time.Now())
+		procSpan.finish(time.Now())
 		iPipe.Close()
 		oPipe.Close()
-		ePipe.Close()
-		go func(cmd *exec.Cmd) {
-			time.Sleep(50 * time.Millisecond)
-			if cmd.Process != nil {
-				cmd.Process.Kill()
-			}
-			cmd.Wait()
-		}(cmd)
+		if ePipe != nil {
+			ePipe.Close()
+		}
+		killProcessGroup(cmd)
+		go cmd.Wait()
 		cmd = nil
 	}
 
 	faile := func(msg string, e error) {
+		var ole *OutputLimitError
 		if errors.Is(e, os.ErrDeadlineExceeded) {
-			log.Printf("%s: time limit exceeded", t.path)
+			log.Printf("%s: time limit exceeded%s", t.path, stopGracefully(cmd))
+			fail("timeout")
+			return
+		} else if errors.As(e, &ole) {
+			what := "output"
+			if ole.stream == '!' {
+				what = "error output"
+			}
+			log.Printf("%s: %s: %s", t.path, what, e)
+			log.Printf("%s began: %s", what, printable(ole.excerpt))
+			fail("output limit")
+			return
 		} else if e != nil {
 			log.Printf("%s: %s: %s", t.path, msg, e)
 		}
-		fail()
+		fail("io")
 	}
 
-	buf := make([]byte, 65536)
-	expect := func(pipe io.ReadCloser, what, want string, got *string) bool {
+	limit := newOutputLimit()
+	outs := newStream(oPipe, '>', r.transcript, ignoreOuts, limit)
+	defer outs.stop()
+	outs.ws, outs.newline = newWhitespaceFilter(ws), lenient
+	outs.scrub = newScrubFilter(ss)
+	errs, errWhat := outs, "test output"
+	if !merged {
+		errs, errWhat = newStream(ePipe, '!', r.transcript, ignoreErrs, limit), "test error output"
+		defer errs.stop()
+		errs.ws, errs.newline = newWhitespaceFilter(ws), lenient
+		errs.scrub = newScrubFilter(ss)
+	}
+	expect := func(s *Stream, what, want string) bool {
 		for same, done := 0, false;; {
-			for same < len(want) && same < len(*got) {
-				if want[same] == (*got)[same] {
+			have := s.pending()
+			for same < len(want) && same < len(have) {
+				if want[same] == have[same] {
 					same++
 				} else {
-					have := *got
-					if n := strings.IndexByte(have, '\n'); n >= 0 {
-						have = have[:n+1]
-					}
 					log.Printf("%s: incorrect %s", t.path, what)
-					log.Printf("expected: %s", want)
-					log.Printf("  actual: %s", have)
-					fail()
+					if binaryData(want) || binaryData(have) {
+						logHexDiff(want, have, same)
+					} else {
+						if n := bytes.IndexByte(have, '\n'); n >= 0 {
+							have = have[:n+1]
+						}
+						log.Printf("expected: %s", printable(want))
+						log.Printf("  actual: %s", printable(have))
+					}
+					fail(strings.TrimPrefix(what, "test "))
 					return false
 				}
 			}
 			if same >= len(want) {
-				*got = (*got)[len(want):]
+				s.consume(len(want))
 				return true
 			}
 			if done {
 				log.Printf("%s: incomplete %s", t.path, what)
-				log.Printf("expected: %s", want)
-				log.Printf("  actual: %s", *got)
-				fail()
+				if binaryData(want) || binaryData(have) {
+					logHexDiff(want, have, same)
+				} else {
+					log.Printf("expected: %s", printable(want))
+					log.Printf("  actual: %s", printable(have))
+				}
+				fail(strings.TrimPrefix(what, "test "))
 				return false
 			}
-			n, e := pipe.Read(buf)
-			*got += string(buf[:n])
+			_, e := s.read(deadline)
 			if e == io.EOF {
 				done = true
 			} else if e != nil {
@@ -317,24 +1664,303 @@ func runTest(t Test, program []string) {
 		}
 	}
 
-	lines := strings.SplitAfter(t.content, "\n")
+	// search skips output until the needle is found, and then to the end of its line.
+	search := func(s *Stream, what, needle string) bool {
+		found := false
+		for {
+			have := s.pending()
+			if !found {
+				if n := bytes.Index(have, []byte(needle)); n >= 0 {
+					s.consume(n + len(needle))
+					have, found = s.pending(), true
+				} else if len(have) >= len(needle) {
+					s.consume(len(have) - len(needle) + 1)
+				}
+			}
+			if found {
+				if n := bytes.IndexByte(have, '\n'); n >= 0 {
+					s.consume(n + 1)
+					return true
+				}
+				s.consume(len(have))
+			}
+			_, e := s.read(deadline)
+			if e == io.EOF && found {
+				return true
+			} else if e == io.EOF {
+				log.Printf("%s: %s does not contain: %s", t.path, what, printable(needle))
+				fail(strings.TrimPrefix(what, "test "))
+				return false
+			} else if e != nil {
+				faile("reading " + what, e)
+				return false
+			}
+		}
+	}
+	// matchUnordered matches the lines expected in an unordered block.
+	matchUnordered := func(s *Stream, what string, want []string) bool {
+		var have []string
+		for len(have) < len(want) {
+			line, e := s.readLine(deadline)
+			if e == io.EOF {
+				log.Printf("%s: incomplete %s in unordered block", t.path, what)
+				log.Printf("expected %d more lines", len(want) - len(have))
+				fail(strings.TrimPrefix(what, "test "))
+				return false
+			} else if e != nil {
+				faile("reading " + what, e)
+				return false
+			}
+			have = append(have, line)
+		}
+		if missing, unexpected, same := unorderedDiff(want, have); !same {
+			log.Printf("%s: incorrect %s in unordered block", t.path, what)
+			log.Printf("expected: %s", printable(missing))
+			log.Printf("  actual: %s", printable(unexpected))
+			fail(strings.TrimPrefix(what, "test "))
+			return false
+		}
+		return true
+	}
+	// matchJSON matches the JSON value expected in a JSON block.
+	matchJSON := func(s *Stream, what string, want []string, ignore []string) bool {
+		var have []byte
+		for {
+			if complete, e := jsonStatus(have); complete {
+				break
+			} else if e != nil {
+				log.Printf("%s: %s in JSON block is not valid JSON: %s", t.path, what, e)
+				log.Printf("  actual: %s", printable(have))
+				fail(strings.TrimPrefix(what, "test "))
+				return false
+			}
+			line, e := s.readLine(deadline)
+			if e == io.EOF {
+				log.Printf("%s: incomplete %s in JSON block", t.path, what)
+				log.Printf("  actual: %s", printable(have))
+				fail(strings.TrimPrefix(what, "test "))
+				return false
+			} else if e != nil {
+				faile("reading " + what, e)
+				return false
+			}
+			have = append(have, line...)
+		}
+		if diff, e := jsonDiff(strings.Join(want, ""), string(have), ignore); e != nil {
+			log.Printf("%s: %s", t.path, e)
+			r.status, r.category = errored, "directive"
+			return false
+		} else if diff != "" {
+			log.Printf("%s: incorrect %s in JSON block", t.path, what)
+			log.Printf("%s", diff)
+			fail(strings.TrimPrefix(what, "test "))
+			return false
+		}
+		return true
+	}
+	// matchChecksum matches all the remaining output against its SHA-256 checksum.
+	matchChecksum := func(s *Stream, what, want string) bool {
+		have, e := s.checksum(deadline)
+		if e != nil {
+			faile("reading " + what, e)
+			return false
+		} else if have != want {
+			log.Printf("%s: incorrect checksum of %s", t.path, what)
+			log.Printf("expected: %s", want)
+			log.Printf("  actual: %s", have)
+			fail(strings.TrimPrefix(what, "test "))
+			return false
+		}
+		return true
+	}
+	// block holds the lines expected in an unordered block, for each stream,
+	// while one is being read; nil otherwise.
+	var block map[*Stream][]string
+	// jsonBlock holds the lines expected in a JSON block, for each stream,
+	// while one is being read; nil otherwise. jsonIgnore lists the fields it ignores.
+	var jsonBlock map[*Stream][]string
+	var jsonIgnore []string
+	// contents holds the contents block being read, if any; contentsChecks
+	// those already read, which are matched once the program has exited.
+	var contents *ContentsCheck
+	var contentsChecks []ContentsCheck
+	// unsorted holds the lines expected on each stream, when they are to be
+	// compared sorted, once all the output has been received.
+	unsorted := map[*Stream][]string{}
+	// compared holds the lines expected on each stream, when they are to be
+	// compared by the comparator command, once all the output has been received.
+	compared := map[*Stream][]string{}
+	if comparator != "" && !ignoreOuts {
+		compared[outs] = nil
+	}
+	if comparator != "" && !ignoreErrs {
+		compared[errs] = nil
+	}
+
+	// skipRest records the streams whose remaining output is to be skipped,
+	// since the last line expecting output from them was a search.
+	skipRest := map[*Stream]bool{}
+
 	reads := 0
 	readPrefix := comment + "<"
-	for _, line := range lines {
+	var atExit []string
+	var within time.Duration
+	var wantSignal os.Signal
+	var wantStatus *ExitStatuses
+	forbidden := map[byte][]string{}
+	inContents := false
+	lr := t.lines()
+	for lr.scan() {
+		line := lr.text()
 		if strings.HasPrefix(line, readPrefix) {
 			reads++
+		} else if strings.HasPrefix(line, comment + "?") {
+			wantStatus, _ = parseExitStatuses(line[len(comment)+1:])
+		} else if strings.HasPrefix(line, comment + ">") || strings.HasPrefix(line, comment + "!") {
+			if text, ok := forbiddenText(line[len(comment)+1:]); ok && !inContents {
+				forbidden[line[len(comment)]] = append(forbidden[line[len(comment)]], text)
+			}
+		} else if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			switch name, arg := splitDirective(line[len(comment):]); name {
+			case "at-exit":
+				data := arg[1:]
+				if strings.HasSuffix(line, "\n") {
+					data += "\n"
+				}
+				if data = ws.normalize(data); lenient {
+					data = withNewline(data)
+				}
+				if data != "" {
+					atExit = append(atExit, data)
+				}
+			case "first-output-within":
+				within, _ = parseFirstOutput(arg)
+			case "killed":
+				wantSignal, _ = parseSignal(arg)
+			case "contents", "end-contents":
+				inContents = name == "contents"
+			}
 		}
 	}
+	if e := lr.close(); e != nil {
+		faile("reading test case", e)
+		return
+	}
+	if companions.input != "" {
+		reads++
+	}
 
-	var ogot, egot string
-	erred := false
-	for _, line := range lines {
-		if reads == 0 {
-			if e := iPipe.Close(); e != nil {
-				faile("closing test input", e)
-				return
+	erred := len(atExit) > 0
+	if ignoreErrs {
+		atExit = nil
+	}
+
+	// When some error output is expected only at exit, we must know how much
+	// error output was produced before the input was closed. So we read
+	// whatever is available at that point, waiting only a moment.
+	eClosedAt := 0
+	drainErrors := func() bool {
+		until := time.Now().Add(drainTime)
+		for {
+			_, e := errs.read(until)
+			if errors.Is(e, os.ErrDeadlineExceeded) || errors.Is(e, io.EOF) {
+				return true
+			} else if e != nil {
+				faile("reading test error output", e)
+				return false
+			}
+		}
+	}
+
+	endInput := func() error {
+		if term, ok := iPipe.(*Terminal); ok {
+			return writeInput(term, term.endOfInput(), deadline, r.transcript)
+		}
+		return iPipe.Close()
+	}
+	closeInput := func() bool {
+		if len(atExit) > 0 && !drainErrors() {
+			return false
+		}
+		eClosedAt = errs.received
+		if e := endInput(); e != nil {
+			faile("closing test input", e)
+			return false
+		}
+		reads = -1
+		return true
+	}
+
+	// expectData handles data expected on one stream, '>' or '!', which is
+	// matched at once, or added to those to be matched later. Raw data, from a
+	// file, is never a search or forbidden text. It returns false if the test
+	// case has failed.
+	expectData := func(stream byte, data string, raw bool) bool {
+		if _, ok := forbiddenText(data); ok && !raw {
+			// Checked once all the output has been received.
+			return true
+		} else if data = ws.normalize(data); data == "" {
+			// A blank line, when blank lines are ignored, or the end of a file.
+			return true
+		} else if lenient {
+			data = withNewline(data)
+		}
+		s, what, ignored := outs, "test output", ignoreOuts
+		if stream == '!' {
+			erred = true
+			s, what, ignored = errs, errWhat, ignoreErrs
+		}
+		if ignored {
+			return true
+		} else if sum, ok := checksumText(data); ok && !raw {
+			return matchChecksum(s, what, sum)
+		} else if comparator != "" {
+			compared[s] = append(compared[s], data)
+		} else if sorted {
+			unsorted[s] = append(unsorted[s], data)
+		} else if block != nil {
+			block[s] = append(block[s], data)
+		} else if jsonBlock != nil {
+			jsonBlock[s] = append(jsonBlock[s], data)
+		} else if needle, ok := searchText(data); ok && !raw {
+			if !search(s, what, needle) {
+				return false
+			}
+			skipRest[s] = true
+		} else if !expect(s, what, data) {
+			return false
+		} else {
+			skipRest[s] = false
+		}
+		return true
+	}
+
+	// feedInput writes all the input at once, and closes the input, while the
+	// output is matched; written receives any error once it is done.
+	var written chan error
+	feedInput := func(data string) {
+		reads = -1
+		written = make(chan error, 1)
+		go func() {
+			if e := writeInput(iPipe, data, deadline, r.transcript); e != nil {
+				written <- e
+			} else if e := endInput(); e != nil {
+				written <- fmt.Errorf("closing test input: %w", e)
 			}
-			reads = -1
+			close(written)
+		}()
+	}
+	if stdinInput {
+		// The test case itself is the input, matched against all its output.
+		feedInput(stdinText)
+	}
+
+	lr = t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if reads == 0 && !closeInput() {
+			return
 		}
 		if !strings.HasPrefix(line, comment) || len(line) < len(comment) + 2 {
 			continue
@@ -350,100 +1976,423 @@ func runTest(t Test, program []string) {
 			}
 		}
 
+		if isDirective(line) {
+			switch name, arg := splitDirective(line); name {
+			case "signal":
+				if verbose {
+					fmt.Println(strings.TrimSuffix(line, "\n"))
+				}
+				sig, _ := parseSignal(arg)
+				if e := cmd.Process.Signal(sig); e != nil {
+					log.Printf("%s: sending SIG%s: %s", t.path, strings.TrimPrefix(arg, "SIG"), e)
+					fail("signal")
+					return
+				}
+			case "unordered":
+				block = map[*Stream][]string{}
+			case "end-unordered":
+				for _, s := range []*Stream{outs, errs} {
+					if want := block[s]; len(want) > 0 {
+						what := "test output"
+						if s != outs {
+							what = errWhat
+						}
+						if !matchUnordered(s, what, want) {
+							return
+						}
+						skipRest[s] = false
+						delete(block, s)
+					}
+				}
+				block = nil
+			case "contents":
+				contents = &ContentsCheck{path: arg}
+			case "end-contents":
+				contentsChecks = append(contentsChecks, *contents)
+				contents = nil
+			case "json":
+				jsonBlock = map[*Stream][]string{}
+				jsonIgnore, _ = parseJSONIgnore(arg)
+			case "end-json":
+				for _, s := range []*Stream{outs, errs} {
+					if want := jsonBlock[s]; len(want) > 0 {
+						what := "test output"
+						if s != outs {
+							what = errWhat
+						}
+						if !matchJSON(s, what, want, jsonIgnore) {
+							return
+						}
+						skipRest[s] = false
+						delete(jsonBlock, s)
+					}
+				}
+				jsonBlock = nil
+			}
+			continue
+		}
+
 		data := line[1:]
 		switch line[0] {
 		case '<':
 			reads--
-			for k := 0; k < len(data); {
-				if n, e := io.WriteString(iPipe, data[k:]); e != nil {
-					faile("writing to test input", e)
+			if ref, ok := fileReference(data); ok {
+				content, e := readReference(t, ref)
+				if e != nil {
+					log.Printf("%s: %s", t.path, e)
+					r.status, r.category = errored, "setup"
 					return
-				} else {
-					k += n
 				}
+				data = content
+			} else if decoded, ok, _ := encodedData(data); ok {
+				data = decoded
 			}
-		case '>':
-			if !expect(oPipe, "test output", data, &ogot) {
+			if e := writeInput(iPipe, data, deadline, r.transcript); e != nil {
+				faile("writing to test input", e)
 				return
 			}
-		case '!':
-			erred = true
-			if !expect(ePipe, "test error output", data, &egot) {
+		case '>', '!':
+			if contents != nil {
+				// Matched once the program has exited.
+				contents.lines = append(contents.lines, data)
+			} else if ref, ok := fileReference(data); ok {
+				content, e := readReference(t, ref)
+				if e != nil {
+					log.Printf("%s: %s", t.path, e)
+					r.status, r.category = errored, "setup"
+					return
+				}
+				for _, data := range strings.SplitAfter(content, "\n") {
+					if !expectData(line[0], data, true) {
+						return
+					}
+				}
+			} else if decoded, ok, _ := encodedData(data); ok {
+				if !expectData(line[0], decoded, true) {
+					return
+				}
+			} else if !expectData(line[0], data, false) {
 				return
 			}
 		}
 	}
 
+	if e := lr.close(); e != nil {
+		faile("reading test case", e)
+		return
+	}
+
+	// The input from a companion file is written, and the input closed, while
+	// the expected output from companion files is matched, since a program with
+	// much of both may not read all its input before writing its output. Error
+	// output expected at exit may then come at any time before the exit.
+	if companions.input != "" {
+		feedInput(companions.input)
+	}
+	for _, data := range strings.SplitAfter(companions.output, "\n") {
+		if !expectData('>', data, true) {
+			return
+		}
+	}
+	for _, data := range strings.SplitAfter(companions.errors, "\n") {
+		if !expectData('!', data, true) {
+			return
+		}
+	}
+	if written != nil {
+		if e := <-written; e != nil {
+			faile("writing to test input", e)
+			return
+		}
+	}
+
 	if reads > 0 {
 		panic("bug")
 	} else if reads == 0 {
-		// Should only happen for an empty test case.
-		if e := iPipe.Close(); e != nil {
-			faile("closing test input", e)
+		// The last input was on the last line, or in a companion file.
+		if !closeInput() {
+			return
+		}
+	}
+
+	if comparator != "" && !ignoreErrs && len(atExit) > 0 {
+		compared[errs] = append(compared[errs], atExit...)
+		atExit = nil
+	} else if sorted && !ignoreErrs && len(atExit) > 0 {
+		unsorted[errs] = append(unsorted[errs], atExit...)
+		atExit = nil
+	}
+	for _, s := range []*Stream{outs, errs} {
+		want, ok := compared[s]
+		if !ok {
+			continue
+		}
+		delete(compared, s)
+		for {
+			if _, e := s.read(deadline); e == io.EOF {
+				break
+			} else if e != nil {
+				faile("reading output", e)
+				return
+			}
+		}
+		have := string(s.pending())
+		s.consume(len(have))
+		if len(want) == 0 && have == "" {
+			continue
+		}
+		what := "test output"
+		if s != outs {
+			what = errWhat
+		}
+		same, msg, e := runComparator(ctx, comparator, strings.Join(want, ""), have, deadline)
+		if e != nil {
+			faile("running comparator", e)
+			return
+		} else if !same {
+			log.Printf("%s: comparator rejected %s", t.path, what)
+			if msg != "" {
+				log.Print(msg)
+			}
+			fail(strings.TrimPrefix(what, "test "))
+			return
+		}
+	}
+	for _, s := range []*Stream{outs, errs} {
+		want, ok := unsorted[s]
+		if !ok {
+			continue
+		}
+		delete(unsorted, s)
+		var have []string
+		for {
+			line, e := s.readLine(deadline)
+			if e == io.EOF {
+				break
+			} else if e != nil {
+				faile("reading output", e)
+				return
+			}
+			have = append(have, line)
+		}
+		if missing, unexpected, same := unorderedDiff(want, have); !same {
+			what := "test output"
+			if s != outs {
+				what = errWhat
+			}
+			if missing == "" {
+				log.Printf("%s: extra %s, with lines sorted: %s", t.path, strings.TrimPrefix(what, "test "), printable(unexpected))
+			} else if unexpected == "" {
+				log.Printf("%s: incomplete %s, with lines sorted", t.path, what)
+				log.Printf("expected: %s", printable(missing))
+			} else {
+				log.Printf("%s: incorrect %s, with lines sorted", t.path, what)
+				log.Printf("expected: %s", printable(missing))
+				log.Printf("  actual: %s", printable(unexpected))
+			}
+			fail(strings.TrimPrefix(what, "test "))
+			return
+		}
+	}
+
+	for _, want := range atExit {
+		if verbose {
+			fmt.Print("at-exit!" + want)
+			if !strings.HasSuffix(want, "\n") {
+				fmt.Println()
+			}
+		}
+		if errs.received - len(errs.pending()) < eClosedAt {
+			have := errs.pending()
+			if n := bytes.IndexByte(have, '\n'); n >= 0 {
+				have = have[:n+1]
+			}
+			log.Printf("%s: error output before input was closed", t.path)
+			log.Printf("expected at exit: %s", printable(want))
+			log.Printf("          actual: %s", printable(have))
+			fail("error output")
+			return
+		}
+		if !expect(errs, errWhat + " at exit", want) {
+			return
+		}
+	}
+
+	// Output on streams whose volume is checked is only counted.
+	for _, v := range volumes {
+		if v.stream == '>' {
+			skipRest[outs] = true
+		} else {
+			skipRest[errs] = true
+		}
+	}
+	for _, s := range []*Stream{outs, errs} {
+		for skipRest[s] {
+			s.consume(len(s.pending()))
+			if _, e := s.read(deadline); e == io.EOF {
+				break
+			} else if e != nil {
+				faile("reading output", e)
+				return
+			}
+		}
+	}
+
+	for _, v := range volumes {
+		s, what := outs, "test output"
+		if v.stream == '!' {
+			s, what = errs, errWhat
+		}
+		n := s.lineCount()
+		if v.bytes {
+			n = uint64(s.received)
+		}
+		if !v.accepts(n) {
+			log.Printf("%s: %s has %d %s, but expected %s", t.path, what, n, v.unit(), v.spec)
+			fail(strings.TrimPrefix(what, "test "))
 			return
 		}
-		reads = -1
 	}
 
-	if ogot == "" {
-		n, e := oPipe.Read(buf[:64])
-		ogot = string(buf[:n])
-		if e != nil && !errors.Is(e, io.EOF) {
+	if len(outs.pending()) == 0 {
+		if _, e := outs.read(deadline); e != nil && !errors.Is(e, io.EOF) {
 			faile("output error", e)
 			return
 		}
 	}
-	if ogot != "" {
-		log.Printf("%s: extra output: %s", t.path, ogot)
-		fail()
+	if extra := outs.pending(); len(extra) > 0 {
+		log.Printf("%s: extra output: %s", t.path, printable(extra))
+		fail("output")
 		return
 	}
 
-	if egot == "" {
-		n, e := ePipe.Read(buf[:64])
-		egot = string(buf[:n])
-		if e != nil && !errors.Is(e, io.EOF) {
+	if len(errs.pending()) == 0 {
+		if _, e := errs.read(deadline); e != nil && !errors.Is(e, io.EOF) {
 			faile("output problem", e)
 			return
 		}
 	}
-	if egot != "" {
-		log.Printf("%s: extra error output: %s", t.path, egot)
-		fail()
+	if extra := errs.pending(); len(extra) > 0 {
+		log.Printf("%s: extra error output: %s", t.path, printable(extra))
+		fail("error output")
 		return
 	}
 
+	for _, stream := range []byte{'>', '!'} {
+		what, from := "test output", byte('>')
+		if stream == '!' && !merged {
+			what, from = "test error output", '!'
+		}
+		output := r.transcript.stream(from)
+		if ansiMode != "" {
+			output = string((&ANSIFilter{}).filter([]byte(output), true))
+		}
+		if text, line, found := findForbidden(output, forbidden[stream]); found {
+			log.Printf("%s: %s contains forbidden text: %s", t.path, what, printable(text))
+			log.Printf("  actual: %s", printable(line))
+			fail(strings.TrimPrefix(what, "test "))
+			return
+		}
+	}
+
+	matchSpan.finish(time.Now())
+
 	if e := oPipe.Close(); e != nil {
 		faile("closing test output", e)
 		return
 	}
-	if e := ePipe.Close(); e != nil {
-		faile("closing test error output", e)
-		return
+	if ePipe != nil {
+		if e := ePipe.Close(); e != nil {
+			faile("closing test error output", e)
+			return
+		}
 	}
 
 	code := 0
-	if e := cmd.Wait(); e != nil {
+	e = cmd.Wait()
+	procSpan.finish(time.Now())
+	r.maxRSS = peakRSS(cmd.ProcessState)
+	if cmd.ProcessState != nil {
+		r.userTime = cmd.ProcessState.UserTime()
+		r.systemTime = cmd.ProcessState.SystemTime()
+	}
+	r.exited = cmd.ProcessState != nil
+	if cg.oomKilled() || ct.oomKilled() {
+		log.Printf("%s: killed for exceeding memory limit of %d bytes", t.path, memoryMax)
+		r.status, r.category = failed, "memory"
+		return
+	}
+	if e != nil {
 		if ee, ok := e.(*exec.ExitError); ok {
 			code = ee.ExitCode()
+			r.exitCode = code
+			procSpan.setAttr("exit.code", fmt.Sprint(code))
 		} else {
 			log.Printf("%s: %s", t.path, e)
-			failCount++
+			r.status, r.category = failed, "exit"
 			return
 		}
 	}
 
-	if erred {
+	if wantSignal != nil {
+		if sig := exitSignal(cmd.ProcessState); sig == nil {
+			log.Printf("%s: expected to be killed by %s, but exit code was %d", t.path, signalName(wantSignal), code)
+			r.status, r.category = failed, "signal"
+			return
+		} else if sig != wantSignal {
+			log.Printf("%s: expected to be killed by %s, but was killed by %s", t.path, signalName(wantSignal), signalName(sig))
+			r.status, r.category = failed, "signal"
+			return
+		}
+	} else if wantStatus != nil {
+		if sig := exitSignal(cmd.ProcessState); sig != nil {
+			log.Printf("%s: expected exit code %s, but was killed by %s", t.path, wantStatus.spec, signalName(sig))
+			r.status, r.category = failed, "exit code"
+			return
+		} else if !wantStatus.accepts(code) {
+			log.Printf("%s: expected exit code %s, but exit code was %d", t.path, wantStatus.spec, code)
+			r.status, r.category = failed, "exit code"
+			return
+		}
+	} else if c, ok := exitCodes[code]; ok && code != 0 {
+		log.Printf("%s: exit code %d (%s)", t.path, code, c.name)
+		r.status, r.category = c.status, c.category
+		return
+	} else if erred {
 		if code == 0 {
 			log.Printf("%s: produced error output but exit code was 0", t.path)
-			failCount++
+			r.status, r.category = failed, "exit code"
 			return
 		}
 	} else {
 		if code != 0 {
 			log.Printf("%s: exit code %d", t.path, code)
-			failCount++
+			r.status, r.category = failed, "exit code"
+			return
+		}
+	}
+
+	for _, fc := range files {
+		if !fc.verify(t, dir) {
+			r.status, r.category = failed, "file"
+			return
+		}
+	}
+	for _, cc := range contentsChecks {
+		if !cc.verify(t, dir) {
+			r.status, r.category = failed, "file"
 			return
 		}
 	}
+
+	if within > 0 {
+		if first, ok := r.transcript.firstOutput(); !ok {
+			log.Printf("%s: no output, but expected first output within %s", t.path, within)
+			r.status, r.category = failed, "latency"
+		} else if first > within {
+			log.Printf("%s: first output after %s, but expected within %s", t.path, first.Round(time.Millisecond), within)
+			r.status, r.category = failed, "latency"
+		}
+	}
+	return
 }
@@ -4,10 +4,22 @@
 package main_test
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/pat42smith/gotest"
 	"github.com/pat42smith/or"
@@ -19,6 +31,9 @@ func TestAll(t *testing.T) {
 	ex := filepath.Join(tmp, "invigilate")
 	gotest.Command("go", "build", "-o", ex).Run(t, "")
 
+	// Most tests expect every test case to be run, so turn off the result cache.
+	t.Setenv("INVIGILATE_CACHE", "off")
+
 	t.Run("Defaults", func (t2 *testing.T) { Defaults(t2, ex) })
 	t.Run("Time Limit", func (t2 *testing.T) { Time(t2, ex) })
 	t.Run("Extension", func (t2 *testing.T) { Extension(t2, ex) })
@@ -27,6 +42,98 @@ func TestAll(t *testing.T) {
 	t.Run("Help", func (t2 *testing.T) { Help(t2, ex) })
 	t.Run("Error", func (t2 *testing.T) { Error(t2, ex) })
 	t.Run("Testee", func (t2 *testing.T) { Testee(t2, ex) })
+	t.Run("Requires", func (t2 *testing.T) { Requires(t2, ex) })
+	t.Run("CSV", func (t2 *testing.T) { CSV(t2, ex) })
+	t.Run("Directives", func (t2 *testing.T) { Directives(t2, ex) })
+	t.Run("History", func (t2 *testing.T) { History(t2, ex) })
+	t.Run("Trace", func (t2 *testing.T) { Trace(t2, ex) })
+	t.Run("Compare", func (t2 *testing.T) { Compare(t2, ex) })
+	t.Run("Pprof", func (t2 *testing.T) { Pprof(t2, ex) })
+	t.Run("Quarantine", func (t2 *testing.T) { Quarantine(t2, ex) })
+	t.Run("Soak", func (t2 *testing.T) { Soak(t2, ex) })
+	t.Run("Shard", func (t2 *testing.T) { Shard(t2, ex) })
+	t.Run("Bundle", func (t2 *testing.T) { Bundle(t2, ex) })
+	t.Run("Cache", func (t2 *testing.T) { Cache(t2, ex) })
+	t.Run("Replay", func (t2 *testing.T) { Replay(t2, ex) })
+	t.Run("At Exit", func (t2 *testing.T) { AtExit(t2, ex) })
+	t.Run("Exit Codes", func (t2 *testing.T) { ExitCodes(t2, ex) })
+	t.Run("Interrupt", func (t2 *testing.T) { Interrupt(t2, ex) })
+	t.Run("Invariant", func (t2 *testing.T) { Invariant(t2, ex) })
+	t.Run("Catalog", func (t2 *testing.T) { Catalog(t2, ex) })
+	t.Run("Grace", func (t2 *testing.T) { Grace(t2, ex) })
+	t.Run("Latency", func (t2 *testing.T) { Latency(t2, ex) })
+	t.Run("Exit Code Classes", func (t2 *testing.T) { ExitCodeClasses(t2, ex) })
+	t.Run("Process Group", func (t2 *testing.T) { ProcessGroup(t2, ex) })
+	t.Run("Forward Signals", func (t2 *testing.T) { ForwardSignals(t2, ex) })
+	t.Run("Signal Directive", func (t2 *testing.T) { SignalDirective(t2, ex) })
+	t.Run("Killed", func (t2 *testing.T) { Killed(t2, ex) })
+	t.Run("Golden", func (t2 *testing.T) { Golden(t2, ex) })
+	t.Run("Rlimit", func (t2 *testing.T) { Rlimit(t2, ex) })
+	t.Run("Resources", func (t2 *testing.T) { Resources(t2, ex) })
+	t.Run("Directory Summary", func (t2 *testing.T) { DirectorySummary(t2, ex) })
+	t.Run("Memory Max", func (t2 *testing.T) { MemoryMax(t2, ex) })
+	t.Run("Validate", func (t2 *testing.T) { Validate(t2, ex) })
+	t.Run("Wrap", func (t2 *testing.T) { Wrap(t2, ex) })
+	t.Run("Docker", func (t2 *testing.T) { Docker(t2, ex) })
+	t.Run("Build", func (t2 *testing.T) { Build(t2, ex) })
+	t.Run("Workers", func (t2 *testing.T) { Workers(t2, ex) })
+	t.Run("Serve", func (t2 *testing.T) { Serve(t2, ex) })
+	t.Run("Pushgateway", func (t2 *testing.T) { Pushgateway(t2, ex) })
+	t.Run("Profiles", func (t2 *testing.T) { Profiles(t2, ex) })
+	t.Run("Large Output", func (t2 *testing.T) { LargeOutput(t2, ex) })
+	t.Run("Large Test", func (t2 *testing.T) { LargeTest(t2, ex) })
+	t.Run("Interleaved Streams", func (t2 *testing.T) { InterleavedStreams(t2, ex) })
+	t.Run("Blocked Input", func (t2 *testing.T) { BlockedInput(t2, ex) })
+	t.Run("Pty", func (t2 *testing.T) { Pty(t2, ex) })
+	t.Run("ANSI", func (t2 *testing.T) { ANSI(t2, ex) })
+	t.Run("Merge", func (t2 *testing.T) { Merge(t2, ex) })
+	t.Run("Ignore Stderr", func (t2 *testing.T) { IgnoreStderr(t2, ex) })
+	t.Run("Ignore Stdout", func (t2 *testing.T) { IgnoreStdout(t2, ex) })
+	t.Run("Exit Statuses", func (t2 *testing.T) { ExitStatuses(t2, ex) })
+	t.Run("Contains", func (t2 *testing.T) { Contains(t2, ex) })
+	t.Run("Unordered", func (t2 *testing.T) { Unordered(t2, ex) })
+	t.Run("Sort", func (t2 *testing.T) { Sort(t2, ex) })
+	t.Run("Whitespace", func (t2 *testing.T) { Whitespace(t2, ex) })
+	t.Run("Lenient Newline", func (t2 *testing.T) { LenientNewline(t2, ex) })
+	t.Run("CRLF", func (t2 *testing.T) { CRLF(t2, ex) })
+	t.Run("JSON", func (t2 *testing.T) { JSON(t2, ex) })
+	t.Run("Scrub", func (t2 *testing.T) { Scrub(t2, ex) })
+	t.Run("Comparator", func (t2 *testing.T) { Comparator(t2, ex) })
+	t.Run("Companion Files", func (t2 *testing.T) { CompanionFiles(t2, ex) })
+	t.Run("File References", func (t2 *testing.T) { FileReferences(t2, ex) })
+	t.Run("Encoded Data", func (t2 *testing.T) { EncodedData(t2, ex) })
+	t.Run("Hexdump", func (t2 *testing.T) { Hexdump(t2, ex) })
+	t.Run("Printable", func (t2 *testing.T) { Printable(t2, ex) })
+	t.Run("Checksum", func (t2 *testing.T) { Checksum(t2, ex) })
+	t.Run("Volume", func (t2 *testing.T) { Volume(t2, ex) })
+	t.Run("Max Output", func (t2 *testing.T) { MaxOutput(t2, ex) })
+	t.Run("Save Actual", func (t2 *testing.T) { SaveActual(t2, ex) })
+	t.Run("Artifacts", func (t2 *testing.T) { Artifacts(t2, ex) })
+	t.Run("Transcript", func (t2 *testing.T) { Transcript(t2, ex) })
+	t.Run("Cwd", func (t2 *testing.T) { Cwd(t2, ex) })
+	t.Run("Fixture", func (t2 *testing.T) { Fixture(t2, ex) })
+	t.Run("File Checks", func (t2 *testing.T) { FileChecks(t2, ex) })
+	t.Run("Contents", func (t2 *testing.T) { Contents(t2, ex) })
+	t.Run("Hooks", func (t2 *testing.T) { Hooks(t2, ex) })
+	t.Run("Before After", func (t2 *testing.T) { BeforeAfter(t2, ex) })
+	t.Run("Compile", func (t2 *testing.T) { Compile(t2, ex) })
+	t.Run("Subcommands", func (t2 *testing.T) { Subcommands(t2, ex) })
+	t.Run("EnvOptions", func (t2 *testing.T) { EnvOptions(t2, ex) })
+	t.Run("ArgsFile", func (t2 *testing.T) { ArgsFile(t2, ex) })
+	t.Run("Stdin", func (t2 *testing.T) { Stdin(t2, ex) })
+	t.Run("Strip", func (t2 *testing.T) { Strip(t2, ex) })
+	t.Run("Shebang", func (t2 *testing.T) { Shebang(t2, ex) })
+	t.Run("Interp", func (t2 *testing.T) { Interp(t2, ex) })
+	t.Run("Comments", func (t2 *testing.T) { Comments(t2, ex) })
+	t.Run("Named Comment", func (t2 *testing.T) { NamedComment(t2, ex) })
+	t.Run("Program Option", func (t2 *testing.T) { ProgramOption(t2, ex) })
+	t.Run("Cases", func (t2 *testing.T) { Cases(t2, ex) })
+	t.Run("Title", func (t2 *testing.T) { Title(t2, ex) })
+	t.Run("Include", func (t2 *testing.T) { Include(t2, ex) })
+	t.Run("Variables", func (t2 *testing.T) { Variables(t2, ex) })
+	t.Run("Matrix", func (t2 *testing.T) { Matrix(t2, ex) })
+	t.Run("Count", func (t2 *testing.T) { Count(t2, ex) })
+	t.Run("Determinism", func (t2 *testing.T) { Determinism(t2, ex) })
 }
 
 // Test some invocations with default arguments.
@@ -51,9 +158,9 @@ expected: right
 expected: Nonsense!
   actual: Blimey!`)
 
-	mustFail("testdata/fail/badorder.test", `time limit exceeded`)
+	mustFail("testdata/fail/badorder.test", `time limit exceeded; program terminated by SIGTERM`)
 
-	mustFail("testdata/fail/toolong.test", `time limit exceeded`)
+	mustFail("testdata/fail/toolong.test", `time limit exceeded; program terminated by SIGTERM`)
 
 	mustFail("testdata/fail/missingoutput.test", `incomplete test output
 expected: beta
@@ -113,6 +220,13 @@ func Time(t *testing.T, invig string) {
 	gotest.Command(invig, "-t", ".7s", "/bin/sh", "--", "testdata/halfsecond.test").Run(t, "")
 
 	cmd := gotest.Command(invig, "-t", ".3s", "/bin/sh", "--", "testdata/halfsecond.test")
+	cmd.WantStderr(`testdata/halfsecond.test: time limit exceeded; program terminated by SIGTERM
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-t", ".3s", "-grace", "0", "/bin/sh", "--", "testdata/halfsecond.test")
 	cmd.WantStderr(`testdata/halfsecond.test: time limit exceeded
 1 failed tests
 `)
@@ -120,6 +234,25 @@ func Time(t *testing.T, invig string) {
 	cmd.Run(t, "")
 }
 
+// Check the handling of SIGTERM after a timeout
+func Grace(t *testing.T, invig string) {
+	t.Setenv("TRAP", "exit 5")
+	cmd := gotest.Command(invig, "-t", ".2s", "-e", ".sh", "/bin/sh", "--", "testdata/trapterm.sh")
+	cmd.WantStderr(`testdata/trapterm.sh: time limit exceeded; program exited with status 5 after SIGTERM
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	t.Setenv("TRAP", "")
+	cmd = gotest.Command(invig, "-t", ".2s", "-grace", ".2s", "-e", ".sh", "/bin/sh", "--", "testdata/trapterm.sh")
+	cmd.WantStderr(`testdata/trapterm.sh: time limit exceeded; program killed after ignoring SIGTERM for 200ms
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
 // Check the filename extension option
 func Extension(t *testing.T, invig string) {
 	cmd := gotest.Command(invig, "-e", ".sh", "/bin/sh", "--", "testdata/normal", "testdata/fail")
@@ -149,24 +282,30 @@ func Verbose(t *testing.T, invig string) {
 	cmd := gotest.Command(invig, "-v", "/bin/sh", "--", "testdata/normal")
 	cmd.WantStdout(`
 testdata/normal/1second.test
+$ /bin/sh testdata/normal/1second.test
 >Boo!
 
 testdata/normal/extraread.test
+$ /bin/sh testdata/normal/extraread.test
 >Say something
 !no input
 
 testdata/normal/hello.test
+$ /bin/sh testdata/normal/hello.test
 >What is your name?
 <Alice
 >Hello, Alice
 
 testdata/normal/noEOFerror.test
+$ /bin/sh testdata/normal/noEOFerror.test
 !Something's missing!
 
 testdata/normal/noEOFoutput.test
+$ /bin/sh testdata/normal/noEOFoutput.test
 >Boo
 
 testdata/normal/nonsense.test
+$ /bin/sh testdata/normal/nonsense.test
 <lavish
 >No McTavish
 >Was ever lavish
@@ -188,12 +327,15 @@ testdata/normal/nonsense.test
 <done
 
 testdata/normal/oops.test
+$ /bin/sh testdata/normal/oops.test
 !Oops
 
 testdata/normal/split.test
+$ /bin/sh testdata/normal/split.test
 >Hello, world!
 
 testdata/normal/world.test
+$ /bin/sh testdata/normal/world.test
 >Hello, world!
 
 All tests passed.
@@ -230,7 +372,7 @@ func Error(t *testing.T, invig string) {
 		return strings.Contains(actual, "permission denied") &&
 			strings.HasSuffix(actual, "0 failed tests; 1 other errors\n")
 	})
-	cmd.WantCode(1)
+	cmd.WantCode(2)
 	cmd.Run(t, "")
 
 	cmd = gotest.Command(invig, "/bin/sh", "--", mix)
@@ -238,7 +380,7 @@ func Error(t *testing.T, invig string) {
 		return strings.Contains(actual, "permission denied") &&
 			strings.HasSuffix(actual, "2 failed tests; 1 other errors\n")
 	})
-	cmd.WantCode(1)
+	cmd.WantCode(2)
 	cmd.Run(t, "")
 }
 
@@ -246,3 +388,2210 @@ func Error(t *testing.T, invig string) {
 func Testee(t *testing.T, invig string) {
 	gotest.Command(invig, "/usr/bin/awk", "-f", "--", "testdata/sum.test").Run(t, "")
 }
+
+// Check the minimum version requirement for test cases
+func Requires(t *testing.T, invig string) {
+	gotest.Command(invig, "/bin/sh", "--", "testdata/requires.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "/bin/sh", "--", "testdata/toonew.test")
+	cmd.WantStderr(`testdata/toonew.test:6: harness too old: requires invigilate >=99.0, but this is version 0.5
+0 failed tests; 1 other errors
+`)
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the CSV summary of results
+func CSV(t *testing.T, invig string) {
+	out := filepath.Join(t.TempDir(), "results.csv")
+	cmd := gotest.Command(invig, "-csv", out, "/bin/sh", "--", "testdata/mix", "testdata/toonew.test")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "3 failed tests; 1 other errors\n")
+	})
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	content, e := os.ReadFile(out)
+	if e != nil {
+		t.Fatal(e)
+	}
+	data := string(content)
+	lines := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	want := []string{
+		"path,status,duration,category",
+		"testdata/mix/anteater.test,pass,,",
+		"testdata/mix/bumblebee.test,fail,,output",
+		"testdata/mix/corgi.test,pass,,",
+		"testdata/mix/dingo.test,fail,,output",
+		"testdata/mix/elk.test,fail,,output",
+		"testdata/mix/ferret.test,pass,,",
+		"testdata/toonew.test,error,,directive",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("wrong number of CSV lines:\n%s", data)
+	}
+	for k, line := range lines {
+		// Remove the duration, which varies from run to run.
+		fields := strings.Split(line, ",")
+		if k > 0 && len(fields) == 4 {
+			fields[2] = ""
+		}
+		if got := strings.Join(fields, ","); got != want[k] {
+			t.Errorf("CSV line %d is %q; want %q", k, got, want[k])
+		}
+	}
+}
+
+// Check handling of unknown directives
+func Directives(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "/bin/sh", "--", "testdata/extension.test")
+	cmd.WantStderr(`testdata/extension.test:6: warning: ignoring extension directive "x-owner"
+testdata/extension.test:8: warning: ignoring extension directive "x-ticket"
+`)
+	cmd.Run(t, "")
+
+	gotest.Command(invig, "/bin/sh", "--", "testdata/unknown.test").Run(t, "")
+
+	cmd = gotest.Command(invig, "validate", "testdata/unknown.test")
+	cmd.WantStdout(`testdata/unknown.test:6: unknown directive "frobnicate"
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check the history database and the trends subcommand
+func History(t *testing.T, invig string) {
+	if _, e := exec.LookPath("sqlite3"); e != nil {
+		t.Skip("sqlite3 is not available")
+	}
+	tmp := t.TempDir()
+	db := filepath.Join(tmp, "history.db")
+	a := filepath.Join(tmp, "a.test")
+	b := filepath.Join(tmp, "b.test")
+	write := func(path, content string) {
+		or.Fatal0(os.WriteFile(path, []byte(content), 0644))
+	}
+
+	write(a, "echo alpha\n#>alpha\n")
+	write(b, "echo beta\n#>gamma\n")
+	cmd := gotest.Command(invig, "-history", db, "/bin/sh", "--", a, b)
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "1 failed tests\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "trends", db)
+	cmd.WantStderr(db + ": at least two runs are needed to show trends\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	// A test failing in its first recorded run is newly failing.
+	c := filepath.Join(tmp, "c.test")
+	write(a, "echo delta\n#>alpha\n")
+	write(b, "echo gamma\n#>gamma\n")
+	write(c, "echo delta\n#>epsilon\n")
+	cmd = gotest.Command(invig, "-history", db, "/bin/sh", "--", a, b, c)
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "2 failed tests\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "trends", db)
+	cmd.WantStdout("Newly failing:\n  " + a + " (fail: output)\n  " + c + " (fail: output)\nRecovered:\n  " + b + "\n")
+	cmd.Run(t, "")
+}
+
+// Check sending trace spans to an OpenTelemetry collector
+func Trace(t *testing.T, invig string) {
+	var body []byte
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	gotest.Command(invig, "-otel-endpoint", server.URL, "/bin/sh", "--", "testdata/normal/world.test").Run(t, "")
+
+	if path != "/v1/traces" {
+		t.Errorf("traces sent to %q", path)
+	}
+	var traces struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					Name         string
+					TraceId      string
+					SpanId       string
+					ParentSpanId string
+				}
+			}
+		}
+	}
+	if e := json.Unmarshal(body, &traces); e != nil {
+		t.Fatal(e)
+	}
+	parents := map[string]string{}
+	ids := map[string]string{}
+	for _, rs := range traces.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, sp := range ss.Spans {
+				parents[sp.Name] = sp.ParentSpanId
+				ids[sp.Name] = sp.SpanId
+			}
+		}
+	}
+	want := map[string]string{
+		"invigilate": "",
+		"testdata/normal/world.test": "invigilate",
+		"discovery": "testdata/normal/world.test",
+		"process": "testdata/normal/world.test",
+		"matcher": "testdata/normal/world.test",
+	}
+	if len(parents) != len(want) {
+		t.Errorf("wrong spans: %s", body)
+	}
+	for name, parent := range want {
+		if parents[name] != ids[parent] {
+			t.Errorf("span %q has the wrong parent", name)
+		}
+	}
+}
+
+// Check JSON reports and comparisons between them
+func Compare(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	old := filepath.Join(tmp, "old.json")
+	current := filepath.Join(tmp, "new.json")
+
+	gotest.Command(invig, "-json", old, "/bin/sh", "--", "testdata/normal/hello.test", "testdata/normal/world.test",
+		"testdata/mix/anteater.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "-json", current, "-compare-to", old, "/bin/sh", "--", "testdata/normal/hello.test",
+		"testdata/normal/world.test", "testdata/mix/bumblebee.test")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "1 failed tests\n")
+	})
+	cmd.WantStdout(`
+Compared with ` + old + `:
+Added:
+  testdata/mix/bumblebee.test (fail: output)
+Removed:
+  testdata/mix/anteater.test
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "diff", current, old)
+	cmd.WantStdout(`Added:
+  testdata/mix/anteater.test (pass)
+Removed:
+  testdata/mix/bumblebee.test
+`)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "diff", old, old)
+	cmd.WantStdout("No changes.\n")
+	cmd.Run(t, "")
+
+	a := filepath.Join(tmp, "a.test")
+	b := filepath.Join(tmp, "b.test")
+	or.Fatal0(os.WriteFile(a, []byte("echo alpha\n#>alpha\n"), 0644))
+	or.Fatal0(os.WriteFile(b, []byte("echo beta\n#>gamma\n"), 0644))
+	cmd = gotest.Command(invig, "-json", old, "/bin/sh", "--", a, b)
+	cmd.CheckStderr(func(actual string) bool { return true })
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	or.Fatal0(os.WriteFile(a, []byte("echo delta\n#>alpha\n"), 0644))
+	or.Fatal0(os.WriteFile(b, []byte("echo gamma\n#>gamma\n"), 0644))
+	cmd = gotest.Command(invig, "-json", current, "/bin/sh", "--", a, b)
+	cmd.CheckStderr(func(actual string) bool { return true })
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "diff", old, current)
+	cmd.WantStdout("Regressions:\n  " + a + " (fail: output)\nFixes:\n  " + b + "\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	// With -count, each run is compared separately, and times do not matter.
+	or.Fatal0(os.WriteFile(old, []byte(`{"Results": [
+		{"Path": "x.test", "Iteration": 1, "Status": "pass", "Duration": 1},
+		{"Path": "x.test", "Iteration": 2, "Status": "fail", "Duration": 1, "Category": "output"},
+		{"Path": "x.test", "Iteration": 3, "Status": "pass", "Duration": 1}]}`), 0644))
+	or.Fatal0(os.WriteFile(current, []byte(`{"Results": [
+		{"Path": "x.test", "Iteration": 1, "Status": "fail", "Duration": 2, "Category": "timeout"},
+		{"Path": "x.test", "Iteration": 2, "Status": "pass", "Duration": 2},
+		{"Path": "x.test", "Iteration": 3, "Status": "pass", "Duration": 2}]}`), 0644))
+	cmd = gotest.Command(invig, "diff", old, current)
+	cmd.WantStdout("Regressions:\n  x.test run 1 (fail: timeout)\nFixes:\n  x.test run 2\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check serving profiles while tests are running
+func Pprof(t *testing.T, invig string) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(invig, "-pprof", addr, "/bin/sh", "--", "testdata/halfsecond.test")
+	or.Fatal0(cmd.Start())
+	defer cmd.Wait()
+
+	var body []byte
+	for k := 0; k < 20 && body == nil; k++ {
+		time.Sleep(20 * time.Millisecond)
+		if resp, e := http.Get("http://" + addr + "/debug/vars"); e == nil {
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+	if !strings.Contains(string(body), `"tests_run"`) || !strings.Contains(string(body), `"memstats"`) {
+		t.Errorf("unexpected metrics: %s", body)
+	}
+}
+
+// Check that quarantined tests do not fail the run
+func Quarantine(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-quarantine", "testdata/quarantine", "/bin/sh", "--", "testdata/mix")
+	cmd.WantStdout(`
+Quarantined tests:
+  testdata/mix/dingo.test: failed
+  testdata/mix/elk.test: failed
+  testdata/mix/ferret.test: passed
+`)
+	cmd.WantStderr(`testdata/mix/bumblebee.test: incorrect test output
+expected: bumblebee
+  actual: hornet
+testdata/mix/dingo.test: incorrect test output
+expected: dingo
+  actual: fox
+testdata/mix/elk.test: incorrect test output
+expected: elk
+  actual: moose
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-quarantine", "testdata/quarantine", "/bin/sh", "--", "testdata/mix/elk.test")
+	cmd.WantStdout(`
+Quarantined tests:
+  testdata/mix/elk.test: failed
+`)
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, "testdata/mix/elk.test: incorrect test output")
+	})
+	cmd.Run(t, "")
+}
+
+// Check leak detection in soak mode
+func Soak(t *testing.T, invig string) {
+	gotest.Command(invig, "-soak", "3", "/bin/sh", "--", "testdata/normal/world.test").Run(t, "")
+
+	grow := filepath.Join(t.TempDir(), "grow.test")
+	gotest.Command("/bin/cp", "testdata/grow.sh", grow).Run(t, "")
+	cmd := gotest.Command(invig, "-soak", "4", "/bin/sh", "--", grow)
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, grow + ": probable memory leak: peak memory grew from ") &&
+			strings.HasSuffix(actual, " over 4 runs\n1 failed tests\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check that shards divide up the tests
+func Shard(t *testing.T, invig string) {
+	check := func(extra ...string) {
+		seen := map[string]int{}
+		for k := 1; k <= 3; k++ {
+			args := append(extra, "-v", "-shard", fmt.Sprintf("%d/3", k), "/bin/sh", "--", "testdata/normal")
+			out, e := exec.Command(invig, args...).Output()
+			if e != nil {
+				t.Fatal(e)
+			}
+			for _, line := range strings.Split(string(out), "\n") {
+				if strings.HasPrefix(line, "testdata/") {
+					seen[line]++
+				}
+			}
+		}
+		if len(seen) != 9 {
+			t.Errorf("wrong tests run: %v", seen)
+		}
+		for test, n := range seen {
+			if n != 1 {
+				t.Errorf("%s was run %d times", test, n)
+			}
+		}
+	}
+	check()
+
+	if _, e := exec.LookPath("sqlite3"); e == nil {
+		db := filepath.Join(t.TempDir(), "history.db")
+		gotest.Command(invig, "-history", db, "/bin/sh", "--", "testdata/normal").Run(t, "")
+		check("-shard-balance", db)
+
+		// 1second.test is by far the longest, so it should be alone in its shard.
+		cmd := gotest.Command(invig, "-v", "-shard-balance", db, "-shard", "1/3", "/bin/sh", "--", "testdata/normal")
+		cmd.WantStdout("\ntestdata/normal/1second.test\n$ /bin/sh testdata/normal/1second.test\n>Boo!\n\nAll tests passed.\n")
+		cmd.Run(t, "")
+	}
+
+	cmd := gotest.Command(invig, "-shard", "4/3", "/bin/sh", "--", "testdata/normal")
+	cmd.WantStderr("invalid shard \"4/3\": must be i/n, with 1 <= i <= n\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check reproducer bundles for failed tests
+func Bundle(t *testing.T, invig string) {
+	dir := t.TempDir()
+	cmd := gotest.Command(invig, "-repro-bundle", dir, "/bin/sh", "--",
+		"testdata/fail/halflineerror.test", "testdata/normal/hello.test")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "1 failed tests\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		t.Fatal(e)
+	} else if len(entries) != 1 || entries[0].Name() != "testdata_fail_halflineerror.test.tar.gz" {
+		t.Fatalf("wrong bundles: %v", entries)
+	}
+
+	f, e := os.Open(filepath.Join(dir, entries[0].Name()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer f.Close()
+	zr, e := gzip.NewReader(f)
+	if e != nil {
+		t.Fatal(e)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			t.Fatal(e)
+		}
+		data, e := io.ReadAll(tr)
+		if e != nil {
+			t.Fatal(e)
+		}
+		files[hdr.Name] = string(data)
+	}
+
+	prefix := "testdata_fail_halflineerror.test/"
+	original, e := os.ReadFile("testdata/fail/halflineerror.test")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if files[prefix + "test/halflineerror.test"] != string(original) {
+		t.Error("test case missing from bundle")
+	}
+	if !strings.Contains(files[prefix + "transcript.txt"], "! I'm riding a roll (no newline)") {
+		t.Errorf("wrong transcript: %s", files[prefix + "transcript.txt"])
+	}
+	if !strings.Contains(files[prefix + "run.sh"], "/bin/sh -- test/halflineerror.test") {
+		t.Errorf("wrong script: %s", files[prefix + "run.sh"])
+	}
+	for _, name := range []string{"command.txt", "env.txt", "result.txt"} {
+		if files[prefix + name] == "" {
+			t.Errorf("%s missing from bundle", name)
+		}
+	}
+}
+
+// Check the result cache
+func Cache(t *testing.T, invig string) {
+	t.Setenv("INVIGILATE_CACHE", t.TempDir())
+
+	cmd := gotest.Command(invig, "-v", "/bin/sh", "--", "testdata/mix/anteater.test", "testdata/mix/elk.test")
+	cmd.WantStdout(`
+testdata/mix/anteater.test
+$ /bin/sh testdata/mix/anteater.test
+>anteater
+
+testdata/mix/elk.test
+$ /bin/sh testdata/mix/elk.test
+>elk
+`)
+	cmd.CheckStderr(func(actual string) bool { return true })
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-v", "/bin/sh", "--", "testdata/mix/anteater.test", "testdata/mix/elk.test")
+	cmd.WantStdout(`
+testdata/mix/anteater.test (cached)
+
+testdata/mix/elk.test
+$ /bin/sh testdata/mix/elk.test
+>elk
+`)
+	cmd.CheckStderr(func(actual string) bool { return true })
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-v", "-no-cache", "/bin/sh", "--", "testdata/mix/anteater.test")
+	cmd.WantStdout(`
+testdata/mix/anteater.test
+$ /bin/sh testdata/mix/anteater.test
+>anteater
+
+All tests passed.
+`)
+	cmd.Run(t, "")
+
+	// A different time limit may change the result, so the cached result is not used.
+	cmd = gotest.Command(invig, "-v", "-t", "3s", "/bin/sh", "--", "testdata/mix/anteater.test")
+	cmd.WantStdout(`
+testdata/mix/anteater.test
+$ /bin/sh testdata/mix/anteater.test
+>anteater
+
+All tests passed.
+`)
+	cmd.Run(t, "")
+}
+
+// Check replay scripts for failed tests
+func Replay(t *testing.T, invig string) {
+	dir := t.TempDir()
+	failure := `testdata/mix/elk.test: incorrect test output
+expected: elk
+  actual: moose
+1 failed tests
+`
+	cmd := gotest.Command(invig, "-replay", dir, "-t", "3s", "/bin/sh", "--",
+		"testdata/mix/elk.test", "testdata/mix/ferret.test")
+	cmd.WantStderr(failure)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		t.Fatal(e)
+	} else if len(entries) != 1 || entries[0].Name() != "testdata_mix_elk.test.sh" {
+		t.Fatalf("wrong replay scripts: %v", entries)
+	}
+	script := filepath.Join(dir, entries[0].Name())
+	content, e := os.ReadFile(script)
+	if e != nil {
+		t.Fatal(e)
+	} else if !strings.Contains(string(content), " -t=3s /bin/sh -- testdata/mix/elk.test\n") ||
+		!strings.Contains(string(content), " -grace=1s ") {
+		t.Errorf("wrong replay script:\n%s", content)
+	}
+
+	cmd = gotest.Command(script)
+	cmd.WantStderr(failure)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check error output expected at exit
+func AtExit(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-v", "/bin/sh", "--", "testdata/atexit/shutdown.test")
+	cmd.WantStdout(`
+testdata/atexit/shutdown.test
+$ /bin/sh testdata/atexit/shutdown.test
+!Starting
+<hello
+>got hello
+at-exit!Goodbye
+
+All tests passed.
+`)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "/bin/sh", "--", "testdata/atexit/early.test")
+	cmd.WantStderr(`testdata/atexit/early.test: error output before input was closed
+expected at exit: Goodbye
+          actual: Goodbye
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check the exit codes for different kinds of problems
+func ExitCodes(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "/bin/sh", "--", "testdata/mix/elk.test", "testdata/nonexistent")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "1 failed tests; 1 other errors\n")
+	})
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-e", ".nothing", "/bin/sh", "--", "testdata/normal")
+	cmd.WantStderr("No tests found\n")
+	cmd.WantCode(3)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "/bin/sh", "--")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "\nNo test cases specified\n")
+	})
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check handling of SIGINT
+func Interrupt(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	test := filepath.Join(tmp, "interrupt.test")
+	gotest.Command("/bin/cp", "testdata/interrupt.sh", test).Run(t, "")
+
+	var stderr strings.Builder
+	cmd := exec.Command(invig, "/bin/sh", "--", "testdata/normal/world.test", test, "testdata/normal/hello.test")
+	cmd.Stderr = &stderr
+	or.Fatal0(cmd.Start())
+	time.Sleep(200 * time.Millisecond)
+	or.Fatal0(cmd.Process.Signal(syscall.SIGINT))
+	e := cmd.Wait()
+
+	if ee, ok := e.(*exec.ExitError); !ok || ee.ExitCode() != 130 {
+		t.Errorf("wrong exit status: %v", e)
+	}
+	if !strings.HasSuffix(stderr.String(), "Interrupted after 2 tests: 0 failed tests; 1 other errors\n") {
+		t.Errorf("wrong error output: %s", stderr.String())
+	}
+
+	// The background process started by the test case should have been killed.
+	time.Sleep(600 * time.Millisecond)
+	if _, e := os.Stat(filepath.Join(tmp, "marker")); e == nil {
+		t.Error("background process was not killed")
+	}
+}
+
+// Check the -invariant option
+func Invariant(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	stray := filepath.Join(tmp, "stray")
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "a.test"), []byte("echo a\n#>a\n"), 0644))
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "b.test"), []byte("touch " + stray + "\n"), 0644))
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "c.test"), []byte("echo c\n#>c\n"), 0644))
+
+	invariant := "test ! -e " + stray + " || { echo stray file; rm " + stray + "; exit 1; }"
+	cmd := gotest.Command(invig, "-invariant", invariant, "/bin/sh", "--", tmp)
+	cmd.WantStderr(filepath.Join(tmp, "b.test") + ": invariant violated after test: stray file\n" +
+		"1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check message catalogs
+func Catalog(t *testing.T, invig string) {
+	t.Setenv("LANG", "en_US.UTF-8")
+	cmd := gotest.Command(invig, "-catalog", "testdata/catalog/en.cat", "/bin/sh", "--", "testdata/catalog")
+	cmd.Run(t, "")
+
+	t.Setenv("LANG", "fr_FR.UTF-8")
+	cmd = gotest.Command(invig, "-catalog", "testdata/catalog/fr.cat", "/bin/sh", "--", "testdata/catalog")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-catalog", "testdata/catalog/en.cat", "/bin/sh", "--", "testdata/catalog")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, "testdata/catalog/greet.test: incorrect test output\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	tmp := t.TempDir()
+	bad := filepath.Join(tmp, "bad.test")
+	or.Fatal0(os.WriteFile(bad, []byte("#>msg GREETING\n"), 0644))
+	cmd = gotest.Command(invig, "-catalog", "testdata/catalog/en.cat", "/bin/sh", "--", bad)
+	cmd.WantStderr(bad + ":1: message GREETING needs argument name\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the first-output-within directive
+func Latency(t *testing.T, invig string) {
+	gotest.Command(invig, "/bin/sh", "--", "testdata/latency/prompt.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "/bin/sh", "--", "testdata/latency/slow.test")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, "testdata/latency/slow.test: first output after ") &&
+			strings.HasSuffix(actual, ", but expected within 100ms\n1 failed tests\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	tmp := t.TempDir()
+	bad := filepath.Join(tmp, "bad.test")
+	or.Fatal0(os.WriteFile(bad, []byte("#first-output-within soon\n"), 0644))
+	cmd = gotest.Command(invig, "/bin/sh", "--", bad)
+	cmd.WantStderr(bad + ":1: first-output-within needs a duration, such as 200ms\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the -exit-codes option
+func ExitCodeClasses(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-exit-codes", "testdata/wrapper/exitcodes", "/bin/sh", "--", "testdata/wrapper")
+	cmd.WantStderr(`testdata/wrapper/broken.test: exit code 98 (tool error)
+testdata/wrapper/leak.test: exit code 99 (memory error)
+1 failed tests; 1 other errors
+`)
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	// oops.test expects exit code 1, but here that is classified as a failure.
+	cmd = gotest.Command(invig, "-exit-codes", "testdata/wrapper/exitcodes", "/bin/sh", "--", "testdata/normal/oops.test")
+	cmd.WantStderr("testdata/normal/oops.test: exit code 1 (test failure)\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-exit-codes", "testdata/quarantine", "/bin/sh", "--", "testdata/wrapper")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, "testdata/quarantine:")
+	})
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check that processes started by a test case are killed after a timeout
+func ProcessGroup(t *testing.T, invig string) {
+	for _, grace := range []string{"0", "1s"} {
+		tmp := t.TempDir()
+		test := filepath.Join(tmp, "timeout.test")
+		gotest.Command("/bin/cp", "testdata/interrupt.sh", test).Run(t, "")
+
+		cmd := gotest.Command(invig, "-t", ".1s", "-grace", grace, "/bin/sh", "--", test)
+		cmd.CheckStderr(func(actual string) bool {
+			return strings.HasPrefix(actual, test + ": time limit exceeded")
+		})
+		cmd.WantCode(1)
+		cmd.Run(t, "")
+
+		time.Sleep(600 * time.Millisecond)
+		if _, e := os.Stat(filepath.Join(tmp, "marker")); e == nil {
+			t.Errorf("with -grace %s, background process was not killed", grace)
+		}
+	}
+}
+
+// Check that SIGHUP is passed on to the test in progress
+func ForwardSignals(t *testing.T, invig string) {
+	var stderr strings.Builder
+	cmd := exec.Command(invig, "-e", ".sh", "/bin/sh", "--", "testdata/hangup.sh")
+	cmd.Stderr = &stderr
+	or.Fatal0(cmd.Start())
+	time.Sleep(300 * time.Millisecond)
+	or.Fatal0(cmd.Process.Signal(syscall.SIGHUP))
+	if e := cmd.Wait(); e != nil {
+		t.Errorf("%s\n%s", e, stderr.String())
+	}
+}
+
+// Check the signal directive
+func SignalDirective(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-v", "/bin/sh", "--", "testdata/signal")
+	cmd.WantStdout(`
+testdata/signal/ignore.test
+$ /bin/sh testdata/signal/ignore.test
+>ready
+signal USR1
+>shutting down
+
+testdata/signal/reload.test
+$ /bin/sh testdata/signal/reload.test
+>ready
+signal HUP
+>reloading configuration
+signal SIGTERM
+>shutting down
+`)
+	cmd.WantStderr(`testdata/signal/ignore.test: incorrect test output
+expected: shutting down
+  actual: still running
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	tmp := t.TempDir()
+	bad := filepath.Join(tmp, "bad.test")
+	or.Fatal0(os.WriteFile(bad, []byte("#signal BOGUS\n"), 0644))
+	cmd = gotest.Command(invig, "/bin/sh", "--", bad)
+	cmd.WantStderr(bad + ":1: unknown signal \"BOGUS\"\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the killed directive
+func Killed(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "/bin/sh", "--", "testdata/killed")
+	cmd.WantStderr(`testdata/killed/survive.test: expected to be killed by SIGABRT, but exit code was 0
+testdata/killed/wrong.test: expected to be killed by SIGABRT, but was killed by SIGTERM
+2 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check the golden subcommand
+func Golden(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	write := func(name, content string) {
+		or.Fatal0(os.WriteFile(filepath.Join(tmp, name), []byte(content), 0644))
+	}
+	write("greet.test", "read name\necho \"Hello, $name.\"\necho done >&2\n")
+	write("greet.in", "Pat\n")
+	write("greet.out", "Hi, Pat.\n")
+	write("input.test", "cat\n")
+	write("input.in", "data\n")
+	write("old.test", "echo old\n")
+	write("old.out", "old\n")
+	write("data.out", "not a golden file\n")
+
+	cmd := gotest.Command(invig, "golden", "list", tmp)
+	cmd.WantStdout(filepath.Join(tmp, "greet.in") + "\n" +
+		filepath.Join(tmp, "greet.out") + "\n" +
+		filepath.Join(tmp, "input.in") + "\n" +
+		filepath.Join(tmp, "old.out") + "\n")
+	cmd.Run(t, "")
+
+	gotest.Command(invig, "golden", "hash", tmp).Run(t, "")
+	gotest.Command(invig, "golden", "verify", tmp).Run(t, "")
+
+	// Only golden files recorded in the manifest may be orphans.
+	or.Fatal0(os.Remove(filepath.Join(tmp, "old.test")))
+	cmd = gotest.Command(invig, "golden", "list", tmp)
+	cmd.WantStdout(filepath.Join(tmp, "greet.in") + "\n" +
+		filepath.Join(tmp, "greet.out") + "\n" +
+		filepath.Join(tmp, "input.in") + "\n" +
+		filepath.Join(tmp, "old.out") + " (orphaned)\n")
+	cmd.Run(t, "")
+	cmd = gotest.Command(invig, "golden", "prune", tmp)
+	cmd.WantStdout(filepath.Join(tmp, "old.out") + "\n")
+	cmd.Run(t, "")
+	if _, e := os.Stat(filepath.Join(tmp, "old.out")); e == nil {
+		t.Error("orphaned golden file was not pruned")
+	}
+	if _, e := os.Stat(filepath.Join(tmp, "data.out")); e != nil {
+		t.Error("file that is not a golden file was pruned")
+	}
+	gotest.Command(invig, "golden", "verify", tmp).Run(t, "")
+
+	// Only the golden files that exist are rewritten.
+	cmd = gotest.Command(invig, "golden", "update", "/bin/sh", "--", tmp)
+	cmd.WantStdout(filepath.Join(tmp, "greet.test") + "\n")
+	cmd.Run(t, "")
+	cmd = gotest.Command("/bin/cat", filepath.Join(tmp, "greet.out"))
+	cmd.WantStdout("Hello, Pat.\n")
+	cmd.Run(t, "")
+	for _, name := range []string{"greet.err", "input.out"} {
+		if _, e := os.Stat(filepath.Join(tmp, name)); e == nil {
+			t.Errorf("golden file %s was created", name)
+		}
+	}
+	gotest.Command(invig, "golden", "verify", tmp).Run(t, "")
+
+	write("greet.out", "Hello, Chris.\n")
+	or.Fatal0(os.Remove(filepath.Join(tmp, "input.in")))
+	cmd = gotest.Command(invig, "golden", "verify", tmp)
+	cmd.WantStdout(filepath.Join(tmp, "greet.out") + ": changed\n" +
+		filepath.Join(tmp, "input.in") + ": missing\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	write("greet.test", "read name\necho \"Goodbye, $name.\"\necho done >&2\n")
+	write("greet.err", "")
+	cmd = gotest.Command(invig, "golden", "update", "-provenance", "/bin/sh", "--", tmp)
+	cmd.WantStdout(filepath.Join(tmp, "greet.test") + "\n")
+	cmd.Run(t, "")
+	manifest, e := os.ReadFile(filepath.Join(tmp, "golden.sha256"))
+	or.Fatal0(e)
+	lines := strings.Split(string(manifest), "\n")
+	// greet.in is unchanged, so it has no provenance comment.
+	if len(lines) != 6 || !strings.HasPrefix(lines[0], "# updated ") ||
+		!strings.Contains(lines[0], " by invigilate 0.5 from /bin/sh (sha256 ") ||
+		!strings.HasSuffix(lines[1], "  greet.err") || !strings.HasSuffix(lines[2], "  greet.in") ||
+		!strings.HasPrefix(lines[3], "# updated ") || !strings.HasSuffix(lines[4], "  greet.out") {
+		t.Errorf("wrong provenance in manifest:\n%s", manifest)
+	}
+
+	// Golden files belong to test cases found as when running them.
+	or.Fatal0(os.Remove(filepath.Join(tmp, "golden.sha256")))
+	write("hello.sh", "echo hello\n")
+	write("hello.out", "hello\n")
+	cmd = gotest.Command(invig, "golden", "list", "-interp", ".sh=/bin/sh", tmp)
+	cmd.WantStdout(filepath.Join(tmp, "greet.err") + "\n" +
+		filepath.Join(tmp, "greet.in") + "\n" +
+		filepath.Join(tmp, "greet.out") + "\n" +
+		filepath.Join(tmp, "hello.out") + "\n")
+	cmd.Run(t, "")
+}
+
+// Check resource limits
+func Rlimit(t *testing.T, invig string) {
+	// The rlimit directives override the -rlimit option.
+	gotest.Command(invig, "-rlimit", "nofile=30,cpu=5", "/bin/sh", "--", "testdata/rlimit").Run(t, "")
+
+	tmp := t.TempDir()
+	test := filepath.Join(tmp, "limits.test")
+	or.Fatal0(os.WriteFile(test, []byte("ulimit -n\nulimit -t\n#>30\n#>5\n"), 0644))
+	gotest.Command(invig, "-rlimit", "nofile=30,cpu=5", "/bin/sh", "--", test).Run(t, "")
+
+	bad := filepath.Join(tmp, "bad.test")
+	or.Fatal0(os.WriteFile(bad, []byte("#rlimit nofile=lots\n"), 0644))
+	cmd := gotest.Command(invig, "/bin/sh", "--", bad)
+	cmd.WantStderr(bad + ":1: invalid limit \"lots\" for nofile\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the reporting of CPU time and peak memory
+func Resources(t *testing.T, invig string) {
+	report := filepath.Join(t.TempDir(), "report.json")
+	out, e := exec.Command(invig, "-resources", "-json", report, "/bin/sh", "--", "testdata/normal/hello.test").Output()
+	or.Fatal0(e)
+	want := regexp.MustCompile(`^testdata/normal/hello.test: \d+\.\d{3}s user, \d+\.\d{3}s system, [1-9]\d* KiB peak memory\n$`)
+	if !want.Match(out) {
+		t.Errorf("wrong output: %s", out)
+	}
+
+	var rep struct{ Results []struct{ MaxRSS int64 } }
+	data, e := os.ReadFile(report)
+	or.Fatal0(e)
+	or.Fatal0(json.Unmarshal(data, &rep))
+	if len(rep.Results) != 1 || rep.Results[0].MaxRSS <= 0 {
+		t.Errorf("peak memory missing from report:\n%s", data)
+	}
+}
+
+// Check the -dirs option
+func DirectorySummary(t *testing.T, invig string) {
+	cmd := exec.Command(invig, "-dirs", "/bin/sh", "--", "testdata/normal/hello.test", "testdata/mix", "testdata/toonew.test")
+	out, e := cmd.Output()
+	if ee, ok := e.(*exec.ExitError); !ok || ee.ExitCode() != 2 {
+		t.Fatalf("wrong exit status: %v", e)
+	}
+	want := regexp.MustCompile(`^
+By directory:
+    tests  failed  errors    time  directory
+        6       3       0  \d+\.\d{3}s  testdata/mix
+        1       0       1  \d+\.\d{3}s  testdata
+        1       0       0  \d+\.\d{3}s  testdata/normal
+$`)
+	if !want.Match(out) {
+		t.Errorf("wrong summary:\n%s", out)
+	}
+}
+
+// Check the checking of the -memory-max and -cgroup options.
+// Enforcing the limit needs cgroup v2 or systemd, which may not be available.
+func MemoryMax(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-memory-max", "bogus", "/bin/sh", "--", "testdata/normal/hello.test")
+	cmd.WantStderr("invalid memory limit \"bogus\"\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-cgroup", t.TempDir(), "/bin/sh", "--", "testdata/normal/hello.test")
+	cmd.WantStderr("-cgroup requires -memory-max\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	cmd = gotest.Command(invig, "-memory-max", "64M", "-cgroup", missing, "/bin/sh", "--", "testdata/normal/hello.test")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, "testdata/normal/hello.test: setting memory limit: ")
+	})
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the validate subcommand
+func Validate(t *testing.T, invig string) {
+	gotest.Command(invig, "validate", "-schema", "testdata/schema/suite.schema", "testdata/schema/good.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "validate", "-schema", "testdata/schema/suite.schema", "testdata/schema")
+	cmd.WantStdout(`testdata/schema/bad.test:1: x-owner argument "Pat" does not match ^[a-z]+@example\.com$
+testdata/schema/bad.test:2: first-output-within 5s exceeds the maximum of 1s
+testdata/schema/bad.test:3: directive "rlimit" is not allowed
+testdata/schema/unowned.test:3: unknown directive "bogus"
+testdata/schema/unowned.test: missing required directive "x-owner"
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	schema := filepath.Join(t.TempDir(), "bad.schema")
+	or.Fatal0(os.WriteFile(schema, []byte("forbid rlimit\n"), 0644))
+	cmd = gotest.Command(invig, "validate", "-schema", schema, "testdata/schema")
+	cmd.WantStderr(schema + ":1: unknown keyword \"forbid\"; must be allow, require, match, or max\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the -wrap option
+func Wrap(t *testing.T, invig string) {
+	trace := "/bin/sh testdata/wrap/trace.sh"
+	gotest.Command(invig, "-wrap", trace, "/bin/sh", "--", "testdata/wrap/wrapped.test").Run(t, "")
+	gotest.Command(invig, "-wrap", trace + " {program} {test}", "/bin/sh", "--", "testdata/wrap/wrapped.test").Run(t, "")
+	gotest.Command(invig, "-wrap", "env WRAPPED={test}.log {program} {test}", "/bin/sh", "--", "testdata/wrap/env.test").Run(t, "")
+
+	// The wrapper's exit codes may be classified.
+	tmp := t.TempDir()
+	codes, quiet := filepath.Join(tmp, "codes"), filepath.Join(tmp, "quiet.test")
+	or.Fatal0(os.WriteFile(codes, []byte("99 memory error\n"), 0644))
+	or.Fatal0(os.WriteFile(quiet, []byte("true\n"), 0644))
+	cmd := gotest.Command(invig, "-wrap", "/bin/sh testdata/wrap/crash.sh", "-exit-codes", codes, "/bin/sh", "--", quiet)
+	cmd.WantStderr(quiet + ": exit code 99 (memory error)\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check the docker backend, using a fake docker which runs the command on the host
+func Docker(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	record := filepath.Join(tmp, "docker.log")
+	fake := `#!/bin/sh
+echo "$@" >> "$DOCKER_LOG"
+if [ "$1" = run ]; then
+	while [ "$1" != alpine ]; do shift; done
+	shift
+	exec "$@"
+elif [ "$1" = inspect ]; then
+	echo false
+fi
+`
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "docker"), []byte(fake), 0755))
+
+	cmd := exec.Command(invig, "-backend", "docker", "-image", "alpine", "-rlimit", "nofile=30", "/bin/sh", "--", "testdata/normal/hello.test")
+	cmd.Env = append(os.Environ(), "PATH=" + tmp + ":" + os.Getenv("PATH"), "DOCKER_LOG=" + record)
+	if out, e := cmd.CombinedOutput(); e != nil {
+		t.Fatalf("%s\n%s", e, out)
+	}
+	data, e := os.ReadFile(record)
+	or.Fatal0(e)
+	wd, e := os.Getwd()
+	or.Fatal0(e)
+	want := regexp.MustCompile(`^run -i --init --name (invigilate-\d+-1) -v ` + regexp.QuoteMeta(wd + ":" + wd + " -w " + wd) +
+		` --ulimit nofile=30:30 alpine /bin/sh testdata/normal/hello.test\ninspect -f \{\{.State.OOMKilled\}\} (invigilate-\d+-1)\nrm -f (invigilate-\d+-1)\n$`)
+	if !want.Match(data) {
+		t.Errorf("wrong docker commands:\n%s", data)
+	}
+
+	check := gotest.Command(invig, "-backend", "docker", "/bin/sh", "--", "testdata/normal/hello.test")
+	check.WantStderr("-backend docker requires -image\n")
+	check.WantCode(2)
+	check.Run(t, "")
+}
+
+// Check the -build option
+func Build(t *testing.T, invig string) {
+	build := `printf '#!/bin/sh\nexec /bin/sh "$@"\n' > {out} && chmod +x {out}`
+	gotest.Command(invig, "-build", build, "{out}", "--", "testdata/normal/hello.test").Run(t, "")
+
+	report := filepath.Join(t.TempDir(), "report.json")
+	cmd := gotest.Command(invig, "-build", "echo oops; exit 1", "-json", report, "{out}", "--", "testdata/normal/hello.test")
+	cmd.WantStderr("build failed: exit status 1\noops\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+	data, e := os.ReadFile(report)
+	or.Fatal0(e)
+	if !strings.Contains(string(data), `"Path": "(build)",
+			"Status": "error",`) {
+		t.Errorf("build failure missing from report:\n%s", data)
+	}
+}
+
+// Check running tests on workers
+func Workers(t *testing.T, invig string) {
+	w := exec.Command(invig, "worker", "-listen", "127.0.0.1:0")
+	stderr, e := w.StderrPipe()
+	or.Fatal0(e)
+	or.Fatal0(w.Start())
+	defer w.Process.Kill()
+	var addr string
+	if _, e = fmt.Fscanf(stderr, "listening on %s\n", &addr); e != nil {
+		t.Fatal(e)
+	}
+
+	// The results should be as if the tests were run locally.
+	local := exec.Command(invig, "/bin/sh", "--", "testdata/mix")
+	want, _ := local.CombinedOutput()
+	cmd := gotest.Command(invig, "-workers", addr, "/bin/sh", "--", "testdata/mix")
+	cmd.WantStderr(string(want))
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	gotest.Command(invig, "-workers", addr + "," + addr, "/bin/sh", "--", "testdata/normal").Run(t, "")
+}
+
+// Check the HTTP API of the serve subcommand
+func Serve(t *testing.T, invig string) {
+	srv := exec.Command(invig, "serve", "-listen", "127.0.0.1:0")
+	stderr, e := srv.StderrPipe()
+	or.Fatal0(e)
+	or.Fatal0(srv.Start())
+	defer srv.Process.Kill()
+	var addr string
+	if _, e = fmt.Fscanf(stderr, "listening on %s\n", &addr); e != nil {
+		t.Fatal(e)
+	}
+
+	type Run struct {
+		ID       int
+		State    string
+		ExitCode int
+		Stderr   string
+		Results  []struct{ Path, Status string }
+	}
+	submit := func(id int, body string) Run {
+		var run Run
+		resp, e := http.Post("http://" + addr + "/runs", "application/json", strings.NewReader(body))
+		or.Fatal0(e)
+		or.Fatal0(json.NewDecoder(resp.Body).Decode(&run))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated || run.ID != id {
+			t.Fatalf("wrong reply to POST: %d %+v", resp.StatusCode, run)
+		}
+
+		for deadline := time.Now().Add(10 * time.Second); run.State != "done"; {
+			if time.Now().After(deadline) {
+				t.Fatal("run did not finish")
+			}
+			time.Sleep(50 * time.Millisecond)
+			resp, e = http.Get(fmt.Sprintf("http://%s/runs/%d", addr, id))
+			or.Fatal0(e)
+			or.Fatal0(json.NewDecoder(resp.Body).Decode(&run))
+			resp.Body.Close()
+		}
+		return run
+	}
+
+	run := submit(1, `{"Options": ["-no-cache"], "Program": ["/bin/sh"], "Tests": ["testdata/mix"]}`)
+	if run.ExitCode != 1 || len(run.Results) != 6 || run.Results[1].Path != "testdata/mix/bumblebee.test" || run.Results[1].Status != "fail" {
+		t.Errorf("wrong results: %+v", run)
+	}
+
+	// The runs are carried out in the server, which survives a run ended by an
+	// invalid option, and starts each run afresh.
+	run = submit(2, `{"Options": ["-count", "0"], "Program": ["/bin/sh"], "Tests": ["testdata/mix"]}`)
+	if run.ExitCode != 2 || run.Stderr != "-count must be at least 1\n" {
+		t.Errorf("wrong outcome of invalid run: %+v", run)
+	}
+	run = submit(3, `{"Options": ["-no-cache"], "Program": ["/bin/sh"], "Tests": ["testdata/normal/hello.test"]}`)
+	if run.ExitCode != 0 || run.Stderr != "" || len(run.Results) != 1 || run.Results[0].Status != "pass" {
+		t.Errorf("wrong results of later run: %+v", run)
+	}
+
+	// Test case files found and read in one run are reused in later runs,
+	// unless their sizes or modification times, or those of their directories, change.
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.test")
+	or.Fatal0(os.WriteFile(a, []byte("echo a\n#>a\n"), 0666))
+	request, e := json.Marshal(map[string][]string{"Options": {"-no-cache"}, "Program": {"/bin/sh"}, "Tests": {dir}})
+	or.Fatal0(e)
+	run = submit(4, string(request))
+	if run.ExitCode != 0 || len(run.Results) != 1 || run.Results[0].Status != "pass" {
+		t.Errorf("wrong results of first run of changing tree: %+v", run)
+	}
+	aInfo, e := os.Stat(a)
+	or.Fatal0(e)
+	dirInfo, e := os.Stat(dir)
+	or.Fatal0(e)
+	or.Fatal0(os.WriteFile(a, []byte("echo a\n#>b\n"), 0666))
+	or.Fatal0(os.WriteFile(filepath.Join(dir, "new.test"), []byte("echo n\n#>n\n"), 0666))
+	or.Fatal0(os.Chtimes(a, aInfo.ModTime(), aInfo.ModTime()))
+	or.Fatal0(os.Chtimes(dir, dirInfo.ModTime(), dirInfo.ModTime()))
+	run = submit(5, string(request))
+	if run.ExitCode != 0 || len(run.Results) != 1 || run.Results[0].Status != "pass" {
+		t.Errorf("files apparently unchanged were not reused: %+v", run)
+	}
+	later := time.Now().Add(time.Second)
+	or.Fatal0(os.Chtimes(a, later, later))
+	or.Fatal0(os.Chtimes(dir, later, later))
+	run = submit(6, string(request))
+	if run.ExitCode != 1 || len(run.Results) != 2 || run.Results[0].Path != a || run.Results[0].Status != "fail" ||
+		run.Results[1].Status != "pass" {
+		t.Errorf("changed files were not found and read again: %+v", run)
+	}
+
+	resp, e := http.Get("http://" + addr + "/runs/7")
+	or.Fatal0(e)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown run gave status %d", resp.StatusCode)
+	}
+
+	resp, e = http.Get("http://" + addr + "/metrics")
+	or.Fatal0(e)
+	metrics, e := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	or.Fatal0(e)
+	for _, want := range []string{"invigilate_runs_total 6\n", "invigilate_tests_total{status=\"fail\"} 4\n",
+		"invigilate_test_duration_seconds_count 11\n"} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("metrics lack %q:\n%s", want, metrics)
+		}
+	}
+}
+
+// Check pushing metrics to a Pushgateway
+func Pushgateway(t *testing.T, invig string) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		method, path, body = req.Method, req.URL.Path, string(data)
+	}))
+	defer gateway.Close()
+
+	cmd := gotest.Command(invig, "-no-cache", "-pushgateway", gateway.URL, "/bin/sh", "--", "testdata/normal")
+	cmd.Run(t, "")
+	if method != http.MethodPut || path != "/metrics/job/invigilate" {
+		t.Errorf("metrics sent by %s to %s", method, path)
+	}
+	for _, want := range []string{"invigilate_runs_total 1\n", "invigilate_tests_total{status=\"fail\"} 0\n",
+		"invigilate_test_duration_seconds_bucket{le=\"+Inf\"} "} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+}
+
+// Check the -cpuprofile and -memprofile options
+func Profiles(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	cpu, mem := filepath.Join(tmp, "cpu.prof"), filepath.Join(tmp, "mem.prof")
+	gotest.Command(invig, "-cpuprofile", cpu, "-memprofile", mem, "/bin/sh", "--", "testdata/normal").Run(t, "")
+	for _, f := range []string{cpu, mem} {
+		if info, e := os.Stat(f); e != nil {
+			t.Error(e)
+		} else if info.Size() == 0 {
+			t.Errorf("%s is empty", f)
+		}
+	}
+}
+
+// Check matching of output much larger than the buffers used to read it
+func LargeOutput(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	long := strings.Repeat("abcdefgh", 1 << 17)
+	test := filepath.Join(tmp, "long.test")
+	var content strings.Builder
+	content.WriteString("printf '%s\\n' " + long + "\nseq 1 20000\n#>" + long + "\n")
+	for k := 1; k <= 20000; k++ {
+		fmt.Fprintf(&content, "#>%d\n", k)
+	}
+	or.Fatal0(os.WriteFile(test, []byte(content.String()), 0644))
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", test).Run(t, "")
+
+	bad := filepath.Join(tmp, "bad.test")
+	or.Fatal0(os.WriteFile(bad, []byte("printf '%s\\n' " + long + "x\n#>" + long + "y\n"), 0644))
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", bad)
+	cmd.WantStderr(bad + ": incorrect test output\nexpected: " + long + "y\n  actual: " + long + "x\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check test case files too large to be held in memory
+func LargeTest(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	var content strings.Builder
+	content.WriteString("cat\n#rlimit nofile=64\n")
+	for k := 0; content.Len() < 3 << 20; k++ {
+		fmt.Fprintf(&content, "#<input line %d\n#>input line %d\n", k, k)
+	}
+	content.WriteString("#<Hello, world!\n#>msg GREETING name=world\n")
+	test := filepath.Join(tmp, "large.test")
+	or.Fatal0(os.WriteFile(test, []byte(content.String()), 0644))
+	gotest.Command(invig, "-no-cache", "-t", "30s", "-catalog", "testdata/catalog/en.cat", "/bin/sh", "--", test).Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "-t", "30s", "-catalog", "testdata/catalog/fr.cat", "/bin/sh", "--", test)
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, test + ": incorrect test output\nexpected: Bonjour, world !\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check a program producing much error output before the output expected first,
+// which it cannot do unless both streams are read at once
+func InterleavedStreams(t *testing.T, invig string) {
+	long := strings.Repeat("x", 300000)
+	test := filepath.Join(t.TempDir(), "stderr-first.test")
+	content := "echo " + long + " >&2\necho hello\nexit 1\n#>hello\n#!" + long + "\n"
+	or.Fatal0(os.WriteFile(test, []byte(content), 0644))
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", test).Run(t, "")
+}
+
+// Check the time limit when a program stops reading its input while invigilate
+// still has more input for it than a pipe can hold
+func BlockedInput(t *testing.T, invig string) {
+	test := filepath.Join(t.TempDir(), "blocked.test")
+	content := "sleep 5\n#<" + strings.Repeat("x", 300000) + "\n"
+	or.Fatal0(os.WriteFile(test, []byte(content), 0644))
+	cmd := gotest.Command(invig, "-no-cache", "-t", "500ms", "/bin/sh", "--", test)
+	cmd.WantStderr(test + `: time limit exceeded; program terminated by SIGTERM
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check running programs under a pseudo-terminal
+func Pty(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/pty").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "-pty", "132x50", "/bin/sh", "--", "testdata/pty/size.test")
+	cmd.WantStderr(`testdata/pty/size.test: incorrect test output
+expected: not a terminal
+  actual: 50 132
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-pty", "80", "/bin/sh", "--", "testdata/pty/size.test")
+	cmd.WantStderr("invalid terminal size \"80\"; must be columns x rows, such as 80x24\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check stripping and showing ANSI escape sequences in output
+func ANSI(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "-ansi", "strip", "/bin/sh", "--", "testdata/ansi/strip.test").Run(t, "")
+	gotest.Command(invig, "-no-cache", "-ansi", "show", "/bin/sh", "--", "testdata/ansi/show.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/ansi/strip.test")
+	cmd.WantStderr("testdata/ansi/strip.test: incorrect test output\nexpected: Error: bad\n  actual: ^[[1;31mError:^[[0m bad\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-ansi", "bogus", "/bin/sh", "--", "testdata/ansi/strip.test")
+	cmd.WantStderr("unknown -ansi mode \"bogus\"; must be strip or show\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check matching the output and error output as one stream
+func Merge(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/merge").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "-merge", "/bin/sh", "--", "testdata/merge")
+	cmd.WantStderr(`testdata/merge/swapped.test: incorrect test output
+expected: output
+  actual: error
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check ignoring the error output
+func IgnoreStderr(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "-ignore-stderr", "/bin/sh", "--", "testdata/ignore").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/ignore/failing.test")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, "testdata/ignore/failing.test: incorrect test error output\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-merge", "-ignore-stderr", "/bin/sh", "--", "testdata/ignore")
+	cmd.WantStderr("-ignore-stderr cannot be used with -merge\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check ignoring the output
+func IgnoreStdout(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/ignore/diagnostics.test").Run(t, "")
+	gotest.Command(invig, "-no-cache", "-ignore-stdout", "/bin/sh", "--", "testdata/normal/hello.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "-ignore-stdout", "/bin/sh", "--", "testdata/fail/baderror.test")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, "testdata/fail/baderror.test: incorrect test error output\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check "#?" lines giving the acceptable exit codes
+func ExitStatuses(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/status")
+	cmd.WantStderr(`testdata/status/killed.test: expected exit code any, but was killed by SIGKILL
+testdata/status/wrong.test: expected exit code 1|2, but exit code was 0
+2 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	bad := filepath.Join(t.TempDir(), "bad.test")
+	or.Fatal0(os.WriteFile(bad, []byte("#? 1|x\n#? 2\n"), 0644))
+	cmd = gotest.Command(invig, "validate", bad)
+	cmd.WantStdout(bad + `:1: invalid exit code "x"; must be a code, a range such as 64-78, any-nonzero, or any
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check "#>?" lines searching the output, and "#>^" lines forbidding text in it
+func Contains(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/contains")
+	cmd.WantStderr(`testdata/contains/leaked.test: test output contains forbidden text: DEBUG
+  actual: DEBUG x=41
+testdata/contains/missing.test: test output does not contain: second
+2 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check unordered blocks of expected output
+func Unordered(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/unordered")
+	cmd.WantStderr(`testdata/unordered/wrong.test: incorrect test output in unordered block
+expected: c 3
+  actual: c 4
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	bad := filepath.Join(t.TempDir(), "bad.test")
+	or.Fatal0(os.WriteFile(bad, []byte("#unordered\n#>x\n#<y\n#end-unordered\n"), 0644))
+	cmd = gotest.Command(invig, "validate", bad)
+	cmd.WantStdout(bad + ":3: input in the unordered block beginning at line 1\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check comparing output with its lines sorted
+func Sort(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/sort/shuffled.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "-sort", "/bin/sh", "--", "testdata/sort")
+	cmd.WantStderr(`testdata/sort/extra.test: extra output, with lines sorted: a
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check ignoring differences in white space
+func Whitespace(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "-whitespace", "trailing", "/bin/sh", "--", "testdata/whitespace").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/whitespace/option.test")
+	cmd.WantStderr(`testdata/whitespace/option.test: incorrect test output
+expected: a
+  actual: a 
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check ignoring a missing final newline
+func LenientNewline(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "-lenient-newline", "/bin/sh", "--", "testdata/newline").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/newline")
+	cmd.WantStderr("testdata/newline/expected.test: extra output: \n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check treating "\r\n" as "\n"
+func CRLF(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "-crlf", "/bin/sh", "--", "testdata/crlf").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/crlf")
+	cmd.WantStderr("testdata/crlf/windows.test: incorrect test output\nexpected: x.^M\n  actual: x^M.^M\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check comparing JSON output as data
+func JSON(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/json")
+	cmd.WantStderr(`testdata/json/incorrect.test: incorrect test output in JSON block
+$.items[1].n: expected 3, but was 2
+testdata/json/invalid.test: test output in JSON block is not valid JSON: invalid character 'o' after object key:value pair
+  actual: {"a": 1
+oops
+2 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check substitutions in output before matching
+func Scrub(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "-scrub", "/[0-9]+ms/TIME/", "/bin/sh", "--", "testdata/scrub").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/scrub")
+	cmd.WantStderr(`testdata/scrub/volatile.test: incorrect test output
+expected: started DATE in TIME
+  actual: started DATE in 17ms
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-scrub", "/unterminated", "/bin/sh", "--", "testdata/scrub")
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasPrefix(actual, `invalid value "/unterminated" for flag -scrub: substitution must be written as "/regexp/replacement/"`)
+	})
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check comparing output with an external command
+func Comparator(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/comparator/numbers.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "-comparator", "diff", "/bin/sh", "--", "testdata/comparator")
+	cmd.WantStderr(`testdata/comparator/diff.test: comparator rejected test error output
+2c2
+< four
+---
+> three
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check input and expected output in companion files
+func CompanionFiles(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/companion")
+	cmd.WantStderr(`testdata/companion/wrong.test: incorrect test output
+expected: 4
+  actual: 3
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	// Companion files replace the extension by which the test case was found.
+	tmp := t.TempDir()
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "good.sh"), []byte("echo hi\n"), 0644))
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "good.out"), []byte("hi\n"), 0644))
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "bad.sh"), []byte("echo bye\n"), 0644))
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "bad.out"), []byte("hi\n"), 0644))
+	bad := filepath.Join(tmp, "bad.sh")
+	cmd = gotest.Command(invig, "-no-cache", "-save-actual", "-interp", ".sh=/bin/sh", tmp)
+	cmd.WantStderr(bad + ": incorrect test output\nexpected: hi\n  actual: bye\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+	actual, e := os.ReadFile(filepath.Join(tmp, "bad.actual.out"))
+	or.Fatal0(e)
+	if string(actual) != "bye\n" {
+		t.Errorf("bad.actual.out holds %q", actual)
+	}
+}
+
+// Check input and expected output in files referred to by test cases
+func FileReferences(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/fileref/session.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/fileref")
+	cmd.WantStderr(`testdata/fileref/missing.test:8: stat testdata/fileref/expected/missing.txt: no such file or directory
+0 failed tests; 1 other errors
+`)
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check input and expected output given with escapes and base64
+func EncodedData(t *testing.T, invig string) {
+	gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/encoded/binary.test").Run(t, "")
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/encoded")
+	cmd.WantStderr(`testdata/encoded/unknown.test:8: unknown escape \q
+0 failed tests; 1 other errors
+`)
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check showing mismatches in binary output as hexdumps
+func Hexdump(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/hexdump")
+	cmd.WantStderr(`testdata/hexdump/binary.test: incorrect test output
+first difference at byte 8:
+      expected                                                             actual
+0000  68 65 61 64 65 72 00 01  03 61 62 63 64 65 66 67 |header...abcdefg|  68 65 61 64 65 72 00 01  02 61 62 63 64 65 66 67 |header...abcdefg|
+0010  68 69 6a 6b 6c 6d 6e 6f  70 71 72 73 74 75 0a    |hijklmnopqrstu. |  68 69 6a 6b 6c 6d 6e 6f  70 71 72 73 74 75 0a    |hijklmnopqrstu. |
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check showing control characters in failure messages
+func Printable(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/printable")
+	cmd.WantStderr(`testdata/printable/control.test: incorrect test output
+expected: ab
+  actual: a^[[1mb^M
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check matching output against its checksum
+func Checksum(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/checksum")
+	cmd.WantStderr(`testdata/checksum/wrong.test: incorrect checksum of test error output
+expected: 73cb3858a687a8494ca3323053016282f3dad39d42cf62ca4e79dda2aac7d9ac
+  actual: 3bb2abb69ebb27fbfe63c7639624c6ec5e331b841a5bc8c3ebc10b9285e90877
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check the number of lines and bytes of output
+func Volume(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/volume")
+	cmd.WantStderr(`testdata/volume/toomany.test: test output has 111 lines, but expected 90-110
+1 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check killing a program writing too much output
+func MaxOutput(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "-max-output", "64K", "/bin/sh", "--", "testdata/maxoutput")
+	cmd.WantStderr("testdata/maxoutput/runaway.test: error output: output limit of 65536 bytes exceeded\n" +
+		"error output began: " + strings.Repeat("0", 256) + "\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-max-output", "lots", "/bin/sh", "--", "testdata/maxoutput")
+	cmd.WantStderr("invalid output limit \"lots\"\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check saving the output of failed tests beside them
+func SaveActual(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	good := filepath.Join(tmp, "good.test")
+	bad := filepath.Join(tmp, "bad.test")
+	or.Fatal0(os.WriteFile(good, []byte("echo alpha\n#>alpha\n"), 0644))
+	or.Fatal0(os.WriteFile(bad, []byte("echo gamma >&2; echo beta\n#!gamma\n#>delta\n"), 0644))
+	cmd := gotest.Command(invig, "-no-cache", "-save-actual", "/bin/sh", "--", good, bad)
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "1 failed tests\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	for path, want := range map[string]string{"bad.actual.out": "beta\n", "bad.actual.err": "gamma\n"} {
+		content, e := os.ReadFile(filepath.Join(tmp, path))
+		or.Fatal0(e)
+		if string(content) != want {
+			t.Errorf("%s holds %q; expected %q", path, content, want)
+		}
+	}
+	if _, e := os.Stat(filepath.Join(tmp, "good.actual.out")); !os.IsNotExist(e) {
+		t.Errorf("output saved for a passing test")
+	}
+}
+
+// Check the directories of files describing failed tests
+func Artifacts(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "artifacts")
+	test := filepath.Join(tmp, "bad.test")
+	or.Fatal0(os.WriteFile(test, []byte("echo beta\nexit 3\n#>beta\n"), 0644))
+	cmd := gotest.Command(invig, "-no-cache", "-artifacts", dir, "-save-actual", "/bin/sh", "--", test)
+	cmd.CheckStderr(func(actual string) bool {
+		return strings.HasSuffix(actual, "1 failed tests\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	entries, e := os.ReadDir(dir)
+	or.Fatal0(e)
+	if len(entries) != 1 {
+		t.Fatalf("%d artifact directories; expected 1", len(entries))
+	}
+	sub := filepath.Join(dir, entries[0].Name())
+	for name, want := range map[string]string{
+		"command.txt":    "command: /bin/sh " + test + "\n",
+		"transcript.txt": "> beta\n",
+		"result.txt":     "exit code: 3\n",
+		"bad.actual.out": "beta\n",
+	} {
+		content, e := os.ReadFile(filepath.Join(sub, name))
+		or.Fatal0(e)
+		if !strings.Contains(string(content), want) {
+			t.Errorf("%s does not contain %q:\n%s", name, want, content)
+		}
+	}
+	if _, e := os.Stat(filepath.Join(tmp, "bad.actual.out")); !os.IsNotExist(e) {
+		t.Errorf("output saved beside the test, rather than with the artifacts")
+	}
+}
+
+// Check showing the whole transcript of failed tests
+func Transcript(t *testing.T, invig string) {
+	pattern := regexp.MustCompile(`^testdata/transcript/session.test: incorrect test output
+expected: four
+  actual: three
+testdata/transcript/session.test: run as: /bin/sh testdata/transcript/session.test
+testdata/transcript/session.test: transcript of the failed run:
+ +[0-9.]+s > one
+ +[0-9.]+s < 1
+ +[0-9.]+s ! two
+ +[0-9.]+s < 2
+ +[0-9.]+s > three
+1 failed tests
+$`)
+	cmd := gotest.Command(invig, "-no-cache", "-transcript", "/bin/sh", "--", "testdata/transcript")
+	cmd.CheckStderr(pattern.MatchString)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check the cwd directive
+func Cwd(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/cwd")
+	cmd.WantStderr(`testdata/cwd/missing.test: working directory: stat testdata/cwd/nowhere: no such file or directory
+0 failed tests; 1 other errors
+`)
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the fixture directive
+func Fixture(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/fixture")
+	cmd.WantStderr(`testdata/fixture/missing.test: copying fixture data/absent.csv: lstat testdata/fixture/data/absent.csv: no such file or directory
+testdata/fixture/withcwd.test: cwd and fixture directives cannot both be given
+0 failed tests; 2 other errors
+`)
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check the file directive
+func FileChecks(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/filecheck")
+	cmd.WantStderr(`testdata/filecheck/stray.test: file log.txt exists, but should not
+testdata/filecheck/unwritten.test: file out.txt was not written
+testdata/filecheck/wrong.test: incorrect contents of file out.txt at line 2
+expected: beta
+  actual: gamma
+3 failed tests
+`)
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check contents blocks matching files written by the program
+func Contents(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/contents")
+	cmd.WantStderr(`testdata/contents/extra.test: incorrect contents of file list.txt at line 2
+expected: (end of file)
+  actual: two
+testdata/contents/forbidden.test: file log.txt contains forbidden text: error
+  actual: error: disk full
+testdata/contents/stderr.test:8: error output in the contents block beginning at line 6
+testdata/contents/wrong.test: incorrect contents of file list.txt at line 2
+expected: three
+  actual: two
+3 failed tests; 1 other errors
+`)
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check setup and teardown scripts for directories
+func Hooks(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/hooks")
+	cmd.WantStderr(`testdata/hooks/broken/_setup.sh: exit status 1
+cannot start
+testdata/hooks/broken/never.test: not run, since testdata/hooks/broken/_setup.sh failed
+0 failed tests; 1 other errors
+`)
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	if _, e := os.Stat("testdata/hooks/state.txt"); !os.IsNotExist(e) {
+		t.Errorf("teardown script was not run")
+	}
+}
+
+// Check the commands run before and after all the tests
+func BeforeAfter(t *testing.T, invig string) {
+	log := filepath.Join(t.TempDir(), "log")
+	cmd := gotest.Command(invig, "-no-cache", "-before", "echo before >> " + log, "-after", "echo after >> " + log,
+		"/bin/sh", "--", "testdata/mix/anteater.test")
+	cmd.Run(t, "")
+	content, e := os.ReadFile(log)
+	or.Fatal0(e)
+	if string(content) != "before\nafter\n" {
+		t.Errorf("wrong commands run: %q", content)
+	}
+
+	cmd = gotest.Command(invig, "-no-cache", "-before", "echo no server; exit 1", "-after", "echo cleaned up >> " + log,
+		"/bin/sh", "--", "testdata/mix/anteater.test")
+	cmd.WantStderr("before command failed: exit status 1\nno server\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+	content, e = os.ReadFile(log)
+	or.Fatal0(e)
+	if string(content) != "before\nafter\ncleaned up\n" {
+		t.Errorf("after command not run after failure: %q", content)
+	}
+	// Interrupting the -before command stops it; a second interrupt, while the
+	// -after command is running, waits for it to finish.
+	or.Fatal0(os.Remove(log))
+	interrupted := exec.Command(invig, "-no-cache", "-before", "sleep 5", "-after", "sleep 1; echo after >> " + log,
+		"/bin/sh", "--", "testdata/mix/anteater.test")
+	or.Fatal0(interrupted.Start())
+	time.Sleep(300 * time.Millisecond)
+	or.Fatal0(interrupted.Process.Signal(syscall.SIGINT))
+	time.Sleep(300 * time.Millisecond)
+	or.Fatal0(interrupted.Process.Signal(syscall.SIGINT))
+	e = interrupted.Wait()
+	if ee, ok := e.(*exec.ExitError); !ok || ee.ExitCode() != 130 {
+		t.Errorf("wrong exit status: %v", e)
+	}
+	content, e = os.ReadFile(log)
+	or.Fatal0(e)
+	if string(content) != "after\n" {
+		t.Errorf("after command not run once when interrupted: %q", content)
+	}
+}
+
+// Check compiling each test case, and placing the test case in the command line
+func Compile(t *testing.T, invig string) {
+	compile := "sh -n {test} && { echo '#!/bin/sh'; cat {test}; } > {exe} && chmod +x {exe}"
+	cmd := gotest.Command(invig, "-no-cache", "-compile", compile, "{exe}", "--", "testdata/compile")
+	cmd.CheckStderr(func(actual string) bool {
+		// The message about the syntax error depends on the shell.
+		return strings.HasPrefix(actual, "testdata/compile/bad.test: compilation failed: exit status 2\n") &&
+			strings.HasSuffix(actual, "\n1 failed tests\n")
+	})
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "/bin/sh", "{test}", "last", "--", "testdata/template")
+	cmd.Run(t, "")
+	cmd = gotest.Command(invig, "-no-cache", "/bin/sh", "{}", "last", "--", "testdata/template")
+	cmd.Run(t, "")
+}
+
+// Check the run, list, fmt, and record subcommands
+func Subcommands(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "run", "-no-cache", "/bin/sh", "{test}", "last", "--", "testdata/template")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "list", "-shard", "1/2", "testdata/mix")
+	cmd.WantStdout("testdata/mix/bumblebee.test\ntestdata/mix/dingo.test\n")
+	cmd.Run(t, "")
+
+	// The list subcommand finds test cases as running them does.
+	scripts := t.TempDir()
+	hello := filepath.Join(scripts, "hello.sh")
+	or.Fatal0(os.WriteFile(hello, []byte("echo hello\n#>hello\n"), 0644))
+	or.Fatal0(os.WriteFile(filepath.Join(scripts, "notes.txt"), []byte("not a test\n"), 0644))
+	cmd = gotest.Command(invig, "list", "-interp", ".sh=/bin/sh", scripts)
+	cmd.WantStdout(hello + "\n")
+	cmd.Run(t, "")
+
+	// A program named like a subcommand follows "--".
+	bin := t.TempDir()
+	or.Fatal0(os.WriteFile(filepath.Join(bin, "list"), []byte("#!/bin/sh\nexec /bin/sh \"$@\"\n"), 0755))
+	t.Setenv("PATH", bin + string(os.PathListSeparator) + os.Getenv("PATH"))
+	gotest.Command(invig, "-no-cache", "--", "list", "--", hello).Run(t, "")
+
+	tmp := t.TempDir()
+	messy := filepath.Join(tmp, "messy.test")
+	fresh := filepath.Join(tmp, "fresh.test")
+	or.Fatal0(os.WriteFile(messy, []byte("echo alpha\n#>alpha\n#?   0\n#first-output-within\t5s\n"), 0644))
+	or.Fatal0(os.WriteFile(fresh, []byte("echo beta\n"), 0644))
+
+	cmd = gotest.Command(invig, "fmt", "-l", tmp)
+	cmd.WantStdout(messy + "\n")
+	cmd.Run(t, "")
+	cmd = gotest.Command(invig, "fmt", tmp)
+	cmd.WantStdout(messy + "\n")
+	cmd.Run(t, "")
+	content, e := os.ReadFile(messy)
+	or.Fatal0(e)
+	if want := "echo alpha\n#>alpha\n#? 0\n#first-output-within 5s\n"; string(content) != want {
+		t.Errorf("formatted test holds %q; expected %q", content, want)
+	}
+
+	cmd = gotest.Command(invig, "record", "/bin/sh", "--", tmp)
+	cmd.WantStdout(fresh + "\n")
+	cmd.Run(t, "")
+	content, e = os.ReadFile(filepath.Join(tmp, "fresh.out"))
+	or.Fatal0(e)
+	if string(content) != "beta\n" {
+		t.Errorf("recorded output is %q; expected %q", content, "beta\n")
+	}
+	if _, e := os.Stat(filepath.Join(tmp, "messy.out")); !os.IsNotExist(e) {
+		t.Errorf("output recorded for a test giving its own expected output")
+	}
+}
+
+// Check default options given in INVIGILATE_OPTS
+func EnvOptions(t *testing.T, invig string) {
+	cmd := gotest.Command("env", "INVIGILATE_OPTS=-no-cache  -v", invig, "/bin/sh", "--", "testdata/mix/anteater.test")
+	cmd.WantStdout("\ntestdata/mix/anteater.test\n$ /bin/sh testdata/mix/anteater.test\n>anteater\n\nAll tests passed.\n")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command("env", "INVIGILATE_OPTS=-no-cache -v", invig, "-v=false", "/bin/sh", "--", "testdata/mix/anteater.test")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command("env", "INVIGILATE_OPTS=-no-cache /bin/sh", invig, "/bin/sh", "--", "testdata/mix/anteater.test")
+	cmd.WantStderr("INVIGILATE_OPTS may hold only options; found /bin/sh\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	// Replay scripts are given the options explicitly, not through INVIGILATE_OPTS.
+	dir := t.TempDir()
+	cmd = gotest.Command("env", "INVIGILATE_OPTS=-t 3s", invig, "-replay", dir, "/bin/sh", "--", "testdata/mix/bumblebee.test")
+	cmd.CheckStderr(func(actual string) bool { return true })
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+	script, e := os.ReadFile(filepath.Join(dir, "testdata_mix_bumblebee.test.sh"))
+	if e != nil {
+		t.Fatal(e)
+	} else if strings.Contains(string(script), "INVIGILATE_OPTS") || !strings.Contains(string(script), " -t=3s ") {
+		t.Errorf("wrong replay script:\n%s", script)
+	}
+}
+
+// Check arguments read from files named with @
+func ArgsFile(t *testing.T, invig string) {
+	args := filepath.Join(t.TempDir(), "args")
+	or.Fatal0(os.WriteFile(args, []byte("-no-cache\r\n/bin/sh\n--\n\ntestdata/mix/anteater.test\ntestdata/mix/bumblebee.test\n"), 0644))
+	cmd := gotest.Command(invig, "@" + args)
+	cmd.WantStderr("testdata/mix/bumblebee.test: incorrect test output\nexpected: bumblebee\n  actual: hornet\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "/bin/sh", "--", "@" + args + ".missing")
+	cmd.WantStderr("open " + args + ".missing: no such file or directory\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check giving test cases to the program on standard input
+func Stdin(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "-stdin", "sed", "-n", "s/^say //p", "--", "testdata/stdin/say.test")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "-stdin", "-strip", "grep", "-c", ".", "--", "testdata/stdin/count.test")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "-stdin", "grep", "-c", ".", "--", "testdata/stdin/count.test")
+	cmd.WantStderr("testdata/stdin/count.test: incorrect test output\nexpected: 6\n  actual: 9\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	input := filepath.Join(t.TempDir(), "input.test")
+	or.Fatal0(os.WriteFile(input, []byte("#<alpha\n#>alpha\n"), 0644))
+	cmd = gotest.Command(invig, "-no-cache", "-stdin", "cat", "--", input)
+	cmd.WantStderr(input + ": input cannot be given with -stdin\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+}
+
+// Check giving the program a copy of the test case without the lines for invigilate
+func Strip(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "-strip", "grep", "-c", ".", "--", "testdata/stdin/count.test")
+	cmd.Run(t, "")
+
+	compile := "{ echo 'grep -c .' {test}; } > {exe} && chmod +x {exe}"
+	cmd = gotest.Command(invig, "-no-cache", "-strip", "-compile", compile, "/bin/sh", "{exe}", "--", "testdata/stdin/count.test")
+	cmd.Run(t, "")
+}
+
+// Check running test cases with the interpreters named on their "#!" lines
+func Shebang(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "-shebang", "/bin/sh", "--", "testdata/shebang")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-shebang", "--", "testdata/shebang")
+	cmd.WantStderr("testdata/shebang/plain.test: no program for the test case\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/shebang/shell.test")
+	cmd.WantStderr("testdata/shebang/shell.test: incomplete test error output\nexpected: /bin/sh -e\n  actual: \n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
+
+// Check running test cases with interpreters chosen by their extensions
+func Interp(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "-interp", ".awk=awk -f, .sh=/bin/sh", "/bin/sh", "--", "testdata/interp")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-interp", ".awk=awk -f,.sh=/bin/sh", "--", "testdata/interp")
+	cmd.WantStderr("testdata/interp/plain.test: no program for the test case\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-interp", "awk", "--", "testdata/interp")
+	cmd.WantStderr("invalid interpreter \"awk\": must be .ext=command\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check comment delimiters chosen by the extensions of test cases
+func Comments(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "-comments", ".txt=//", "grep", "^[a-z]", "--", "testdata/comments")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "grep", "^[a-z]", "--", "testdata/comments/lines.txt")
+	cmd.WantStderr("testdata/comments/lines.txt: extra output: alpha\nbeta\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "validate", "-comments", ".txt=//", "testdata/comments")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-comments", ".txt", "cat", "--", "testdata/comments")
+	cmd.WantStderr("invalid comment delimiter \".txt\": must be .ext=delimiter\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check comment delimiters named by test cases
+func NamedComment(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "grep", "^[a-z]", "--", "testdata/comments/named.test")
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "-shebang", "--", "testdata/shebang/comment.test")
+	cmd.Run(t, "")
+}
+
+// Check giving the program with -program
+func ProgramOption(t *testing.T, invig string) {
+	test := filepath.Join(t.TempDir(), "args.test")
+	or.Fatal0(os.WriteFile(test, []byte("echo \"$1|$2|$3\"\n#>two words|--|a\"b\n"), 0644))
+	cmd := gotest.Command(invig, "-no-cache", "-program", `/bin/sh {} 'two words' -- "a\"b"`, test)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "-program", `/bin/sh {} 'two words' -- "a\"b"`, "--", test)
+	cmd.Run(t, "")
+
+	// A backslash and newline continue the line, within double quotes too.
+	cmd = gotest.Command(invig, "-no-cache", "-program", "/bin/sh {} \\\n'two words' \\\n-\\\n- \"a\\\"\\\nb\"", test)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-program", "/bin/sh 'oops", test)
+	cmd.WantStderr("-program: unterminated single quote in \"/bin/sh 'oops\"\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-program", "/bin/sh", "cat", "--", test)
+	cmd.WantStderr("-program cannot be used with a program before \"--\"\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check files holding several test cases
+func Cases(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/cases")
+	cmd.WantStderr("testdata/cases/sum.test:wrong: incorrect test output\nexpected: 5\n  actual: 4\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	dup := filepath.Join(t.TempDir(), "dup.test")
+	or.Fatal0(os.WriteFile(dup, []byte("echo alpha\n#>alpha\n#case one\n#case one\n"), 0644))
+	cmd = gotest.Command(invig, "-no-cache", "/bin/sh", "--", dup)
+	cmd.WantStderr(dup + ":4: duplicate test case \"one\"\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "validate", "testdata/cases")
+	cmd.Run(t, "")
+}
+
+// Check the titles of test cases
+func Title(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	test := filepath.Join(tmp, "sum.test")
+	report := filepath.Join(tmp, "report.json")
+	or.Fatal0(os.WriteFile(test, []byte("#: Adds two\n#:   small numbers\necho 4\n#>5\n"), 0644))
+	cmd := gotest.Command(invig, "-no-cache", "-json", report, "/bin/sh", "--", test)
+	cmd.WantStderr(test + ": incorrect test output\nexpected: 5\n  actual: 4\n" +
+		test + ": title: Adds two small numbers\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+	content, e := os.ReadFile(report)
+	or.Fatal0(e)
+	if !strings.Contains(string(content), `"Title": "Adds two small numbers"`) {
+		t.Errorf("report does not include the title:\n%s", content)
+	}
+
+	or.Fatal0(os.WriteFile(test, []byte("#: Adds two numbers\necho 4\n#>4\n"), 0644))
+	cmd = gotest.Command(invig, "-no-cache", "-v", "/bin/sh", "--", test)
+	cmd.WantStdout("\n" + test + ": Adds two numbers\n$ /bin/sh " + test + "\n>4\n\nAll tests passed.\n")
+	cmd.Run(t, "")
+}
+
+// Check including shared files in test cases
+func Include(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/include")
+	cmd.Run(t, "")
+
+	tmp := t.TempDir()
+	missing := filepath.Join(tmp, "missing.test")
+	loop := filepath.Join(tmp, "loop.test")
+	or.Fatal0(os.WriteFile(missing, []byte("echo alpha\n#include nothing.inc\n"), 0644))
+	or.Fatal0(os.WriteFile(loop, []byte("echo alpha\n#>alpha\n#include loop.test\n"), 0644))
+
+	// An absolute path is used as it is.
+	abs := filepath.Join(tmp, "abs.test")
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "greet.inc"), []byte("#<hello\n#>hello\n"), 0644))
+	or.Fatal0(os.WriteFile(abs, []byte("read x\necho $x\n#include " + filepath.Join(tmp, "greet.inc") + "\n"), 0644))
+	cmd = gotest.Command(invig, "-no-cache", "/bin/sh", "--", abs)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-no-cache", "/bin/sh", "--", missing, loop)
+	cmd.WantStderr(missing + ":2: open " + filepath.Join(tmp, "nothing.inc") + ": no such file or directory\n" +
+		loop + ":3: loop.test includes itself\n0 failed tests; 2 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check replacing variables in the arguments of directives
+func Variables(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	work := filepath.Join(tmp, "work")
+	or.Fatal0(os.Mkdir(work, 0755))
+	t.Setenv("VARS_WORK", work)
+	env := filepath.Join(tmp, "env.test")
+	builtin := filepath.Join(tmp, "builtin.test")
+	unset := filepath.Join(tmp, "unset.test")
+	or.Fatal0(os.WriteFile(env, []byte("#cwd ${VARS_WORK}\ntouch marker\n#file marker exists\n"), 0644))
+	or.Fatal0(os.WriteFile(builtin, []byte("#expand\n#cwd %{testdir}\n#file %{testname}.test exists\n#file %%{testname} absent\n" +
+		"echo builtin '%{testname}'\n#>%{testname} %%{testname}\n"), 0644))
+	or.Fatal0(os.WriteFile(unset, []byte("#expand\necho '${VARS_UNSET} %{unknown} ${'\n#>${VARS_UNSET} %{unknown} ${\n"), 0644))
+	// Without an expand directive, data lines are left alone.
+	data := filepath.Join(tmp, "data.test")
+	or.Fatal0(os.WriteFile(data, []byte("echo '%{testname} ${HOME}'\n#>%{testname} ${HOME}\n"), 0644))
+
+	// The argument of an include directive is replaced before the file is read.
+	t.Setenv("VARS_SUB", "sub")
+	or.Fatal0(os.Mkdir(filepath.Join(tmp, "sub"), 0755))
+	or.Fatal0(os.WriteFile(filepath.Join(tmp, "sub", "greet.inc"), []byte("#<hello\n#>hello\n"), 0644))
+	include := filepath.Join(tmp, "include.test")
+	or.Fatal0(os.WriteFile(include, []byte("read x\necho $x\n#include ${VARS_SUB}/greet.inc\n"), 0644))
+
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", env, builtin, include, unset, data)
+	cmd.Run(t, "")
+	if _, e := os.Stat(filepath.Join(work, "marker")); e != nil {
+		t.Error(e)
+	}
+}
+
+// Check running test cases for each of several values of variables
+func Matrix(t *testing.T, invig string) {
+	cmd := gotest.Command(invig, "-no-cache", "/bin/sh", "--", "testdata/matrix")
+	cmd.Run(t, "")
+
+	tmp := t.TempDir()
+	size := filepath.Join(tmp, "size.test")
+	dup := filepath.Join(tmp, "dup.test")
+	or.Fatal0(os.WriteFile(size, []byte("#matrix N=1,2\n#output-lines %{N}\necho x\n"), 0644))
+	or.Fatal0(os.WriteFile(dup, []byte("#matrix N=1,1\n"), 0644))
+	cmd = gotest.Command(invig, "-no-cache", "/bin/sh", "--", size, dup)
+	cmd.WantStderr(size + ":N=2: test output has 1 lines, but expected 2\n" +
+		dup + ":1: duplicate value \"1\" for matrix variable N\n1 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check running each test several times
+func Count(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	t.Setenv("FLAKY_COUNT", filepath.Join(tmp, "count"))
+	flaky := filepath.Join(tmp, "flaky.test")
+	script := `n=$(($(cat "$FLAKY_COUNT" 2>/dev/null || echo 0) + 1))
+echo $n > "$FLAKY_COUNT"
+[ $((n % 2)) = 1 ] && echo ok || echo bad
+#>ok
+`
+	or.Fatal0(os.WriteFile(flaky, []byte(script), 0644))
+	// The test is counted once, however many of its runs fail.
+	cmd := gotest.Command(invig, "-count", "5", "/bin/sh", "--", flaky)
+	fail := flaky + ": incorrect test output\nexpected: ok\n  actual: bad\n"
+	cmd.WantStderr(fail + flaky + ": run 2 of 5\n" + fail + flaky + ": run 4 of 5\n1 failed tests (2 of 5 runs)\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	// Errors are likewise counted once for each test.
+	missing := filepath.Join(tmp, "missing.test")
+	or.Fatal0(os.WriteFile(missing, []byte("#cwd nowhere\necho x\n"), 0644))
+	cmd = gotest.Command(invig, "-count", "2", "/bin/sh", "--", missing)
+	noDir := missing + ": working directory: stat " + filepath.Join(tmp, "nowhere") + ": no such file or directory\n"
+	cmd.WantStderr(noDir + missing + ": run 1 of 2\n" + noDir + missing + ": run 2 of 2\n0 failed tests; 1 other errors\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+
+	cmd = gotest.Command(invig, "-count", "0", "/bin/sh", "--", flaky)
+	cmd.WantStderr("-count must be at least 1\n")
+	cmd.WantCode(2)
+	cmd.Run(t, "")
+}
+
+// Check finding tests whose output differs from one run to the next
+func Determinism(t *testing.T, invig string) {
+	tmp := t.TempDir()
+	t.Setenv("RUN_COUNT", filepath.Join(tmp, "count"))
+	stable := filepath.Join(tmp, "stable.test")
+	varies := filepath.Join(tmp, "varies.test")
+	or.Fatal0(os.WriteFile(stable, []byte("echo same\n#>same\n"), 0644))
+	script := `n=$(($(cat "$RUN_COUNT" 2>/dev/null || echo 0) + 1))
+echo $n > "$RUN_COUNT"
+echo start
+echo run $n
+#ignore-stdout
+`
+	or.Fatal0(os.WriteFile(varies, []byte(script), 0644))
+	cmd := gotest.Command(invig, "-determinism", "/bin/sh", "--", stable, varies)
+	cmd.WantStderr(varies + ": output differs between runs at line 2\n first run: \"run 1\\n\"\nsecond run: \"run 2\\n\"\n" +
+		"1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+
+	// A test failing only the second time fails.
+	or.Fatal0(os.Remove(filepath.Join(tmp, "count")))
+	second := filepath.Join(tmp, "second.test")
+	script = `n=$(($(cat "$RUN_COUNT" 2>/dev/null || echo 0) + 1))
+echo $n > "$RUN_COUNT"
+[ $n = 1 ] && echo ok || echo bad
+#>ok
+`
+	or.Fatal0(os.WriteFile(second, []byte(script), 0644))
+	cmd = gotest.Command(invig, "-determinism", "/bin/sh", "--", second)
+	cmd.WantStderr(second + ": incorrect test output\nexpected: ok\n  actual: bad\n1 failed tests\n")
+	cmd.WantCode(1)
+	cmd.Run(t, "")
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Programs that write JSON may order the keys of objects, and lay out the text,
+// differently from run to run, or from one version to the next. The lines expected
+// between the directives "json" and "end-json" hold a single JSON value, which is
+// compared with the next JSON value received, as data rather than as text: the
+// order of keys and the white space between tokens are ignored. Output is read a
+// line at a time until it holds a complete JSON value. With "json ignore=id,time",
+// the listed fields are ignored wherever they appear in objects, for fields such as
+// timestamps and generated identifiers. Input cannot be given within such a block.
+
+// parseJSONIgnore parses the argument of a "json" directive, returning the names
+// of the fields to ignore.
+func parseJSONIgnore(arg string) ([]string, error) {
+	if arg == "" {
+		return nil, nil
+	}
+	list, ok := strings.CutPrefix(arg, "ignore=")
+	if !ok || list == "" {
+		return nil, errors.New("argument must be ignore= followed by field names")
+	}
+	return strings.Split(list, ","), nil
+}
+
+// checkJSON checks a "json" directive.
+func checkJSON(arg string) error {
+	_, e := parseJSONIgnore(arg)
+	return e
+}
+
+// jsonStatus reports whether text begins with a complete JSON value, or returns
+// an error if it cannot, whatever text follows.
+func jsonStatus(text []byte) (bool, error) {
+	var v any
+	e := json.NewDecoder(bytes.NewReader(text)).Decode(&v)
+	if e == io.EOF || e == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	return e == nil, e
+}
+
+// jsonDiff compares an expected JSON value with the one received, ignoring the
+// listed fields. If they differ, it describes the first difference found.
+func jsonDiff(want, have string, ignore []string) (string, error) {
+	var w, h any
+	if e := json.Unmarshal([]byte(want), &w); e != nil {
+		return "", fmt.Errorf("invalid JSON expected: %s", e)
+	}
+	if e := json.Unmarshal([]byte(have), &h); e != nil {
+		return "", fmt.Errorf("invalid JSON received: %s", e)
+	}
+	ignored := map[string]bool{}
+	for _, name := range ignore {
+		ignored[name] = true
+	}
+	return jsonValueDiff("$", w, h, ignored), nil
+}
+
+// jsonValueDiff describes the first difference between two decoded JSON values,
+// found at the given path, or returns "" if there is none.
+func jsonValueDiff(path string, want, have any, ignored map[string]bool) string {
+	switch w := want.(type) {
+	case map[string]any:
+		h, ok := have.(map[string]any)
+		if !ok {
+			break
+		}
+		var keys []string
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range h {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if ignored[k] {
+				continue
+			}
+			wv, wok := w[k]
+			hv, hok := h[k]
+			if !hok {
+				return fmt.Sprintf("%s: missing field %q", path, k)
+			} else if !wok {
+				return fmt.Sprintf("%s: unexpected field %q", path, k)
+			} else if diff := jsonValueDiff(path+"."+k, wv, hv, ignored); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case []any:
+		h, ok := have.([]any)
+		if !ok {
+			break
+		} else if len(w) != len(h) {
+			return fmt.Sprintf("%s: expected %d elements, but there are %d", path, len(w), len(h))
+		}
+		for i := range w {
+			if diff := jsonValueDiff(fmt.Sprintf("%s[%d]", path, i), w[i], h[i], ignored); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	default:
+		if want == have {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s: expected %s, but was %s", path, jsonText(want), jsonText(have))
+}
+
+// jsonText returns a decoded JSON value as compact JSON text.
+func jsonText(v any) string {
+	text, _ := json.Marshal(v)
+	return string(text)
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// streamThreshold is the size, in bytes, above which a test case file is not
+// read into memory, but is read a line at a time whenever it is needed. This
+// allows for generated test cases holding hundreds of megabytes of input.
+const streamThreshold = 1 << 20
+
+// LineReader reads the lines of a test case, each with its final newline, if any,
+// either from its content or, for a streamed test case, from its file.
+type LineReader struct {
+	rest    string        // the lines not yet read, for a test case held in memory
+	f       *os.File      // the file, for a streamed test case
+	r       *bufio.Reader // reading from f
+	resolve bool          // whether to resolve message references in each line
+	shebang bool          // whether to skip a first line beginning with "#!"
+	path    string
+	line    string // the line most recently read
+	lineno  int    // its number, counting from 1
+	err     error
+}
+
+// lines returns a LineReader for the lines of a test case. In a streamed test case,
+// message references are resolved as the lines are read; resolveMessages has
+// already done so for other test cases. The LineReader must be closed.
+func (t Test) lines() *LineReader {
+	lr := &LineReader{rest: t.content, path: t.path, shebang: shebangMode}
+	if t.streamed {
+		lr.f, lr.err = os.Open(t.path)
+		if lr.err == nil {
+			lr.r = bufio.NewReaderSize(lr.f, 65536)
+		}
+		lr.resolve = catalog != nil
+	}
+	return lr
+}
+
+// scan reads the next line, which is then available from text. It returns false
+// when there are no more lines, or an error has occurred.
+func (lr *LineReader) scan() bool {
+	if lr.err != nil {
+		return false
+	}
+	if lr.r == nil {
+		if lr.rest == "" {
+			return false
+		}
+		n := strings.IndexByte(lr.rest, '\n') + 1
+		if n == 0 {
+			n = len(lr.rest)
+		}
+		lr.line, lr.rest = lr.rest[:n], lr.rest[n:]
+	} else {
+		var e error
+		lr.line, e = lr.r.ReadString('\n')
+		if e != nil && e != io.EOF {
+			lr.err = e
+			return false
+		} else if lr.line == "" {
+			return false
+		}
+	}
+	lr.lineno++
+	if lr.lineno == 1 && lr.shebang && strings.HasPrefix(lr.line, "#!") {
+		// The interpreter of the test case, with -shebang.
+		return lr.scan()
+	}
+	lr.line = trimCR(lr.line)
+	if lr.resolve {
+		resolved, e := resolveLine(lr.line)
+		if e != nil {
+			lr.err = fmt.Errorf("%s:%d: %s", lr.path, lr.lineno, e)
+			return false
+		}
+		lr.line = resolved
+	}
+	return true
+}
+
+// text returns the line most recently read by scan.
+func (lr *LineReader) text() string {
+	return lr.line
+}
+
+// close closes the file, if any, and returns the first error that occurred
+// reading the lines. It may be called more than once.
+func (lr *LineReader) close() error {
+	if lr.f != nil {
+		lr.f.Close()
+		lr.f = nil
+	}
+	return lr.err
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// list implements the list subcommand, which lists the test cases that would
+// be run, without running them.
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	discoveryFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `
+Usage: invigilate list [options] files
+
+List shows the paths of the test cases that would be run with the same files,
+one per line, in the order they would be run, without running them. The options
+are those that choose the test cases when running them, and should be given in
+the same way; with -shard, only those in the given shard are listed.
+
+Options:
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		fatal(exitError, "No test cases specified")
+	}
+	if interpSpec != "" {
+		if e := parseInterpreters(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+	if e := parseComments(); e != nil {
+		fatal(exitError, e)
+	}
+	if shardSpec != "" {
+		if e := parseShard(); e != nil {
+			fatal(exitError, e)
+		}
+	}
+
+	ctx := context.Background()
+	ch := make(chan Test, lookahead)
+	go findTests(ctx, fs.Args(), ch)
+	if shardSpec != "" {
+		all := ch
+		ch = make(chan Test, lookahead)
+		go shardTests(ctx, all, ch)
+	}
+	errors := 0
+	for t := range ch {
+		if t.err != nil {
+			log.Print(t.err)
+			errors++
+		} else {
+			fmt.Println(t.path)
+		}
+	}
+	if errors > 0 {
+		os.Exit(exitError)
+	}
+}
+
+// discoveryFlags defines the options that choose the test cases to be run,
+// and their order, so that the list subcommand chooses them in the same way.
+func discoveryFlags(fs *flag.FlagSet) {
+	fs.StringVar(&commentSpec, "comments", "", "use these comment delimiters for test cases with these extensions, given as a comma separated `map` such as \".c=//,.sql=--\"")
+	fs.StringVar(&extension, "e", ".test", "test case files have this extension")
+	fs.StringVar(&interpSpec, "interp", "", "run test cases with these extensions with these interpreters, given as a comma separated `map` such as \".py=python3,.awk=awk -f\"")
+	fs.StringVar(&shardSpec, "shard", "", "run only shard `i/n` of the tests, for splitting a run across machines")
+	fs.StringVar(&shardBalance, "shard-balance", "", "balance shards using durations from this history database")
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A test case may be run with each of several values of a variable, given by
+// a directive such as "#matrix SIZE=1,10,1000". The test case is then split into
+// instances, one for each value, in which "%{SIZE}" is replaced by the value
+// throughout: in the input, the expected output, and the arguments of directives.
+// With more than one matrix directive, there is an instance for each combination
+// of their values. The program is run separately for each instance, and given
+// a copy of it, as for the test cases in a file with case directives. Each
+// instance is reported as the path of the file, a colon, and the values of the
+// variables, as in "sort.test:SIZE=10" or "sort.test:SIZE=10,ORDER=up".
+
+// checkMatrix checks the argument of a matrix directive.
+func checkMatrix(arg string) error {
+	_, _, e := parseMatrix(arg)
+	return e
+}
+
+// parseMatrix parses the argument of a matrix directive, returning the name
+// of the variable and its values.
+func parseMatrix(arg string) (string, []string, error) {
+	name, list, ok := strings.Cut(arg, "=")
+	if !ok {
+		return "", nil, errors.New("matrix must be given as NAME=value,value,...")
+	}
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_')
+	}) >= 0 {
+		return "", nil, fmt.Errorf("matrix variable name %q must be letters, digits, and underscores", name)
+	}
+	switch name {
+	case "testdir", "testname", "tmpdir":
+		return "", nil, fmt.Errorf("matrix variable name %q is already in use", name)
+	}
+	values := strings.Split(list, ",")
+	for k, v := range values {
+		if v == "" {
+			return "", nil, fmt.Errorf("empty value for matrix variable %s", name)
+		}
+		for _, w := range values[:k] {
+			if v == w {
+				return "", nil, fmt.Errorf("duplicate value %q for matrix variable %s", v, name)
+			}
+		}
+	}
+	return name, values, nil
+}
+
+// expandMatrix returns the instances of a test case: just the test case itself,
+// if it has no matrix directives.
+func expandMatrix(t Test) ([]Test, error) {
+	var names []string
+	var values [][]string
+	var lines []string
+	data := false // whether an expand directive applies substitute to data lines
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		lines = append(lines, line)
+		if !strings.HasPrefix(line, comment) || !isDirective(line[len(comment):]) {
+			continue
+		}
+		name, arg := splitDirective(line[len(comment):])
+		data = data || name == "expand"
+		if name == "matrix" {
+			v, vs, e := parseMatrix(arg)
+			if e != nil {
+				return nil, fmt.Errorf("%s:%d: %s", t.path, lr.lineno, e)
+			}
+			for _, n := range names {
+				if n == v {
+					return nil, fmt.Errorf("%s:%d: duplicate matrix variable %s", t.path, lr.lineno, v)
+				}
+			}
+			names, values = append(names, v), append(values, vs)
+		}
+	}
+	if e := lr.close(); e != nil {
+		return nil, e
+	} else if len(names) == 0 {
+		return []Test{t}, nil
+	}
+
+	var instances []Test
+	choice := make([]int, len(names))
+	for {
+		var settings, pairs []string
+		for k, n := range names {
+			settings = append(settings, n+"="+values[k][choice[k]])
+			pairs = append(pairs, "%{"+n+"}", values[k][choice[k]])
+		}
+		// In the lines in which substitute replaces variables, "%%{" is left
+		// for it to replace; elsewhere, it is replaced here.
+		forSubstitute := strings.NewReplacer(append([]string{"%%{", "%%{"}, pairs...)...)
+		elsewhere := strings.NewReplacer(append([]string{"%%{", "%{"}, pairs...)...)
+		var content strings.Builder
+		for _, line := range lines {
+			if substituted(line, data) {
+				content.WriteString(forSubstitute.Replace(line))
+			} else {
+				content.WriteString(elsewhere.Replace(line))
+			}
+		}
+		instances = append(instances, Test{
+			path:    t.path + ":" + strings.Join(settings, ","),
+			file:    t.source(),
+			content: content.String(),
+			found:   t.found,
+			loaded:  t.loaded,
+			reading: t.reading,
+		})
+
+		k := len(choice) - 1
+		for k >= 0 && choice[k] == len(values[k])-1 {
+			choice[k] = 0
+			k--
+		}
+		if k < 0 {
+			return instances, nil
+		}
+		choice[k]++
+	}
+}
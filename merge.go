@@ -0,0 +1,17 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+// Some programs write to both the output and the error output, in an order that
+// matters. With the -merge option, or the merge-output directive, both are sent
+// to the same pipe, so that they are received in the order written, and matched
+// against the "#>" and "#!" lines of the test case alike, in the order given.
+
+// mergeOutput records the -merge option.
+var mergeOutput bool
+
+// testMerged reports whether a test case's output and error output are merged.
+func testMerged(t Test) bool {
+	return mergeOutput || hasDirective(t, "merge-output")
+}
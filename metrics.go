@@ -0,0 +1,101 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Metrics of test runs may be exported in the Prometheus text format: by the
+// serve subcommand, at /metrics, and after a batch run, by pushing them to the
+// Prometheus Pushgateway given with -pushgateway.
+
+// pushgateway is the URL of a Prometheus Pushgateway; "" for none.
+var pushgateway string
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the
+// histogram of test durations.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+// Metrics accumulates the results of test runs.
+type Metrics struct {
+	runs    int
+	tests   map[string]int // by status
+	buckets []int          // counts of tests by duration, for each of durationBuckets
+	count   int            // tests actually run, rather than found in the result cache
+	sum     float64        // their total duration, in seconds
+}
+
+// newMetrics returns an empty Metrics.
+func newMetrics() *Metrics {
+	return &Metrics{tests: map[string]int{}, buckets: make([]int, len(durationBuckets))}
+}
+
+// addRun adds the results of one run.
+func (m *Metrics) addRun(results []Result) {
+	m.runs++
+	for _, r := range results {
+		m.tests[r.status]++
+		if r.cached {
+			continue
+		}
+		seconds := r.duration.Seconds()
+		for k, le := range durationBuckets {
+			if seconds <= le {
+				m.buckets[k]++
+			}
+		}
+		m.count++
+		m.sum += seconds
+	}
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *Metrics) write(w io.Writer) {
+	fmt.Fprint(w, "# HELP invigilate_runs_total Runs of invigilate.\n")
+	fmt.Fprint(w, "# TYPE invigilate_runs_total counter\n")
+	fmt.Fprintf(w, "invigilate_runs_total %d\n", m.runs)
+	fmt.Fprint(w, "# HELP invigilate_tests_total Test cases run, by status.\n")
+	fmt.Fprint(w, "# TYPE invigilate_tests_total counter\n")
+	for _, status := range []string{passed, failed, errored} {
+		fmt.Fprintf(w, "invigilate_tests_total{status=%q} %d\n", status, m.tests[status])
+	}
+	fmt.Fprint(w, "# HELP invigilate_test_duration_seconds Time taken by test cases not found in the result cache.\n")
+	fmt.Fprint(w, "# TYPE invigilate_test_duration_seconds histogram\n")
+	for k, le := range durationBuckets {
+		fmt.Fprintf(w, "invigilate_test_duration_seconds_bucket{le=\"%g\"} %d\n", le, m.buckets[k])
+	}
+	fmt.Fprintf(w, "invigilate_test_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "invigilate_test_duration_seconds_sum %g\n", m.sum)
+	fmt.Fprintf(w, "invigilate_test_duration_seconds_count %d\n", m.count)
+}
+
+// pushMetrics pushes the metrics of a run to the Pushgateway, replacing those
+// of the previous run.
+func pushMetrics(results []Result) error {
+	m := newMetrics()
+	m.addRun(results)
+	var body bytes.Buffer
+	m.write(&body)
+
+	url := strings.TrimSuffix(pushgateway, "/") + "/metrics/job/invigilate"
+	req, e := http.NewRequest(http.MethodPut, url, &body)
+	if e != nil {
+		return fmt.Errorf("pushing metrics: %w", e)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, e := http.DefaultClient.Do(req)
+	if e != nil {
+		return fmt.Errorf("pushing metrics: %w", e)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushing metrics: %s: %s", url, resp.Status)
+	}
+	return nil
+}
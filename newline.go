@@ -0,0 +1,27 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+// Whether output ends with a newline is often an accident of how it was written,
+// such as with "echo -n" or "echo", and a test case file may or may not end with
+// one. With the -lenient-newline option, or the lenient-newline directive, output
+// and expected output that differ only in a final newline are treated as equal;
+// each of the output and error output, and the last line expected on each, is
+// matched as if it ended with a newline.
+
+// lenientNewline records the -lenient-newline option.
+var lenientNewline bool
+
+// testLenientNewline reports whether a test case ignores missing final newlines.
+func testLenientNewline(t Test) bool {
+	return lenientNewline || hasDirective(t, "lenient-newline")
+}
+
+// withNewline returns an expected line of output ending with a newline.
+func withNewline(line string) string {
+	if line != "" && line[len(line)-1] != '\n' {
+		line += "\n"
+	}
+	return line
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A program stuck in a loop may write gigabytes of output, which invigilate
+// would otherwise hold, and record in its transcript, until the time limit.
+// With the -max-output option, a program writing more than the given number
+// of bytes on either its output or its error output is killed, and the test
+// fails, showing the beginning of that output.
+
+// maxOutputSpec records the -max-output option; "" for no limit.
+var maxOutputSpec string
+
+// maxOutput is the most bytes the program may write on each output stream; 0 for no limit.
+var maxOutput int
+
+// excerptSize is the number of bytes shown from the beginning of output that
+// exceeded the limit.
+const excerptSize = 256
+
+// parseMaxOutput parses the -max-output option.
+func parseMaxOutput() error {
+	n, e := parseSize(maxOutputSpec)
+	if e != nil || n == 0 || n > 1<<40 {
+		return fmt.Errorf("invalid output limit %q", maxOutputSpec)
+	}
+	maxOutput = int(n)
+	return nil
+}
+
+// OutputLimitError ends a stream on which the program wrote more than -max-output allows.
+type OutputLimitError struct {
+	stream  byte   // '>' for the output, or '!' for the error output
+	excerpt []byte // the beginning of the output
+}
+
+func (e *OutputLimitError) Error() string {
+	return fmt.Sprintf("output limit of %d bytes exceeded", maxOutput)
+}
+
+// OutputLimit is shared by the output streams of a test. Once the program has
+// exceeded the limit on one of them, reading from either returns the error, so
+// that the test fails at once, whichever stream it is waiting for.
+type OutputLimit struct {
+	once     sync.Once
+	exceeded chan struct{} // closed once the limit has been exceeded
+	err      error
+}
+
+// newOutputLimit returns an OutputLimit, or nil if there is no limit.
+func newOutputLimit() *OutputLimit {
+	if maxOutput == 0 {
+		return nil
+	}
+	return &OutputLimit{exceeded: make(chan struct{})}
+}
+
+// exceed records that the limit has been exceeded. It may be called on a nil
+// *OutputLimit, and then does nothing.
+func (ol *OutputLimit) exceed(e *OutputLimitError) {
+	if ol == nil {
+		return
+	}
+	ol.once.Do(func() {
+		ol.err = e
+		close(ol.exceeded)
+	})
+}
+
+// done returns a channel closed once the limit has been exceeded; it may be
+// called on a nil *OutputLimit, and then returns nil, which is never closed.
+func (ol *OutputLimit) done() <-chan struct{} {
+	if ol == nil {
+		return nil
+	}
+	return ol.exceeded
+}
@@ -0,0 +1,43 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Output shown in failure messages may hold control characters, which would
+// upset the terminal showing them. They are shown instead in caret notation,
+// as by "cat -v": "^M" for a carriage return, "^[" for escape, and "^?" for
+// delete. Other characters that cannot be shown, such as bytes that are not part
+// of valid UTF-8, are shown as Go escapes, such as "\xff" or "\u0085". Tabs and
+// newlines are shown as they are.
+
+// printable returns data with the characters that cannot be shown replaced.
+func printable[T string | []byte](data T) string {
+	text := string(data)
+	var s strings.Builder
+	for len(text) > 0 {
+		r, n := utf8.DecodeRuneInString(text)
+		switch {
+		case r == utf8.RuneError && n == 1:
+			fmt.Fprintf(&s, `\x%02x`, text[0])
+		case r == '\t' || r == '\n':
+			s.WriteRune(r)
+		case r < ' ':
+			s.WriteByte('^')
+			s.WriteRune(r + '@')
+		case r == 0x7f:
+			s.WriteString("^?")
+		case 0x80 <= r && r < 0xa0:
+			fmt.Fprintf(&s, `\u%04x`, r)
+		default:
+			s.WriteString(text[:n])
+		}
+		text = text[n:]
+	}
+	return s.String()
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// forwardedSignals lists the signals which invigilate passes on to the test in progress;
+// there are none on this system.
+var forwardedSignals []os.Signal
+
+// newProcessGroup would arrange for a command to run in a process group of its own,
+// but process groups are not supported on this system.
+func newProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills a started command.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// signalProcessGroup sends a signal to a started command.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Signal(sig)
+}
+
+// parseSignal would return the signal with the given name, but signals cannot
+// be sent to programs on this system.
+func parseSignal(name string) (os.Signal, error) {
+	return nil, errors.New("signals are not supported on this system")
+}
+
+// signalName returns the name of a signal.
+func signalName(sig os.Signal) string {
+	return sig.String()
+}
+
+// exitSignal would return the signal which terminated a process, but processes
+// are not terminated by signals on this system.
+func exitSignal(ps *os.ProcessState) os.Signal {
+	return nil
+}
+
+// terminate would ask a started command to exit, but there is no way to do so
+// on this system.
+func terminate(cmd *exec.Cmd) error {
+	return errors.New("terminate not supported")
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// forwardedSignals lists the signals which invigilate passes on to the test in progress.
+var forwardedSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// newProcessGroup arranges for a command to run in a process group of its own,
+// so that it can be killed along with any processes it starts.
+func newProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills a started command, and the rest of its process group.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// signalNames maps the names of the signals that may be given in directives
+// to the signals.
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"ILL":   syscall.SIGILL,
+	"TRAP":  syscall.SIGTRAP,
+	"ABRT":  syscall.SIGABRT,
+	"BUS":   syscall.SIGBUS,
+	"FPE":   syscall.SIGFPE,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"SEGV":  syscall.SIGSEGV,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"WINCH": syscall.SIGWINCH,
+	"XCPU":  syscall.SIGXCPU,
+	"XFSZ":  syscall.SIGXFSZ,
+}
+
+// signalName returns the name of a signal, such as "SIGUSR1".
+func signalName(sig os.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// exitSignal returns the signal which terminated a process, or nil if it
+// was not terminated by a signal.
+func exitSignal(ps *os.ProcessState) os.Signal {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal()
+	}
+	return nil
+}
+
+// parseSignal returns the signal with the given name, such as "USR1" or "SIGUSR1".
+func parseSignal(name string) (os.Signal, error) {
+	if sig, ok := signalNames[strings.TrimPrefix(strings.TrimSpace(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unknown signal %q", strings.TrimSpace(name))
+}
+
+// terminate asks a started command, and the rest of its process group,
+// to exit, by sending them SIGTERM.
+func terminate(cmd *exec.Cmd) error {
+	return signalProcessGroup(cmd, syscall.SIGTERM)
+}
+
+// signalProcessGroup sends a signal to a started command, and the rest of its process group.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	if s, ok := sig.(syscall.Signal); ok && syscall.Kill(-cmd.Process.Pid, s) == nil {
+		return nil
+	}
+	return cmd.Process.Signal(sig)
+}
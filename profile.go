@@ -0,0 +1,87 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// pprofAddr is the address on which to serve profiling data; "" for none.
+var pprofAddr string
+
+// cpuProfile and memProfile are the files to which to write CPU and memory
+// profiles of invigilate itself; "" for none.
+var cpuProfile, memProfile string
+
+// cpuProfileFile is the open CPU profile, if there is one.
+var cpuProfileFile *os.File
+
+// Counters published at /debug/vars, alongside the runtime's memory statistics.
+var (
+	testsRun    = expvar.NewInt("tests_run")
+	testsFailed = expvar.NewInt("tests_failed")
+	testErrors  = expvar.NewInt("test_errors")
+)
+
+// startPprof starts serving net/http/pprof profiles and expvar metrics
+// on pprofAddr, in the background, for as long as invigilate runs.
+func startPprof() error {
+	l, e := net.Listen("tcp", pprofAddr)
+	if e != nil {
+		return fmt.Errorf("profiling server: %w", e)
+	}
+	if verbose {
+		fmt.Printf("Serving profiles at http://%s/debug/pprof/\n", l.Addr())
+	}
+	go http.Serve(l, nil)
+	return nil
+}
+
+// startProfiles starts writing a CPU profile of invigilate, if requested.
+func startProfiles() error {
+	if cpuProfile == "" {
+		return nil
+	}
+	f, e := os.Create(cpuProfile)
+	if e != nil {
+		return e
+	}
+	if e = pprof.StartCPUProfile(f); e != nil {
+		f.Close()
+		return e
+	}
+	cpuProfileFile = f
+	return nil
+}
+
+// stopProfiles finishes the CPU profile, and writes the memory profile,
+// if these were requested.
+func stopProfiles() error {
+	if cpuProfileFile != nil {
+		pprof.StopCPUProfile()
+		if e := cpuProfileFile.Close(); e != nil {
+			return e
+		}
+	}
+	if memProfile == "" {
+		return nil
+	}
+	f, e := os.Create(memProfile)
+	if e != nil {
+		return e
+	}
+	runtime.GC()
+	e = pprof.WriteHeapProfile(f)
+	if e2 := f.Close(); e == nil {
+		e = e2
+	}
+	return e
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The program is normally given by the arguments before "--", which is awkward
+// for scripts when its own arguments include "--". With -program, it is given
+// instead as a single string, split into words as the shell would, and all the
+// arguments are test cases.
+
+// programSpec is the program's command line, as given with -program; "" for none.
+var programSpec string
+
+// shellSplit splits a command line into words as the shell does, honoring
+// single and double quotes and backslashes, but with no expansions. As in the
+// shell, a backslash and newline, outside single quotes, are removed, continuing
+// the line.
+func shellSplit(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for k := 0; k < len(s); k++ {
+		switch c := s[k]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[k+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in %q", s)
+			}
+			word.WriteString(s[k+1 : k+1+end])
+			k += end + 1
+			inWord = true
+		case c == '"':
+			for k++; k < len(s) && s[k] != '"'; k++ {
+				// Within double quotes, a backslash and newline are removed,
+				// and a backslash escapes only the characters listed below.
+				if s[k] == '\\' && k+1 < len(s) && s[k+1] == '\n' {
+					k++
+					continue
+				} else if s[k] == '\\' && k+1 < len(s) && strings.IndexByte("\"\\$`", s[k+1]) >= 0 {
+					k++
+				}
+				word.WriteByte(s[k])
+			}
+			if k == len(s) {
+				return nil, fmt.Errorf("unterminated double quote in %q", s)
+			}
+			inWord = true
+		case c == '\\':
+			if k++; k == len(s) {
+				return nil, fmt.Errorf("backslash at end of %q", s)
+			} else if s[k] != '\n' {
+				word.WriteByte(s[k])
+				inWord = true
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
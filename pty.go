@@ -0,0 +1,135 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The -pty option, and the pty directive, run the program with a pseudo-terminal
+// as its standard input and output, so that programs which behave differently when
+// isatty() is true, such as by prompting, buffering output by lines, or using
+// readline, may be tested as they are used interactively. The error output is
+// still a pipe, so that it can be told apart from the output.
+
+// errNoPty is the error for using a pseudo-terminal on a system without them.
+var errNoPty = errors.New("pseudo-terminals are not supported on this system")
+
+// ptySpec is the size of the terminal given with -pty; "" to use none.
+var ptySpec string
+
+// termSize is the size of the terminal for test cases run under one.
+var termSize = TermSize{cols: 80, rows: 24}
+
+// TermSize is the size of a terminal, in characters.
+type TermSize struct {
+	cols, rows uint16
+}
+
+// parseTermSize parses the size of a terminal, given as COLSxROWS, such as 80x24.
+func parseTermSize(spec string) (TermSize, error) {
+	if !ptySupported {
+		return TermSize{}, errNoPty
+	}
+	c, r, ok := strings.Cut(strings.TrimSpace(spec), "x")
+	cols, e1 := strconv.ParseUint(c, 10, 16)
+	rows, e2 := strconv.ParseUint(r, 10, 16)
+	if !ok || e1 != nil || e2 != nil || cols == 0 || rows == 0 {
+		return TermSize{}, fmt.Errorf("invalid terminal size %q; must be columns x rows, such as 80x24", spec)
+	}
+	return TermSize{uint16(cols), uint16(rows)}, nil
+}
+
+// parsePty parses the -pty option.
+func parsePty() (e error) {
+	termSize, e = parseTermSize(ptySpec)
+	return
+}
+
+// checkPty checks a "pty" directive, whose argument, if any, is the size of the terminal.
+func checkPty(arg string) error {
+	if arg != "" {
+		_, e := parseTermSize(arg)
+		return e
+	} else if !ptySupported {
+		return errNoPty
+	}
+	return nil
+}
+
+// testTerminal reports whether a test case is to be run under a pseudo-terminal,
+// and if so, of what size.
+func testTerminal(t Test) (size TermSize, ok bool) {
+	size, ok = termSize, ptySpec != ""
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "pty" {
+				ok = true
+				if arg != "" {
+					size, _ = parseTermSize(arg)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Terminal writes the program's input to the controlling side of its pseudo-terminal.
+type Terminal struct {
+	f       *os.File
+	midLine bool // whether the input so far ends part way through a line
+}
+
+// Write types input on the terminal.
+func (term *Terminal) Write(data []byte) (int, error) {
+	n, e := term.f.Write(data)
+	if n > 0 {
+		term.midLine = data[n-1] != '\n'
+	}
+	return n, e
+}
+
+// Close closes the terminal, which also ends the program's output.
+func (term *Terminal) Close() error {
+	return term.f.Close()
+}
+
+// endOfInput returns what must be typed to signal the end of the input: ^D,
+// twice if the last line is incomplete, since the first then only ends the line.
+// This only works while the terminal is in its usual line-by-line mode.
+func (term *Terminal) endOfInput() string {
+	if term.midLine {
+		return "\x04\x04"
+	}
+	return "\x04"
+}
+
+// terminalOutput reads the program's output from the controlling side of its pseudo-terminal.
+type terminalOutput struct {
+	f *os.File
+}
+
+// Read reads output. Once the program and any processes it started have all
+// closed the terminal, reading fails with EIO, which is taken as the end of the output.
+func (to terminalOutput) Read(data []byte) (int, error) {
+	n, e := to.f.Read(data)
+	if errors.Is(e, syscall.EIO) {
+		e = io.EOF
+	}
+	return n, e
+}
+
+// Close closes the terminal, which also ends the program's input.
+func (to terminalOutput) Close() error {
+	return to.f.Close()
+}
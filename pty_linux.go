@@ -0,0 +1,96 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// ptySupported indicates whether programs can be run under pseudo-terminals on this system.
+const ptySupported = true
+
+// openTerminal opens a pseudo-terminal of the given size, returning its controlling
+// side and the terminal itself, for the program. The terminal does not echo input,
+// or turn newlines in the output into carriage return and newline, so that test
+// cases are written just as for a program not using a terminal.
+func openTerminal(size TermSize) (master, tty *os.File, err error) {
+	if master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0); err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	var n uint32
+	err = control(master, func(fd uintptr) error {
+		if e := ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); e != nil {
+			return e
+		}
+		return ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	})
+	if err == nil {
+		tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err == nil {
+		err = control(tty, func(fd uintptr) error {
+			var tio syscall.Termios
+			if e := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&tio)); e != nil {
+				return e
+			}
+			tio.Lflag &^= syscall.ECHO
+			tio.Oflag &^= syscall.ONLCR
+			if e := ioctl(fd, syscall.TCSETS, unsafe.Pointer(&tio)); e != nil {
+				return e
+			}
+			ws := [4]uint16{size.rows, size.cols, 0, 0}
+			return ioctl(fd, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+		})
+	}
+	if err != nil {
+		master.Close()
+		if tty != nil {
+			tty.Close()
+		}
+		return nil, nil, err
+	}
+	return master, tty, nil
+}
+
+// control calls fn with the file descriptor of f, without putting f in blocking
+// mode, as f.Fd would.
+func control(f *os.File, fn func(fd uintptr) error) error {
+	rc, e := f.SyscallConn()
+	if e != nil {
+		return e
+	}
+	var fe error
+	if e = rc.Control(func(fd uintptr) { fe = fn(fd) }); e != nil {
+		return e
+	}
+	return fe
+}
+
+// ioctl performs an ioctl system call.
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// runOnTerminal arranges for a command to run in a new session, with tty as its
+// controlling terminal, standard input, and standard output.
+func runOnTerminal(cmd *exec.Cmd, tty *os.File) {
+	cmd.Stdin, cmd.Stdout = tty, tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// The new session is also a new process group, as newProcessGroup would create;
+	// but a session leader cannot then be moved to a process group with setpgid.
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+}
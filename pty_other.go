@@ -0,0 +1,24 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// ptySupported indicates whether programs can be run under pseudo-terminals on this system.
+const ptySupported = false
+
+// openTerminal would open a pseudo-terminal, but they are not supported on this system.
+func openTerminal(size TermSize) (master, tty *os.File, err error) {
+	return nil, nil, errNoPty
+}
+
+// runOnTerminal would arrange for a command to run under a pseudo-terminal,
+// but they are not supported on this system.
+func runOnTerminal(cmd *exec.Cmd, tty *os.File) {
+}
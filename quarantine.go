@@ -0,0 +1,98 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// quarantinePath is a file listing tests whose failures should not fail the run; "" for none.
+var quarantinePath string
+
+// quarantine holds the patterns read from quarantinePath.
+var quarantine []string
+
+// quarantinedFails counts the failures of quarantined tests.
+var quarantinedFails = 0
+
+// loadQuarantine reads the quarantine file. Each line holds a test path,
+// or a pattern as for filepath.Match; blank lines and lines beginning
+// with "#" are ignored.
+func loadQuarantine() error {
+	data, e := os.ReadFile(quarantinePath)
+	if e != nil {
+		return e
+	}
+	for k, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if _, e := filepath.Match(line, ""); e != nil {
+			return fmt.Errorf("%s:%d: %w", quarantinePath, k+1, e)
+		}
+		quarantine = append(quarantine, filepath.Clean(line))
+	}
+	return nil
+}
+
+// isQuarantined reports whether a test is in quarantine.
+func isQuarantined(path string) bool {
+	path = filepath.Clean(path)
+	for _, q := range quarantine {
+		if ok, _ := filepath.Match(q, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reportQuarantine lists the quarantined tests that were run, and how they fared.
+// If there is a history database, it also shows how often each has failed there.
+func reportQuarantine() error {
+	var paths []string
+	seen := map[string]bool{}
+	for _, r := range results {
+		if r.quarantined && !seen[r.path] {
+			paths = append(paths, r.path)
+			seen[r.path] = true
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	counts := map[string]string{}
+	if historyPath != "" {
+		var quoted []string
+		for _, p := range paths {
+			quoted = append(quoted, sqlQuote(p))
+		}
+		rows, e := runSQL(historyPath, fmt.Sprintf(
+			"SELECT path, sum(status != 'pass'), count(*) FROM results WHERE path IN (%s) GROUP BY path;",
+			strings.Join(quoted, ", ")))
+		if e != nil {
+			return e
+		}
+		for _, row := range rows {
+			counts[row[0]] = fmt.Sprintf("; failed in %s of %s recorded runs", row[1], row[2])
+		}
+	}
+
+	fmt.Println()
+	fmt.Println("Quarantined tests:")
+	for _, p := range paths {
+		outcome := "passed"
+		for _, r := range results {
+			if r.path == p && r.status != passed {
+				outcome = "failed"
+			}
+		}
+		fmt.Printf("  %s: %s%s\n", p, outcome, counts[p])
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// replayDir is the directory in which to write replay scripts for failed tests; "" for none.
+var replayDir string
+
+// replayFlags lists the options that affect the outcome of a single test case,
+// and so must be repeated when running a test case again.
+var replayFlags = map[string]bool{
+	"ansi":            true,
+	"backend":         true,
+	"build":           true,
+	"c":               true,
+	"catalog":         true,
+	"cgroup":          true,
+	"comments":        true,
+	"comparator":      true,
+	"compile":         true,
+	"count":           true,
+	"crlf":            true,
+	"determinism":     true,
+	"exit-codes":      true,
+	"grace":           true,
+	"ignore-stderr":   true,
+	"ignore-stdout":   true,
+	"image":           true,
+	"interp":          true,
+	"leak":            true,
+	"lenient-newline": true,
+	"max-output":      true,
+	"memory-max":      true,
+	"merge":           true,
+	"pty":             true,
+	"rlimit":          true,
+	"scrub":           true,
+	"shebang":         true,
+	"soak":            true,
+	"sort":            true,
+	"stdin":           true,
+	"strip":           true,
+	"t":               true,
+	"whitespace":      true,
+	"wrap":            true,
+}
+
+// replayOptions returns the options needed to run a single test case again
+// in the same way, including -no-cache so that it really is run.
+func replayOptions() []string {
+	return append([]string{"-no-cache"}, testOptions()...)
+}
+
+// multiValue is implemented by options that may be given more than once,
+// each of which must be repeated.
+type multiValue interface {
+	values() []string
+}
+
+// testOptions returns the options affecting the outcome of a single test case,
+// as given for this run.
+func testOptions() []string {
+	var opts []string
+	runFlags.VisitAll(func(f *flag.Flag) {
+		// Options left empty or false, such as -wrap when there is no wrapper,
+		// need not be repeated.
+		if mv, ok := f.Value.(multiValue); ok && replayFlags[f.Name] {
+			for _, v := range mv.values() {
+				opts = append(opts, "-"+f.Name+"="+v)
+			}
+		} else if replayFlags[f.Name] && f.Value.String() != "" && f.Value.String() != "false" {
+			opts = append(opts, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return opts
+}
+
+// childEnv returns the environment for copies of invigilate started by this one,
+// or by its replay scripts. These are given the options they need explicitly,
+// so INVIGILATE_OPTS is left out, lest its options be applied twice.
+func childEnv() []string {
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "INVIGILATE_OPTS=") {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
+// artifactName returns a file name, without extension, unique within a run,
+// for files describing a test.
+func artifactName(path string) string {
+	name := filepath.ToSlash(filepath.Clean(path))
+	name = strings.TrimLeft(name, "./")
+	return strings.ReplaceAll(name, "/", "_")
+}
+
+// writeReplay writes a shell script that runs a failed test again, on its own,
+// with the same program, options, working directory, and environment.
+func writeReplay(t Test, program []string) error {
+	if e := os.MkdirAll(replayDir, 0755); e != nil {
+		return e
+	}
+	self, e := os.Executable()
+	if e != nil {
+		return e
+	}
+	wd, e := os.Getwd()
+	if e != nil {
+		return e
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "#!/bin/sh\n# Run the failed test case %s again, on its own.\n", t.path)
+	if t.file != "" {
+		fmt.Fprintf(&script, "# The other test cases in %s are run as well.\n", t.file)
+	}
+	fmt.Fprintf(&script, "cd %s || exit 1\n", shellQuote(wd))
+	script.WriteString("exec env -i \\\n")
+	for _, v := range childEnv() {
+		fmt.Fprintf(&script, "\t%s \\\n", shellQuote(v))
+	}
+	args := append([]string{self}, replayOptions()...)
+	args = append(args, unbuilt(program)...)
+	fmt.Fprintf(&script, "\t%s -- %s\n", shellJoin(args), shellQuote(t.source()))
+
+	dest := filepath.Join(replayDir, artifactName(t.path)+".sh")
+	return os.WriteFile(dest, []byte(script.String()), 0755)
+}
@@ -0,0 +1,244 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Possible values for Result.status.
+const (
+	passed  = "pass"
+	failed  = "fail"
+	errored = "error"
+)
+
+// Result describes the outcome of one test case.
+type Result struct {
+	// The path to the test case file
+	path string
+
+	// The title of the test case, given by its "#:" lines; "" if none
+	title string
+
+	// Which run of the test case this was, counting from 1, when each is run
+	// several times with -count; 0 otherwise
+	iteration int
+
+	// One of passed, failed, or errored
+	status string
+
+	// How long the test case took to run
+	duration time.Duration
+
+	// For failures and errors, a short description of what went wrong,
+	// such as "timeout" or "output"; "" for tests that passed.
+	category string
+
+	// The peak memory use of the program, in bytes, or 0 if not known
+	maxRSS int64
+
+	// The user and system CPU time used by the program, or 0 if not known
+	userTime   time.Duration
+	systemTime time.Duration
+
+	// Whether the program ran to completion, and if so, its exit code
+	exited   bool
+	exitCode int
+
+	// How the program was run, as given by describeCommand; "" if it was not
+	command string
+
+	// The data exchanged with the program, if it was run, as far as it is needed;
+	// nil once the result has been handled
+	transcript *Transcript
+
+	// How long after the start of the test its first output was received; 0 if none
+	firstOutput time.Duration
+
+	// Whether this was the first test run by invigilate, when the program
+	// was less likely to be in the operating system's caches
+	cold bool
+
+	// Whether the test was not run because the result cache shows it passes
+	cached bool
+
+	// Whether the test is in quarantine, so that its failure does not fail the run
+	quarantined bool
+}
+
+// results lists the results of all test cases run so far.
+var results []Result
+
+// csvPath is the file to which CSV results should be written; "" for none.
+var csvPath string
+
+// csvFile and csvWriter are used to write CSV results, if requested.
+var csvFile *os.File
+var csvWriter *csv.Writer
+
+// showResources requests a line showing the resources used by each test.
+var showResources bool
+
+// record notes the result of a test case.
+func record(r Result) {
+	if showResources && !r.cached && r.exited {
+		fmt.Printf("%s: %.3fs user, %.3fs system, %d KiB peak memory\n",
+			r.path, r.userTime.Seconds(), r.systemTime.Seconds(), r.maxRSS/1024)
+	}
+	r.quarantined = isQuarantined(r.path)
+	results = append(results, r)
+	testsRun.Add(1)
+	if r.iteration > 0 {
+		repeatedRuns++
+	}
+	switch r.status {
+	case failed:
+		if r.quarantined {
+			quarantinedFails++
+		} else {
+			if r.iteration > 0 {
+				failedRuns++
+			}
+			if firstRepeat(r, failedRepeats) {
+				failCount++
+			}
+		}
+		testsFailed.Add(1)
+	case errored:
+		if firstRepeat(r, erroredRepeats) {
+			errorCount++
+		}
+		testErrors.Add(1)
+	}
+
+	if csvWriter != nil {
+		csvWriter.Write([]string{
+			r.path,
+			r.status,
+			strconv.FormatFloat(r.duration.Seconds(), 'f', 3, 64),
+			r.category,
+		})
+	}
+}
+
+// openCSV creates the CSV results file and writes its header row.
+func openCSV(path string) error {
+	f, e := os.Create(path)
+	if e != nil {
+		return e
+	}
+	csvFile = f
+	csvWriter = csv.NewWriter(f)
+	return csvWriter.Write([]string{"path", "status", "duration", "category"})
+}
+
+// closeCSV finishes writing the CSV results file, if there is one.
+func closeCSV() error {
+	if csvWriter == nil {
+		return nil
+	}
+	csvWriter.Flush()
+	e := csvWriter.Error()
+	if e2 := csvFile.Close(); e == nil {
+		e = e2
+	}
+	if e != nil {
+		return fmt.Errorf("writing %s: %w", csvPath, e)
+	}
+	return nil
+}
+
+// jsonPath is the file to which a JSON report should be written; "" for none.
+var jsonPath string
+
+// Report is the form of the JSON report.
+type Report struct {
+	Version string
+	Started time.Time
+	Results []ReportEntry
+}
+
+// ReportEntry is the JSON form of a Result.
+type ReportEntry struct {
+	Path        string
+	Title       string `json:",omitempty"`
+	Iteration   int    `json:",omitempty"`
+	Status      string
+	Duration    float64 // seconds
+	Category    string  `json:",omitempty"`
+	Quarantined bool    `json:",omitempty"`
+	Cached      bool    `json:",omitempty"`
+	FirstOutput float64 `json:",omitempty"` // seconds
+	Cold        bool    `json:",omitempty"`
+	UserTime    float64 `json:",omitempty"` // seconds
+	SystemTime  float64 `json:",omitempty"` // seconds
+	MaxRSS      int64   `json:",omitempty"` // bytes
+}
+
+// writeReport writes a JSON report of the results to path.
+func writeReport(path string, started time.Time, results []Result) error {
+	rep := Report{Version: version, Started: started.UTC(), Results: []ReportEntry{}}
+	for _, r := range results {
+		rep.Results = append(rep.Results, reportEntry(r))
+	}
+	data, e := json.MarshalIndent(rep, "", "\t")
+	if e != nil {
+		return e
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// readReport reads the results from a JSON report.
+func readReport(path string) ([]Result, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	var rep Report
+	if e = json.Unmarshal(data, &rep); e != nil {
+		return nil, fmt.Errorf("%s: %w", path, e)
+	}
+	var results []Result
+	for _, r := range rep.Results {
+		results = append(results, entryResult(r))
+	}
+	return results, nil
+}
+
+// reportEntry converts a Result to its JSON form.
+func reportEntry(r Result) ReportEntry {
+	return ReportEntry{
+		r.path, r.title, r.iteration, r.status, r.duration.Seconds(), r.category, r.quarantined, r.cached,
+		r.firstOutput.Seconds(), r.cold,
+		r.userTime.Seconds(), r.systemTime.Seconds(), r.maxRSS,
+	}
+}
+
+// entryResult converts the JSON form of a Result back to a Result.
+func entryResult(r ReportEntry) Result {
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second))
+	}
+	return Result{
+		path:        r.Path,
+		title:       r.Title,
+		iteration:   r.Iteration,
+		status:      r.Status,
+		duration:    seconds(r.Duration),
+		category:    r.Category,
+		quarantined: r.Quarantined,
+		cached:      r.Cached,
+		firstOutput: seconds(r.FirstOutput),
+		cold:        r.Cold,
+		userTime:    seconds(r.UserTime),
+		systemTime:  seconds(r.SystemTime),
+		maxRSS:      r.MaxRSS,
+	}
+}
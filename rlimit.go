@@ -0,0 +1,161 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resource limits cannot be set on a child process directly through os/exec.
+// Instead, invigilate runs a copy of itself, which sets the limits on itself
+// and then executes the program. The limits are passed in the environment
+// variable named by rlimitEnv, which the copy removes before executing the program.
+const rlimitEnv = "INVIGILATE_RLIMITS"
+
+// Rlimits maps the names of resources to their limits, in bytes for "as" and
+// "fsize", in seconds for "cpu", and as a count for "nofile".
+type Rlimits map[string]uint64
+
+// rlimits holds the resource limits given with the -rlimit option.
+var rlimits = Rlimits{}
+
+// rlimitNames lists the resources that may be limited.
+var rlimitNames = []string{"as", "cpu", "fsize", "nofile"}
+
+// String formats the limits as for the -rlimit option.
+func (rl Rlimits) String() string {
+	var parts []string
+	for name, n := range rl {
+		parts = append(parts, name+"="+strconv.FormatUint(n, 10))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// Set adds the limits in spec, a comma separated list such as "as=512M,nofile=16".
+func (rl Rlimits) Set(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(item, "=")
+		n, e := parseRlimit(name, value)
+		if e != nil {
+			return e
+		}
+		rl[name] = n
+	}
+	return nil
+}
+
+// parseRlimit parses the limit for one resource. Sizes may have the suffix
+// K, M, or G, and CPU time may be given as a duration, such as "1.5s".
+func parseRlimit(name, value string) (uint64, error) {
+	known := false
+	for _, n := range rlimitNames {
+		known = known || n == name
+	}
+	if !known {
+		return 0, fmt.Errorf("unknown resource %q; must be one of %s", name, strings.Join(rlimitNames, ", "))
+	} else if !rlimitSupported {
+		return 0, fmt.Errorf("resource limits are not supported on this system")
+	}
+
+	if name == "cpu" {
+		if d, e := time.ParseDuration(value); e == nil && d > 0 {
+			return uint64((d + time.Second - 1) / time.Second), nil
+		}
+	}
+	var n uint64
+	var e error
+	if name == "as" || name == "fsize" {
+		n, e = parseSize(value)
+	} else {
+		n, e = strconv.ParseUint(value, 10, 64)
+	}
+	if e != nil {
+		return 0, fmt.Errorf("invalid limit %q for %s", value, name)
+	}
+	return n, nil
+}
+
+// parseSize parses a size in bytes, which may have the suffix K, M, or G.
+func parseSize(value string) (uint64, error) {
+	scale := uint64(1)
+	for k, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(value, suffix) {
+			value = strings.TrimSuffix(value, suffix)
+			scale = 1 << (10 * (k + 1))
+		}
+	}
+	n, e := strconv.ParseUint(value, 10, 64)
+	return n * scale, e
+}
+
+// checkRlimit checks an "rlimit" directive.
+func checkRlimit(arg string) error {
+	return Rlimits{}.Set(arg)
+}
+
+// testRlimits returns the resource limits for a test case: those given with
+// the -rlimit option, overridden by any rlimit directives.
+func testRlimits(t Test) Rlimits {
+	rl := Rlimits{}
+	for name, n := range rlimits {
+		rl[name] = n
+	}
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "rlimit" {
+				rl.Set(arg)
+			}
+		}
+	}
+	return rl
+}
+
+// limitCommand arranges for a command to run with the given resource limits,
+// if there are any, by having a copy of invigilate set them and run the program.
+func limitCommand(cmd *exec.Cmd, rl Rlimits) error {
+	if len(rl) == 0 {
+		return nil
+	}
+	self, e := os.Executable()
+	if e != nil {
+		return e
+	}
+	cmd.Args = append([]string{self}, cmd.Args...)
+	cmd.Path = self
+	cmd.Env = append(os.Environ(), rlimitEnv+"="+rl.String())
+	return nil
+}
+
+// runLimited is run instead of the usual main program when invigilate is run
+// by limitCommand. It sets the resource limits and executes the program;
+// it returns only if that fails.
+func runLimited(spec string) {
+	rl := Rlimits{}
+	if e := rl.Set(spec); e != nil {
+		fatal(127, e)
+	}
+	os.Unsetenv(rlimitEnv)
+	path, e := exec.LookPath(os.Args[1])
+	if e != nil {
+		fatal(127, e)
+	}
+	if e := setRlimits(rl); e != nil {
+		fatal(127, e)
+	}
+	fatal(127, execProgram(path, os.Args[1:]))
+}
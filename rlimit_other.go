@@ -0,0 +1,22 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+//go:build !(linux || darwin)
+
+package main
+
+import "errors"
+
+// rlimitSupported indicates whether resource limits can be set on this system.
+const rlimitSupported = false
+
+// setRlimits would set resource limits, but this system has none.
+func setRlimits(rl Rlimits) error {
+	return errors.New("resource limits are not supported on this system")
+}
+
+// execProgram would replace this process with another program,
+// but this system cannot do so.
+func execProgram(path string, args []string) error {
+	return errors.New("exec is not supported on this system")
+}
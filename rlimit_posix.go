@@ -0,0 +1,46 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+//go:build linux || darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// rlimitSupported indicates whether resource limits can be set on this system.
+const rlimitSupported = true
+
+// rlimitResources maps the names of resources to their numbers.
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"cpu":    syscall.RLIMIT_CPU,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+}
+
+// setRlimits sets the soft resource limits of this process. The hard limits
+// are left alone, so that, for example, a program exceeding its CPU time
+// limit receives SIGXCPU rather than being killed at once.
+func setRlimits(rl Rlimits) error {
+	for name, n := range rl {
+		var lim syscall.Rlimit
+		e := syscall.Getrlimit(rlimitResources[name], &lim)
+		if e == nil {
+			lim.Cur = n
+			e = syscall.Setrlimit(rlimitResources[name], &lim)
+		}
+		if e != nil {
+			return fmt.Errorf("setting %s limit to %d: %w", name, n, e)
+		}
+	}
+	return nil
+}
+
+// execProgram replaces this process with the program at path.
+func execProgram(path string, args []string) error {
+	return syscall.Exec(path, args, os.Environ())
+}
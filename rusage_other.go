@@ -0,0 +1,14 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+//go:build !unix
+
+package main
+
+import "os"
+
+// peakRSS returns the maximum resident set size, in bytes, of a process
+// that has exited, or 0 if this is not known.
+func peakRSS(ps *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Output often holds text that changes from run to run, such as timestamps,
+// UUIDs, and the names of temporary files. The -scrub option, which may be given
+// more than once, and the scrub directive, give substitutions applied to each line
+// of the output and error output before it is matched, replacing such text with
+// stable tokens. Each is written as in sed, as "/regexp/replacement/", where any
+// character may take the place of "/", and the replacement may refer to
+// submatches as "$1" or "${name}". Substitutions are applied in the order given,
+// those from options first. A line is scrubbed once it is complete, or once the
+// program stops writing for the moment, as it does when it prompts for input.
+
+// Scrub is one substitution applied to the program's output.
+type Scrub struct {
+	spec        string
+	re          *regexp.Regexp
+	replacement string
+}
+
+// Scrubs holds the substitutions given with the -scrub option.
+type Scrubs []Scrub
+
+// scrubs holds the -scrub options.
+var scrubs Scrubs
+
+// parseScrub parses a substitution written as "/regexp/replacement/".
+func parseScrub(spec string) (Scrub, error) {
+	if len(spec) < 3 {
+		return Scrub{}, errors.New(`substitution must be written as "/regexp/replacement/"`)
+	}
+	delim := spec[:1]
+	parts := strings.Split(spec[1:], delim)
+	if len(parts) != 3 || parts[2] != "" {
+		return Scrub{}, errors.New(`substitution must be written as "/regexp/replacement/"`)
+	}
+	re, e := regexp.Compile(parts[0])
+	if e != nil {
+		return Scrub{}, e
+	}
+	return Scrub{spec, re, parts[1]}, nil
+}
+
+// String formats the substitutions, separated by spaces.
+func (ss *Scrubs) String() string {
+	return strings.Join(ss.values(), " ")
+}
+
+// Set adds a substitution.
+func (ss *Scrubs) Set(spec string) error {
+	s, e := parseScrub(spec)
+	if e == nil {
+		*ss = append(*ss, s)
+	}
+	return e
+}
+
+// values returns the substitutions as they were given, one per option.
+func (ss *Scrubs) values() []string {
+	var specs []string
+	for _, s := range *ss {
+		specs = append(specs, s.spec)
+	}
+	return specs
+}
+
+// checkScrub checks a "scrub" directive.
+func checkScrub(arg string) error {
+	_, e := parseScrub(arg)
+	return e
+}
+
+// testScrubs returns the substitutions applied to the output of a test case.
+func testScrubs(t Test) Scrubs {
+	ss := append(Scrubs(nil), scrubs...)
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "scrub" {
+				if s, e := parseScrub(arg); e == nil {
+					ss = append(ss, s)
+				}
+			}
+		}
+	}
+	return ss
+}
+
+// ScrubFilter applies substitutions to each line of one of the program's output
+// streams. The data may be split between reads anywhere, so an incomplete last
+// line is held back until the rest of it arrives, or until it is flushed.
+type ScrubFilter struct {
+	scrubs Scrubs
+	held   []byte
+}
+
+// newScrubFilter returns a filter applying the substitutions, or nil if there are none.
+func newScrubFilter(ss Scrubs) *ScrubFilter {
+	if len(ss) == 0 {
+		return nil
+	}
+	return &ScrubFilter{scrubs: ss}
+}
+
+// filter returns the complete lines in the data, after the substitutions. If flush
+// is true, it also returns any incomplete last line, likewise.
+func (f *ScrubFilter) filter(data []byte, flush bool) []byte {
+	data = append(f.held, data...)
+	f.held = nil
+	var out []byte
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n')
+		if n < 0 && !flush {
+			f.held = append([]byte(nil), data...)
+			break
+		} else if n < 0 {
+			n = len(data) - 1
+		}
+		line := data[:n+1]
+		data = data[n+1:]
+		end := len(line)
+		if line[end-1] == '\n' {
+			end--
+		}
+		text := line[:end]
+		for _, s := range f.scrubs {
+			text = s.re.ReplaceAll(text, []byte(s.replacement))
+		}
+		out = append(append(out, text...), line[end:]...)
+	}
+	return out
+}
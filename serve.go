@@ -0,0 +1,285 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The serve subcommand runs invigilate as a daemon, so that editors and bots can
+// start runs and fetch their results over HTTP. The runs are carried out one at
+// a time, within the server, just as if invigilate had been started with their
+// options from the command line, and their JSON reports are kept for later
+// requests. Since the server's own process is used, the state left by each run
+// in package variables is cleared before the next.
+
+// RunRequest is the body of a request to start a run.
+type RunRequest struct {
+	Options []string // such as ["-t", "5s"]
+	Program []string
+	Tests   []string // files and directories holding the test cases
+}
+
+// RunStatus describes a run started by a RunRequest.
+type RunStatus struct {
+	ID       int
+	State    string // "queued", "running", or "done"
+	Started  time.Time
+	ExitCode int           `json:",omitempty"` // once done
+	Stdout   string        `json:",omitempty"`
+	Stderr   string        `json:",omitempty"`
+	Results  []ReportEntry `json:",omitempty"`
+}
+
+// server holds the runs started by the serve subcommand.
+type server struct {
+	mu      sync.Mutex
+	runs    []*RunStatus // indexed by ID - 1
+	dir     string       // for the reports of the runs
+	metrics *Metrics     // of the runs that are done
+	running sync.Mutex   // held while a run is being carried out
+}
+
+// serving records whether invigilate is running as a server, so that fatal
+// ends only the run in progress, with this exit status.
+var serving bool
+
+// exitStatus is the exit status of a run ended by fatal in the server.
+type exitStatus int
+
+// serve implements the "serve" subcommand.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:7421", "listen for requests at this `address`")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `
+Usage: invigilate serve [options]
+
+Serve runs invigilate as a daemon with an HTTP API:
+
+  POST /runs       start a run, given a JSON object with the fields Options,
+                   Program, and Tests, each a list of strings; the reply gives
+                   the ID and state of the new run
+  GET /runs        list all runs
+  GET /runs/ID     show a run; once its state is "done", this includes its exit
+                   code, output, error output, and results as in a JSON report
+  GET /metrics     metrics of the runs that are done, in the Prometheus format
+
+The runs are carried out one at a time, in the server itself, each as if its
+options, program, and test cases had been given on the command line; runs waiting
+for an earlier one to finish are "queued". INVIGILATE_OPTS is not applied to them.
+Paths are relative to the working directory of the server. The test case files
+found, and their contents, are kept in memory between runs; a tree of test cases
+is searched again only when one of its directories has changed, and a file is
+read again only when its size or modification time has changed. The server runs
+whatever programs it is asked to, so it should only be reachable by trusted users.
+
+Options:
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		fatal(exitError, "Unexpected arguments")
+	}
+
+	dir, e := os.MkdirTemp("", "invigilate-serve")
+	if e != nil {
+		fatal(exitError, e)
+	}
+	srv := &server{dir: dir, metrics: newMetrics()}
+	testCache = newTestCache()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /runs", srv.start)
+	mux.HandleFunc("GET /runs", srv.list)
+	mux.HandleFunc("GET /runs/{id}", srv.show)
+	mux.HandleFunc("GET /metrics", srv.exportMetrics)
+
+	ln, e := net.Listen("tcp", *listen)
+	if e != nil {
+		fatal(exitError, e)
+	}
+	log.Printf("listening on %s", ln.Addr())
+	serving = true
+	// The server's own errors are not to be mixed with the error output of a run.
+	errorLog := log.New(os.Stderr, "", 0)
+	hs := &http.Server{Handler: mux, ErrorLog: errorLog}
+	errorLog.Print(hs.Serve(ln))
+	os.Exit(exitError)
+}
+
+// reply writes a JSON reply to an HTTP request.
+func reply(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	data, _ := json.MarshalIndent(v, "", "\t")
+	w.Write(append(data, '\n'))
+}
+
+// start handles a request to start a run.
+func (srv *server) start(w http.ResponseWriter, req *http.Request) {
+	var rr RunRequest
+	if e := json.NewDecoder(req.Body).Decode(&rr); e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	} else if len(rr.Program) == 0 || len(rr.Tests) == 0 {
+		http.Error(w, "Program and Tests must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	srv.mu.Lock()
+	run := &RunStatus{ID: len(srv.runs) + 1, State: "queued", Started: time.Now().UTC()}
+	srv.runs = append(srv.runs, run)
+	status := *run
+	srv.mu.Unlock()
+
+	go srv.execute(run, rr)
+	reply(w, http.StatusCreated, status)
+}
+
+// execute carries out a run, once any earlier run is done, and records its outcome.
+func (srv *server) execute(run *RunStatus, rr RunRequest) {
+	srv.running.Lock()
+	defer srv.running.Unlock()
+	srv.mu.Lock()
+	run.State = "running"
+	srv.mu.Unlock()
+
+	report := filepath.Join(srv.dir, fmt.Sprintf("%d.json", run.ID))
+	defer os.Remove(report)
+	args := append(append([]string{}, rr.Options...), "-json", report)
+	args = append(append(append(args, rr.Program...), "--"), rr.Tests...)
+	code, stdout, stderr := runServed(srv.dir, args)
+
+	var results []ReportEntry
+	if data, e := os.ReadFile(report); e == nil {
+		var rep Report
+		if json.Unmarshal(data, &rep) == nil {
+			results = rep.Results
+		}
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	run.State, run.ExitCode = "done", code
+	run.Stdout, run.Stderr, run.Results = stdout, stderr, results
+	var rs []Result
+	for _, r := range results {
+		rs = append(rs, entryResult(r))
+	}
+	srv.metrics.addRun(rs)
+}
+
+// runServed carries out a run within the server, with the given command line
+// arguments, and returns its exit code, output, and error output. These are
+// gathered in files in dir while the run's standard output and error output,
+// and the log, are redirected to them.
+func runServed(dir string, args []string) (code int, stdout, stderr string) {
+	outFile, e := os.CreateTemp(dir, "stdout")
+	if e != nil {
+		return exitError, "", e.Error() + "\n"
+	}
+	errFile, e := os.CreateTemp(dir, "stderr")
+	if e != nil {
+		outFile.Close()
+		os.Remove(outFile.Name())
+		return exitError, "", e.Error() + "\n"
+	}
+	savedOut, savedErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outFile, errFile
+	log.SetOutput(errFile)
+	defer func() {
+		os.Stdout, os.Stderr = savedOut, savedErr
+		log.SetOutput(savedErr)
+		for _, f := range []*os.File{outFile, errFile} {
+			f.Close()
+			data, _ := os.ReadFile(f.Name())
+			os.Remove(f.Name())
+			if f == outFile {
+				stdout = string(data)
+			} else {
+				stderr = string(data)
+			}
+		}
+	}()
+	defer func() {
+		if v := recover(); v != nil {
+			status, ok := v.(exitStatus)
+			if !ok {
+				panic(v)
+			}
+			code = int(status)
+			finishHooks()
+			removeBuild()
+			removeTmpDir()
+			closeCSV()
+		}
+	}()
+
+	resetState()
+	return runTests(flag.NewFlagSet("invigilate", flag.ContinueOnError), nil, args), "", ""
+}
+
+// resetState clears the state left in package variables by an earlier run.
+// The options are reset to their defaults when they are defined for the next.
+func resetState() {
+	results, failCount, errorCount = nil, 0, 0
+	repeatedRuns, failedRuns = 0, 0
+	failedRepeats, erroredRepeats = map[string]bool{}, map[string]bool{}
+	quarantine, quarantinedFails = nil, 0
+	warned = map[string]bool{}
+	hooks, builtProgram, runTmpDir, ranTest = nil, "", "", false
+	afterOnce = sync.Once{}
+	catalog, exitCodes = nil, map[int]exitClass{}
+	memoryMax, maxOutput = 0, 0
+	termSize = TermSize{cols: 80, rows: 24}
+	shardIndex, shardCount = 0, 0
+	interpreters, commentDelimiters = map[string][]string{}, map[string]string{}
+	spans = nil
+	csvFile, csvWriter = nil, nil
+	programHash, cacheDir = "", ""
+}
+
+// list handles a request to list the runs.
+func (srv *server) list(w http.ResponseWriter, req *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	runs := []RunStatus{}
+	for _, run := range srv.runs {
+		runs = append(runs, RunStatus{ID: run.ID, State: run.State, Started: run.Started, ExitCode: run.ExitCode})
+	}
+	reply(w, http.StatusOK, runs)
+}
+
+// show handles a request for the status of a run.
+func (srv *server) show(w http.ResponseWriter, req *http.Request) {
+	id, e := strconv.Atoi(req.PathValue("id"))
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if e != nil || id < 1 || id > len(srv.runs) {
+		http.NotFound(w, req)
+		return
+	}
+	reply(w, http.StatusOK, *srv.runs[id-1])
+}
+
+// exportMetrics handles a request for the metrics of the runs.
+func (srv *server) exportMetrics(w http.ResponseWriter, req *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	srv.metrics.write(w)
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shardSpec selects one shard of the tests, as "i/n"; "" to run all tests.
+var shardSpec string
+
+// shardIndex and shardCount are parsed from shardSpec; shardIndex counts from 0.
+var shardIndex, shardCount int
+
+// shardBalance is a history database whose durations are used to balance the shards;
+// "" to assign tests to shards by hashing their paths.
+var shardBalance string
+
+// parseShard checks and parses shardSpec.
+func parseShard() error {
+	i, n, ok := strings.Cut(shardSpec, "/")
+	index, e1 := strconv.Atoi(i)
+	count, e2 := strconv.Atoi(n)
+	if !ok || e1 != nil || e2 != nil || count < 1 || index < 1 || index > count {
+		return fmt.Errorf("invalid shard %q: must be i/n, with 1 <= i <= n", shardSpec)
+	}
+	shardIndex, shardCount = index-1, count
+	return nil
+}
+
+// hashShard chooses a shard for a test by hashing its path.
+func hashShard(path string) int {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return int(h.Sum32() % uint32(shardCount))
+}
+
+// shardTests passes on, from in to out, those tests belonging to the selected shard.
+// It stops early if ctx is cancelled.
+func shardTests(ctx context.Context, in <-chan Test, out chan<- Test) {
+	defer close(out)
+	if shardBalance == "" {
+		for t := range in {
+			if hashShard(t.path) == shardIndex && !sendTest(ctx, t, out) {
+				return
+			}
+		}
+		return
+	}
+
+	// Balancing needs to see every test before assigning any of them.
+	var tests []Test
+	for t := range in {
+		tests = append(tests, t)
+	}
+	shards, e := balanceShards(tests)
+	if e != nil {
+		sendTest(ctx, Test{path: shardBalance, err: e}, out)
+		return
+	}
+	for _, t := range tests {
+		if shards[t.path] == shardIndex && !sendTest(ctx, t, out) {
+			return
+		}
+	}
+}
+
+// balanceShards assigns tests to shards so that the shards' total durations,
+// according to the history database shardBalance, are roughly equal.
+// The longest tests are assigned first, each to the shard with the least work so far.
+// Tests with no recorded durations are assumed to take the average time.
+func balanceShards(tests []Test) (map[string]int, error) {
+	rows, e := runSQL(shardBalance, "SELECT path, avg(duration) FROM results WHERE status = 'pass' GROUP BY path;")
+	if e != nil {
+		return nil, e
+	}
+	known := map[string]time.Duration{}
+	var total time.Duration
+	for _, row := range rows {
+		if secs, e := strconv.ParseFloat(row[1], 64); e == nil {
+			known[row[0]] = time.Duration(secs * float64(time.Second))
+			total += known[row[0]]
+		}
+	}
+	average := time.Second
+	if len(known) > 0 {
+		average = total / time.Duration(len(known))
+	}
+
+	type job struct {
+		path     string
+		duration time.Duration
+	}
+	var jobs []job
+	seen := map[string]bool{}
+	for _, t := range tests {
+		if seen[t.path] {
+			continue
+		}
+		seen[t.path] = true
+		d, ok := known[t.path]
+		if !ok {
+			d = average
+		}
+		jobs = append(jobs, job{t.path, d})
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		if jobs[a].duration != jobs[b].duration {
+			return jobs[a].duration > jobs[b].duration
+		}
+		return jobs[a].path < jobs[b].path
+	})
+
+	load := make([]time.Duration, shardCount)
+	shards := map[string]int{}
+	for _, j := range jobs {
+		least := 0
+		for k := range load {
+			if load[k] < load[least] {
+				least = k
+			}
+		}
+		shards[j.path] = least
+		load[least] += j.duration
+	}
+	return shards, nil
+}
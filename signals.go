@@ -0,0 +1,99 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// When invigilate is interrupted, it cancels the context of the run, so that it
+// finds and starts no more tests, and the test in progress is killed; it then
+// reports the results so far. A second interrupt makes it exit at once, after
+// running the -after command.
+// Some other signals are simply passed on to the test in progress.
+
+// interruption records an interrupt, and the test program currently running.
+var interruption struct {
+	sync.Mutex
+	signal  os.Signal
+	running *exec.Cmd
+}
+
+// handleSignals starts watching for SIGINT and SIGTERM, which call cancel,
+// and for signals to be forwarded.
+func handleSignals(cancel context.CancelFunc) {
+	if len(forwardedSignals) > 0 {
+		fwd := make(chan os.Signal, 4)
+		signal.Notify(fwd, forwardedSignals...)
+		go func() {
+			for sig := range fwd {
+				interruption.Lock()
+				if interruption.running != nil {
+					signalProcessGroup(interruption.running, sig)
+				}
+				interruption.Unlock()
+			}
+		}()
+	}
+
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range ch {
+			interruption.Lock()
+			if interruption.signal != nil {
+				log.Print("Interrupted again; exiting")
+				if interruption.running != nil {
+					killProcessGroup(interruption.running)
+				}
+				interruption.Unlock()
+				runAfter()
+				os.Exit(exitCode(sig))
+			}
+			interruption.signal = sig
+			interruption.Unlock()
+			cancel()
+		}
+	}()
+}
+
+// interrupted returns the signal that interrupted invigilate, or nil if there was none.
+func interrupted() os.Signal {
+	interruption.Lock()
+	defer interruption.Unlock()
+	return interruption.signal
+}
+
+// setRunning records the test program now running, or nil if there is none.
+func setRunning(cmd *exec.Cmd) {
+	interruption.Lock()
+	defer interruption.Unlock()
+	interruption.running = cmd
+}
+
+// commandContext returns a command which, with the rest of its process group,
+// is killed if ctx is cancelled before it exits. If ctx has already been
+// cancelled, the command cannot be started.
+func commandContext(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Cancel = func() error {
+		killProcessGroup(cmd)
+		return nil
+	}
+	return cmd
+}
+
+// exitCode returns the conventional exit code after being stopped by a signal.
+func exitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return exitError
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// soakCount is the number of times each test should be run in soak mode;
+// 1 or less disables soak mode.
+var soakCount int
+
+// leakThreshold is the fractional growth in peak memory use over a soak run
+// that is reported as a probable leak.
+var leakThreshold float64
+
+// soakTest runs a test repeatedly, failing it if any run fails or if its peak
+// memory use grows steadily from one run to the next.
+func soakTest(ctx context.Context, t Test, program []string, span *Span) (r Result) {
+	var rss []int64
+	for k := 0; k < soakCount; k++ {
+		r = runTest(ctx, t, program, span)
+		if r.status != passed || ctx.Err() != nil {
+			return r
+		}
+		rss = append(rss, r.maxRSS)
+	}
+
+	if leaking(rss) {
+		log.Printf("%s: probable memory leak: peak memory grew from %d KiB to %d KiB over %d runs",
+			t.path, rss[0]/1024, rss[len(rss)-1]/1024, len(rss))
+		r.status, r.category = failed, "leak"
+	}
+	return r
+}
+
+// leaking reports whether a series of peak memory samples grows monotonically,
+// and by more than leakThreshold overall.
+func leaking(rss []int64) bool {
+	if len(rss) < 2 || rss[0] <= 0 {
+		return false
+	}
+	for k := 1; k < len(rss); k++ {
+		if rss[k] < rss[k-1] {
+			return false
+		}
+	}
+	growth := float64(rss[len(rss)-1]-rss[0]) / float64(rss[0])
+	return growth > leakThreshold
+}
@@ -0,0 +1,19 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+// For output whose order does not matter at all, the -sort option, or the
+// sort-output directive, is simpler than unordered blocks: all the lines expected
+// on each of the output and error output are compared with all the lines received
+// there, once the program has finished writing them, as if both had been sorted.
+// Input is then given without waiting for any output, and searches, at-exit
+// directives, and unordered blocks are not treated specially.
+
+// sortOutput records the -sort option.
+var sortOutput bool
+
+// testSorted reports whether a test case's output is compared with its lines sorted.
+func testSorted(t Test) bool {
+	return sortOutput || hasDirective(t, "sort-output")
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Some programs, such as filters and interpreters, read the text they work on
+// from standard input. With -stdin, each test case file is given to the program
+// on its standard input, in place of the input lines, instead of as an argument.
+// With -strip, the lines meant for invigilate are first removed, for programs
+// that would not accept them; without -stdin, the program, and any compile
+// command, is then given the path to a copy of the test case without them, in a
+// temporary directory.
+
+// stdinInput is whether each test case is given on the program's standard input.
+var stdinInput bool
+
+// stripLines is whether the lines meant for invigilate are removed from a test
+// case before it is given to the program.
+var stripLines bool
+
+// isTestLine reports whether a line of a test case is meant for invigilate:
+// input, expected output, an exit status, a title, or a directive.
+func isTestLine(line string) bool {
+	if !strings.HasPrefix(line, comment) || len(line) == len(comment) {
+		return false
+	}
+	line = line[len(comment):]
+	return strings.ContainsRune("<>!?:", rune(line[0])) || isDirective(line)
+}
+
+// hasInputLines reports whether a test case gives input for the program.
+func hasInputLines(t Test) bool {
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		if strings.HasPrefix(lr.text(), comment+"<") {
+			return true
+		}
+	}
+	return false
+}
+
+// programText returns the text of a test case as given to the program: the
+// whole file or, with -strip, the file without the lines meant for invigilate.
+func programText(t Test) (string, error) {
+	if !stripLines && !t.streamed {
+		return t.content, nil
+	}
+	var text strings.Builder
+	lr := t.lines()
+	for lr.scan() {
+		if line := lr.text(); !stripLines || !isTestLine(line) {
+			text.WriteString(line)
+		}
+	}
+	return text.String(), lr.close()
+}
+
+// needsCopy reports whether the program is given a copy of a test case, rather
+// than its file: when the lines meant for invigilate are stripped, or the file
+// holds several test cases.
+func needsCopy(t Test) bool {
+	return !stdinInput && (stripLines || t.file != "")
+}
+
+// writeCopy writes a copy of a test case, as given to the program, into the
+// directory dir, with the same name as its file, and returns its path.
+func writeCopy(t Test, dir string) (string, error) {
+	text, e := programText(t)
+	if e != nil {
+		return "", e
+	}
+	path := filepath.Join(dir, filepath.Base(t.source()))
+	return path, os.WriteFile(path, []byte(text), 0644)
+}
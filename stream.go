@@ -0,0 +1,222 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+// readSize is the most data read from an output stream at once.
+const readSize = 65536
+
+// maxChunks is the most pieces of data read from an output stream that may wait
+// to be matched. It bounds the memory used when a program produces much output
+// on one stream while the test case still expects output on the other; beyond
+// that, the program must again wait for the data to be matched.
+const maxChunks = 256
+
+// Stream holds the data received from one of the program's output streams that
+// has not yet been matched against the test case. Each stream is read by a
+// goroutine of its own, so that a program is never blocked writing to one
+// stream while invigilate waits for output on the other. The data is gathered
+// in a buffer that is reused once its contents have been matched, so that a
+// program producing megabytes of output does not cause it to be copied repeatedly.
+type Stream struct {
+	stream   byte   // '>' for standard output, '!' for standard error output
+	buf      []byte // buf[start:] is the data not yet matched
+	start    int
+	received int               // the amount of data received so far, after filtering
+	err      error             // the error that ended the stream, once it has been received
+	crlf     *CRLFFilter       // for line endings in the data, if -crlf is given
+	ansi     *ANSIFilter       // for escape sequences in the data, if -ansi is given
+	ignored  bool              // whether the data is only recorded in the transcript
+	scrub    *ScrubFilter      // for substitutions in the data, if any are given
+	ws       *WhitespaceFilter // for white space in the data, if differences in it are ignored
+	newline  bool              // whether to end the data with a newline, if it does not
+	last     byte              // the last byte received, after filtering
+	lines    int               // the number of newlines received, after filtering
+
+	limit  *OutputLimit  // shared with the other stream, if -max-output is given
+	chunks chan chunk    // data read by the goroutine
+	done   chan struct{} // closed to stop the goroutine
+}
+
+// chunk is one piece of data read from an output stream.
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// newStream starts reading from pipe, recording the data in the transcript.
+// If ignored is true, the data is not kept for matching, so the Stream only
+// receives the end of the data. The limit, if not nil, is shared by all the
+// streams of a test. The Stream must be stopped when it is no longer needed.
+func newStream(pipe io.Reader, stream byte, tr *Transcript, ignored bool, limit *OutputLimit) *Stream {
+	s := &Stream{stream: stream, chunks: make(chan chunk, maxChunks), done: make(chan struct{}), ignored: ignored, limit: limit}
+	if crlf {
+		s.crlf = &CRLFFilter{}
+	}
+	if ansiMode != "" {
+		s.ansi = &ANSIFilter{}
+	}
+	go s.receive(pipe, tr)
+	return s
+}
+
+// receive reads from the pipe until an error occurs, or the Stream is stopped.
+func (s *Stream) receive(pipe io.Reader, tr *Transcript) {
+	buf := make([]byte, readSize)
+	var excerpt []byte
+	for total := 0; ; {
+		n, e := pipe.Read(buf)
+		if total += n; maxOutput > 0 && total > maxOutput {
+			// The rest is not read, so the program is blocked until it is killed.
+			n -= total - maxOutput
+			excerpt = append(excerpt, buf[:min(n, excerptSize-len(excerpt))]...)
+			ole := &OutputLimitError{s.stream, excerpt}
+			s.limit.exceed(ole)
+			e = ole
+		} else if len(excerpt) < excerptSize {
+			excerpt = append(excerpt, buf[:min(n, excerptSize-len(excerpt))]...)
+		}
+		tr.add(s.stream, string(buf[:n]))
+		if s.ignored && e == nil {
+			continue
+		} else if s.ignored {
+			n = 0
+		}
+		select {
+		case s.chunks <- chunk{append([]byte(nil), buf[:n]...), e}:
+		case <-s.done:
+			return
+		}
+		if e != nil {
+			return
+		}
+	}
+}
+
+// stop stops reading from the pipe.
+func (s *Stream) stop() {
+	close(s.done)
+}
+
+// pending returns the data not yet matched.
+func (s *Stream) pending() []byte {
+	return s.buf[s.start:]
+}
+
+// consume discards the first n bytes of the data not yet matched.
+func (s *Stream) consume(n int) {
+	s.start += n
+	if s.start == len(s.buf) {
+		s.buf, s.start = s.buf[:0], 0
+	}
+}
+
+// read waits for more data, adding it to the data not yet matched. If deadline
+// is not zero and no data is received by then, it returns os.ErrDeadlineExceeded.
+// Once the stream has ended, read returns the error that ended it, such as io.EOF.
+func (s *Stream) read(deadline time.Time) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	var c chunk
+	select {
+	case <-s.limit.done():
+		return 0, s.limit.err
+	case c = <-s.chunks:
+	default:
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-s.limit.done():
+			return 0, s.limit.err
+		case c = <-s.chunks:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	if s.start > 0 && s.start >= len(s.buf)/2 {
+		n := copy(s.buf, s.buf[s.start:])
+		s.buf, s.start = s.buf[:n], 0
+	}
+	data := c.data
+	if s.crlf != nil {
+		data = s.crlf.filter(data, c.err != nil)
+	}
+	if s.ansi != nil {
+		data = s.ansi.filter(data, c.err != nil)
+	}
+	if s.scrub != nil {
+		// An incomplete line is flushed if no more data is waiting.
+		data = s.scrub.filter(data, c.err != nil || len(s.chunks) == 0)
+	}
+	if s.ws != nil {
+		data = s.ws.filter(data, c.err != nil)
+	}
+	if len(data) > 0 {
+		s.last = data[len(data)-1]
+	}
+	if c.err != nil && s.newline && s.received+len(data) > 0 && s.last != '\n' {
+		data = append(data, '\n')
+	}
+	s.buf = append(s.buf, data...)
+	s.received += len(data)
+	s.lines += bytes.Count(data, []byte{'\n'})
+	s.err = c.err
+	return len(data), c.err
+}
+
+// writeInput writes data to the program's input, recording it in the transcript.
+// The writing is done by a goroutine of its own, so that a program which stops
+// reading its input cannot block invigilate past the deadline; in that case,
+// writeInput returns os.ErrDeadlineExceeded, and the goroutine ends once the
+// program is stopped. This does not need pipes that support deadlines, which
+// they do not on every system.
+func writeInput(pipe io.Writer, data string, deadline time.Time, tr *Transcript) error {
+	written := make(chan error, 1)
+	go func() {
+		n, e := io.WriteString(pipe, data)
+		tr.add('<', data[:n])
+		written <- e
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case e := <-written:
+		return e
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// readLine returns the next line of data not yet matched, including its newline,
+// if any, and consumes it. At the end of the stream, it returns any incomplete
+// last line, and then io.EOF.
+func (s *Stream) readLine(deadline time.Time) (string, error) {
+	for {
+		have := s.pending()
+		if n := bytes.IndexByte(have, '\n'); n >= 0 {
+			s.consume(n + 1)
+			return string(have[:n+1]), nil
+		}
+		if _, e := s.read(deadline); e == io.EOF && len(s.pending()) > 0 {
+			line := string(s.pending())
+			s.consume(len(line))
+			return line, nil
+		} else if e != nil {
+			return "", e
+		}
+	}
+}
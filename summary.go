@@ -0,0 +1,75 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// dirSummary requests a summary of the results for each directory at the end of the run.
+var dirSummary bool
+
+// DirStats summarizes the results of the tests in one directory.
+type DirStats struct {
+	dir      string
+	tests    int
+	failures int
+	errors   int
+	duration time.Duration
+}
+
+// summarizeDirs groups results by the directory containing the test case,
+// sorting the directories with the most failures and errors first, then
+// those taking the most time.
+func summarizeDirs(results []Result) []DirStats {
+	byDir := map[string]*DirStats{}
+	for _, r := range results {
+		dir := filepath.Dir(r.path)
+		s := byDir[dir]
+		if s == nil {
+			s = &DirStats{dir: dir}
+			byDir[dir] = s
+		}
+		s.tests++
+		s.duration += r.duration
+		switch r.status {
+		case failed:
+			s.failures++
+		case errored:
+			s.errors++
+		}
+	}
+
+	var stats []DirStats
+	for _, s := range byDir {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.failures+a.errors != b.failures+b.errors {
+			return a.failures+a.errors > b.failures+b.errors
+		} else if a.duration != b.duration {
+			return a.duration > b.duration
+		}
+		return a.dir < b.dir
+	})
+	return stats
+}
+
+// printDirSummary writes a table of the results for each directory.
+func printDirSummary(w io.Writer, results []Result) {
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "By directory:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "  tests\tfailed\terrors\ttime\t  directory")
+	for _, s := range summarizeDirs(results) {
+		fmt.Fprintf(tw, "  %d\t%d\t%d\t%.3fs\t  %s\n", s.tests, s.failures, s.errors, s.duration.Seconds(), s.dir)
+	}
+	tw.Flush()
+}
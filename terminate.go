@@ -0,0 +1,43 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// gracePeriod is how long a program that has exceeded its time limit
+// is given to exit after SIGTERM, before it is killed.
+var gracePeriod time.Duration
+
+// stopGracefully stops a program that has exceeded its time limit: it sends
+// SIGTERM to its process group, waits up to gracePeriod for the program to exit,
+// and then kills whatever remains of the group. It returns a description of how the program ended, for
+// appending to the report of the timeout.
+func stopGracefully(cmd *exec.Cmd) string {
+	if gracePeriod <= 0 || terminate(cmd) != nil {
+		return ""
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(gracePeriod):
+		killProcessGroup(cmd)
+		<-done
+		return fmt.Sprintf("; program killed after ignoring SIGTERM for %s", gracePeriod)
+	}
+	killProcessGroup(cmd) // any processes it left behind
+
+	if ps := cmd.ProcessState; ps != nil && ps.Exited() {
+		return fmt.Sprintf("; program exited with status %d after SIGTERM", ps.ExitCode())
+	}
+	return "; program terminated by SIGTERM"
+}
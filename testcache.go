@@ -0,0 +1,121 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// The server, which carries out many runs of the same trees of test cases, keeps
+// what it has learned of them between runs: the test case files found in each
+// tree, and the contents of the files. A tree is searched again only when the
+// modification time of one of its directories has changed, as it does when a file
+// is added to it, removed, or renamed; and a file is read again only when its size
+// or modification time has changed. So a run after one file has been edited reads
+// just that file. Outside the server, each run finds and reads the test cases
+// afresh, and nothing is kept.
+
+// testCacheLimit is the most test case content, in bytes, kept between runs.
+const testCacheLimit = 64 << 20
+
+// TestCache holds the test case files found, and their contents, in earlier runs.
+type TestCache struct {
+	mu       sync.Mutex
+	trees    map[string]cachedTree    // by treeKey
+	contents map[string]cachedContent // by path
+	size     int                      // the total length of the contents
+}
+
+// cachedTree records the test case files found in a tree of directories.
+type cachedTree struct {
+	dirs  map[string]time.Time // the modification time of each directory
+	files []string             // in the order they were found
+}
+
+// cachedContent records the content of a test case file, and the size and
+// modification time of the file when it was read.
+type cachedContent struct {
+	size    int64
+	modTime time.Time
+	content string
+}
+
+// testCache is the cache of the server; nil, and so unused, in other runs.
+var testCache *TestCache
+
+// newTestCache returns a new, empty cache.
+func newTestCache() *TestCache {
+	return &TestCache{trees: map[string]cachedTree{}, contents: map[string]cachedContent{}}
+}
+
+// treeKey identifies a tree of test cases, together with the options that
+// decide which of its files are test cases.
+func treeKey(root string) string {
+	return root + "\x00" + extension + "\x00" + interpSpec + "\x00" + commentSpec
+}
+
+// files returns the test case files found in the tree at root in an earlier run,
+// if none of its directories has changed since.
+func (tc *TestCache) files(root string) ([]string, bool) {
+	if tc == nil {
+		return nil, false
+	}
+	tc.mu.Lock()
+	tree, ok := tc.trees[treeKey(root)]
+	tc.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	for dir, modTime := range tree.dirs {
+		if info, e := os.Lstat(dir); e != nil || !info.IsDir() || !info.ModTime().Equal(modTime) {
+			return nil, false
+		}
+	}
+	return tree.files, true
+}
+
+// storeFiles records the test case files found in the tree at root.
+func (tc *TestCache) storeFiles(root string, tree cachedTree) {
+	if tc != nil {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		tc.trees[treeKey(root)] = tree
+	}
+}
+
+// content returns the content of a test case file read in an earlier run,
+// if the file, described by info, has the same size and modification time.
+func (tc *TestCache) content(path string, info fs.FileInfo) (string, bool) {
+	if tc == nil {
+		return "", false
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	c, ok := tc.contents[path]
+	if !ok || c.size != info.Size() || !c.modTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	return c.content, true
+}
+
+// storeContent records the content of a test case file, described by info,
+// in place of any earlier content, unless that would exceed testCacheLimit.
+func (tc *TestCache) storeContent(path string, info fs.FileInfo, content string) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if old, ok := tc.contents[path]; ok {
+		tc.size -= len(old.content)
+		delete(tc.contents, path)
+	}
+	if tc.size+len(content) <= testCacheLimit {
+		tc.contents[path] = cachedContent{info.Size(), info.ModTime(), content}
+		tc.size += len(content)
+	}
+}
@@ -0,0 +1,11 @@
+# Copyright 2024 Patrick Smith
+# Use of this source code is subject to the MIT-style license in the LICENSE file.
+#
+# Use more memory each time this is run, by keeping a counter in a file
+# next to the test case. Used to check leak detection in soak mode.
+
+counter="$(dirname "$0")/counter"
+n=$(cat "$counter" 2>/dev/null || echo 0)
+n=$((n+1))
+echo $n > "$counter"
+x=$(head -c $((n*5000000)) /dev/zero | tr '\0' a)
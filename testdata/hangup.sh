@@ -0,0 +1,12 @@
+# Copyright 2024 Patrick Smith
+# Use of this source code is subject to the MIT-style license in the LICENSE file.
+#
+# A test case that waits for SIGHUP.
+
+trap 'echo "got SIGHUP"; exit 0' HUP
+echo ready
+sleep 3 &
+wait
+
+#>ready
+#>got SIGHUP
@@ -0,0 +1,6 @@
+# Copyright 2024 Patrick Smith
+# Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+# Run once before the tests in this directory.
+
+echo ready > state.txt
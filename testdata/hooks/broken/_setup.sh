@@ -0,0 +1,5 @@
+# Copyright 2024 Patrick Smith
+# Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+echo cannot start
+exit 1
@@ -0,0 +1,7 @@
+# Copyright 2024 Patrick Smith
+# Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+# Run by awk, with -f, for the extension .awk.
+
+BEGIN { print "hello from awk" }
+#>hello from awk
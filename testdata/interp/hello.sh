@@ -0,0 +1,7 @@
+# Copyright 2024 Patrick Smith
+# Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+# Run by the shell, for the extension .sh.
+
+echo "hello from $0"
+#>hello from testdata/interp/hello.sh
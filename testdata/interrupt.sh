@@ -0,0 +1,8 @@
+# Copyright 2024 Patrick Smith
+# Use of this source code is subject to the MIT-style license in the LICENSE file.
+#
+# A test case that starts a background process, which creates a file
+# named "marker" next to the test case unless it is killed first.
+
+(sleep 0.5; touch "$(dirname "$0")/marker") &
+wait
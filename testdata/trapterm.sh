@@ -0,0 +1,8 @@
+# Copyright 2024 Patrick Smith
+# Use of this source code is subject to the MIT-style license in the LICENSE file.
+#
+# A test case that takes too long, and handles SIGTERM as given in $TRAP.
+
+trap "$TRAP" TERM
+sleep 3 &
+wait
@@ -14,30 +14,36 @@ $INVIGILATE -v /bin/sh -- testdata/mix
 
 #>
 #>testdata/mix/anteater.test
+#>$ /bin/sh testdata/mix/anteater.test
 #>>anteater
 #>
 #>testdata/mix/bumblebee.test
+#>$ /bin/sh testdata/mix/bumblebee.test
 #>>bumblebee
 #!testdata/mix/bumblebee.test: incorrect test output
 #!expected: bumblebee
 #!  actual: hornet
 #>
 #>testdata/mix/corgi.test
+#>$ /bin/sh testdata/mix/corgi.test
 #>>corgi
 #>
 #>testdata/mix/dingo.test
+#>$ /bin/sh testdata/mix/dingo.test
 #>>dingo
 #!testdata/mix/dingo.test: incorrect test output
 #!expected: dingo
 #!  actual: fox
 #>
 #>testdata/mix/elk.test
+#>$ /bin/sh testdata/mix/elk.test
 #>>elk
 #!testdata/mix/elk.test: incorrect test output
 #!expected: elk
 #!  actual: moose
 #>
 #>testdata/mix/ferret.test
+#>$ /bin/sh testdata/mix/ferret.test
 #>>ferret
 #!3 failed tests
 
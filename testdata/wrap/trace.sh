@@ -0,0 +1,2 @@
+echo "args: $*"
+exec "$@"
@@ -0,0 +1,33 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import "strings"
+
+// A test case may describe itself with a title, for readers of the results who
+// do not know the test cases by their paths, in lines beginning "#:", as in
+// "#: Rejects an empty file". The text of several such lines is joined with
+// spaces. The title is shown with the path in verbose output and when the test
+// case fails, and is included in JSON reports.
+
+// testTitle returns the title of a test case; "" if it has none.
+func testTitle(t Test) string {
+	var words []string
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		if text, ok := strings.CutPrefix(lr.text(), comment+":"); ok {
+			words = append(words, strings.Fields(text)...)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// displayName returns the path of a test case, followed by its title, if any.
+func displayName(t Test) string {
+	if title := testTitle(t); title != "" {
+		return t.path + ": " + title
+	}
+	return t.path
+}
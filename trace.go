@@ -0,0 +1,192 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Traces are sent to an OpenTelemetry collector using OTLP over HTTP
+// with JSON encoding, which needs nothing beyond the standard library.
+
+// otelEndpoint is the OTLP/HTTP collector to which spans should be sent; "" for none.
+var otelEndpoint string
+
+// Span is one span of a trace. All methods may be called on a nil *Span,
+// in which case they do nothing; this is how tracing is disabled.
+type Span struct {
+	name     string
+	traceID  string
+	id       string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      string
+}
+
+// spans holds all the spans started so far, to be sent when the run is complete.
+var spans []*Span
+
+// randomID returns n random bytes, encoded in hexadecimal.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a new span at time start, as a child of parent,
+// or as the root of a new trace if parent is nil.
+// It returns nil if tracing was not requested.
+func startSpan(name string, parent *Span, start time.Time) *Span {
+	if otelEndpoint == "" {
+		return nil
+	}
+	s := &Span{name: name, id: randomID(8), start: start, attrs: map[string]string{}}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.id
+	} else {
+		s.traceID = randomID(16)
+	}
+	spans = append(spans, s)
+	return s
+}
+
+// setAttr sets an attribute of the span.
+func (s *Span) setAttr(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// setError marks the span as having failed.
+func (s *Span) setError(msg string) {
+	if s != nil {
+		s.err = msg
+	}
+}
+
+// finish ends the span at time end.
+func (s *Span) finish(end time.Time) {
+	if s != nil {
+		s.end = end
+	}
+}
+
+// The following types give the OTLP JSON encoding of spans.
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// exportSpans sends all the spans to the collector.
+func exportSpans() error {
+	if otelEndpoint == "" || len(spans) == 0 {
+		return nil
+	}
+
+	var out []otlpSpan
+	for _, s := range spans {
+		end := s.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		o := otlpSpan{
+			TraceID:      s.traceID,
+			SpanID:       s.id,
+			ParentSpanID: s.parentID,
+			Name:         s.name,
+			Kind:         1, // internal
+			Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+			End:          strconv.FormatInt(end.UnixNano(), 10),
+			Attributes:   []otlpAttr{},
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttr{k, otlpValue{v}})
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{2, s.err}
+		}
+		out = append(out, o)
+	}
+
+	body, e := json.Marshal(otlpTraces{[]otlpResourceSpans{{
+		Resource:   otlpResource{[]otlpAttr{{"service.name", otlpValue{"invigilate"}}}},
+		ScopeSpans: []otlpScopeSpans{{otlpScope{"invigilate", version}, out}},
+	}}})
+	if e != nil {
+		return e
+	}
+
+	url := otelEndpoint
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url = strings.TrimSuffix(url, "/") + "/v1/traces"
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, e := client.Post(url, "application/json", bytes.NewReader(body))
+	if e != nil {
+		return fmt.Errorf("sending traces: %w", e)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sending traces to %s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// showTranscript requests the whole transcript of each failed test.
+var showTranscript bool
+
+// Transcript records the data exchanged with the program during a test case.
+// Its methods may be called concurrently, since each stream is read separately.
+type Transcript struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []Event
+
+	// The streams whose data is recorded; for the others, only the time of
+	// the first output or error output is noted.
+	keep string
+
+	// When the first output or error output was received, if output is set
+	first  time.Duration
+	output bool
+}
+
+// Event is one piece of data sent to or received from the program.
+type Event struct {
+	// When the data was sent or received, relative to the start of the test
+	at time.Duration
+
+	// '<' for standard input, '>' for standard output, '!' for standard error output
+	stream byte
+
+	data string
+}
+
+// newTranscript starts a new, empty transcript, recording the data of the given streams.
+func newTranscript(keep string) *Transcript {
+	return &Transcript{start: time.Now(), keep: keep}
+}
+
+// transcriptStreams returns the streams whose data must be recorded for a test
+// case: all of them, if the transcript is to be shown, saved, or compared once the
+// test has run; the output and error output, if the test checks them for text
+// that must not appear; and otherwise none, since the data may be large.
+func transcriptStreams(t Test) string {
+	if showTranscript || bundleDir != "" || artifactsDir != "" || saveActual || checkDeterminism || updatingGoldens {
+		return "<>!"
+	}
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment+">") || strings.HasPrefix(line, comment+"!") {
+			if _, ok := forbiddenText(line[len(comment)+1:]); ok {
+				return ">!"
+			}
+		}
+	}
+	return ""
+}
+
+// add records data sent on, or received from, one of the program's streams.
+// It may be called on a nil *Transcript, and then does nothing.
+func (tr *Transcript) add(stream byte, data string) {
+	if tr != nil && data != "" {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		at := time.Since(tr.start)
+		if stream != '<' && !tr.output {
+			tr.first, tr.output = at, true
+		}
+		if strings.IndexByte(tr.keep, stream) >= 0 {
+			tr.events = append(tr.events, Event{at, stream, data})
+		}
+	}
+}
+
+// firstOutput returns the time at which the first output or error output
+// was received from the program, and whether there was any.
+func (tr *Transcript) firstOutput() (time.Duration, bool) {
+	if tr != nil {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		return tr.first, tr.output
+	}
+	return 0, false
+}
+
+// stream returns all the data sent or received on one stream.
+func (tr *Transcript) stream(stream byte) string {
+	if tr == nil {
+		return ""
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var s strings.Builder
+	for _, ev := range tr.events {
+		if ev.stream == stream {
+			s.WriteString(ev.data)
+		}
+	}
+	return s.String()
+}
+
+// write writes the transcript in a readable form, one line of data per line,
+// each marked with its time and stream.
+func (tr *Transcript) write(w io.Writer) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, ev := range tr.events {
+		for _, line := range strings.SplitAfter(ev.data, "\n") {
+			if line == "" {
+				continue
+			}
+			if !strings.HasSuffix(line, "\n") {
+				line += " (no newline)\n"
+			}
+			fmt.Fprintf(w, "%8.3fs %c %s", ev.at.Seconds(), ev.stream, line)
+		}
+	}
+}
+
+// logTranscript shows the whole transcript of a failed test, since what led up
+// to the failure is often as telling as the failure itself.
+func logTranscript(t Test, r Result) {
+	var s strings.Builder
+	r.transcript.write(&s)
+	if r.command != "" {
+		log.Printf("%s: run as: %s", t.path, r.command)
+	}
+	if s.Len() == 0 {
+		log.Printf("%s: no data was exchanged with the program", t.path)
+	} else {
+		log.Printf("%s: transcript of the failed run:\n%s", t.path, printable(s.String()))
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+// Programs that iterate over hash maps, or run goroutines, may write lines in an
+// order that changes from run to run. The lines expected between the directives
+// "unordered" and "end-unordered" may then be received in any order: for each of
+// the output and error output, as many lines are read as are expected, and the
+// two sets of lines must be the same. Input cannot be given within such a block.
+
+// unorderedDiff compares the lines expected in an unordered block with as many
+// lines received, as sets that may contain repeated lines. If they differ, it
+// returns an expected line that was not received, and a line that was received
+// but not expected.
+func unorderedDiff(want, have []string) (missing, unexpected string, same bool) {
+	count := map[string]int{}
+	for _, w := range want {
+		count[w]++
+	}
+	for _, h := range have {
+		count[h]--
+	}
+	for _, w := range want {
+		if count[w] > 0 {
+			missing = w
+			break
+		}
+	}
+	for _, h := range have {
+		if count[h] < 0 {
+			unexpected = h
+			break
+		}
+	}
+	return missing, unexpected, missing == "" && unexpected == ""
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Schema holds the conventions a suite of test cases must follow, as read from
+// a schema file by the validate subcommand.
+type Schema struct {
+	allowed  map[string]bool           // the directives that may be used; nil for all
+	required []string                  // directives every test case must use
+	patterns map[string]*regexp.Regexp // patterns the arguments of directives must match
+	maxima   map[string]time.Duration  // limits on the arguments of directives
+}
+
+// readSchema reads a schema file. Each line holds a keyword and its arguments:
+//
+//	allow NAME...            only these directives may be used
+//	require NAME...          each test case must use these directives
+//	match NAME REGEXP        the argument of directive NAME must match REGEXP
+//	max NAME DURATION        the argument of directive NAME must be a duration no longer than DURATION
+//
+// Blank lines and lines beginning with "#" are ignored.
+func readSchema(path string) (*Schema, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	s := &Schema{patterns: map[string]*regexp.Regexp{}, maxima: map[string]time.Duration{}}
+	for k, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "allow":
+			if s.allowed == nil {
+				s.allowed = map[string]bool{}
+			}
+			for _, name := range fields[1:] {
+				s.allowed[name] = true
+			}
+		case "require":
+			s.required = append(s.required, fields[1:]...)
+		case "match":
+			name, pattern, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "match")), " ")
+			re, e := regexp.Compile(strings.TrimSpace(pattern))
+			if name == "" || e != nil {
+				return nil, fmt.Errorf("%s:%d: match needs a directive name and a valid regular expression", path, k+1)
+			}
+			s.patterns[name] = re
+		case "max":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: max needs a directive name and a duration", path, k+1)
+			}
+			d, e := time.ParseDuration(fields[2])
+			if e != nil {
+				return nil, fmt.Errorf("%s:%d: invalid duration %q", path, k+1, fields[2])
+			}
+			s.maxima[fields[1]] = d
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown keyword %q; must be allow, require, match, or max", path, k+1, fields[0])
+		}
+	}
+	return s, nil
+}
+
+// check checks one test case against the schema, and returns a description
+// of each violation.
+func (s *Schema) check(t Test) []string {
+	var problems []string
+	used := map[string]bool{}
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if !strings.HasPrefix(line, comment) || !isDirective(line[len(comment):]) {
+			continue
+		}
+		name, arg := splitDirective(line[len(comment):])
+		used[name] = true
+		where := fmt.Sprintf("%s:%d: ", t.path, lr.lineno)
+		if s.allowed != nil && !s.allowed[name] {
+			problems = append(problems, where+fmt.Sprintf("directive %q is not allowed", name))
+		}
+		if re := s.patterns[name]; re != nil && !re.MatchString(arg) {
+			problems = append(problems, where+fmt.Sprintf("%s argument %q does not match %s", name, arg, re))
+		}
+		if max, ok := s.maxima[name]; ok {
+			if d, e := time.ParseDuration(strings.TrimSpace(arg)); e != nil {
+				problems = append(problems, where+fmt.Sprintf("%s argument %q is not a duration", name, arg))
+			} else if d > max {
+				problems = append(problems, where+fmt.Sprintf("%s %s exceeds the maximum of %s", name, d, max))
+			}
+		}
+	}
+	for _, name := range s.required {
+		if !used[name] {
+			problems = append(problems, fmt.Sprintf("%s: missing required directive %q", t.path, name))
+		}
+	}
+	return problems
+}
+
+// validate implements the "validate" subcommand.
+func validate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.StringVar(&comment, "c", "#", "comment delimiter for expected input and output")
+	fs.StringVar(&commentSpec, "comments", "", "use these comment delimiters for test cases with these extensions, given as a comma separated `map` such as \".c=//,.sql=--\"")
+	fs.StringVar(&extension, "e", ".test", "test case files have this extension")
+	schemaPath := fs.String("schema", "", "check the test cases against this schema `file`")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `
+Usage: invigilate validate [options] files
+
+Validate checks test case files without running them: every directive must have
+a valid argument, and no comment line may look like a directive invigilate does
+not know, as these are taken for ordinary comments when the tests are run. With -schema, the test cases must also follow
+the conventions in the schema file, whose lines may be:
+
+    allow NAME...         only these directives may be used
+    require NAME...       every test case must use these directives
+    match NAME REGEXP     the argument of directive NAME must match REGEXP
+    max NAME DURATION     the argument of directive NAME must be a duration
+                          no longer than DURATION
+
+Blank lines and lines beginning with "#" are ignored. Extension directives,
+such as "#x-owner", may be used for conventions invigilate itself does not
+know about, such as owners or tags. Each violation is listed on standard
+output, and the exit code is 1 if there are any.
+
+Options:
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		fatal(exitError, "No test case files specified")
+	}
+	if e := parseComments(); e != nil {
+		fatal(exitError, e)
+	}
+
+	var schema *Schema
+	if *schemaPath != "" {
+		var e error
+		if schema, e = readSchema(*schemaPath); e != nil {
+			fatal(exitError, e)
+		}
+		// Extension directives named in the schema are expected, so need no warning.
+		for name := range schema.allowed {
+			warned[name] = true
+		}
+		for _, name := range schema.required {
+			warned[name] = true
+		}
+	}
+
+	ch := make(chan Test, lookahead)
+	go findTests(context.Background(), fs.Args(), ch)
+	problems := 0
+	for t := range ch {
+		if t.err == nil {
+			loadTest(&t)
+		}
+		selectComment(t)
+		if t.err != nil {
+			fatal(exitError, t.err)
+		}
+		if e := expandIncludes(&t); e != nil {
+			fmt.Println(e)
+			problems++
+		} else if instances, e := expandMatrix(t); e != nil {
+			fmt.Println(e)
+			problems++
+		} else {
+			for _, i := range instances {
+				if e := substitute(&i); e != nil {
+					fmt.Println(e)
+					problems++
+				} else if e := checkDirectives(i); e != nil {
+					fmt.Println(e)
+					problems++
+				}
+			}
+		}
+		for _, p := range unknownDirectives(t) {
+			fmt.Println(p)
+			problems++
+		}
+		if schema != nil {
+			for _, p := range schema.check(t) {
+				fmt.Println(p)
+				problems++
+			}
+		}
+	}
+	removeTmpDir()
+	if problems > 0 {
+		os.Exit(exitFailed)
+	}
+}
+
+// unknownDirectives describes each comment line in a test case that looks like
+// a directive, but is not one that invigilate knows.
+func unknownDirectives(t Test) []string {
+	var problems []string
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if !strings.HasPrefix(line, comment) || isDirective(line[len(comment):]) {
+			continue
+		}
+		if name := directiveName(line[len(comment):]); name != "" {
+			problems = append(problems, fmt.Sprintf("%s:%d: unknown directive %q", t.path, lr.lineno, name))
+		}
+	}
+	return problems
+}
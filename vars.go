@@ -0,0 +1,156 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The arguments of directives may refer to environment variables, as "${HOME}",
+// and to these values, as "%{testdir}":
+//
+//	testdir   the absolute path of the directory holding the test case
+//	testname  the name of the test case file, without its directory or extension
+//	tmpdir    a directory made for the run, and removed at its end
+//
+// These are replaced before the test case is checked or run, and in the argument
+// of an include directive, before the file is read. With an expand directive,
+// they are also replaced in the lines of input, expected output, and expected
+// error output; otherwise those are left alone, since they may well hold "${"
+// meant for the program. A reference to an environment variable that is not set,
+// or to an unknown value, is left as it is. "$${" and "%%{" stand for "${" and
+// "%{" themselves.
+
+// runTmpDir is the directory made for %{tmpdir}; "" until it is first needed.
+var runTmpDir string
+
+// substitute replaces the references to variables in the directives of a test
+// case, and with an expand directive, in its lines of input and expected output.
+// A test case with no such references is left as it is.
+func substitute(t *Test) error {
+	data := hasDirective(*t, "expand")
+	if !hasSubstitutions(*t, data) {
+		return nil
+	}
+	var out strings.Builder
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if !substituted(line, data) {
+			out.WriteString(line)
+			continue
+		}
+		expanded, e := expandVars(line, *t)
+		if e != nil {
+			return fmt.Errorf("%s:%d: %s", t.path, lr.lineno, e)
+		}
+		out.WriteString(expanded)
+	}
+	if e := lr.close(); e != nil {
+		return e
+	}
+	t.content, t.streamed = out.String(), false
+	return nil
+}
+
+// substituted reports whether references to variables are replaced in a line:
+// whether it is a directive, or, if data is true, a line of input, expected
+// output, or expected error output.
+func substituted(line string, data bool) bool {
+	if !strings.HasPrefix(line, comment) {
+		return false
+	}
+	rest := line[len(comment):]
+	return isDirective(rest) || data && rest != "" && strings.ContainsRune("<>!", rune(rest[0]))
+}
+
+// hasSubstitutions reports whether any line of a test case in which references
+// to variables are replaced may refer to a variable.
+func hasSubstitutions(t Test, data bool) bool {
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if substituted(line, data) && (strings.Contains(line, "${") || strings.Contains(line, "%{")) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandVars returns a line with the references to variables replaced by their values.
+func expandVars(line string, t Test) (string, error) {
+	var out strings.Builder
+	for {
+		k := strings.IndexAny(line, "$%")
+		if k < 0 {
+			out.WriteString(line)
+			return out.String(), nil
+		}
+		out.WriteString(line[:k])
+		sigil, rest := line[k], line[k+1:]
+		if len(rest) > 1 && rest[0] == sigil && rest[1] == '{' {
+			out.WriteString(rest[:2])
+			line = rest[2:]
+			continue
+		} else if !strings.HasPrefix(rest, "{") {
+			out.WriteByte(sigil)
+			line = rest
+			continue
+		}
+		name, after, ok := strings.Cut(rest[1:], "}")
+		if !ok {
+			out.WriteByte(sigil)
+			line = rest
+			continue
+		}
+		value, known, e := varValue(sigil, name, t)
+		if e != nil {
+			return "", e
+		} else if !known {
+			value = line[k : len(line)-len(after)]
+		}
+		out.WriteString(value)
+		line = after
+	}
+}
+
+// varValue returns the value of a variable: an environment variable for "$",
+// or one of the values describing the test case for "%". It returns false if
+// there is no such variable.
+func varValue(sigil byte, name string, t Test) (string, bool, error) {
+	if sigil == '$' {
+		v, ok := os.LookupEnv(name)
+		return v, ok, nil
+	}
+	switch name {
+	case "testdir":
+		dir, e := filepath.Abs(filepath.Dir(t.source()))
+		return dir, true, e
+	case "testname":
+		base := filepath.Base(t.source())
+		return strings.TrimSuffix(base, filepath.Ext(base)), true, nil
+	case "tmpdir":
+		if runTmpDir == "" {
+			dir, e := os.MkdirTemp("", "invigilate-tmp")
+			if e != nil {
+				return "", true, e
+			}
+			runTmpDir = dir
+		}
+		return runTmpDir, true, nil
+	}
+	return "", false, nil
+}
+
+// removeTmpDir removes the directory made for %{tmpdir}.
+func removeTmpDir() {
+	if runTmpDir != "" {
+		os.RemoveAll(runTmpDir)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// For programs that generate output whose content does not matter, but whose
+// volume does, the directives output-lines, output-bytes, error-lines, and
+// error-bytes check the number of lines or bytes in all the output or error
+// output. Each is given a number, such as 100; a range, such as 90-110; or a
+// bound, such as >=90, >90, <=110, or <110. Sizes in bytes may have the suffix
+// K, M, or G. Output beyond that matched by the test case is then not reported as
+// extra, but only counted. The counts are of the output as it is matched, after
+// any filters, such as -ansi strip, are applied; a last line without a newline
+// counts as a line.
+
+// Volume is a check on the number of lines or bytes on one output stream.
+type Volume struct {
+	stream byte // '>' for the output, or '!' for the error output
+	bytes  bool // whether bytes, rather than lines, are counted
+	spec   string
+	lo, hi uint64 // the inclusive range of acceptable counts
+}
+
+// volumeDirectives maps the names of the directives checking volumes to
+// the streams and units they check.
+var volumeDirectives = map[string]struct {
+	stream byte
+	bytes  bool
+}{
+	"output-lines": {'>', false},
+	"output-bytes": {'>', true},
+	"error-lines":  {'!', false},
+	"error-bytes":  {'!', true},
+}
+
+// parseVolume parses the argument of a directive checking a volume.
+func parseVolume(name, arg string) (Volume, error) {
+	d := volumeDirectives[name]
+	v := Volume{stream: d.stream, bytes: d.bytes, spec: arg, hi: math.MaxUint64}
+	parse := func(s string) (uint64, error) {
+		if d.bytes {
+			return parseSize(strings.TrimSpace(s))
+		}
+		return strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	}
+	var e error
+	switch {
+	case strings.HasPrefix(arg, ">="):
+		v.lo, e = parse(arg[2:])
+	case strings.HasPrefix(arg, "<="):
+		v.hi, e = parse(arg[2:])
+	case strings.HasPrefix(arg, ">"):
+		v.lo, e = parse(arg[1:])
+		v.lo++
+	case strings.HasPrefix(arg, "<"):
+		if v.hi, e = parse(arg[1:]); v.hi == 0 {
+			v.lo = 1 // no count is less than 0
+		} else {
+			v.hi--
+		}
+	case strings.Contains(arg, "-"):
+		lo, hi, _ := strings.Cut(arg, "-")
+		if v.lo, e = parse(lo); e == nil {
+			v.hi, e = parse(hi)
+		}
+	default:
+		v.lo, e = parse(arg)
+		v.hi = v.lo
+	}
+	if e != nil || v.lo > v.hi {
+		return v, fmt.Errorf("invalid count %q; must be a number, a range such as 90-110, or a bound such as >=90", arg)
+	}
+	return v, nil
+}
+
+// checkVolume returns a function checking a directive checking a volume.
+func checkVolume(name string) func(string) error {
+	return func(arg string) error {
+		_, e := parseVolume(name, arg)
+		return e
+	}
+}
+
+// accepts reports whether a count is acceptable.
+func (v Volume) accepts(n uint64) bool {
+	return v.lo <= n && n <= v.hi
+}
+
+// unit returns the unit counted.
+func (v Volume) unit() string {
+	if v.bytes {
+		return "bytes"
+	}
+	return "lines"
+}
+
+// testVolumes returns the volumes checked by a test case.
+func testVolumes(t Test) []Volume {
+	var vs []Volume
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			name, arg := splitDirective(line[len(comment):])
+			if _, ok := volumeDirectives[name]; ok {
+				if v, e := parseVolume(name, arg); e == nil {
+					vs = append(vs, v)
+				}
+			}
+		}
+	}
+	return vs
+}
+
+// lineCount returns the number of lines received so far; an incomplete last line counts.
+func (s *Stream) lineCount() uint64 {
+	n := s.lines
+	if s.received > 0 && s.last != '\n' {
+		n++
+	}
+	return uint64(n)
+}
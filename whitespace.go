@@ -0,0 +1,138 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expected output written by hand often differs from the real output only in
+// white space that cannot be seen. The -whitespace option, and the whitespace
+// directive, give a comma separated list of the differences to ignore: "trailing"
+// ignores spaces and tabs at the ends of lines; "collapse" treats each run of
+// spaces and tabs as a single space; and "blank" ignores lines that are empty or
+// hold only spaces and tabs. Both the output and the expected output are
+// normalized in these ways before they are compared.
+
+// whitespaceSpec records the -whitespace option.
+var whitespaceSpec string
+
+// Whitespace is a set of differences in white space to ignore.
+type Whitespace struct {
+	trailing, collapse, blank bool
+}
+
+// none reports whether no differences in white space are ignored.
+func (ws Whitespace) none() bool {
+	return ws == Whitespace{}
+}
+
+// parseWhitespace adds the differences listed in spec to ws.
+func parseWhitespace(spec string, ws *Whitespace) error {
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "trailing":
+			ws.trailing = true
+		case "collapse":
+			ws.collapse = true
+		case "blank":
+			ws.blank = true
+		case "":
+		default:
+			return fmt.Errorf("unknown white space difference %q; must be trailing, collapse, or blank", strings.TrimSpace(name))
+		}
+	}
+	return nil
+}
+
+// checkWhitespace checks a "whitespace" directive.
+func checkWhitespace(arg string) error {
+	var ws Whitespace
+	return parseWhitespace(arg, &ws)
+}
+
+// testWhitespace returns the differences in white space to ignore in a test case.
+func testWhitespace(t Test) Whitespace {
+	var ws Whitespace
+	parseWhitespace(whitespaceSpec, &ws)
+	lr := t.lines()
+	defer lr.close()
+	for lr.scan() {
+		line := lr.text()
+		if strings.HasPrefix(line, comment) && isDirective(line[len(comment):]) {
+			if name, arg := splitDirective(line[len(comment):]); name == "whitespace" {
+				parseWhitespace(arg, &ws)
+			}
+		}
+	}
+	return ws
+}
+
+// WhitespaceFilter normalizes the white space in one of the program's output
+// streams, which may be split between reads anywhere. Only white space is held
+// back until it is known how to treat it, so a prompt is still received at once.
+type WhitespaceFilter struct {
+	ws        Whitespace
+	held      []byte // spaces and tabs not yet passed on
+	emptyLine bool   // whether nothing but white space has been seen on this line
+}
+
+// newWhitespaceFilter returns a filter ignoring the given differences, or nil if there are none.
+func newWhitespaceFilter(ws Whitespace) *WhitespaceFilter {
+	if ws.none() {
+		return nil
+	}
+	return &WhitespaceFilter{ws: ws, emptyLine: true}
+}
+
+// filter returns the data with its white space normalized. If end is true,
+// this is the end of the stream, so no more white space is held back.
+func (f *WhitespaceFilter) filter(data []byte, end bool) []byte {
+	var out []byte
+	for _, c := range data {
+		switch c {
+		case ' ', '\t':
+			f.held = append(f.held, c)
+		case '\n':
+			if !(f.ws.blank && f.emptyLine) {
+				if !f.ws.trailing {
+					out = f.release(out)
+				}
+				out = append(out, '\n')
+			}
+			f.held, f.emptyLine = f.held[:0], true
+		default:
+			out = append(f.release(out), c)
+			f.emptyLine = false
+		}
+	}
+	if end {
+		if !f.ws.trailing && !(f.ws.blank && f.emptyLine) {
+			out = f.release(out)
+		}
+		f.held = f.held[:0]
+	}
+	return out
+}
+
+// release passes on the white space held back.
+func (f *WhitespaceFilter) release(out []byte) []byte {
+	if len(f.held) > 0 && f.ws.collapse {
+		out = append(out, ' ')
+	} else {
+		out = append(out, f.held...)
+	}
+	f.held = f.held[:0]
+	return out
+}
+
+// normalize returns an expected line of output with its white space normalized,
+// or "" if the line is to be ignored.
+func (ws Whitespace) normalize(line string) string {
+	if ws.none() {
+		return line
+	}
+	return string(newWhitespaceFilter(ws).filter([]byte(line), true))
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Patrick Smith
+// Use of this source code is subject to the MIT-style license in the LICENSE file.
+
+package main
+
+import "strings"
+
+// wrapper is a command prefixed to every run of the program, such as
+// "valgrind --error-exitcode=99", as given with -wrap; "" for none.
+var wrapper string
+
+// testCommand returns the command line for running the program on a test case.
+// "{test}" anywhere in a word of the program's command line, or a word that is
+// just "{}", is replaced by the path to the test case. Any wrapper is split into
+// words at white space. A word "{program}" is replaced by the program and its
+// arguments, and "{test}" anywhere in a word by the path to the test case.
+// Without "{test}" in either, the path follows the program's arguments, unless
+// the test case is given on standard input, and without "{program}", the program
+// follows the wrapper's words.
+func testCommand(program []string, path string) []string {
+	named := strings.Contains(wrapper, "{test}")
+	var args []string
+	for _, a := range program {
+		if a == "{}" {
+			a = "{test}"
+		}
+		named = named || strings.Contains(a, "{test}")
+		args = append(args, strings.ReplaceAll(a, "{test}", path))
+	}
+	if !named && !stdinInput {
+		args = append(args, path)
+	}
+	if wrapper == "" {
+		return args
+	}
+	var cmd []string
+	placed := false
+	for _, w := range strings.Fields(wrapper) {
+		if w == "{program}" {
+			cmd = append(cmd, args...)
+			placed = true
+		} else {
+			cmd = append(cmd, strings.ReplaceAll(w, "{test}", path))
+		}
+	}
+	if !placed {
+		cmd = append(cmd, args...)
+	}
+	return cmd
+}